@@ -0,0 +1,351 @@
+package convert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"mangav5/internal/downloader"
+	"mangav5/internal/zipper"
+)
+
+// Format is the image format pages are converted to
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatWebP Format = "webp"
+	FormatAVIF Format = "avif"
+)
+
+// Page statuses reported in Progress and PageResult
+const (
+	PageConverted = "converted"
+	PageSkipped   = "skipped" // already in the target format or the result was bigger
+	PageFailed    = "failed"
+)
+
+const defaultQuality = 80
+
+// Options configures a chapter conversion
+type Options struct {
+	Format  Format `json:"format"`
+	Quality int    `json:"quality"` // 1-100, 80 when empty
+	Workers int    `json:"workers"` // pages encoded in parallel, number of CPUs when empty
+
+	// KeepLarger keeps converted pages even when they are bigger than the original
+	KeepLarger bool `json:"keepLarger"`
+
+	// Encoder binaries, looked up in PATH when empty
+	CWebPPath   string `json:"-"`
+	AvifEncPath string `json:"-"`
+}
+
+// Progress is reported after every page
+type Progress struct {
+	Path     string `json:"path"`
+	Index    int    `json:"index"` // pages done so far
+	Total    int    `json:"total"`
+	Filename string `json:"filename"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PageResult is the outcome of one page
+type PageResult struct {
+	Source      string `json:"source"` // path relative to the chapter
+	Output      string `json:"output"`
+	BytesBefore int64  `json:"bytesBefore"`
+	BytesAfter  int64  `json:"bytesAfter"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Report summarizes the conversion of a chapter
+type Report struct {
+	Path        string       `json:"path"`
+	Format      Format       `json:"format"`
+	Total       int          `json:"total"`
+	Converted   int          `json:"converted"`
+	Skipped     int          `json:"skipped"`
+	Failed      int          `json:"failed"`
+	BytesBefore int64        `json:"bytesBefore"`
+	BytesAfter  int64        `json:"bytesAfter"`
+	BytesSaved  int64        `json:"bytesSaved"`
+	Pages       []PageResult `json:"pages"` // ordered by source name
+}
+
+// ConvertChapter re-encodes every page of a chapter folder or .cbz/.zip
+// archive to opts.Format. A page replaces its original only once the encoded
+// file has been verified; an archive is rebuilt next to the original and
+// swapped in when every page is done.
+func ConvertChapter(ctx context.Context, path string, opts Options, onProgress func(Progress)) (*Report, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		report, err := convertDir(ctx, path, path, opts, onProgress)
+		// Pages converted before a cancel already replaced their originals
+		if report != nil && report.Converted > 0 {
+			if mErr := downloader.RebuildManifest(path); mErr != nil && err == nil {
+				err = mErr
+			}
+		}
+		return report, err
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".cbz" && ext != ".zip" {
+		return nil, fmt.Errorf("%s is not a chapter folder or archive", path)
+	}
+	return convertArchive(ctx, path, opts, onProgress)
+}
+
+func convertArchive(ctx context.Context, archivePath string, opts Options, onProgress func(Progress)) (*Report, error) {
+	workDir, err := os.MkdirTemp(filepath.Dir(archivePath), ".convert_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := zipper.ExtractAllFromArchive(archivePath, workDir); err != nil {
+		return nil, err
+	}
+
+	report, err := convertDir(ctx, workDir, archivePath, opts, onProgress)
+	if err != nil || report.Converted == 0 {
+		// Nothing changed, the original archive stays as it is
+		return report, err
+	}
+	if report.Failed > 0 {
+		// Keep the original archive untouched rather than mixing formats
+		return report, fmt.Errorf("%d of %d pages failed, archive left unchanged", report.Failed, report.Total)
+	}
+
+	// The archive holds only pages and ComicInfo.xml, a manifest packed by
+	// older versions is dropped
+	if err := zipper.CompressChapter(workDir, archivePath, nil, downloader.ManifestName); err != nil {
+		return report, err
+	}
+
+	// Make sure the new archive holds every page before reporting success
+	images, err := zipper.ListImages(archivePath)
+	if err != nil {
+		return report, err
+	}
+	if len(images) != report.Total {
+		return report, fmt.Errorf("archive has %d pages after conversion, expected %d", len(images), report.Total)
+	}
+	return report, nil
+}
+
+// convertDir converts every page below dir; reportPath is the chapter path shown to the user
+func convertDir(ctx context.Context, dir string, reportPath string, opts Options, onProgress func(Progress)) (*Report, error) {
+	pages, err := listPages(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Path:   reportPath,
+		Format: opts.Format,
+		Total:  len(pages),
+		Pages:  make([]PageResult, len(pages)),
+	}
+
+	conflicts := outputConflicts(pages, opts.Format)
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+
+	workers := min(opts.Workers, len(pages))
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				var res PageResult
+				if other, ok := conflicts[i]; ok {
+					res = conflictResult(dir, pages[i], other)
+				} else {
+					res = convertPage(ctx, dir, pages[i], opts)
+				}
+
+				mu.Lock()
+				report.Pages[i] = res
+				done++
+				if onProgress != nil {
+					onProgress(Progress{
+						Path:     reportPath,
+						Index:    done,
+						Total:    len(pages),
+						Filename: res.Source,
+						Status:   res.Status,
+						Error:    res.Error,
+					})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range pages {
+		select {
+		case <-ctx.Done():
+			break feed
+		case jobs <- i:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, p := range report.Pages {
+		switch p.Status {
+		case PageConverted:
+			report.Converted++
+		case PageSkipped:
+			report.Skipped++
+		case PageFailed:
+			report.Failed++
+		}
+		report.BytesBefore += p.BytesBefore
+		report.BytesAfter += p.BytesAfter
+	}
+	report.BytesSaved = report.BytesBefore - report.BytesAfter
+
+	return report, ctx.Err()
+}
+
+// outputConflicts returns the pages whose output would replace another
+// page, e.g. 001.png next to 001.jpg when converting to JPEG, mapped to that
+// page. Names are compared without case like on Windows.
+func outputConflicts(pages []string, format Format) map[int]string {
+	stem := func(rel string) string {
+		return strings.ToLower(strings.TrimSuffix(rel, filepath.Ext(rel)))
+	}
+
+	// Pages already in the target format keep their name
+	claimed := make(map[string]string, len(pages))
+	for _, p := range pages {
+		if formatOfExt(filepath.Ext(p)) == format {
+			claimed[stem(p)] = p
+		}
+	}
+
+	conflicts := make(map[int]string)
+	for i, p := range pages {
+		if formatOfExt(filepath.Ext(p)) == format {
+			continue
+		}
+		if other, ok := claimed[stem(p)]; ok {
+			conflicts[i] = other
+			continue
+		}
+		claimed[stem(p)] = p
+	}
+	return conflicts
+}
+
+// conflictResult fails a page left as it is because of outputConflicts
+func conflictResult(dir, rel, other string) PageResult {
+	res := PageResult{Source: filepath.ToSlash(rel), Output: filepath.ToSlash(rel)}
+	if fi, err := os.Stat(filepath.Join(dir, rel)); err == nil {
+		res.BytesBefore = fi.Size()
+		res.BytesAfter = fi.Size()
+	}
+	return res.fail(fmt.Errorf("converts to the same name as %s", filepath.ToSlash(other)))
+}
+
+// listPages returns the images below dir relative to it, sorted by name
+func listPages(dir string) ([]string, error) {
+	var pages []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isPage(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		pages = append(pages, rel)
+		return nil
+	})
+	sort.Strings(pages)
+	return pages, err
+}
+
+func (o *Options) normalize() error {
+	switch o.Format {
+	case FormatJPEG, FormatWebP, FormatAVIF:
+	case "jpg":
+		o.Format = FormatJPEG
+	case "":
+		o.Format = FormatWebP
+	default:
+		return fmt.Errorf("unsupported format %q", o.Format)
+	}
+
+	if o.Quality <= 0 {
+		o.Quality = defaultQuality
+	}
+	if o.Quality > 100 {
+		o.Quality = 100
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.NumCPU()
+	}
+
+	// Fail before touching anything when the encoder is missing
+	_, err := o.encoderPath()
+	return err
+}
+
+// encoderPath returns the external encoder binary of the target format, "" for JPEG
+func (o *Options) encoderPath() (string, error) {
+	var name, configured string
+	switch o.Format {
+	case FormatWebP:
+		name, configured = "cwebp", o.CWebPPath
+	case FormatAVIF:
+		name, configured = "avifenc", o.AvifEncPath
+	default:
+		return "", nil
+	}
+
+	if configured != "" {
+		if _, err := os.Stat(configured); err != nil {
+			return "", fmt.Errorf("%s not found at %s: %w", name, configured, err)
+		}
+		return configured, nil
+	}
+	path, err := lookPath(name)
+	if err != nil {
+		return "", errors.New(name + " is required to convert to " + string(o.Format) + " but was not found in PATH")
+	}
+	return path, nil
+}
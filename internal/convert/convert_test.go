@@ -0,0 +1,292 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"mangav5/internal/downloader"
+	"mangav5/internal/zipper"
+)
+
+// writePNG writes a w x h page; noisy pages shrink as JPEG, flat ones grow
+func writePNG(t *testing.T, path string, w, h int, noisy bool) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rnd := rand.New(rand.NewSource(int64(w*h + len(path))))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{40, 90, 160, 255}
+			if noisy {
+				c = color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func pageStatus(r *Report) map[string]string {
+	m := make(map[string]string, len(r.Pages))
+	for _, p := range r.Pages {
+		m[p.Source] = p.Status
+	}
+	return m
+}
+
+func TestConvertDirJPEG(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "001.png"), 64, 48, true)
+	writePNG(t, filepath.Join(dir, "002.png"), 64, 48, false) // bigger as JPEG
+	if err := os.WriteFile(filepath.Join(dir, "003.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ConvertChapter(context.Background(), dir, Options{Format: FormatJPEG, Workers: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"001.png": PageConverted, "002.png": PageSkipped, "003.png": PageFailed}
+	if got := pageStatus(report); len(got) != len(want) || got["001.png"] != want["001.png"] || got["002.png"] != want["002.png"] || got["003.png"] != want["003.png"] {
+		t.Errorf("page statuses = %v, want %v", got, want)
+	}
+	if report.Converted != 1 || report.Skipped != 1 || report.Failed != 1 {
+		t.Errorf("report = %+v", report)
+	}
+
+	// Only the verified page replaced its original
+	if got := listDir(t, dir); !equal(got, []string{"001.jpg", "002.png", "003.png"}) {
+		t.Errorf("files = %v", got)
+	}
+	cfg, name, err := decodeConfigFile(filepath.Join(dir, "001.jpg"))
+	if err != nil || name != "jpeg" || cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("001.jpg = %+v %s %v", cfg, name, err)
+	}
+}
+
+func TestConvertDirCancelRebuildsManifest(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"001.png", "002.png", "003.png"} {
+		writePNG(t, filepath.Join(dir, name), 64, 48, true)
+	}
+	if err := os.WriteFile(filepath.Join(dir, downloader.ManifestName), []byte(`{"version":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloader.RebuildManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel once the first page replaced its original
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	report, err := ConvertChapter(ctx, dir, Options{Format: FormatJPEG, Workers: 1}, func(p Progress) {
+		cancel()
+	})
+	if err == nil {
+		t.Fatal("ConvertChapter() succeeded after cancel")
+	}
+	if report == nil || report.Converted == 0 {
+		t.Fatalf("report = %+v, want converted pages", report)
+	}
+
+	verify, err := downloader.VerifyManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify.Valid() {
+		t.Errorf("manifest after cancel: missing %v, mismatched %v", verify.Missing, verify.Mismatched)
+	}
+}
+
+func TestConvertSameOutputName(t *testing.T) {
+	dir := t.TempDir()
+	// 001.jpg is already a JPEG page, 001.png would replace it
+	writePNG(t, filepath.Join(dir, "001.png"), 32, 32, true)
+	if err := encodeJPEG(filepath.Join(dir, "001.png"), filepath.Join(dir, "001.jpg"), 80); err != nil {
+		t.Fatal(err)
+	}
+	// 002.gif and 002.png would both become 002.jpg
+	writePNG(t, filepath.Join(dir, "002.png"), 32, 32, true)
+	f, err := os.Create(filepath.Join(dir, "002.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noise, err := decodeFile(filepath.Join(dir, "002.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.Encode(f, noise, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	report, err := ConvertChapter(context.Background(), dir, Options{Format: FormatJPEG, Workers: 4}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := pageStatus(report)
+	if status["001.jpg"] != PageSkipped || status["001.png"] != PageFailed {
+		t.Errorf("001 statuses = %v, want the JPEG kept and the PNG left alone", status)
+	}
+	if (status["002.gif"] == PageConverted) == (status["002.png"] == PageConverted) {
+		t.Errorf("002 statuses = %v, want exactly one converted", status)
+	}
+
+	files := listDir(t, dir)
+	want := []string{"001.jpg", "001.png", "002.jpg", "002.png"}
+	if status["002.png"] == PageConverted {
+		want = []string{"001.jpg", "001.png", "002.gif", "002.jpg"}
+	}
+	if !equal(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+}
+
+func TestConvertArchiveJPEG(t *testing.T) {
+	src := t.TempDir()
+	writePNG(t, filepath.Join(src, "001.png"), 64, 48, true)
+	writePNG(t, filepath.Join(src, "002.png"), 64, 48, true)
+	archive := filepath.Join(t.TempDir(), "chapter.cbz")
+	if err := zipper.CompressDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ConvertChapter(context.Background(), archive, Options{Format: FormatJPEG}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Converted != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	images, err := zipper.ListImages(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(images)
+	if !equal(images, []string{"001.jpg", "002.jpg"}) {
+		t.Errorf("archive pages = %v", images)
+	}
+	// No work folder is left next to the archive
+	if files := listDir(t, filepath.Dir(archive)); !equal(files, []string{"chapter.cbz"}) {
+		t.Errorf("files next to the archive = %v", files)
+	}
+}
+
+func TestConvertArchiveFailedPage(t *testing.T) {
+	src := t.TempDir()
+	writePNG(t, filepath.Join(src, "001.png"), 64, 48, true)
+	if err := os.WriteFile(filepath.Join(src, "002.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "chapter.cbz")
+	if err := zipper.CompressDirectory(src, archive); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ConvertChapter(context.Background(), archive, Options{Format: FormatJPEG}, nil)
+	if err == nil {
+		t.Fatal("ConvertChapter() succeeded with a broken page")
+	}
+	if report == nil || report.Failed != 1 {
+		t.Errorf("report = %+v", report)
+	}
+	after, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("archive changed although a page failed")
+	}
+}
+
+func TestConvertUnverifiedOutputKeepsOriginal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake encoder is a shell script")
+	}
+	// An encoder that exits fine but writes garbage to its output (last argument)
+	encoder := filepath.Join(t.TempDir(), "cwebp")
+	script := "#!/bin/sh\nfor last; do :; done\nhead -c 4096 /dev/urandom > \"$last\"\n"
+	if err := os.WriteFile(encoder, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "001.png"), 64, 48, true)
+	original, err := os.ReadFile(filepath.Join(dir, "001.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ConvertChapter(context.Background(), dir, Options{Format: FormatWebP, CWebPPath: encoder}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 1 {
+		t.Errorf("report = %+v, want the page failed", report)
+	}
+	if files := listDir(t, dir); !equal(files, []string{"001.png"}) {
+		t.Errorf("files = %v, want only the original", files)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "001.png")); !bytes.Equal(got, original) {
+		t.Error("original page changed")
+	}
+}
+
+func TestMissingEncoder(t *testing.T) {
+	dir := t.TempDir()
+	writePNG(t, filepath.Join(dir, "001.png"), 8, 8, true)
+
+	_, err := ConvertChapter(context.Background(), dir, Options{Format: FormatWebP, CWebPPath: filepath.Join(dir, "missing-cwebp")}, nil)
+	if err == nil {
+		t.Fatal("ConvertChapter() succeeded without an encoder")
+	}
+	if files := listDir(t, dir); !equal(files, []string{"001.png"}) {
+		t.Errorf("files = %v, want the chapter untouched", files)
+	}
+}
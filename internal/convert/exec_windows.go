@@ -0,0 +1,16 @@
+//go:build windows
+
+package convert
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// hideWindow keeps encoder processes from flashing a console window
+func hideWindow(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		HideWindow:    true,
+		CreationFlags: 0x08000000, // CREATE_NO_WINDOW
+	}
+}
@@ -0,0 +1,302 @@
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	// Decoders for the source pages
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+var lookPath = exec.LookPath
+
+// convertPage encodes dir/rel to the target format and swaps it in for the
+// original once the result is verified
+func convertPage(ctx context.Context, dir string, rel string, opts Options) PageResult {
+	src := filepath.Join(dir, rel)
+	res := PageResult{Source: filepath.ToSlash(rel), Output: filepath.ToSlash(rel)}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return res.fail(err)
+	}
+	res.BytesBefore = fi.Size()
+	res.BytesAfter = fi.Size()
+
+	if err := ctx.Err(); err != nil {
+		return res.fail(err)
+	}
+
+	srcExt := strings.ToLower(filepath.Ext(rel))
+	if formatOfExt(srcExt) == opts.Format {
+		res.Status = PageSkipped
+		return res
+	}
+
+	srcCfg, _, err := decodeConfigFile(src)
+	if err != nil {
+		// AVIF sources cannot be decoded without cgo
+		return res.fail(fmt.Errorf("unsupported source image: %w", err))
+	}
+
+	dstRel := outputName(rel, opts.Format)
+	dst := filepath.Join(dir, dstRel)
+	if _, err := os.Stat(dst); err == nil {
+		return res.fail(fmt.Errorf("%s already exists", filepath.Base(dst)))
+	}
+
+	// Hidden temp name so a crash never leaves a half written page behind a real name
+	tmp, err := os.CreateTemp(filepath.Dir(src), "."+filepath.Base(dstRel)+".*.part")
+	if err != nil {
+		return res.fail(err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := encode(ctx, src, srcExt, tmpPath, opts); err != nil {
+		return res.fail(err)
+	}
+	if err := verifyOutput(tmpPath, opts.Format, srcCfg); err != nil {
+		return res.fail(err)
+	}
+
+	out, err := os.Stat(tmpPath)
+	if err != nil {
+		return res.fail(err)
+	}
+	if out.Size() >= fi.Size() && !opts.KeepLarger {
+		res.Status = PageSkipped
+		return res
+	}
+
+	if err := os.Rename(tmpPath, dst); err != nil {
+		return res.fail(err)
+	}
+	if err := os.Remove(src); err != nil {
+		// Leave the original in place rather than two copies of the page
+		os.Remove(dst)
+		return res.fail(err)
+	}
+
+	res.Output = filepath.ToSlash(dstRel)
+	res.BytesAfter = out.Size()
+	res.Status = PageConverted
+	return res
+}
+
+func (r PageResult) fail(err error) PageResult {
+	r.Status = PageFailed
+	r.Error = err.Error()
+	return r
+}
+
+func encode(ctx context.Context, src, srcExt, dst string, opts Options) error {
+	if opts.Format == FormatJPEG {
+		return encodeJPEG(src, dst, opts.Quality)
+	}
+
+	encoder, err := opts.encoderPath()
+	if err != nil {
+		return err
+	}
+
+	// cwebp reads PNG, JPEG, TIFF and WebP, avifenc only PNG and JPEG;
+	// anything else goes through a lossless PNG first
+	input := src
+	direct := srcExt == ".png" || srcExt == ".jpg" || srcExt == ".jpeg"
+	if opts.Format == FormatWebP && srcExt == ".webp" {
+		direct = true
+	}
+	if !direct {
+		input, err = toTempPNG(src)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(input)
+	}
+
+	var args []string
+	switch opts.Format {
+	case FormatWebP:
+		args = []string{"-quiet", "-mt", "-q", fmt.Sprint(opts.Quality), input, "-o", dst}
+	case FormatAVIF:
+		args = []string{"-q", fmt.Sprint(opts.Quality), "--jobs", "1", input, dst}
+	}
+
+	cmd := exec.CommandContext(ctx, encoder, args...)
+	hideWindow(cmd)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%s: %w: %s", filepath.Base(encoder), err, msg)
+		}
+		return fmt.Errorf("%s: %w", filepath.Base(encoder), err)
+	}
+	return nil
+}
+
+func encodeJPEG(src, dst string, quality int) error {
+	img, err := decodeFile(src)
+	if err != nil {
+		return err
+	}
+
+	// JPEG has no alpha channel, transparent areas become white
+	if !isOpaque(img) {
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: quality}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func toTempPNG(src string) (string, error) {
+	img, err := decodeFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(src), ".convert_*.png")
+	if err != nil {
+		return "", err
+	}
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := enc.Encode(f, img); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// verifyOutput checks that the encoded page is readable and has the size of the source
+func verifyOutput(path string, format Format, src image.Config) error {
+	if format == FormatAVIF {
+		return verifyAVIF(path)
+	}
+
+	cfg, name, err := decodeConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("encoded page is unreadable: %w", err)
+	}
+	if formatOfExt("."+name) != format {
+		return fmt.Errorf("encoded page is %s, expected %s", name, format)
+	}
+	if cfg.Width != src.Width || cfg.Height != src.Height {
+		return fmt.Errorf("encoded page is %dx%d, expected %dx%d", cfg.Width, cfg.Height, src.Width, src.Height)
+	}
+	return nil
+}
+
+// verifyAVIF checks the ISO BMFF header since there is no pure Go AVIF decoder
+func verifyAVIF(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 32)
+	n, _ := f.Read(head)
+	head = head[:n]
+	if n < 12 || string(head[4:8]) != "ftyp" {
+		return errors.New("encoded page is not an AVIF file")
+	}
+	if !bytes.Contains(head[8:], []byte("avif")) && !bytes.Contains(head[8:], []byte("avis")) {
+		return errors.New("encoded page is not an AVIF file")
+	}
+	return nil
+}
+
+func decodeFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+func decodeConfigFile(path string) (image.Config, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer f.Close()
+
+	return image.DecodeConfig(f)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+func formatOfExt(ext string) Format {
+	switch strings.ToLower(ext) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".webp":
+		return FormatWebP
+	case ".avif":
+		return FormatAVIF
+	}
+	return ""
+}
+
+func extOfFormat(f Format) string {
+	switch f {
+	case FormatJPEG:
+		return ".jpg"
+	case FormatAVIF:
+		return ".avif"
+	}
+	return ".webp"
+}
+
+// outputName is the path rel is encoded to
+func outputName(rel string, f Format) string {
+	return strings.TrimSuffix(rel, filepath.Ext(rel)) + extOfFormat(f)
+}
+
+func isPage(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".avif":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+CREATE TABLE IF NOT EXISTS download_jobs (
+  job_id        INTEGER PRIMARY KEY AUTOINCREMENT,
+  manga_id      INTEGER,
+  title         TEXT NOT NULL DEFAULT '',
+  output_dir    TEXT NOT NULL,
+  options_json  TEXT NOT NULL DEFAULT '{}',
+  position      INTEGER NOT NULL DEFAULT 0,
+
+  status        TEXT NOT NULL DEFAULT 'queued'
+                CHECK (status IN ('queued', 'running', 'paused', 'completed', 'failed', 'cancelled')),
+  error         TEXT,
+
+  created_at    TEXT NOT NULL DEFAULT (datetime('now')),
+  updated_at    TEXT NOT NULL DEFAULT (datetime('now')),
+
+  FOREIGN KEY (manga_id)
+    REFERENCES manga(manga_id)
+    ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS download_job_images (
+  image_id      INTEGER PRIMARY KEY AUTOINCREMENT,
+  job_id        INTEGER NOT NULL,
+  image_index   INTEGER NOT NULL,
+  url           TEXT NOT NULL,
+  filename      TEXT,
+
+  status        TEXT NOT NULL DEFAULT 'pending'
+                CHECK (status IN ('pending', 'done', 'failed')),
+  attempts      INTEGER NOT NULL DEFAULT 0,
+  error         TEXT,
+
+  updated_at    TEXT NOT NULL DEFAULT (datetime('now')),
+
+  FOREIGN KEY (job_id)
+    REFERENCES download_jobs(job_id)
+    ON DELETE CASCADE,
+  UNIQUE (job_id, image_index)
+);
+
+CREATE INDEX IF NOT EXISTS idx_download_jobs_status
+ON download_jobs(status, position);
+
+CREATE INDEX IF NOT EXISTS idx_download_job_images_job
+ON download_job_images(job_id);
+
+CREATE TRIGGER trg_download_jobs_updated
+AFTER UPDATE ON download_jobs
+FOR EACH ROW
+BEGIN
+  UPDATE download_jobs
+  SET updated_at = datetime('now')
+  WHERE job_id = OLD.job_id;
+END;
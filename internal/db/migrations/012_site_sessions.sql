@@ -0,0 +1,19 @@
+-- Cookies and login credentials per scraping rule, AES-GCM encrypted with
+-- the key file in the config directory
+CREATE TABLE IF NOT EXISTS site_sessions (
+  site_key     TEXT PRIMARY KEY,
+  cookies      BLOB,   -- encrypted JSON array of cookies
+  credentials  BLOB,   -- encrypted JSON {username, password}
+
+  created_at   TEXT NOT NULL DEFAULT (datetime('now')),
+  updated_at   TEXT NOT NULL DEFAULT (datetime('now'))
+);
+
+CREATE TRIGGER trg_site_sessions_updated
+AFTER UPDATE ON site_sessions
+FOR EACH ROW
+BEGIN
+  UPDATE site_sessions
+  SET updated_at = datetime('now')
+  WHERE site_key = OLD.site_key;
+END;
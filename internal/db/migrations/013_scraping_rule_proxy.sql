@@ -0,0 +1,3 @@
+-- Proxy of a site: proxy URLs separated by commas, "direct" to skip the
+-- global proxy, empty to use it
+ALTER TABLE scraping_rules ADD COLUMN proxy TEXT NOT NULL DEFAULT '';
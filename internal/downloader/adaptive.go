@@ -1,26 +1,59 @@
 package downloader
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 )
 
+// Default latency thresholds used when DownloadConfig leaves them empty
+const (
+	defaultLatencyLow    = 400 * time.Millisecond
+	defaultLatencyHigh   = 800 * time.Millisecond
+	defaultLatencyWindow = 5
+)
+
+// AdaptiveController picks the number of in-flight downloads with AIMD:
+// one more slot while the average latency stays under the low threshold,
+// half the slots when it goes over the high threshold or a request fails.
 type AdaptiveController struct {
 	current int
 	min     int
 	max     int
 
+	low  time.Duration
+	high time.Duration
+
 	window []time.Duration
 	size   int
 	mu     sync.Mutex
 }
 
-func NewAdaptiveController(start, min, max int) *AdaptiveController {
+func NewAdaptiveController(start, min, max int, low, high time.Duration, window int) *AdaptiveController {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if low <= 0 {
+		low = defaultLatencyLow
+	}
+	if high <= 0 {
+		high = defaultLatencyHigh
+	}
+	if window <= 0 {
+		window = defaultLatencyWindow
+	}
+
 	return &AdaptiveController{
-		current: start,
+		current: clamp(start, min, max),
 		min:     min,
 		max:     max,
-		size:    5,
+		low:     low,
+		high:    high,
+		size:    window,
 	}
 }
 
@@ -34,17 +67,21 @@ func (c *AdaptiveController) AddLatency(d time.Duration) {
 	}
 }
 
-func (c *AdaptiveController) Adjust(success bool) {
+// Adjust updates the limit after a request finished and reports whether it changed.
+// The latency window is cleared on every change so one slow burst only counts once.
+func (c *AdaptiveController) Adjust(success bool) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	prev := c.current
+
 	if !success {
-		c.current = max(c.min, c.current/2)
-		return
+		c.decrease()
+		return c.current != prev
 	}
 
 	if len(c.window) < c.size {
-		return
+		return false
 	}
 
 	var sum time.Duration
@@ -54,11 +91,19 @@ func (c *AdaptiveController) Adjust(success bool) {
 	avg := sum / time.Duration(len(c.window))
 
 	switch {
-	case avg < 400*time.Millisecond && c.current < c.max:
+	case avg < c.low && c.current < c.max:
 		c.current++
-	case avg > 800*time.Millisecond:
-		c.current = max(c.min, c.current/2)
+		c.window = c.window[:0]
+	case avg > c.high:
+		c.decrease()
 	}
+
+	return c.current != prev
+}
+
+func (c *AdaptiveController) decrease() {
+	c.current = max(c.min, c.current/2)
+	c.window = c.window[:0]
 }
 
 func (c *AdaptiveController) Current() int {
@@ -66,3 +111,88 @@ func (c *AdaptiveController) Current() int {
 	defer c.mu.Unlock()
 	return c.current
 }
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
+}
+
+// dynamicLimit is a semaphore whose size follows an AdaptiveController
+type dynamicLimit struct {
+	ctrl *AdaptiveController
+
+	mu       sync.Mutex
+	inFlight int
+	changed  chan struct{}
+}
+
+func newDynamicLimit(ctrl *AdaptiveController) *dynamicLimit {
+	return &dynamicLimit{
+		ctrl:    ctrl,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire blocks until fewer than ctrl.Current() requests are in flight
+func (l *dynamicLimit) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.ctrl.Current() {
+			l.inFlight++
+			l.mu.Unlock()
+			return nil
+		}
+		ch := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ch:
+		}
+	}
+}
+
+func (l *dynamicLimit) release() {
+	l.mu.Lock()
+	l.inFlight--
+	l.mu.Unlock()
+	l.notify()
+}
+
+// notify wakes waiters so they re-read the limit
+func (l *dynamicLimit) notify() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// attemptGate holds a dynamicLimit slot for a single request and feeds its
+// latency to the controller. Limiter waits and retry backoff happen outside
+// of it, so a throttled host does not look congested. A nil gate does
+// nothing.
+type attemptGate struct {
+	ctrl  *AdaptiveController
+	limit *dynamicLimit
+}
+
+func (g *attemptGate) acquire(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	return g.limit.acquire(ctx)
+}
+
+// release frees the slot taken by acquire. Missing pages (permanent errors)
+// say nothing about congestion, cancelled requests have no latency.
+func (g *attemptGate) release(latency time.Duration, err error) {
+	if g == nil {
+		return
+	}
+	if !errors.Is(err, context.Canceled) {
+		g.ctrl.AddLatency(latency)
+		g.ctrl.Adjust(!isCongestion(err))
+	}
+	// releasing also wakes waiters to re-read a raised limit
+	g.limit.release()
+}
@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveControllerAdjust(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   int
+		latency time.Duration
+		success bool
+		want    int
+	}{
+		{"low latency grows by one", 4, 10 * time.Millisecond, true, 5},
+		{"between thresholds holds", 4, 150 * time.Millisecond, true, 4},
+		{"high latency halves", 4, 500 * time.Millisecond, true, 2},
+		{"failure halves", 4, 10 * time.Millisecond, false, 2},
+		{"never above max", 8, 10 * time.Millisecond, true, 8},
+		{"never below min", 2, 500 * time.Millisecond, true, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewAdaptiveController(tt.start, 2, 8, 100*time.Millisecond, 200*time.Millisecond, 3)
+			for i := 0; i < 3; i++ {
+				c.AddLatency(tt.latency)
+			}
+			c.Adjust(tt.success)
+
+			if got := c.Current(); got != tt.want {
+				t.Errorf("Current() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveControllerClearsWindowAfterChange(t *testing.T) {
+	c := NewAdaptiveController(8, 1, 8, 100*time.Millisecond, 200*time.Millisecond, 3)
+	for i := 0; i < 3; i++ {
+		c.AddLatency(time.Second)
+	}
+
+	if !c.Adjust(true) {
+		t.Fatal("Adjust() = false, want a decrease")
+	}
+	// The same slow samples must not halve the limit a second time
+	if c.Adjust(true) {
+		t.Errorf("Adjust() changed the limit again without new samples, current %d", c.Current())
+	}
+	if got := c.Current(); got != 4 {
+		t.Errorf("Current() = %d, want 4", got)
+	}
+}
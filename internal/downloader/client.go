@@ -3,12 +3,33 @@ package downloader
 import (
 	"time"
 
+	"mangav5/internal/proxy"
+
 	"github.com/go-resty/resty/v2"
 )
 
-func NewRestyClient(timeout time.Duration) *resty.Client {
-	return resty.New().
+// NewRestyClient creates an image client; requests rotate over the proxies
+// of pool, a nil pool connects directly
+func NewRestyClient(timeout time.Duration, pool *proxy.Pool) *resty.Client {
+	client := resty.New().
 		SetTimeout(timeout).
 		SetRedirectPolicy(resty.FlexibleRedirectPolicy(5)).
 		SetHeader("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	if pool != nil {
+		client.SetTransport(proxy.NewTransport(pool))
+	}
+	return client
+}
+
+// newClient builds the client for a download, carrying the site headers
+// (User-Agent, Referer...) and cookie jar of the config
+func newClient(cfg DownloadConfig) *resty.Client {
+	client := NewRestyClient(cfg.Timeout, cfg.Proxy)
+	if len(cfg.Headers) > 0 {
+		client.SetHeaders(cfg.Headers)
+	}
+	if cfg.CookieJar != nil {
+		client.SetCookieJar(cfg.CookieJar)
+	}
+	return client
 }
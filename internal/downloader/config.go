@@ -1,7 +1,10 @@
 package downloader
 
 import (
+	"net/http"
 	"time"
+
+	"mangav5/internal/proxy"
 )
 
 type DownloadConfig struct {
@@ -12,11 +15,44 @@ type DownloadConfig struct {
 	RetryCount int
 	Timeout    time.Duration
 	OutputDir  string
+
+	// Adaptive concurrency: grow while the average latency of the last
+	// LatencyWindow requests is under LatencyLow, halve over LatencyHigh.
+	// Defaults 400ms / 800ms / 5.
+	LatencyLow    time.Duration
+	LatencyHigh   time.Duration
+	LatencyWindow int
+
+	// Exponential backoff bounds between retries, defaults 500ms / 30s
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// WriteManifest keeps manifest.json with the sha256 of every page in OutputDir
+	WriteManifest bool
+
+	// Sent with every image request, e.g. the Referer and User-Agent of the site
+	Headers   map[string]string
+	CookieJar http.CookieJar
+
+	// Limiter is shared between downloads to enforce per-host budgets; nil disables it
+	Limiter *HostLimiter
+
+	// Proxy pool image requests rotate over; nil connects directly
+	Proxy *proxy.Pool
 }
 
 type ProgressReport struct {
+	JobID    int64  `json:"jobId,omitempty"` // set for queued jobs
 	Index    int    `json:"index"`
 	Total    int    `json:"total"`
 	Filename string `json:"filename"`
 	Status   string `json:"status"` // success | fail
+
+	// Concurrency limit of the engine when this image finished
+	Concurrency int `json:"concurrency"`
+
+	// Set when Status is fail
+	ErrorClass ErrorClass `json:"errorClass,omitempty"` // permanent | transient | rate_limited
+	StatusCode int        `json:"statusCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
 }
@@ -3,25 +3,22 @@ package downloader
 import (
 	"bytes"
 	"strings"
-
-	"github.com/go-resty/resty/v2"
 )
 
-func detectExt(resp *resty.Response) string {
+func detectExt(contentType string, head []byte) string {
 	// 1️⃣ Content-Type header
-	if ct := resp.Header().Get("Content-Type"); ct != "" {
-		if ext := extFromContentType(ct); ext != "" {
+	if contentType != "" {
+		if ext := extFromContentType(contentType); ext != "" {
 			return ext
 		}
 	}
 
-	body := resp.Body()
-	if len(body) == 0 {
+	if len(head) == 0 {
 		return ".bin"
 	}
 
 	// 2️⃣ Magic byte
-	if ext := extFromMagic(body); ext != "" {
+	if ext := extFromMagic(head); ext != "" {
 		return ext
 	}
 
@@ -1,12 +1,18 @@
 package downloader
 
 import (
+	"bufio"
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 )
@@ -19,43 +25,224 @@ func DownloadImage(
 	baseName string,
 	retry int,
 ) error {
+	res := downloadImage(ctx, client, url, baseName, DownloadConfig{
+		RetryCount: retry,
+		OutputDir:  dir,
+	}, nil)
+	return res.err
+}
+
+// downloadImage does the work of DownloadImage and reports the written
+// filename, size and the number of attempts made. Transient failures are retried
+// with exponential backoff, permanent ones are returned right away. When
+// cfg.Limiter is set every attempt waits for the host budget; gate, when set,
+// is only entered once the limiter let the attempt through.
+func downloadImage(
+	ctx context.Context,
+	client *resty.Client,
+	url string,
+	baseName string,
+	cfg DownloadConfig,
+	gate *attemptGate,
+) (res ImageResult) {
+	res.URL = url
+	dir := cfg.OutputDir
+
 	// Ensure directory exists
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+		res.setErr(&DownloadError{
+			Class: ErrorPermanent,
+			Err:   fmt.Errorf("failed to create directory: %w", err),
+		})
+		return res
 	}
 
+	retry := max(cfg.RetryCount, 1)
 	var lastErr error
 
 	for i := 0; i < retry; i++ {
-		resp, err := client.R().SetContext(ctx).Get(url)
-		if err != nil {
-			lastErr = err
-			continue
+		if i > 0 {
+			if err := waitBeforeRetry(ctx, url, i, lastErr, cfg); err != nil {
+				res.setErr(err)
+				return res
+			}
 		}
 
-		if resp.StatusCode() != 200 || len(resp.Body()) == 0 {
-			lastErr = fmt.Errorf("bad response %d", resp.StatusCode())
-			continue
+		if _, local := localPath(url); cfg.Limiter != nil && !local {
+			if err := cfg.Limiter.Wait(ctx, url); err != nil {
+				res.setErr(err)
+				return res
+			}
 		}
 
-		ext := detectExt(resp)
-		var name string
-		if baseName != "" {
-			// Remove existing extension from baseName if present to avoid double extensions like .webp.jpg
-			cleanBaseName := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-			name = cleanBaseName + ext
-		} else {
-			name = fmt.Sprintf("%x%s", sha1.Sum([]byte(url)), ext)
+		if err := gate.acquire(ctx); err != nil {
+			res.setErr(err)
+			return res
 		}
-		path := filepath.Join(dir, name)
 
-		if err := os.WriteFile(path, resp.Body(), 0644); err != nil {
+		res.Attempts++
+		start := time.Now()
+		name, size, sum, err := fetchImage(ctx, client, url, dir, baseName)
+		gate.release(time.Since(start), err)
+		if err != nil {
 			lastErr = err
+			if ctx.Err() != nil {
+				res.setErr(ctx.Err())
+				return res
+			}
+			if isPermanent(lastErr) {
+				break
+			}
 			continue
 		}
 
-		return nil
+		res.Filename = name
+		res.Bytes = size
+		res.SHA256 = sum
+		return res
+	}
+
+	res.setErr(lastErr)
+	return res
+}
+
+// fetchImage makes one request for url and streams the body to disk; a
+// file:// URL of a captured image is copied from the capture directory
+// instead.
+// The body goes to a temp file that is only renamed to its final name once
+// its length and image header check out, so a crash never leaves a
+// truncated page behind.
+func fetchImage(ctx context.Context, client *resty.Client, url, dir, baseName string) (string, int64, string, error) {
+	var (
+		body        io.ReadCloser
+		status      int
+		contentType string
+		expected    int64
+	)
+	if path, ok := localPath(url); ok {
+		f, size, err := openLocal(path)
+		if err != nil {
+			return "", 0, "", err
+		}
+		body, status, expected = f, 200, size
+	} else {
+		resp, err := client.R().SetContext(ctx).SetDoNotParseResponse(true).Get(url)
+		if err != nil {
+			return "", 0, "", requestError(ctx, err)
+		}
+		body = resp.RawBody()
+		status = resp.StatusCode()
+		if status != 200 {
+			body.Close()
+			return "", 0, "", statusError(status, parseRetryAfter(resp.Header().Get("Retry-After"), time.Now()))
+		}
+		contentType = resp.Header().Get("Content-Type")
+		expected = resp.RawResponse.ContentLength
+	}
+	defer body.Close()
+
+	invalid := func(err error) *DownloadError {
+		return &DownloadError{Class: ErrorTransient, StatusCode: status, Err: err}
+	}
+
+	br := bufio.NewReaderSize(body, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return "", 0, "", requestError(ctx, err)
+	}
+	if len(head) == 0 {
+		return "", 0, "", invalid(errors.New("empty response body"))
+	}
+
+	if looksLikeHTML(contentType, head) {
+		// Error and hotlink pages are often served with status 200
+		return "", 0, "", invalid(errors.New("received an HTML page instead of an image"))
 	}
 
-	return lastErr
+	ext := detectExt(contentType, head)
+	var name string
+	if baseName != "" {
+		// Remove existing extension from baseName if present to avoid double extensions like .webp.jpg
+		cleanBaseName := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+		name = cleanBaseName + ext
+	} else {
+		name = fmt.Sprintf("%x%s", sha1.Sum([]byte(url)), ext)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*.part")
+	if err != nil {
+		// Disk errors will not go away by downloading again
+		return "", 0, "", &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), br)
+	if err != nil {
+		tmp.Close()
+		if ctx.Err() != nil {
+			return "", 0, "", ctx.Err()
+		}
+		return "", 0, "", requestError(ctx, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", 0, "", &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, "", &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+
+	if expected > 0 && size != expected {
+		return "", 0, "", invalid(fmt.Errorf("truncated body: got %d of %d bytes", size, expected))
+	}
+	if err := verifyImageFile(tmpPath, ext); err != nil {
+		return "", 0, "", invalid(err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		return "", 0, "", &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+
+	return name, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// waitBeforeRetry sleeps before retry number attempt. Rate limited responses
+// wait at least as long as the server asked for.
+func waitBeforeRetry(ctx context.Context, url string, attempt int, lastErr error, cfg DownloadConfig) error {
+	delay := backoffDelay(attempt, cfg.RetryBaseDelay, cfg.RetryMaxDelay)
+
+	var de *DownloadError
+	if errors.As(lastErr, &de) && de.Class == ErrorRateLimited {
+		wait := de.RetryAfter
+		if wait == 0 {
+			wait = defaultRetryAfter
+		}
+		if cfg.Limiter != nil {
+			// The limiter holds back every request to this host, not just ours
+			cfg.Limiter.Backoff(url, wait)
+			return sleepCtx(ctx, delay)
+		}
+		delay = max(delay, min(wait, maxRetryAfter))
+	}
+
+	return sleepCtx(ctx, delay)
+}
+
+func isPermanent(err error) bool {
+	class, _ := ClassifyError(err)
+	return class == ErrorPermanent
+}
+
+// findExisting looks for a file already written for baseName in dir with any
+// of the extensions the downloader produces
+func findExisting(dir string, baseName string) string {
+	for _, ext := range []string{".jpg", ".png", ".webp", ".gif", ".avif", ".bin"} {
+		name := baseName + ext
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() && info.Size() > 0 {
+			return name
+		}
+	}
+	return ""
 }
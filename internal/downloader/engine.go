@@ -2,35 +2,110 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"sync"
-	"time"
 )
 
+// imageTask is a single image to fetch; index is its position in the chapter
+type imageTask struct {
+	index int
+	url   string
+}
+
+// DownloadImagesAdaptive downloads urls into cfg.OutputDir and reports the
+// outcome of every image. The error is only set when the download as a whole
+// was interrupted; failed images are listed in the result.
 func DownloadImagesAdaptive(
 	ctx context.Context,
 	urls []string,
 	cfg DownloadConfig,
 	onProgress func(ProgressReport),
+) (*DownloadResult, error) {
+	tasks := make([]imageTask, len(urls))
+	for i, u := range urls {
+		tasks[i] = imageTask{index: i, url: u}
+	}
+
+	total := len(urls)
+	completed := 0
+	result := &DownloadResult{
+		OutputDir: cfg.OutputDir,
+		Total:     total,
+		Images:    make([]ImageResult, 0, total),
+	}
+
+	err := downloadAdaptive(ctx, tasks, total, cfg, func(res ImageResult, concurrency int) {
+		completed++
+		result.Images = append(result.Images, res)
+
+		if onProgress != nil {
+			onProgress(newProgressReport(completed, total, concurrency, res))
+		}
+	})
+
+	result.recount()
+	result.sortImages()
+
+	if cfg.WriteManifest {
+		if mErr := UpdateManifest(cfg.OutputDir, result.Images); mErr != nil && err == nil {
+			err = mErr
+		}
+	}
+	return result, err
+}
+
+// newProgressReport builds the report for a finished image
+func newProgressReport(completed, total, concurrency int, res ImageResult) ProgressReport {
+	report := ProgressReport{
+		Index:       completed,
+		Total:       total,
+		Filename:    filepath.Base(res.URL),
+		Status:      "success",
+		Concurrency: concurrency,
+	}
+	if res.Failed() {
+		report.Status = "fail"
+		report.ErrorClass = res.ErrorClass
+		report.StatusCode = res.StatusCode
+		report.Error = res.Error
+	}
+	return report
+}
+
+// downloadAdaptive downloads tasks with adaptive concurrency. Filenames are
+// padded against total so a subset of a chapter gets the same names as the full
+// run. onResult is called from a single goroutine for every finished task
+// together with the concurrency limit at that moment.
+func downloadAdaptive(
+	ctx context.Context,
+	tasks []imageTask,
+	total int,
+	cfg DownloadConfig,
+	onResult func(res ImageResult, concurrency int),
 ) error {
 
-	client := NewRestyClient(cfg.Timeout)
+	client := newClient(cfg)
 	ctrl := NewAdaptiveController(
 		cfg.StartConcurrency,
 		cfg.MinConcurrency,
 		cfg.MaxConcurrency,
+		cfg.LatencyLow,
+		cfg.LatencyHigh,
+		cfg.LatencyWindow,
 	)
 
-	total := len(urls)
-	jobs := make(chan int)
-	results := make(chan struct {
-		index   int
-		success bool
-	}, total)
+	type finished struct {
+		res         ImageResult
+		concurrency int
+	}
 
-	// semaphore controls concurrency
-	sem := make(chan struct{}, cfg.MaxConcurrency)
+	jobs := make(chan imageTask)
+	results := make(chan finished, len(tasks))
+
+	// in-flight requests follow the controller, workers beyond it wait
+	gate := &attemptGate{ctrl: ctrl, limit: newDynamicLimit(ctrl)}
 
 	// Calculate padding width for filenames
 	padWidth := len(fmt.Sprintf("%d", total))
@@ -40,73 +115,59 @@ func DownloadImagesAdaptive(
 	worker := func() {
 		defer wg.Done()
 
-		for idx := range jobs {
-			// acquire token
-			sem <- struct{}{}
-
-			url := urls[idx]
-
+		for task := range jobs {
 			// Generate filename based on index (1-based) with padding
-			baseName := fmt.Sprintf("%0*d", padWidth, idx+1)
-
-			start := time.Now()
-			err := DownloadImage(ctx, client, url, cfg.OutputDir, baseName, cfg.RetryCount)
-			latency := time.Since(start)
+			baseName := fmt.Sprintf("%0*d", padWidth, task.index+1)
 
-			// adaptive logic
-			ctrl.AddLatency(latency)
-			ctrl.Adjust(err == nil)
-
-			// release token
-			<-sem
-
-			results <- struct {
-				index   int
-				success bool
-			}{idx, err == nil}
+			res := downloadImage(ctx, client, task.url, baseName, cfg, gate)
+			res.Index = task.index
+			results <- finished{res, ctrl.Current()}
 		}
 	}
 
-	// start fixed number of workers (MAX)
-	wg.Add(cfg.MaxConcurrency)
-	for i := 0; i < cfg.MaxConcurrency; i++ {
+	// start the maximum number of workers, the limit decides how many run
+	workers := max(cfg.MaxConcurrency, 1)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
 		go worker()
 	}
 
 	// feed jobs
 	go func() {
-		for i := range urls {
+		defer close(jobs)
+		for _, task := range tasks {
 			select {
 			case <-ctx.Done():
 				return
-			case jobs <- i:
+			case jobs <- task:
 			}
 		}
-		close(jobs)
 	}()
 
 	// progress dispatcher
 	completed := 0
-	for completed < total {
+	for completed < len(tasks) {
 		select {
-		case res := <-results:
+		case f := <-results:
 			completed++
-
-			status := "success"
-			if !res.success {
-				status = "fail"
-			}
-
-			if onProgress != nil {
-				onProgress(ProgressReport{
-					Index:    completed,
-					Total:    total,
-					Filename: filepath.Base(urls[res.index]),
-					Status:   status,
-				})
+			if onResult != nil {
+				onResult(f.res, f.concurrency)
 			}
 
 		case <-ctx.Done():
+			// Workers stop at their next request; wait for them so nothing is
+			// written into the chapter directory once Pause/Cancel returned.
+			// results is buffered for every task, so no worker blocks on it.
+			wg.Wait()
+
+			// Images that finished meanwhile are still reported, so they are
+			// saved and not downloaded again on resume
+			close(results)
+			for f := range results {
+				if onResult != nil {
+					onResult(f.res, f.concurrency)
+				}
+			}
 			return ctx.Err()
 		}
 	}
@@ -115,6 +176,15 @@ func DownloadImagesAdaptive(
 	return nil
 }
 
+// isCongestion reports whether err hints that the server is overloaded
+func isCongestion(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	class, _ := ClassifyError(err)
+	return class != ErrorPermanent
+}
+
 // sample config
 // cfg := DownloadConfig{
 // 	MinConcurrency:    2,
@@ -0,0 +1,323 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPNG is a complete 2x2 PNG served by the test servers
+var testPNG = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)))
+	return buf.Bytes()
+}()
+
+// latencyServer serves a small PNG after delay and records the peak number
+// of requests it was handling at the same time
+type latencyServer struct {
+	*httptest.Server
+	delay    time.Duration
+	inFlight atomic.Int32
+	peak     atomic.Int32
+}
+
+func newLatencyServer(t *testing.T, delay time.Duration) *latencyServer {
+	s := &latencyServer{delay: delay}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		for {
+			p := s.peak.Load()
+			if n <= p || s.peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(s.delay)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *latencyServer) urls(n int) []string {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/%d.png", s.URL, i)
+	}
+	return urls
+}
+
+func collectProgress() (func(ProgressReport), func() []ProgressReport) {
+	var mu sync.Mutex
+	var reports []ProgressReport
+	return func(r ProgressReport) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports = append(reports, r)
+		}, func() []ProgressReport {
+			mu.Lock()
+			defer mu.Unlock()
+			return reports
+		}
+}
+
+func TestDownloadImagesAdaptiveShrinksOnHighLatency(t *testing.T) {
+	srv := newLatencyServer(t, 60*time.Millisecond)
+
+	cfg := DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 4,
+		MaxConcurrency:   8,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+		LatencyLow:       5 * time.Millisecond,
+		LatencyHigh:      20 * time.Millisecond,
+		LatencyWindow:    2,
+	}
+
+	onProgress, reports := collectProgress()
+	result, err := DownloadImagesAdaptive(context.Background(), srv.urls(24), cfg, onProgress)
+	if err != nil {
+		t.Fatalf("DownloadImagesAdaptive() error = %v", err)
+	}
+	if result.Failed != 0 || result.Succeeded != 24 {
+		t.Fatalf("result = %d ok / %d failed, want 24 / 0", result.Succeeded, result.Failed)
+	}
+
+	if peak := srv.peak.Load(); peak > int32(cfg.StartConcurrency) {
+		t.Errorf("peak in-flight = %d, want at most start concurrency %d", peak, cfg.StartConcurrency)
+	}
+
+	got := reports()
+	if last := got[len(got)-1].Concurrency; last != cfg.MinConcurrency {
+		t.Errorf("final concurrency = %d, want %d", last, cfg.MinConcurrency)
+	}
+}
+
+func TestDownloadImagesAdaptiveGrowsOnLowLatency(t *testing.T) {
+	srv := newLatencyServer(t, 20*time.Millisecond)
+
+	cfg := DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 1,
+		MaxConcurrency:   4,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+		LatencyLow:       time.Second,
+		LatencyHigh:      2 * time.Second,
+		LatencyWindow:    2,
+	}
+
+	onProgress, reports := collectProgress()
+	result, err := DownloadImagesAdaptive(context.Background(), srv.urls(40), cfg, onProgress)
+	if err != nil {
+		t.Fatalf("DownloadImagesAdaptive() error = %v", err)
+	}
+	if result.Failed != 0 {
+		t.Fatalf("result.Failed = %d, want 0", result.Failed)
+	}
+
+	if peak := srv.peak.Load(); peak > int32(cfg.MaxConcurrency) {
+		t.Errorf("peak in-flight = %d, want at most %d", peak, cfg.MaxConcurrency)
+	}
+	if peak := srv.peak.Load(); peak < 2 {
+		t.Errorf("peak in-flight = %d, want concurrency to grow above 1", peak)
+	}
+
+	got := reports()
+	if last := got[len(got)-1].Concurrency; last != cfg.MaxConcurrency {
+		t.Errorf("final concurrency = %d, want %d", last, cfg.MaxConcurrency)
+	}
+}
+
+func TestDownloadImagesAdaptiveIgnoresLimiterWait(t *testing.T) {
+	srv := newLatencyServer(t, 0)
+
+	// Requests are fast but the host budget spaces them far beyond
+	// LatencyHigh; waiting for it must not count as latency
+	cfg := DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 4,
+		MaxConcurrency:   4,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+		LatencyLow:       50 * time.Millisecond,
+		LatencyHigh:      60 * time.Millisecond,
+		LatencyWindow:    2,
+		Limiter:          NewHostLimiter(HostPolicy{RequestsPerSecond: 10, Burst: 1}),
+	}
+
+	onProgress, reports := collectProgress()
+	result, err := DownloadImagesAdaptive(context.Background(), srv.urls(8), cfg, onProgress)
+	if err != nil {
+		t.Fatalf("DownloadImagesAdaptive() error = %v", err)
+	}
+	if result.Failed != 0 {
+		t.Fatalf("result.Failed = %d, want 0", result.Failed)
+	}
+
+	for _, r := range reports() {
+		if r.Concurrency != cfg.StartConcurrency {
+			t.Fatalf("concurrency = %d after image %d, want %d", r.Concurrency, r.Index, cfg.StartConcurrency)
+		}
+	}
+}
+
+func TestDownloadImagesAdaptiveReportsFailures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	cfg := DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 2,
+		MaxConcurrency:   2,
+		RetryCount:       3,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+	}
+	urls := []string{srv.URL + "/a.png", srv.URL + "/missing.png", srv.URL + "/b.png"}
+
+	result, err := DownloadImagesAdaptive(context.Background(), urls, cfg, nil)
+	if err != nil {
+		t.Fatalf("DownloadImagesAdaptive() error = %v", err)
+	}
+	if result.Succeeded != 2 || result.Failed != 1 {
+		t.Fatalf("result = %d ok / %d failed, want 2 / 1", result.Succeeded, result.Failed)
+	}
+
+	missing := result.Images[1]
+	if missing.ErrorClass != ErrorPermanent || missing.StatusCode != http.StatusNotFound {
+		t.Errorf("missing image = %s/%d, want permanent/404", missing.ErrorClass, missing.StatusCode)
+	}
+	if missing.Attempts != 1 {
+		t.Errorf("missing image attempts = %d, want 1 (no retry on permanent errors)", missing.Attempts)
+	}
+	if result.Images[2].Filename != "3.png" {
+		t.Errorf("filename = %q, want 3.png", result.Images[2].Filename)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.OutputDir, "3.png")); err != nil {
+		t.Errorf("expected 3.png on disk: %v", err)
+	}
+}
+
+func TestDownloadImagesAdaptiveCancelWaitsForWorkers(t *testing.T) {
+	// Every image sends its first bytes and then stalls, so each worker is
+	// writing a partial file when the download is cancelled
+	started := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := append(append([]byte(nil), testPNG...), make([]byte, 4096)...)
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", fmt.Sprint(2*len(body)))
+		w.Write(body)
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	cfg := DownloadConfig{
+		MinConcurrency:   4,
+		StartConcurrency: 4,
+		MaxConcurrency:   4,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for i := 0; i < cfg.MaxConcurrency; i++ {
+			<-started
+		}
+		// Let the workers create their partial files
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	urls := make([]string, 8)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/%d.png", srv.URL, i)
+	}
+	if _, err := DownloadImagesAdaptive(ctx, urls, cfg, nil); err == nil {
+		t.Fatal("DownloadImagesAdaptive() succeeded after cancel")
+	}
+
+	// Workers removed their partial files before the call returned
+	entries, err := os.ReadDir(cfg.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("files left after cancel = %v, want none", names)
+	}
+}
+
+func TestDownloadImagesAdaptiveCancelReportsFinishedImages(t *testing.T) {
+	var served atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+		served.Add(1)
+	}))
+	defer srv.Close()
+
+	cfg := DownloadConfig{
+		MinConcurrency:   4,
+		StartConcurrency: 4,
+		MaxConcurrency:   4,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first report waits until every image is on disk and cancels, so the
+	// other results are still buffered when the cancel is seen
+	var once sync.Once
+	onProgress := func(ProgressReport) {
+		once.Do(func() {
+			for served.Load() < 4 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		})
+	}
+
+	urls := make([]string, 4)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/%d.png", srv.URL, i)
+	}
+	// err may be nil when the results are read before the cancel is noticed
+	result, _ := DownloadImagesAdaptive(ctx, urls, cfg, onProgress)
+	if result.Succeeded != 4 || len(result.Images) != 4 {
+		t.Errorf("reported %d images, %d succeeded, want all 4 finished images", len(result.Images), result.Succeeded)
+	}
+}
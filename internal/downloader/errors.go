@@ -0,0 +1,150 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrorClass tells whether a failed download is worth retrying
+type ErrorClass string
+
+const (
+	ErrorPermanent   ErrorClass = "permanent"    // 404, TLS failure, unknown host... retrying will not help
+	ErrorTransient   ErrorClass = "transient"    // timeout, reset connection, 5xx
+	ErrorRateLimited ErrorClass = "rate_limited" // 429 or 503 with Retry-After
+)
+
+// Default backoff bounds used when DownloadConfig leaves them empty
+const (
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// DownloadError is a classified download failure
+type DownloadError struct {
+	Class      ErrorClass
+	StatusCode int           // HTTP status, 0 when no response was received
+	RetryAfter time.Duration // server requested delay for rate limited responses
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError returns the class and HTTP status of a download error.
+// Unclassified errors are reported as transient.
+func ClassifyError(err error) (ErrorClass, int) {
+	if err == nil {
+		return "", 0
+	}
+	var de *DownloadError
+	if errors.As(err, &de) {
+		return de.Class, de.StatusCode
+	}
+	return ErrorTransient, 0
+}
+
+// statusError classifies a non-200 response
+func statusError(code int, retryAfter time.Duration) *DownloadError {
+	err := &DownloadError{
+		StatusCode: code,
+		RetryAfter: retryAfter,
+		Err:        fmt.Errorf("bad response %d", code),
+	}
+
+	switch {
+	case code == http.StatusTooManyRequests:
+		err.Class = ErrorRateLimited
+	case code == http.StatusServiceUnavailable && retryAfter > 0:
+		err.Class = ErrorRateLimited
+	case code == http.StatusRequestTimeout, code == http.StatusTooEarly, code >= 500:
+		err.Class = ErrorTransient
+	case code >= 400:
+		err.Class = ErrorPermanent
+	default:
+		// 1xx/3xx that survived the redirect policy, 204...
+		err.Class = ErrorTransient
+	}
+	return err
+}
+
+// requestError classifies an error of a request made with ctx that failed
+// before its body was read
+func requestError(ctx context.Context, err error) error {
+	if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		// Cancellation of the whole download, not a property of the image
+		return err
+	}
+
+	// A client timeout also reports context.DeadlineExceeded; it is transient
+	class := ErrorTransient
+
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidCert),
+		errors.As(err, &recordErr):
+		class = ErrorPermanent
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		class = ErrorPermanent
+	}
+
+	return &DownloadError{Class: class, Err: err}
+}
+
+// backoffDelay returns the wait before retry number attempt (starting at 1)
+// using exponential growth with jitter so parallel workers spread out
+func backoffDelay(attempt int, base, maxDelay time.Duration) time.Duration {
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	d := base
+	for i := 1; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	// Equal jitter: half fixed, half random
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// sleepCtx waits for d or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,191 @@
+package downloader
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code       int
+		retryAfter time.Duration
+		want       ErrorClass
+	}{
+		{http.StatusTooManyRequests, 0, ErrorRateLimited},
+		{http.StatusTooManyRequests, time.Second, ErrorRateLimited},
+		{http.StatusServiceUnavailable, time.Second, ErrorRateLimited},
+		{http.StatusServiceUnavailable, 0, ErrorTransient},
+		{http.StatusInternalServerError, 0, ErrorTransient},
+		{http.StatusBadGateway, 0, ErrorTransient},
+		{http.StatusRequestTimeout, 0, ErrorTransient},
+		{http.StatusTooEarly, 0, ErrorTransient},
+		{http.StatusNotFound, 0, ErrorPermanent},
+		{http.StatusForbidden, 0, ErrorPermanent},
+		{http.StatusGone, 0, ErrorPermanent},
+		{http.StatusNoContent, 0, ErrorTransient},
+		{http.StatusFound, 0, ErrorTransient},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.code, tt.retryAfter), func(t *testing.T) {
+			err := statusError(tt.code, tt.retryAfter)
+			class, status := ClassifyError(err)
+			if class != tt.want || status != tt.code {
+				t.Errorf("ClassifyError(statusError(%d)) = %s/%d, want %s/%d", tt.code, class, status, tt.want, tt.code)
+			}
+			if err.RetryAfter != tt.retryAfter {
+				t.Errorf("RetryAfter = %v, want %v", err.RetryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantClass  ErrorClass
+		wantStatus int
+	}{
+		{"nil", nil, "", 0},
+		{"plain error", errors.New("boom"), ErrorTransient, 0},
+		{"download error", &DownloadError{Class: ErrorPermanent, StatusCode: 404, Err: errors.New("x")}, ErrorPermanent, 404},
+		{"wrapped download error", fmt.Errorf("page 3: %w", &DownloadError{Class: ErrorRateLimited, StatusCode: 429}), ErrorRateLimited, 429},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, status := ClassifyError(tt.err)
+			if class != tt.wantClass || status != tt.wantStatus {
+				t.Errorf("ClassifyError() = %s/%d, want %s/%d", class, status, tt.wantClass, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	live := context.Background()
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		err       error
+		wantClass ErrorClass // "" when the error must come back unclassified
+	}{
+		{"download cancelled", cancelled, context.Canceled, ""},
+		{"download deadline", expired, fmt.Errorf("get: %w", context.DeadlineExceeded), ""},
+		{"request timeout", live, fmt.Errorf("get: %w", context.DeadlineExceeded), ErrorTransient},
+		{"connection reset", live, errors.New("connection reset by peer"), ErrorTransient},
+		{"unknown host", live, &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, ErrorPermanent},
+		{"dns timeout", live, &net.DNSError{Err: "timeout", Name: "x.example", IsTimeout: true}, ErrorTransient},
+		{"unknown authority", live, fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}), ErrorPermanent},
+		{"bad hostname", live, x509.HostnameError{Certificate: &x509.Certificate{}, Host: "x"}, ErrorPermanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := requestError(tt.ctx, tt.err)
+			var de *DownloadError
+			if tt.wantClass == "" {
+				if errors.As(err, &de) {
+					t.Fatalf("requestError() = %v, want the cancellation as is", err)
+				}
+				return
+			}
+			if !errors.As(err, &de) || de.Class != tt.wantClass {
+				t.Errorf("requestError() = %v, want class %s", err, tt.wantClass)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("requestError() does not wrap %v", tt.err)
+			}
+		})
+	}
+}
+
+func TestFetchClientTimeoutIsTransient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	client := resty.New().SetTimeout(20 * time.Millisecond)
+	_, _, _, err := fetchImage(context.Background(), client, srv.URL+"/1.png", t.TempDir(), "001")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("fetchImage() error = %v, want a timeout", err)
+	}
+	if class, _ := ClassifyError(err); class != ErrorTransient {
+		t.Errorf("timeout class = %q, want %s", class, ErrorTransient)
+	}
+	var de *DownloadError
+	if !errors.As(err, &de) {
+		t.Errorf("timeout was returned as a cancellation: %v", err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	tests := []struct {
+		name      string
+		attempt   int
+		base, max time.Duration
+		wantFull  time.Duration // delay before jitter
+	}{
+		{"first retry", 1, ms(100), ms(1000), ms(100)},
+		{"doubles", 2, ms(100), ms(1000), ms(200)},
+		{"doubles again", 4, ms(100), ms(1000), ms(800)},
+		{"capped", 5, ms(100), ms(1000), ms(1000)},
+		{"capped far out", 60, ms(100), ms(1000), ms(1000)},
+		{"defaults", 1, 0, 0, defaultRetryBaseDelay},
+		{"default cap", 30, 0, 0, defaultRetryMaxDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Equal jitter keeps the delay between half and the full value
+			lo, hi := tt.wantFull/2, tt.wantFull
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 200; i++ {
+				d := backoffDelay(tt.attempt, tt.base, tt.max)
+				if d < lo || d > hi {
+					t.Fatalf("backoffDelay(%d) = %v, want within [%v, %v]", tt.attempt, d, lo, hi)
+				}
+				seen[d] = true
+			}
+			if len(seen) < 2 {
+				t.Errorf("backoffDelay(%d) has no jitter", tt.attempt)
+			}
+		})
+	}
+}
+
+func TestSleepCtx(t *testing.T) {
+	if err := sleepCtx(context.Background(), 0); err != nil {
+		t.Errorf("sleepCtx(0) = %v", err)
+	}
+	if err := sleepCtx(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleepCtx(1ms) = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := sleepCtx(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled sleepCtx() = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("cancelled sleepCtx() did not return right away")
+	}
+}
@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// captureRoot is the directory local images may be copied from, replaced in tests
+var captureRoot = CaptureDir
+
+// CaptureDir holds the images the browser received while scraping. Downloads
+// copy them and leave them in place for later downloads of the same result.
+func CaptureDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "mangav5", "captures")
+}
+
+// FileURL returns the file:// URL of a local image, e.g. one the browser
+// already received while scraping. Downloads copy such images instead of
+// requesting them again.
+func FileURL(path string) string {
+	p := filepath.ToSlash(path)
+	if !strings.HasPrefix(p, "/") {
+		// Windows drive paths become file:///C:/...
+		p = "/" + p
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String()
+}
+
+// IsCaptureURL reports whether rawURL is a file:// URL of a captured image
+func IsCaptureURL(rawURL string) bool {
+	path, ok := localPath(rawURL)
+	if !ok {
+		return false
+	}
+	_, err := capturePath(path)
+	return err == nil
+}
+
+// localPath returns the file behind a file:// URL; ok is false for other
+// schemes
+func localPath(rawURL string) (string, bool) {
+	if len(rawURL) < len("file:") || !strings.EqualFold(rawURL[:len("file:")], "file:") {
+		return "", false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		// file://host/share is a network path, never opened
+		return "", true
+	}
+	p := u.Path
+	if len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p), true
+}
+
+// capturePath checks that path resolves inside the capture directory.
+// URLs from scraped pages are not trusted: any other file, and UNC paths
+// that would open a network connection on Windows, are rejected.
+func capturePath(path string) (string, error) {
+	root, err := filepath.Abs(captureRoot())
+	if err != nil {
+		return "", err
+	}
+	clean := filepath.Clean(path)
+	if path == "" || !filepath.IsAbs(clean) || strings.HasPrefix(clean, `\\`) || strings.HasPrefix(clean, "//") {
+		return "", errors.New("local file is not a captured image")
+	}
+	// Checked on the name first so nothing outside is ever touched
+	if !within(root, clean) {
+		return "", errors.New("local file is not a captured image")
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(clean)
+	if err != nil {
+		return "", err
+	}
+	if !within(realRoot, real) {
+		return "", errors.New("local file is not a captured image")
+	}
+	return real, nil
+}
+
+// within reports whether path is below dir
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// openLocal opens a captured image like a response body
+func openLocal(path string) (io.ReadCloser, int64, error) {
+	path, err := capturePath(path)
+	if err != nil {
+		// Neither a foreign nor a missing file comes back by retrying
+		return nil, 0, &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, &DownloadError{Class: ErrorPermanent, Err: err}
+	}
+	return f, info.Size(), nil
+}
+
+// PruneCaptures removes captured images older than maxAge, downloaded or not
+func PruneCaptures(maxAge time.Duration) error {
+	entries, err := os.ReadDir(captureRoot())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		os.Remove(filepath.Join(captureRoot(), e.Name()))
+	}
+	return nil
+}
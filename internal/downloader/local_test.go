@@ -0,0 +1,84 @@
+package downloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// useCaptureDir points the capture directory to a temp dir for one test
+func useCaptureDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	captureRoot = func() string { return dir }
+	t.Cleanup(func() { captureRoot = CaptureDir })
+	return dir
+}
+
+func TestFetchCapturedImage(t *testing.T) {
+	captures := useCaptureDir(t)
+	src := filepath.Join(captures, "page.img")
+	if err := os.WriteFile(src, testPNG, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !IsCaptureURL(FileURL(src)) {
+		t.Fatalf("IsCaptureURL(%s) = false", FileURL(src))
+	}
+
+	// The same scrape result can be downloaded again
+	for i := 0; i < 2; i++ {
+		out := t.TempDir()
+		name, size, _, err := fetchImage(context.Background(), resty.New(), FileURL(src), out, "001")
+		if err != nil {
+			t.Fatalf("download %d: %v", i+1, err)
+		}
+		if name != "001.png" || size != int64(len(testPNG)) {
+			t.Errorf("fetchImage() = %s, %d", name, size)
+		}
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("capture removed after the copy: %v", err)
+	}
+}
+
+func TestFetchRejectsForeignFiles(t *testing.T) {
+	captures := useCaptureDir(t)
+	outside := filepath.Join(t.TempDir(), "secret.png")
+	if err := os.WriteFile(outside, testPNG, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	urls := map[string]string{
+		"outside the capture dir": FileURL(outside),
+		"dot dot escape":          FileURL(captures) + "/../" + filepath.Base(filepath.Dir(outside)) + "/secret.png",
+		"network host":            "file://fileserver/share/page.png",
+		"UNC path":                "file:////fileserver/share/page.png",
+		"capture dir itself":      FileURL(captures),
+	}
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(captures, "link.png")
+		if err := os.Symlink(outside, link); err != nil {
+			t.Fatal(err)
+		}
+		urls["symlink out of the capture dir"] = FileURL(link)
+	}
+
+	for name, u := range urls {
+		t.Run(name, func(t *testing.T) {
+			if IsCaptureURL(u) {
+				t.Errorf("IsCaptureURL(%s) = true", u)
+			}
+			_, _, _, err := fetchImage(context.Background(), resty.New(), u, t.TempDir(), "001")
+			if err == nil || !isPermanent(err) {
+				t.Errorf("fetchImage(%s) error = %v, want a permanent error", u, err)
+			}
+		})
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("foreign file was touched: %v", err)
+	}
+}
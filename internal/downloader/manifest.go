@@ -0,0 +1,223 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestName is the file kept next to the pages of a downloaded chapter
+const ManifestName = "manifest.json"
+
+// Manifest lists the pages of a chapter with their hashes so the folder can
+// be verified later
+type Manifest struct {
+	Version   int             `json:"version"`
+	UpdatedAt string          `json:"updatedAt"`
+	Files     []ManifestEntry `json:"files"` // sorted by name
+}
+
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url,omitempty"`
+}
+
+// VerifyReport is the outcome of checking a chapter folder against its manifest
+type VerifyReport struct {
+	Dir        string   `json:"dir"`
+	OK         []string `json:"ok"`
+	Missing    []string `json:"missing"`
+	Mismatched []string `json:"mismatched"` // size or hash differs
+}
+
+// Valid reports whether every listed file is present and unchanged
+func (r *VerifyReport) Valid() bool {
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0
+}
+
+// ReadManifest loads the manifest of dir; it returns nil without error when there is none
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// UpdateManifest records the successful images in the manifest of dir,
+// replacing older entries with the same name
+func UpdateManifest(dir string, images []ImageResult) error {
+	m, err := ReadManifest(dir)
+	if err != nil || m == nil {
+		// A corrupt manifest is rebuilt from what we know now
+		m = &Manifest{}
+	}
+
+	byName := make(map[string]ManifestEntry, len(m.Files))
+	for _, f := range m.Files {
+		byName[f.Name] = f
+	}
+
+	changed := false
+	for _, img := range images {
+		if img.Failed() || img.Filename == "" || img.SHA256 == "" {
+			continue
+		}
+		byName[img.Filename] = ManifestEntry{
+			Name:   img.Filename,
+			Size:   img.Bytes,
+			SHA256: img.SHA256,
+			URL:    img.URL,
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	m.Files = m.Files[:0]
+	for _, f := range byName {
+		m.Files = append(m.Files, f)
+	}
+	return writeManifest(dir, m)
+}
+
+// writeManifest sorts the entries of m and replaces the manifest of dir atomically
+func writeManifest(dir string, m *Manifest) error {
+	m.Version = 1
+	m.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Name < m.Files[j].Name
+	})
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Same temp + rename dance as the pages themselves
+	tmp, err := os.CreateTemp(dir, "."+ManifestName+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, ManifestName))
+}
+
+// RebuildManifest re-hashes the pages of dir after they were changed in place,
+// e.g. converted to another format. URLs are carried over from entries with the
+// same name without extension. Nothing is written when dir has no manifest.
+func RebuildManifest(dir string) error {
+	m, err := ReadManifest(dir)
+	if err != nil || m == nil {
+		return err
+	}
+
+	urls := make(map[string]string, len(m.Files))
+	for _, f := range m.Files {
+		urls[stem(f.Name)] = f.URL
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	next := &Manifest{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !isPageFile(name) {
+			continue
+		}
+		size, sum, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		next.Files = append(next.Files, ManifestEntry{
+			Name:   name,
+			Size:   size,
+			SHA256: sum,
+			URL:    urls[stem(name)],
+		})
+	}
+	return writeManifest(dir, next)
+}
+
+func stem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+func isPageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".avif", ".bmp":
+		return true
+	}
+	return false
+}
+
+// VerifyManifest re-hashes every file listed in the manifest of dir
+func VerifyManifest(dir string) (*VerifyReport, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, errors.New("no manifest in " + dir)
+	}
+
+	report := &VerifyReport{Dir: dir}
+	for _, entry := range m.Files {
+		size, sum, err := hashFile(filepath.Join(dir, entry.Name))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			report.Missing = append(report.Missing, entry.Name)
+		case err != nil:
+			return nil, err
+		case size != entry.Size || sum != entry.SHA256:
+			report.Mismatched = append(report.Mismatched, entry.Name)
+		default:
+			report.OK = append(report.OK, entry.Name)
+		}
+	}
+	return report, nil
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,170 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writePage writes a page to dir and returns its successful result
+func writePage(t *testing.T, dir, name, url string, data []byte) ImageResult {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return ImageResult{URL: url, Filename: name, Bytes: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+func readManifest(t *testing.T, dir string) *Manifest {
+	t.Helper()
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m == nil {
+		t.Fatal("no manifest written")
+	}
+	return m
+}
+
+func TestUpdateManifest(t *testing.T) {
+	dir := t.TempDir()
+	first := writePage(t, dir, "001.png", "https://img.test/1", []byte("page one"))
+	second := writePage(t, dir, "002.png", "https://img.test/2", []byte("page two"))
+	failed := ImageResult{URL: "https://img.test/3", Error: "HTTP 500"}
+
+	if err := UpdateManifest(dir, []ImageResult{second, first, failed}); err != nil {
+		t.Fatal(err)
+	}
+	m := readManifest(t, dir)
+	want := []ManifestEntry{
+		{Name: "001.png", Size: first.Bytes, SHA256: first.SHA256, URL: first.URL},
+		{Name: "002.png", Size: second.Bytes, SHA256: second.SHA256, URL: second.URL},
+	}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Fatalf("files = %+v, want %+v", m.Files, want)
+	}
+
+	// Re-downloading the failed page adds it, re-downloading a page replaces it
+	third := writePage(t, dir, "003.png", "https://img.test/3", []byte("page three"))
+	redone := writePage(t, dir, "001.png", "https://img.test/1b", []byte("page one, again"))
+	if err := UpdateManifest(dir, []ImageResult{redone, third}); err != nil {
+		t.Fatal(err)
+	}
+	m = readManifest(t, dir)
+	want = []ManifestEntry{
+		{Name: "001.png", Size: redone.Bytes, SHA256: redone.SHA256, URL: redone.URL},
+		{Name: "002.png", Size: second.Bytes, SHA256: second.SHA256, URL: second.URL},
+		{Name: "003.png", Size: third.Bytes, SHA256: third.SHA256, URL: third.URL},
+	}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Fatalf("files after re-download = %+v, want %+v", m.Files, want)
+	}
+}
+
+func TestUpdateManifestWithoutSuccess(t *testing.T) {
+	dir := t.TempDir()
+	failed := []ImageResult{{URL: "https://img.test/1", Error: "HTTP 404"}}
+	if err := UpdateManifest(dir, failed); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := ReadManifest(dir); err != nil || m != nil {
+		t.Errorf("ReadManifest() = %v, %v, want no manifest", m, err)
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	dir := t.TempDir()
+	var pages []ImageResult
+	for _, name := range []string{"001.png", "002.png", "003.png", "004.png"} {
+		pages = append(pages, writePage(t, dir, name, "", []byte("content of "+name)))
+	}
+	if err := UpdateManifest(dir, pages); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := VerifyManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Valid() || len(report.OK) != 4 {
+		t.Fatalf("fresh chapter report = %+v", report)
+	}
+
+	// One page gone, one edited in place, one cut short
+	if err := os.Remove(filepath.Join(dir, "002.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "003.png"), []byte("content of 003.pnG"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(dir, "004.png"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = VerifyManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid() {
+		t.Error("Valid() = true for a damaged chapter")
+	}
+	if !reflect.DeepEqual(report.OK, []string{"001.png"}) {
+		t.Errorf("OK = %v", report.OK)
+	}
+	if !reflect.DeepEqual(report.Missing, []string{"002.png"}) {
+		t.Errorf("Missing = %v", report.Missing)
+	}
+	if !reflect.DeepEqual(report.Mismatched, []string{"003.png", "004.png"}) {
+		t.Errorf("Mismatched = %v", report.Mismatched)
+	}
+}
+
+func TestVerifyManifestWithoutManifest(t *testing.T) {
+	if _, err := VerifyManifest(t.TempDir()); err == nil {
+		t.Error("VerifyManifest() succeeded without a manifest")
+	}
+}
+
+func TestRebuildManifest(t *testing.T) {
+	dir := t.TempDir()
+	page := writePage(t, dir, "001.jpg", "https://img.test/1", []byte("jpeg page"))
+	if err := UpdateManifest(dir, []ImageResult{page}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The page is converted to WebP, an unrelated file shows up
+	if err := os.Remove(filepath.Join(dir, "001.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	converted := writePage(t, dir, "001.webp", "", []byte("webp page"))
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RebuildManifest(dir); err != nil {
+		t.Fatal(err)
+	}
+	m := readManifest(t, dir)
+	want := []ManifestEntry{{Name: "001.webp", Size: converted.Bytes, SHA256: converted.SHA256, URL: "https://img.test/1"}}
+	if !reflect.DeepEqual(m.Files, want) {
+		t.Errorf("files = %+v, want %+v", m.Files, want)
+	}
+	if report, err := VerifyManifest(dir); err != nil || !report.Valid() {
+		t.Errorf("VerifyManifest() = %+v, %v", report, err)
+	}
+
+	// Without a manifest there is nothing to rebuild
+	empty := t.TempDir()
+	writePage(t, empty, "001.png", "", []byte("page"))
+	if err := RebuildManifest(empty); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := ReadManifest(empty); m != nil {
+		t.Error("RebuildManifest() wrote a manifest where there was none")
+	}
+}
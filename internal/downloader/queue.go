@@ -0,0 +1,447 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mangav5/internal/models"
+)
+
+var (
+	errJobPaused    = errors.New("download job paused")
+	errJobCancelled = errors.New("download job cancelled")
+)
+
+// Delay before the queue reads the store again after it failed, doubled up
+// to storeRetryMax while it keeps failing (e.g. the database is locked)
+const (
+	storeRetryDelay = time.Second
+	storeRetryMax   = time.Minute
+)
+
+// JobStore persists queued chapter jobs and the state of each of their images
+type JobStore interface {
+	Create(ctx context.Context, job *models.DownloadJob, urls []string) (int64, error)
+	GetByID(ctx context.Context, id int64) (*models.DownloadJob, error)
+	List(ctx context.Context) ([]models.DownloadJob, error)
+	ListByStatus(ctx context.Context, statuses ...string) ([]models.DownloadJob, error)
+	UpdateStatus(ctx context.Context, id int64, status, errMsg string) error
+	MarkRunning(ctx context.Context, id int64) (bool, error)
+	ResetRunning(ctx context.Context) error
+	Reorder(ctx context.Context, ids []int64) error
+	Delete(ctx context.Context, id int64) error
+	GetImages(ctx context.Context, jobID int64) ([]models.DownloadJobImage, error)
+	UpdateImage(ctx context.Context, img *models.DownloadJobImage) error
+}
+
+// Queue runs persisted chapter jobs one at a time in position order.
+// Jobs survive restarts: unfinished jobs are picked up again by Start and
+// images that were already written are skipped.
+type Queue struct {
+	store     JobStore
+	configFor func(job models.DownloadJob) (DownloadConfig, error)
+
+	onProgress  func(ProgressReport)
+	onJobUpdate func(models.DownloadJob)
+	onFinished  func(ctx context.Context, job models.DownloadJob) error
+
+	mu        sync.Mutex
+	currentID int64
+	cancelRun context.CancelCauseFunc
+	wake      chan struct{}
+	started   bool
+
+	retryDelay time.Duration // first delay after a store failure
+	retryMax   time.Duration
+}
+
+// NewQueue creates a queue backed by store. configFor builds the download
+// configuration of a job from its stored options; an error fails the job.
+func NewQueue(store JobStore, configFor func(job models.DownloadJob) (DownloadConfig, error)) *Queue {
+	return &Queue{
+		store:     store,
+		configFor: configFor,
+		wake:      make(chan struct{}, 1),
+
+		retryDelay: storeRetryDelay,
+		retryMax:   storeRetryMax,
+	}
+}
+
+// OnProgress registers a callback for per-image progress of the running job
+func (q *Queue) OnProgress(fn func(ProgressReport)) {
+	q.onProgress = fn
+}
+
+// OnJobUpdate registers a callback fired whenever a job changes status
+func (q *Queue) OnJobUpdate(fn func(models.DownloadJob)) {
+	q.onJobUpdate = fn
+}
+
+// OnFinished registers a step run once every image of a job is on disk,
+// before the job is marked completed. An error fails the job.
+func (q *Queue) OnFinished(fn func(ctx context.Context, job models.DownloadJob) error) {
+	q.onFinished = fn
+}
+
+// Start resumes unfinished jobs and processes the queue until ctx is done
+func (q *Queue) Start(ctx context.Context) error {
+	q.mu.Lock()
+	if q.started {
+		q.mu.Unlock()
+		return nil
+	}
+	q.started = true
+	q.mu.Unlock()
+
+	// Jobs still marked running were interrupted by a shutdown or crash
+	if err := q.store.ResetRunning(ctx); err != nil {
+		return err
+	}
+
+	go q.loop(ctx)
+	q.signal()
+	return nil
+}
+
+// Enqueue stores a new job at the end of the queue
+func (q *Queue) Enqueue(ctx context.Context, job models.DownloadJob, urls []string) (int64, error) {
+	if len(urls) == 0 {
+		return 0, errors.New("no urls to download")
+	}
+	if job.OutputDir == "" {
+		return 0, errors.New("output directory is required")
+	}
+
+	job.Status = models.DownloadJobQueued
+	id, err := q.store.Create(ctx, &job, urls)
+	if err != nil {
+		return 0, err
+	}
+
+	q.notify(ctx, id)
+	q.signal()
+	return id, nil
+}
+
+// Jobs returns all jobs in queue order
+func (q *Queue) Jobs(ctx context.Context) ([]models.DownloadJob, error) {
+	return q.store.List(ctx)
+}
+
+// Pause stops a queued or running job; already downloaded images are kept
+func (q *Queue) Pause(ctx context.Context, id int64) error {
+	return q.stop(ctx, id, models.DownloadJobPaused, errJobPaused)
+}
+
+// Cancel stops a job for good; it stays in the list until removed
+func (q *Queue) Cancel(ctx context.Context, id int64) error {
+	return q.stop(ctx, id, models.DownloadJobCancelled, errJobCancelled)
+}
+
+func (q *Queue) stop(ctx context.Context, id int64, status string, cause error) error {
+	job, err := q.store.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("download job %d not found", id)
+	}
+	if job.Status == models.DownloadJobCompleted {
+		return fmt.Errorf("download job %d is already completed", id)
+	}
+
+	if err := q.store.UpdateStatus(ctx, id, status, ""); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	if q.currentID == id && q.cancelRun != nil {
+		q.cancelRun(cause)
+	}
+	q.mu.Unlock()
+
+	q.notify(ctx, id)
+	return nil
+}
+
+// Resume puts a paused, failed or cancelled job back in the queue.
+// Only images that are not done yet will be downloaded.
+func (q *Queue) Resume(ctx context.Context, id int64) error {
+	job, err := q.store.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("download job %d not found", id)
+	}
+
+	switch job.Status {
+	case models.DownloadJobPaused, models.DownloadJobFailed, models.DownloadJobCancelled:
+	default:
+		return fmt.Errorf("download job %d cannot be resumed from status %s", id, job.Status)
+	}
+
+	if err := q.store.UpdateStatus(ctx, id, models.DownloadJobQueued, ""); err != nil {
+		return err
+	}
+
+	q.notify(ctx, id)
+	q.signal()
+	return nil
+}
+
+// Reorder sets the queue order; ids not listed keep their relative order after the listed ones
+func (q *Queue) Reorder(ctx context.Context, ids []int64) error {
+	jobs, err := q.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[int64]bool, len(ids))
+	order := make([]int64, 0, len(jobs))
+	for _, id := range ids {
+		if !listed[id] {
+			listed[id] = true
+			order = append(order, id)
+		}
+	}
+	for _, j := range jobs {
+		if !listed[j.ID] {
+			order = append(order, j.ID)
+		}
+	}
+
+	return q.store.Reorder(ctx, order)
+}
+
+// Remove deletes a job that is not running. Downloaded files are left on disk.
+func (q *Queue) Remove(ctx context.Context, id int64) error {
+	q.mu.Lock()
+	running := q.currentID == id
+	q.mu.Unlock()
+	if running {
+		return fmt.Errorf("download job %d is running, cancel it first", id)
+	}
+	return q.store.Delete(ctx, id)
+}
+
+// signal wakes the queue loop without blocking
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) notify(ctx context.Context, id int64) {
+	if q.onJobUpdate == nil {
+		return
+	}
+	if job, err := q.store.GetByID(ctx, id); err == nil && job != nil {
+		q.onJobUpdate(*job)
+	}
+}
+
+func (q *Queue) loop(ctx context.Context) {
+	delay := q.retryDelay
+	for {
+		jobs, err := q.store.ListByStatus(ctx, models.DownloadJobQueued)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("download queue: list queued jobs: %v", err)
+		} else if len(jobs) > 0 {
+			if err = q.run(ctx, jobs[0]); err == nil {
+				delay = q.retryDelay
+				continue
+			}
+			log.Printf("download job %d: start: %v", jobs[0].ID, err)
+		}
+
+		// A failing store is retried with backoff instead of spinning
+		var retry <-chan time.Time
+		if err != nil {
+			retry = time.After(delay)
+			delay = min(delay*2, q.retryMax)
+		} else {
+			delay = q.retryDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-retry:
+		}
+	}
+}
+
+// run downloads every image of job that is not already on disk. Only a
+// failure to claim the job is returned; download errors fail the job.
+func (q *Queue) run(ctx context.Context, job models.DownloadJob) error {
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// The job is only claimed while still queued, and the claim is published
+	// under the lock: a Pause/Cancel either wins the status write, or waits
+	// for cancelRun and stops the run
+	q.mu.Lock()
+	started, err := q.store.MarkRunning(ctx, job.ID)
+	if err != nil || !started {
+		q.mu.Unlock()
+		return err
+	}
+	q.currentID = job.ID
+	q.cancelRun = cancel
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.currentID = 0
+		q.cancelRun = nil
+		q.mu.Unlock()
+	}()
+	q.notify(ctx, job.ID)
+
+	err = q.download(runCtx, job)
+	if err == nil && q.onFinished != nil {
+		err = q.onFinished(runCtx, job)
+	}
+
+	switch cause := context.Cause(runCtx); {
+	case errors.Is(cause, errJobPaused), errors.Is(cause, errJobCancelled):
+		// Status was already written by Pause/Cancel
+		return nil
+	case ctx.Err() != nil:
+		// Application is shutting down; ResetRunning requeues the job on next start
+		return nil
+	}
+
+	status, errMsg := models.DownloadJobCompleted, ""
+	if err != nil {
+		status, errMsg = models.DownloadJobFailed, err.Error()
+	}
+	if err := q.store.UpdateStatus(ctx, job.ID, status, errMsg); err != nil {
+		log.Printf("download job %d: set status %s: %v", job.ID, status, err)
+	}
+	q.notify(ctx, job.ID)
+	return nil
+}
+
+func (q *Queue) download(ctx context.Context, job models.DownloadJob) error {
+	images, err := q.store.GetImages(ctx, job.ID)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := q.configFor(job)
+	if err != nil {
+		return err
+	}
+	cfg.OutputDir = job.OutputDir
+
+	total := len(images)
+	padWidth := len(fmt.Sprintf("%d", total))
+	done := 0
+
+	// Images that finish while the job is paused or cancelled are still
+	// saved, or they would be downloaded again on resume
+	storeCtx := context.WithoutCancel(ctx)
+
+	var tasks []imageTask
+	for _, img := range images {
+		// Done images are only skipped while their file is still there
+		if img.Status == models.DownloadImageDone && img.Filename != "" {
+			if _, err := os.Stat(filepath.Join(job.OutputDir, img.Filename)); err == nil {
+				done++
+				continue
+			}
+		}
+
+		// The file may have been written right before the app went down
+		baseName := fmt.Sprintf("%0*d", padWidth, img.Index+1)
+		if name := findExisting(job.OutputDir, baseName); name != "" {
+			img.Filename = name
+			img.Status = models.DownloadImageDone
+			img.Error = ""
+			if err := q.store.UpdateImage(storeCtx, &img); err != nil {
+				return err
+			}
+			done++
+			continue
+		}
+
+		tasks = append(tasks, imageTask{index: img.Index, url: img.URL})
+	}
+
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	attempts := make(map[int]int, len(images))
+	for _, img := range images {
+		attempts[img.Index] = img.Attempts
+	}
+
+	failed := 0
+	var finished []ImageResult
+	var storeErr error // first image state that could not be saved
+	err = downloadAdaptive(ctx, tasks, total, cfg, func(res ImageResult, concurrency int) {
+		finished = append(finished, res)
+
+		img := models.DownloadJobImage{
+			JobID:    job.ID,
+			Index:    res.Index,
+			URL:      res.URL,
+			Filename: res.Filename,
+			Attempts: attempts[res.Index] + res.Attempts,
+			Status:   models.DownloadImageDone,
+		}
+		if res.err != nil {
+			// Errors caused by pausing/cancelling are not failures of the image
+			if ctx.Err() != nil {
+				return
+			}
+			img.Status = models.DownloadImageFailed
+			img.Error = res.Error
+			failed++
+		} else {
+			done++
+		}
+		if err := q.store.UpdateImage(storeCtx, &img); err != nil && storeErr == nil {
+			storeErr = err
+		}
+
+		if q.onProgress != nil {
+			report := newProgressReport(done+failed, total, concurrency, res)
+			report.JobID = job.ID
+			q.onProgress(report)
+		}
+	})
+
+	if cfg.WriteManifest {
+		if mErr := UpdateManifest(job.OutputDir, finished); mErr != nil && err == nil {
+			err = mErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// Images left pending would be downloaded again on every resume
+	if storeErr != nil {
+		return fmt.Errorf("save image state: %w", storeErr)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, total)
+	}
+	return nil
+}
@@ -0,0 +1,508 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mangav5/internal/models"
+)
+
+// failingStore fails every read of queued jobs, or every claim of one
+type failingStore struct {
+	JobStore
+	failList bool
+	lists    atomic.Int32
+	claims   atomic.Int32
+}
+
+func (s *failingStore) ListByStatus(ctx context.Context, statuses ...string) ([]models.DownloadJob, error) {
+	s.lists.Add(1)
+	if s.failList {
+		return nil, errors.New("database is locked")
+	}
+	return []models.DownloadJob{{ID: 1, Status: models.DownloadJobQueued}}, nil
+}
+
+func (s *failingStore) MarkRunning(ctx context.Context, id int64) (bool, error) {
+	s.claims.Add(1)
+	return false, errors.New("database is locked")
+}
+
+func (s *failingStore) ResetRunning(ctx context.Context) error { return nil }
+
+func TestQueueBacksOffWhenStoreFails(t *testing.T) {
+	tests := []struct {
+		name     string
+		failList bool
+	}{
+		{"list fails", true},
+		{"claim fails", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &failingStore{failList: tt.failList}
+			ctx, cancel := context.WithCancel(context.Background())
+			q := NewQueue(store, nil)
+			q.retryDelay, q.retryMax = 10*time.Millisecond, 40*time.Millisecond
+			if err := q.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+
+			// 10+20+40+40+40ms: about 6 reads in 200ms, thousands when spinning
+			if n := store.lists.Load(); n < 2 || n > 10 {
+				t.Errorf("store read %d times in 200ms, want a few retries", n)
+			}
+			if !tt.failList && store.claims.Load() != store.lists.Load() {
+				t.Errorf("claims = %d, lists = %d", store.claims.Load(), store.lists.Load())
+			}
+		})
+	}
+}
+
+// memStore is a JobStore in memory that behaves like the database one
+type memStore struct {
+	mu     sync.Mutex
+	nextID int64
+	jobs   map[int64]*models.DownloadJob
+	images map[int64][]models.DownloadJobImage
+
+	// beforeUpdateImage runs before an image state is saved, outside the lock
+	beforeUpdateImage func()
+}
+
+func newMemStore() *memStore {
+	return &memStore{jobs: make(map[int64]*models.DownloadJob), images: make(map[int64][]models.DownloadJobImage)}
+}
+
+func (s *memStore) Create(ctx context.Context, job *models.DownloadJob, urls []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	j := *job
+	j.ID = s.nextID
+	j.Position = int(s.nextID)
+	s.jobs[j.ID] = &j
+	for i, u := range urls {
+		s.images[j.ID] = append(s.images[j.ID], models.DownloadJobImage{
+			ID: int64(i + 1), JobID: j.ID, Index: i, URL: u, Status: models.DownloadImagePending,
+		})
+	}
+	return j.ID, nil
+}
+
+func (s *memStore) GetByID(ctx context.Context, id int64) (*models.DownloadJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, nil
+	}
+	cp := *j
+	return &cp, nil
+}
+
+func (s *memStore) List(ctx context.Context) ([]models.DownloadJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []models.DownloadJob
+	for _, j := range s.jobs {
+		out = append(out, *j)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Position != out[b].Position {
+			return out[a].Position < out[b].Position
+		}
+		return out[a].ID < out[b].ID
+	})
+	return out, nil
+}
+
+func (s *memStore) ListByStatus(ctx context.Context, statuses ...string) ([]models.DownloadJob, error) {
+	jobs, _ := s.List(ctx)
+	var out []models.DownloadJob
+	for _, j := range jobs {
+		if slices.Contains(statuses, j.Status) {
+			out = append(out, j)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) UpdateStatus(ctx context.Context, id int64, status, errMsg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j, ok := s.jobs[id]; ok {
+		j.Status, j.Error = status, errMsg
+	}
+	return nil
+}
+
+func (s *memStore) MarkRunning(ctx context.Context, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.Status != models.DownloadJobQueued {
+		return false, nil
+	}
+	j.Status, j.Error = models.DownloadJobRunning, ""
+	return true, nil
+}
+
+func (s *memStore) ResetRunning(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Status == models.DownloadJobRunning {
+			j.Status = models.DownloadJobQueued
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Reorder(ctx context.Context, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, id := range ids {
+		if j, ok := s.jobs[id]; ok {
+			j.Position = i
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Delete(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	delete(s.images, id)
+	return nil
+}
+
+func (s *memStore) GetImages(ctx context.Context, jobID int64) ([]models.DownloadJobImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.images[jobID]), nil
+}
+
+func (s *memStore) UpdateImage(ctx context.Context, img *models.DownloadJobImage) error {
+	if s.beforeUpdateImage != nil {
+		s.beforeUpdateImage()
+	}
+	// Like the database, a cancelled context saves nothing
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, cur := range s.images[img.JobID] {
+		if cur.Index == img.Index {
+			s.images[img.JobID][i] = *img
+			return nil
+		}
+	}
+	return fmt.Errorf("image %d of job %d not found", img.Index, img.JobID)
+}
+
+func (s *memStore) status(id int64) string {
+	j, _ := s.GetByID(context.Background(), id)
+	if j == nil {
+		return ""
+	}
+	return j.Status
+}
+
+// waitStatus waits until job id has one of statuses
+func (s *memStore) waitStatus(t *testing.T, id int64, statuses ...string) *models.DownloadJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, _ := s.GetByID(context.Background(), id)
+		if j != nil && slices.Contains(statuses, j.Status) {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d status = %q, want one of %v", id, s.status(id), statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testQueueConfig(job models.DownloadJob) (DownloadConfig, error) {
+	return DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 1,
+		MaxConcurrency:   1,
+		RetryCount:       1,
+		Timeout:          5 * time.Second,
+	}, nil
+}
+
+// startQueue starts a queue on store until the test ends
+func startQueue(t *testing.T, store JobStore, configFor func(models.DownloadJob) (DownloadConfig, error)) *Queue {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q := NewQueue(store, configFor)
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestQueueTransitions(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	q := NewQueue(store, testQueueConfig)
+	var updates []string
+	q.OnJobUpdate(func(job models.DownloadJob) { updates = append(updates, job.Status) })
+
+	id, err := q.Enqueue(ctx, models.DownloadJob{OutputDir: t.TempDir()}, []string{"http://img.test/1.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		do      func(context.Context, int64) error
+		want    string // status afterwards
+		wantErr bool
+	}{
+		{"resume queued", q.Resume, models.DownloadJobQueued, true},
+		{"pause", q.Pause, models.DownloadJobPaused, false},
+		{"pause again", q.Pause, models.DownloadJobPaused, false},
+		{"resume paused", q.Resume, models.DownloadJobQueued, false},
+		{"cancel", q.Cancel, models.DownloadJobCancelled, false},
+		{"resume cancelled", q.Resume, models.DownloadJobQueued, false},
+	}
+	for _, st := range steps {
+		err := st.do(ctx, id)
+		if (err != nil) != st.wantErr {
+			t.Fatalf("%s: err = %v, want error %v", st.name, err, st.wantErr)
+		}
+		if got := store.status(id); got != st.want {
+			t.Fatalf("%s: status = %q, want %q", st.name, got, st.want)
+		}
+	}
+	want := []string{"queued", "paused", "paused", "queued", "cancelled", "queued"}
+	if !slices.Equal(updates, want) {
+		t.Errorf("job updates = %v, want %v", updates, want)
+	}
+
+	// Failed jobs resume, completed ones neither pause nor resume
+	store.UpdateStatus(ctx, id, models.DownloadJobFailed, "1 of 1 images failed")
+	if err := q.Resume(ctx, id); err != nil || store.status(id) != models.DownloadJobQueued {
+		t.Errorf("resume failed job: %v, status %q", err, store.status(id))
+	}
+	store.UpdateStatus(ctx, id, models.DownloadJobCompleted, "")
+	if err := q.Pause(ctx, id); err == nil {
+		t.Error("completed job was paused")
+	}
+	if err := q.Cancel(ctx, id); err == nil {
+		t.Error("completed job was cancelled")
+	}
+	if err := q.Resume(ctx, id); err == nil {
+		t.Error("completed job was resumed")
+	}
+
+	for name, do := range map[string]func(context.Context, int64) error{"pause": q.Pause, "cancel": q.Cancel, "resume": q.Resume} {
+		if err := do(ctx, 99); err == nil {
+			t.Errorf("%s of a missing job succeeded", name)
+		}
+	}
+
+	if _, err := q.Enqueue(ctx, models.DownloadJob{OutputDir: t.TempDir()}, nil); err == nil {
+		t.Error("job without urls was enqueued")
+	}
+	if _, err := q.Enqueue(ctx, models.DownloadJob{}, []string{"http://img.test/1.png"}); err == nil {
+		t.Error("job without output directory was enqueued")
+	}
+}
+
+func TestQueueReorderAndRemove(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+	q := NewQueue(store, testQueueConfig)
+	for i := 0; i < 4; i++ {
+		if _, err := q.Enqueue(ctx, models.DownloadJob{OutputDir: t.TempDir()}, []string{"http://img.test/1.png"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order := func() []int64 {
+		jobs, err := q.Jobs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+
+	// Unlisted jobs follow in their current order, duplicates count once
+	if err := q.Reorder(ctx, []int64{3, 1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order(), []int64{3, 1, 2, 4}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+	if err := q.Reorder(ctx, []int64{4}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order(), []int64{4, 3, 1, 2}; !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+
+	if err := q.Remove(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := order(), []int64{4, 3, 2}; !slices.Equal(got, want) {
+		t.Errorf("order after remove = %v, want %v", got, want)
+	}
+
+	// The running job must be cancelled first
+	q.mu.Lock()
+	q.currentID = 3
+	q.mu.Unlock()
+	if err := q.Remove(ctx, 3); err == nil {
+		t.Error("running job was removed")
+	}
+	if got := order(); len(got) != 3 {
+		t.Errorf("order = %v", got)
+	}
+}
+
+func TestQueueResumeSkipsDoneImages(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+	store := newMemStore()
+	dir := t.TempDir()
+
+	q := NewQueue(store, testQueueConfig)
+	urls := []string{srv.URL + "/1.png", srv.URL + "/2.png", srv.URL + "/3.png", srv.URL + "/4.png"}
+	id, err := q.Enqueue(context.Background(), models.DownloadJob{OutputDir: dir}, urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.UpdateStatus(context.Background(), id, models.DownloadJobPaused, "")
+
+	// Page 1 is done, page 2 was written right before a crash, page 3 is
+	// marked done but its file is gone
+	os.WriteFile(filepath.Join(dir, "1.png"), testPNG, 0644)
+	os.WriteFile(filepath.Join(dir, "2.png"), testPNG, 0644)
+	store.images[id][0].Status, store.images[id][0].Filename = models.DownloadImageDone, "1.png"
+	store.images[id][2].Status, store.images[id][2].Filename = models.DownloadImageDone, "3.png"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := q.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Resume(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	job := store.waitStatus(t, id, models.DownloadJobCompleted, models.DownloadJobFailed)
+	if job.Status != models.DownloadJobCompleted {
+		t.Fatalf("job = %+v", job)
+	}
+
+	if got := requests.Load(); got != 2 {
+		t.Errorf("requests = %d, want 2 for pages 3 and 4 only", got)
+	}
+	images, _ := store.GetImages(ctx, id)
+	for _, img := range images {
+		if img.Status != models.DownloadImageDone || img.Filename == "" {
+			t.Errorf("image %d = %+v, want done", img.Index, img)
+		}
+	}
+	if img := images[1]; img.Filename != "2.png" {
+		t.Errorf("page written before the crash = %q, want 2.png", img.Filename)
+	}
+}
+
+func TestQueueFailsJobWithoutConfig(t *testing.T) {
+	store := newMemStore()
+	q := startQueue(t, store, func(job models.DownloadJob) (DownloadConfig, error) {
+		var options struct{}
+		if err := json.Unmarshal([]byte(job.OptionsJSON), &options); err != nil {
+			return DownloadConfig{}, fmt.Errorf("invalid stored download options: %w", err)
+		}
+		return testQueueConfig(job)
+	})
+
+	id, err := q.Enqueue(context.Background(), models.DownloadJob{OutputDir: t.TempDir(), OptionsJSON: "{broken"}, []string{"http://img.test/1.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := store.waitStatus(t, id, models.DownloadJobFailed, models.DownloadJobCompleted)
+	if job.Status != models.DownloadJobFailed || !strings.Contains(job.Error, "invalid stored download options") {
+		t.Errorf("job = %q %q, want failed on its options", job.Status, job.Error)
+	}
+}
+
+func TestQueuePauseKeepsFinishedImages(t *testing.T) {
+	srv := newLatencyServer(t, 0)
+	store := newMemStore()
+	q := startQueue(t, store, testQueueConfig)
+
+	// The job is paused while the state of its first image is being saved
+	var once sync.Once
+	var id int64
+	store.beforeUpdateImage = func() {
+		once.Do(func() {
+			if err := q.Pause(context.Background(), id); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	var err error
+	id, err = q.Enqueue(context.Background(), models.DownloadJob{OutputDir: t.TempDir()}, srv.urls(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.waitStatus(t, id, models.DownloadJobPaused)
+
+	// Wait for the run to end before reading its images
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		running := q.currentID == id
+		q.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("paused job did not stop")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	images, _ := store.GetImages(context.Background(), id)
+	if images[0].Status != models.DownloadImageDone || images[0].Filename == "" {
+		t.Errorf("image finished while pausing = %+v, want done", images[0])
+	}
+	if store.status(id) != models.DownloadJobPaused {
+		t.Errorf("status = %q, want paused", store.status(id))
+	}
+}
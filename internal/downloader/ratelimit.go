@@ -0,0 +1,201 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRetryAfter is used when a 429/503 response carries no Retry-After header
+const defaultRetryAfter = 5 * time.Second
+
+// maxRetryAfter caps how long a single Retry-After may block a host
+const maxRetryAfter = 5 * time.Minute
+
+// HostPolicy is the request budget of a single host
+type HostPolicy struct {
+	RequestsPerSecond float64       // token refill rate, 0 = unlimited
+	Burst             int           // bucket size, at least 1
+	MinDelay          time.Duration // minimum gap between two requests
+}
+
+// HostLimiter keeps a token bucket per host so a slow or strict site
+// cannot eat into the budget of another one.
+type HostLimiter struct {
+	mu            sync.Mutex
+	defaultPolicy HostPolicy
+	policies      map[string]HostPolicy // domain -> policy, matches subdomains too
+	buckets       map[string]*hostBucket
+}
+
+type hostBucket struct {
+	tat          time.Time // theoretical arrival time of the next request (GCRA)
+	last         time.Time // time the last request was allowed
+	blockedUntil time.Time // set by Retry-After
+}
+
+// NewHostLimiter creates a limiter that applies def to hosts without a policy
+func NewHostLimiter(def HostPolicy) *HostLimiter {
+	return &HostLimiter{
+		defaultPolicy: def,
+		policies:      make(map[string]HostPolicy),
+		buckets:       make(map[string]*hostBucket),
+	}
+}
+
+// SetPolicy sets the policy of domain and all its subdomains.
+// A leading "*." is accepted and ignored.
+func (l *HostLimiter) SetPolicy(domain string, p HostPolicy) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policies[domain] = p
+}
+
+// ReplacePolicies swaps all per-domain policies at once
+func (l *HostLimiter) ReplacePolicies(policies map[string]HostPolicy) {
+	next := make(map[string]HostPolicy, len(policies))
+	for domain, p := range policies {
+		if domain = normalizeDomain(domain); domain != "" {
+			next[domain] = p
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.policies = next
+}
+
+// Wait blocks until a request to rawURL is allowed or ctx is done
+func (l *HostLimiter) Wait(ctx context.Context, rawURL string) error {
+	l.mu.Lock()
+	key, policy := l.resolve(hostOf(rawURL))
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &hostBucket{}
+		l.buckets[key] = b
+	}
+	at := b.reserve(time.Now(), policy)
+	l.mu.Unlock()
+
+	return sleepCtx(ctx, time.Until(at))
+}
+
+// Backoff blocks every request to the host of rawURL for d
+func (l *HostLimiter) Backoff(rawURL string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key, _ := l.resolve(hostOf(rawURL))
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &hostBucket{}
+		l.buckets[key] = b
+	}
+	if until := time.Now().Add(d); until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+}
+
+// resolve returns the bucket key and policy for host. Hosts covered by a
+// domain policy share one bucket, the longest matching domain wins.
+func (l *HostLimiter) resolve(host string) (string, HostPolicy) {
+	best := ""
+	for domain := range l.policies {
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(best) {
+			best = domain
+		}
+	}
+	if best != "" {
+		return best, l.policies[best]
+	}
+	return host, l.defaultPolicy
+}
+
+// reserve books the next slot for a request and returns when it may start
+func (b *hostBucket) reserve(now time.Time, p HostPolicy) time.Time {
+	at := now
+	if b.blockedUntil.After(at) {
+		at = b.blockedUntil
+	}
+
+	if p.RequestsPerSecond > 0 {
+		burst := p.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		interval := time.Duration(float64(time.Second) / p.RequestsPerSecond)
+		tolerance := time.Duration(burst-1) * interval
+
+		if earliest := b.tat.Add(-tolerance); earliest.After(at) {
+			at = earliest
+		}
+		if b.tat.After(at) {
+			b.tat = b.tat.Add(interval)
+		} else {
+			b.tat = at.Add(interval)
+		}
+	}
+
+	if p.MinDelay > 0 && !b.last.IsZero() {
+		if next := b.last.Add(p.MinDelay); next.After(at) {
+			at = next
+		}
+	}
+	b.last = at
+
+	return at
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	// Accept full URLs as well as bare domains
+	if strings.Contains(domain, "://") {
+		domain = hostOf(domain)
+	}
+	return strings.TrimSuffix(domain, ".")
+}
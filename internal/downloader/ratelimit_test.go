@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHostBucketReserve(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	tests := []struct {
+		name   string
+		policy HostPolicy
+		calls  []time.Duration // request times relative to t0
+		want   []time.Duration // granted times relative to t0
+	}{
+		{
+			name:   "unlimited",
+			policy: HostPolicy{},
+			calls:  []time.Duration{0, 0, 0},
+			want:   []time.Duration{0, 0, 0},
+		},
+		{
+			name:   "rate spaces requests",
+			policy: HostPolicy{RequestsPerSecond: 10},
+			calls:  []time.Duration{0, 0, 0},
+			want:   []time.Duration{0, ms(100), ms(200)},
+		},
+		{
+			name:   "burst lets requests through at once",
+			policy: HostPolicy{RequestsPerSecond: 10, Burst: 3},
+			calls:  []time.Duration{0, 0, 0, 0},
+			want:   []time.Duration{0, 0, 0, ms(100)},
+		},
+		{
+			name:   "idle time refills the bucket",
+			policy: HostPolicy{RequestsPerSecond: 10, Burst: 2},
+			calls:  []time.Duration{0, 0, ms(500), ms(500)},
+			want:   []time.Duration{0, 0, ms(500), ms(500)},
+		},
+		{
+			name:   "min delay",
+			policy: HostPolicy{MinDelay: ms(250)},
+			calls:  []time.Duration{0, 0, ms(100), ms(900)},
+			want:   []time.Duration{0, ms(250), ms(500), ms(900)},
+		},
+		{
+			name:   "min delay on top of the rate",
+			policy: HostPolicy{RequestsPerSecond: 10, Burst: 5, MinDelay: ms(50)},
+			calls:  []time.Duration{0, 0, 0},
+			want:   []time.Duration{0, ms(50), ms(100)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &hostBucket{}
+			for i, at := range tt.calls {
+				got := b.reserve(t0.Add(at), tt.policy).Sub(t0)
+				if got != tt.want[i] {
+					t.Errorf("request %d at %v granted at %v, want %v", i, at, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHostBucketBlockedUntil(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &hostBucket{blockedUntil: t0.Add(time.Second)}
+
+	if got := b.reserve(t0, HostPolicy{}); !got.Equal(t0.Add(time.Second)) {
+		t.Errorf("blocked request granted at %v, want %v", got.Sub(t0), time.Second)
+	}
+	if got := b.reserve(t0.Add(2*time.Second), HostPolicy{}); !got.Equal(t0.Add(2 * time.Second)) {
+		t.Errorf("request after the block granted at %v, want 2s", got.Sub(t0))
+	}
+}
+
+func TestHostLimiterResolve(t *testing.T) {
+	def := HostPolicy{RequestsPerSecond: 1}
+	site := HostPolicy{RequestsPerSecond: 2}
+	cdn := HostPolicy{RequestsPerSecond: 3}
+
+	l := NewHostLimiter(def)
+	l.SetPolicy("*.Example.com.", site)
+	l.SetPolicy("https://cdn.example.com/images", cdn)
+	l.SetPolicy("", HostPolicy{RequestsPerSecond: 99})
+
+	tests := []struct {
+		host       string
+		wantKey    string
+		wantPolicy HostPolicy
+	}{
+		{"example.com", "example.com", site},
+		{"www.example.com", "example.com", site},
+		{"cdn.example.com", "cdn.example.com", cdn},
+		{"img.cdn.example.com", "cdn.example.com", cdn},
+		{"notexample.com", "notexample.com", def},
+		{"other.org", "other.org", def},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			key, policy := l.resolve(tt.host)
+			if key != tt.wantKey || policy != tt.wantPolicy {
+				t.Errorf("resolve(%q) = %q %+v, want %q %+v", tt.host, key, policy, tt.wantKey, tt.wantPolicy)
+			}
+		})
+	}
+
+	l.ReplacePolicies(map[string]HostPolicy{"other.org": site})
+	if key, policy := l.resolve("www.example.com"); key != "www.example.com" || policy != def {
+		t.Errorf("after ReplacePolicies resolve(www.example.com) = %q %+v, want the default", key, policy)
+	}
+	if key, policy := l.resolve("a.other.org"); key != "other.org" || policy != site {
+		t.Errorf("after ReplacePolicies resolve(a.other.org) = %q %+v", key, policy)
+	}
+}
+
+func TestHostLimiterBackoff(t *testing.T) {
+	l := NewHostLimiter(HostPolicy{})
+	l.Backoff("https://a.example.com/1.jpg", 80*time.Millisecond)
+	l.Backoff("https://a.example.com/2.jpg", time.Millisecond) // shorter, keeps the block
+	l.Backoff("https://a.example.com/3.jpg", -time.Second)
+
+	start := time.Now()
+	if err := l.Wait(context.Background(), "https://b.example.com/1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 40*time.Millisecond {
+		t.Errorf("other host waited %v", d)
+	}
+
+	if err := l.Wait(context.Background(), "https://a.example.com/4.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("blocked host waited %v, want about 80ms", d)
+	}
+
+	// A cancelled wait returns right away
+	l.Backoff("https://a.example.com/", time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx, "https://a.example.com/5.jpg"); err != context.Canceled {
+		t.Errorf("Wait() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"  ", 0},
+		{"0", 0},
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"-3", 0},
+		{"soon", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseRetryAfter(tt.header, now); got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
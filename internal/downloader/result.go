@@ -0,0 +1,145 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// ImageResult is the outcome of a single image of a chapter
+type ImageResult struct {
+	Index      int        `json:"index"`
+	URL        string     `json:"url"`
+	Filename   string     `json:"filename,omitempty"`
+	Bytes      int64      `json:"bytes"`
+	SHA256     string     `json:"sha256,omitempty"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	ErrorClass ErrorClass `json:"errorClass,omitempty"`
+	StatusCode int        `json:"statusCode,omitempty"`
+
+	err error
+}
+
+// setErr records err and its classification
+func (r *ImageResult) setErr(err error) {
+	r.err = err
+	if err != nil {
+		r.Error = err.Error()
+		r.ErrorClass, r.StatusCode = ClassifyError(err)
+	}
+}
+
+// Failed reports whether the image could not be downloaded
+func (r ImageResult) Failed() bool {
+	return r.Error != ""
+}
+
+// DownloadResult reports every image of a chapter download
+type DownloadResult struct {
+	OutputDir string        `json:"outputDir"`
+	Total     int           `json:"total"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Bytes     int64         `json:"bytes"`
+	Images    []ImageResult `json:"images"` // ordered by index
+
+	// Set when the chapter was packed into a .cbz after the download
+	ArchivePath string `json:"archivePath,omitempty"`
+}
+
+// FailedIndices returns the indices of the images that did not download
+func (r *DownloadResult) FailedIndices() []int {
+	var indices []int
+	for _, img := range r.Images {
+		if img.Failed() {
+			indices = append(indices, img.Index)
+		}
+	}
+	return indices
+}
+
+// set stores img, replacing an earlier result for the same index
+func (r *DownloadResult) set(img ImageResult) {
+	replaced := false
+	for i := range r.Images {
+		if r.Images[i].Index == img.Index {
+			r.Images[i] = img
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		r.Images = append(r.Images, img)
+	}
+	r.recount()
+}
+
+// recount refreshes the totals from Images
+func (r *DownloadResult) recount() {
+	r.Succeeded, r.Failed, r.Bytes = 0, 0, 0
+	for _, it := range r.Images {
+		if it.Failed() {
+			r.Failed++
+		} else {
+			r.Succeeded++
+			r.Bytes += it.Bytes
+		}
+	}
+}
+
+func (r *DownloadResult) sortImages() {
+	sort.Slice(r.Images, func(i, j int) bool {
+		return r.Images[i].Index < r.Images[j].Index
+	})
+}
+
+// RetryFailed downloads again only the failed images of prev into the same
+// directory and file names. It returns a copy of prev with those entries
+// replaced; attempts accumulate across runs.
+func RetryFailed(
+	ctx context.Context,
+	prev *DownloadResult,
+	cfg DownloadConfig,
+	onProgress func(ProgressReport),
+) (*DownloadResult, error) {
+	if prev == nil {
+		return nil, errors.New("no previous download result")
+	}
+
+	result := &DownloadResult{
+		OutputDir: prev.OutputDir,
+		Total:     prev.Total,
+		Images:    append([]ImageResult(nil), prev.Images...),
+	}
+	cfg.OutputDir = prev.OutputDir
+
+	var tasks []imageTask
+	attempts := make(map[int]int)
+	for _, img := range prev.Images {
+		if img.Failed() {
+			tasks = append(tasks, imageTask{index: img.Index, url: img.URL})
+			attempts[img.Index] = img.Attempts
+		}
+	}
+
+	completed := result.Total - len(tasks)
+	err := downloadAdaptive(ctx, tasks, result.Total, cfg, func(res ImageResult, concurrency int) {
+		completed++
+		res.Attempts += attempts[res.Index]
+		result.set(res)
+
+		if onProgress != nil {
+			onProgress(newProgressReport(completed, result.Total, concurrency, res))
+		}
+	})
+	result.recount()
+	result.sortImages()
+
+	if cfg.WriteManifest {
+		if mErr := UpdateManifest(cfg.OutputDir, result.Images); mErr != nil && err == nil {
+			err = mErr
+		}
+	}
+	return result, err
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryFailed(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(testPNG)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "01.png"), testPNG, 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev := &DownloadResult{
+		OutputDir: dir,
+		Total:     10,
+		Images: []ImageResult{
+			{Index: 0, URL: srv.URL + "/ok.png", Filename: "01.png", Bytes: int64(len(testPNG)), Attempts: 1},
+			{Index: 4, URL: srv.URL + "/missing.png", Attempts: 1, Error: "permanent: bad response 404", ErrorClass: ErrorPermanent},
+			{Index: 2, URL: srv.URL + "/flaky.png", Attempts: 3, Error: "transient: bad response 502", ErrorClass: ErrorTransient},
+		},
+	}
+	prev.recount()
+
+	cfg := DownloadConfig{
+		MinConcurrency:   1,
+		StartConcurrency: 2,
+		MaxConcurrency:   2,
+		RetryCount:       2,
+		RetryBaseDelay:   time.Millisecond,
+		Timeout:          5 * time.Second,
+		OutputDir:        t.TempDir(), // replaced by the previous directory
+	}
+
+	onProgress, reports := collectProgress()
+	result, err := RetryFailed(context.Background(), prev, cfg, onProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["/ok.png"] != 0 {
+		t.Errorf("succeeded image requested %d times, want 0", hits["/ok.png"])
+	}
+	if hits["/flaky.png"] != 1 || hits["/missing.png"] != 1 {
+		t.Errorf("requests = %v, want one per failed image", hits)
+	}
+
+	if result.OutputDir != dir || result.Total != 10 {
+		t.Errorf("result = %s / %d, want %s / 10", result.OutputDir, result.Total, dir)
+	}
+	if result.Succeeded != 2 || result.Failed != 1 {
+		t.Errorf("result = %d ok / %d failed, want 2 / 1", result.Succeeded, result.Failed)
+	}
+	if got := []int{result.Images[0].Index, result.Images[1].Index, result.Images[2].Index}; !reflect.DeepEqual(got, []int{0, 2, 4}) {
+		t.Errorf("image order = %v, want [0 2 4]", got)
+	}
+
+	flaky := result.Images[1]
+	if flaky.Failed() || flaky.Filename != "03.png" {
+		t.Errorf("retried image = %+v, want 03.png", flaky)
+	}
+	if flaky.Attempts != 4 {
+		t.Errorf("retried image attempts = %d, want 3 earlier + 1", flaky.Attempts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "03.png")); err != nil {
+		t.Errorf("retried image not in the previous directory: %v", err)
+	}
+	if missing := result.Images[2]; missing.Attempts != 2 || missing.StatusCode != http.StatusNotFound {
+		t.Errorf("missing image = %+v, want 2 attempts and status 404", missing)
+	}
+	if got := result.FailedIndices(); !reflect.DeepEqual(got, []int{4}) {
+		t.Errorf("FailedIndices() = %v, want [4]", got)
+	}
+
+	// Progress continues after the images that were already done
+	got := reports()
+	if len(got) != 2 || got[0].Index != 9 || got[1].Index != 10 || got[1].Total != 10 {
+		t.Errorf("progress = %+v, want images 9 and 10 of 10", got)
+	}
+
+	// prev is left as it was
+	if prev.Images[2].Attempts != 3 || !prev.Images[2].Failed() {
+		t.Errorf("previous result changed: %+v", prev.Images[2])
+	}
+}
+
+func TestRetryFailedWithoutResult(t *testing.T) {
+	if _, err := RetryFailed(context.Background(), nil, DownloadConfig{}, nil); err == nil {
+		t.Error("RetryFailed(nil) succeeded")
+	}
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// sniffLen is how much of a body is inspected before it is written
+const sniffLen = 512
+
+// looksLikeHTML reports whether a response is a web page rather than an image
+func looksLikeHTML(contentType string, head []byte) bool {
+	if extFromMagic(head) != "" {
+		return false
+	}
+	ct := strings.ToLower(contentType)
+	if strings.Contains(ct, "text/html") || strings.Contains(ct, "application/json") {
+		return true
+	}
+	return strings.HasPrefix(http.DetectContentType(head), "text/")
+}
+
+// verifyImageFile checks that the file at path is a complete image of the
+// format ext. The header must decode and the trailer expected by the format
+// must be present, which catches bodies cut short without a Content-Length.
+func verifyImageFile(path string, ext string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	switch ext {
+	case ".jpg", ".png", ".gif":
+		if _, _, err := image.DecodeConfig(f); err != nil {
+			return fmt.Errorf("invalid image header: %w", err)
+		}
+	}
+
+	switch ext {
+	case ".jpg":
+		// End Of Image marker, some encoders pad a few bytes after it
+		tail, err := readTail(f, size, 64)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(tail, []byte{0xFF, 0xD9}) {
+			return errors.New("truncated JPEG: missing end of image marker")
+		}
+
+	case ".png":
+		tail, err := readTail(f, size, 12)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(tail, []byte("IEND")) {
+			return errors.New("truncated PNG: missing IEND chunk")
+		}
+
+	case ".gif":
+		tail, err := readTail(f, size, 1)
+		if err != nil {
+			return err
+		}
+		if len(tail) == 0 || tail[0] != 0x3B {
+			return errors.New("truncated GIF: missing trailer")
+		}
+
+	case ".webp":
+		// RIFF header carries the size of the rest of the file
+		head := make([]byte, 12)
+		if _, err := f.ReadAt(head, 0); err != nil {
+			return fmt.Errorf("invalid WebP header: %w", err)
+		}
+		if string(head[0:4]) != "RIFF" || string(head[8:12]) != "WEBP" {
+			return errors.New("invalid WebP header")
+		}
+		if riffSize := int64(binary.LittleEndian.Uint32(head[4:8])) + 8; size < riffSize {
+			return fmt.Errorf("truncated WebP: got %d of %d bytes", size, riffSize)
+		}
+	}
+
+	return nil
+}
+
+func readTail(f *os.File, size int64, n int64) ([]byte, error) {
+	if size < n {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := f.ReadAt(tail, size-n); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return tail, nil
+}
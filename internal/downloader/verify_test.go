@@ -0,0 +1,181 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+var testJPEG = func() []byte {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	return buf.Bytes()
+}()
+
+var testGIF = func() []byte {
+	var buf bytes.Buffer
+	gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black, color.White}), nil)
+	return buf.Bytes()
+}()
+
+// webpFile returns a RIFF/WEBP container whose header claims riffSize bytes
+// after the first eight, holding body
+func webpFile(riffSize uint32, body []byte) []byte {
+	b := make([]byte, 12, 12+len(body))
+	copy(b, "RIFF")
+	binary.LittleEndian.PutUint32(b[4:8], riffSize)
+	copy(b[8:], "WEBP")
+	return append(b, body...)
+}
+
+func TestVerifyImageFile(t *testing.T) {
+	vp8 := []byte("VP8L\x05\x00\x00\x00\x2f\x00\x00\x00\x00\x00")
+	tests := []struct {
+		name    string
+		ext     string
+		data    []byte
+		wantErr string // "" when the file is complete
+	}{
+		{"jpeg", ".jpg", testJPEG, ""},
+		{"jpeg padded after EOI", ".jpg", append(append([]byte(nil), testJPEG...), 0, 0, 0), ""},
+		{"jpeg missing EOI", ".jpg", testJPEG[:len(testJPEG)-2], "missing end of image marker"},
+		{"jpeg bad header", ".jpg", []byte("\xFF\xD8\xFFgarbage"), "invalid image header"},
+		{"png", ".png", testPNG, ""},
+		{"png missing IEND", ".png", testPNG[:len(testPNG)-12], "missing IEND chunk"},
+		{"gif", ".gif", testGIF, ""},
+		{"gif missing trailer", ".gif", testGIF[:len(testGIF)-1], "missing trailer"},
+		{"webp", ".webp", webpFile(uint32(4+len(vp8)), vp8), ""},
+		{"webp shorter than RIFF size", ".webp", webpFile(uint32(4+len(vp8)+100), vp8), "truncated WebP"},
+		{"webp bad header", ".webp", []byte("RIFF\x00\x00\x00\x00WAVEdata"), "invalid WebP header"},
+		{"webp too short for a header", ".webp", []byte("RIFF"), "invalid WebP header"},
+		{"unchecked format", ".avif", []byte("anything"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "page"+tt.ext)
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := verifyImageFile(path, tt.ext)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyImageFile() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyImageFile() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLooksLikeHTML(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        bool
+	}{
+		{"png", "image/png", testPNG, false},
+		{"png sent as html", "text/html", testPNG, false},
+		{"jpeg without content type", "", testJPEG, false},
+		{"html page", "text/html; charset=utf-8", []byte("<html><body>404</body></html>"), true},
+		{"html sent as an image", "image/jpeg", []byte("<!DOCTYPE html><html><title>Blocked</title>"), true},
+		{"json sent as an image", "image/png", []byte(`{"error":"not found"}`), true},
+		{"json error", "application/json", []byte(`{"error":"not found"}`), true},
+		{"plain text", "image/webp", []byte("Forbidden"), true},
+		{"unknown binary", "application/octet-stream", []byte{0x00, 0x01, 0x02, 0x03}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeHTML(tt.contentType, tt.body); got != tt.want {
+				t.Errorf("looksLikeHTML(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchImageRejectsBadBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("<!DOCTYPE html><html><body>Hotlinking is not allowed</body></html>"))
+		case "/json.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(`{"error":"rate limited"}`))
+		case "/short.png":
+			// Announces more than it sends and hangs up
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: %d\r\n\r\n", len(testPNG)+100)
+			buf.Write(testPNG)
+			buf.Flush()
+		case "/cut.png":
+			// Chunked, so only the missing trailer tells it was cut short
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG[:len(testPNG)-12])
+			w.(http.Flusher).Flush()
+		default:
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(testPNG)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path    string
+		wantErr string // "" when the page is written
+	}{
+		{"/ok.png", ""},
+		{"/html.jpg", "HTML page instead of an image"},
+		{"/json.png", "HTML page instead of an image"},
+		{"/short.png", "transient"},
+		{"/cut.png", "missing IEND chunk"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			dir := t.TempDir()
+			name, _, sum, err := fetchImage(context.Background(), resty.New(), srv.URL+tt.path, dir, "001")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name != "001.png" || sum == "" {
+					t.Errorf("fetchImage() = %q %q", name, sum)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("fetchImage() = %v, want %q", err, tt.wantErr)
+			}
+			var de *DownloadError
+			if !errors.As(err, &de) || de.Class != ErrorTransient {
+				t.Errorf("error class = %v, want transient so the page is retried", err)
+			}
+			// Neither the page nor its temp file is left behind
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("files left = %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package httpcache
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	base := Key("GET", "https://example.com/a", nil)
+	if Key("get", "https://example.com/a", nil) != base {
+		t.Error("Key() depends on the method case")
+	}
+	for name, other := range map[string]string{
+		"method": Key("POST", "https://example.com/a", nil),
+		"url":    Key("GET", "https://example.com/b", nil),
+		"body":   Key("GET", "https://example.com/a", []byte(`{"page":2}`)),
+	} {
+		if other == base {
+			t.Errorf("Key() ignores the %s", name)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key("GET", "https://example.com/a", nil)
+
+	if e, err := s.Get(key); err != nil || e != nil {
+		t.Fatalf("Get() of a missing key = %v, %v", e, err)
+	}
+
+	want := &Entry{
+		Method:   "GET",
+		URL:      "https://example.com/a",
+		Status:   200,
+		Header:   http.Header{"Etag": {`"v1"`}},
+		Body:     []byte("<html></html>"),
+		StoredAt: time.Now().Add(-time.Minute),
+	}
+	if err := s.Put(key, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(key)
+	if err != nil || got == nil {
+		t.Fatalf("Get() = %v, %v", got, err)
+	}
+	if string(got.Body) != string(want.Body) || got.Status != 200 {
+		t.Errorf("Get() = %+v, want %+v", got, want)
+	}
+	if etag, _ := got.Validators(); etag != `"v1"` {
+		t.Errorf("Validators() etag = %q", etag)
+	}
+	if got.Fresh(0) || got.Fresh(30*time.Second) || !got.Fresh(time.Hour) {
+		t.Error("Fresh() does not follow the TTL")
+	}
+
+	// Entries older than the cutoff go, the others stay
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(s.path(key), old, old); err != nil {
+		t.Fatal(err)
+	}
+	other := Key("GET", "https://example.com/b", nil)
+	if err := s.Put(other, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prune(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.Get(key); e != nil {
+		t.Error("Prune() kept an old entry")
+	}
+	if e, _ := s.Get(other); e == nil {
+		t.Error("Prune() removed a recent entry")
+	}
+
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := s.Get(other); e != nil {
+		t.Error("Clear() kept an entry")
+	}
+}
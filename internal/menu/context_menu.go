@@ -2,6 +2,11 @@ package menu
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
+
+	"mangav5/internal/convert"
+	"mangav5/services"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
 )
@@ -9,10 +14,11 @@ import (
 type ContextMenu struct {
 	// You can store menu item references here if you need to update them later
 	// deleteMenuItem *application.MenuItem
+	fileService *services.FileService
 }
 
-func NewContextMenu() *ContextMenu {
-	return &ContextMenu{}
+func NewContextMenu(fileService *services.FileService) *ContextMenu {
+	return &ContextMenu{fileService: fileService}
 }
 
 func (f *ContextMenu) GetHomeContextMenu() *application.ContextMenu {
@@ -25,7 +31,17 @@ func (f *ContextMenu) GetHomeContextMenu() *application.ContextMenu {
 	home_cm.AddSeparator()
 
 	home_cm.Add("Convert Chapter Webp").OnClick(func(ctx *application.Context) {
-		fmt.Println("Convert Chapter Webp")
+		// The chapter ID is passed from the frontend (style="--custom-contextmenu-data: {chapter_id}")
+		chapterID, err := strconv.ParseInt(strings.TrimSpace(ctx.ContextMenuData()), 10, 64)
+		if err != nil {
+			application.Get().Event.Emit("convertError", map[string]any{
+				"error": fmt.Sprintf("invalid chapter id %q", ctx.ContextMenuData()),
+			})
+			return
+		}
+		// Conversion takes a while; progress, the report and failures are
+		// emitted as "convertProgress", "convertResult" and "convertError"
+		go f.fileService.ConvertChapterByID(chapterID, &convert.Options{Format: convert.FormatWebP})
 	})
 
 	home_cm.Add("Compress Manga Chapter").OnClick(func(ctx *application.Context) {
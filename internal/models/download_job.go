@@ -0,0 +1,47 @@
+package models
+
+// Download job statuses
+const (
+	DownloadJobQueued    = "queued"
+	DownloadJobRunning   = "running"
+	DownloadJobPaused    = "paused"
+	DownloadJobCompleted = "completed"
+	DownloadJobFailed    = "failed"
+	DownloadJobCancelled = "cancelled"
+)
+
+// Download job image statuses
+const (
+	DownloadImagePending = "pending"
+	DownloadImageDone    = "done"
+	DownloadImageFailed  = "failed"
+)
+
+type DownloadJob struct {
+	ID          int64  `json:"id"`
+	MangaID     int64  `json:"manga_id"`
+	Title       string `json:"title"`
+	OutputDir   string `json:"output_dir"`
+	OptionsJSON string `json:"options_json"`
+	Position    int    `json:"position"`
+	Status      string `json:"status"` // queued, running, paused, completed, failed, cancelled
+	Error       string `json:"error"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+
+	// Aggregated from download_job_images
+	TotalImages int `json:"total_images"`
+	DoneImages  int `json:"done_images"`
+}
+
+type DownloadJobImage struct {
+	ID        int64  `json:"id"`
+	JobID     int64  `json:"job_id"`
+	Index     int    `json:"index"`
+	URL       string `json:"url"`
+	Filename  string `json:"filename"`
+	Status    string `json:"status"` // pending, done, failed
+	Attempts  int    `json:"attempts"`
+	Error     string `json:"error"`
+	UpdatedAt string `json:"updated_at"`
+}
@@ -8,6 +8,7 @@ type ScrapingRule struct {
 	MangaRuleJSON   string `json:"manga_rule_json"`
 	ChapterRuleJSON string `json:"chapter_rule_json"`
 	Enabled         int    `json:"enabled"`
+	Proxy           string `json:"proxy"` // overrides the global proxy, "direct" for none
 	CreatedAt       string `json:"created_at"`
 	UpdatedAt       string `json:"updated_at"`
 }
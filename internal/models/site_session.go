@@ -0,0 +1,10 @@
+package models
+
+// SiteSession holds the encrypted cookies and credentials of a scraping rule
+type SiteSession struct {
+	SiteKey     string `json:"site_key"`
+	Cookies     []byte `json:"-"`
+	Credentials []byte `json:"-"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
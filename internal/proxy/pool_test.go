@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	pool, err := Resolve("", "socks5://127.0.0.1:1080, http://proxy:8080", "http://global:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool == nil || len(pool.Status()) != 2 {
+		t.Fatalf("Resolve() did not pick the first setting: %+v", pool)
+	}
+	if again, _ := Resolve("socks5://127.0.0.1:1080, http://proxy:8080"); again != pool {
+		t.Error("the same setting did not share its pool")
+	}
+
+	if pool, err := Resolve("direct", "http://global:3128"); err != nil || pool != nil {
+		t.Errorf("Resolve(direct) = %v, %v, want no pool", pool, err)
+	}
+	if pool, err := Resolve("", ""); err != nil || pool != nil {
+		t.Errorf("Resolve() of empty settings = %v, %v, want no pool", pool, err)
+	}
+
+	for _, bad := range []string{"ftp://proxy:21", "http://proxy", "://"} {
+		if _, err := Resolve(bad); err == nil {
+			t.Errorf("Resolve(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestPoolRotationAndHealth(t *testing.T) {
+	urls, err := Parse("http://a:1 http://b:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPool(urls)
+	a, b := urls[0], urls[1]
+
+	if got := []string{pool.Next().Host, pool.Next().Host, pool.Next().Host}; got[0] != "a:1" || got[1] != "b:2" || got[2] != "a:1" {
+		t.Fatalf("Next() order = %v, want rotation", got)
+	}
+
+	fail := errors.New("connection refused")
+	for i := 0; i < failThreshold; i++ {
+		pool.Report(a, fail)
+	}
+	for i := 0; i < 4; i++ {
+		if u := pool.Next(); u != b {
+			t.Fatalf("Next() = %s while a is down, want b", u.Host)
+		}
+	}
+
+	// With every proxy down the one that recovers first is still used
+	for i := 0; i < failThreshold; i++ {
+		pool.Report(b, fail)
+	}
+	if u := pool.Next(); u != a {
+		t.Errorf("Next() = %s with every proxy down, want a", u.Host)
+	}
+
+	pool.Report(a, nil)
+	if s := pool.Status(); !s[0].Healthy || s[0].Fails != 0 || s[1].Healthy {
+		t.Errorf("Status() = %+v, want a healthy and b down", s)
+	}
+}
+
+func TestTransportUsesProxy(t *testing.T) {
+	var seen string
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute target URL
+		seen = r.URL.String()
+	}))
+	defer proxySrv.Close()
+
+	urls, err := Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: NewTransport(NewPool(urls))}
+	resp, err := client.Get("http://example.invalid/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen != "http://example.invalid/page" {
+		t.Errorf("proxy saw %q, want the target URL", seen)
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+type poolKey struct{}
+type chosenKey struct{}
+
+// WithPool makes requests with ctx go through pool, over the pool of the
+// transport. A nil pool sends them directly.
+func WithPool(ctx context.Context, pool *Pool) context.Context {
+	return context.WithValue(ctx, poolKey{}, pool)
+}
+
+// Transport sends every request through the next proxy of its pool and
+// reports the outcome, so proxies that keep failing are rotated out
+type Transport struct {
+	base *http.Transport
+	pool *Pool
+}
+
+// NewTransport creates a transport over pool; requests can pick another
+// pool with WithPool. A nil pool sends requests directly.
+func NewTransport(pool *Pool) *Transport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.Proxy = func(req *http.Request) (*url.URL, error) {
+		u, _ := req.Context().Value(chosenKey{}).(*url.URL)
+		return u, nil
+	}
+	return &Transport{base: base, pool: pool}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool := t.pool
+	if p, ok := req.Context().Value(poolKey{}).(*Pool); ok {
+		pool = p
+	}
+	if pool == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	u := pool.Next()
+	resp, err := t.base.RoundTrip(req.WithContext(context.WithValue(req.Context(), chosenKey{}, u)))
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		// Canceled by the caller, not the proxy's fault
+	case err != nil:
+		pool.Report(u, err)
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		pool.Report(u, errors.New(resp.Status))
+	default:
+		pool.Report(u, nil)
+	}
+	return resp, err
+}
+
+// BrowserServer is the --proxy-server form of u; Chromium takes no
+// credentials there
+func BrowserServer(u *url.URL) (string, error) {
+	if u.User != nil {
+		return "", errors.New("the browser does not support proxy credentials, use a proxy without a login for browser rules")
+	}
+	scheme := u.Scheme
+	if scheme == "socks5h" {
+		// Chromium always resolves names through a SOCKS5 proxy
+		scheme = "socks5"
+	}
+	return scheme + "://" + u.Host, nil
+}
@@ -166,6 +166,24 @@ func (r *ChapterRepo) GetByID(ctx context.Context, id int64) (*models.Chapter, e
 	return &c, nil
 }
 
+// GetByMangaAndNumber returns the chapter of a manga with the given number, nil if there is none
+func (r *ChapterRepo) GetByMangaAndNumber(ctx context.Context, mangaID int64, number float64) (*models.Chapter, error) {
+	var id int64
+	err := r.DB.QueryRowContext(ctx, `
+		SELECT chapter_id FROM chapters
+		WHERE manga_id = ? AND chapter_number = ?
+		ORDER BY chapter_id
+		LIMIT 1
+	`, mangaID, number).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByID(ctx, id)
+}
+
 // Update
 func (r *ChapterRepo) Update(ctx context.Context, c *models.Chapter) error {
 	_, err := r.DB.ExecContext(ctx, `
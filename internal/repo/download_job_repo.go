@@ -0,0 +1,273 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"mangav5/internal/models"
+)
+
+type DownloadJobRepo struct {
+	DB *sql.DB
+}
+
+func NewDownloadJobRepo(db *sql.DB) *DownloadJobRepo {
+	return &DownloadJobRepo{DB: db}
+}
+
+const downloadJobSelect = `
+	SELECT
+		j.job_id, j.manga_id, j.title, j.output_dir, j.options_json, j.position,
+		j.status, j.error, j.created_at, j.updated_at,
+		COUNT(i.image_id),
+		COALESCE(SUM(CASE WHEN i.status = 'done' THEN 1 ELSE 0 END), 0)
+	FROM download_jobs AS j
+	LEFT JOIN download_job_images AS i
+	  ON i.job_id = j.job_id
+`
+
+// Create inserts a job and one pending image row per URL, appending the job to the end of the queue.
+func (r *DownloadJobRepo) Create(ctx context.Context, job *models.DownloadJob, urls []string) (int64, error) {
+	if job.Status == "" {
+		job.Status = models.DownloadJobQueued
+	}
+	if job.OptionsJSON == "" {
+		job.OptionsJSON = "{}"
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var mangaID sql.NullInt64
+	if job.MangaID != 0 {
+		mangaID = sql.NullInt64{Int64: job.MangaID, Valid: true}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO download_jobs (manga_id, title, output_dir, options_json, position, status)
+		VALUES (?, ?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM download_jobs), ?)
+	`, mangaID, job.Title, job.OutputDir, job.OptionsJSON, job.Status)
+	if err != nil {
+		return 0, err
+	}
+	jobID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO download_job_images (job_id, image_index, url)
+		VALUES (?, ?, ?)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i, u := range urls {
+		if _, err := stmt.ExecContext(ctx, jobID, i, u); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	job.ID = jobID
+	return jobID, nil
+}
+
+// GetByID
+func (r *DownloadJobRepo) GetByID(ctx context.Context, id int64) (*models.DownloadJob, error) {
+	rows, err := r.DB.QueryContext(ctx, downloadJobSelect+`
+		WHERE j.job_id = ?
+		GROUP BY j.job_id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scanDownloadJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return &jobs[0], nil
+}
+
+// List returns all jobs in queue order
+func (r *DownloadJobRepo) List(ctx context.Context) ([]models.DownloadJob, error) {
+	rows, err := r.DB.QueryContext(ctx, downloadJobSelect+`
+		GROUP BY j.job_id
+		ORDER BY j.position, j.job_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return scanDownloadJobs(rows)
+}
+
+// ListByStatus returns jobs matching any of the given statuses in queue order
+func (r *DownloadJobRepo) ListByStatus(ctx context.Context, statuses ...string) ([]models.DownloadJob, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(statuses)), ",")
+	args := make([]any, len(statuses))
+	for i, s := range statuses {
+		args[i] = s
+	}
+
+	rows, err := r.DB.QueryContext(ctx, downloadJobSelect+`
+		WHERE j.status IN (`+placeholders+`)
+		GROUP BY j.job_id
+		ORDER BY j.position, j.job_id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDownloadJobs(rows)
+}
+
+func scanDownloadJobs(rows *sql.Rows) ([]models.DownloadJob, error) {
+	defer rows.Close()
+
+	var result []models.DownloadJob
+	for rows.Next() {
+		var j models.DownloadJob
+		var mangaID sql.NullInt64
+		var errMsg sql.NullString
+
+		if err := rows.Scan(
+			&j.ID, &mangaID, &j.Title, &j.OutputDir, &j.OptionsJSON, &j.Position,
+			&j.Status, &errMsg, &j.CreatedAt, &j.UpdatedAt,
+			&j.TotalImages, &j.DoneImages,
+		); err != nil {
+			return nil, err
+		}
+		j.MangaID = mangaID.Int64
+		j.Error = errMsg.String
+		result = append(result, j)
+	}
+	return result, rows.Err()
+}
+
+// UpdateStatus sets the job status and error message
+func (r *DownloadJobRepo) UpdateStatus(ctx context.Context, id int64, status, errMsg string) error {
+	_, err := r.DB.ExecContext(ctx, `
+		UPDATE download_jobs SET status = ?, error = ? WHERE job_id = ?
+	`, status, errMsg, id)
+	return err
+}
+
+// MarkRunning sets a queued job to running. It reports false when the job
+// is no longer queued, e.g. it was paused after being picked.
+func (r *DownloadJobRepo) MarkRunning(ctx context.Context, id int64) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, `
+		UPDATE download_jobs SET status = 'running', error = '' WHERE job_id = ? AND status = 'queued'
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ResetRunning moves jobs left in "running" state (e.g. after a crash) back to "queued"
+func (r *DownloadJobRepo) ResetRunning(ctx context.Context) error {
+	_, err := r.DB.ExecContext(ctx, `
+		UPDATE download_jobs SET status = 'queued' WHERE status = 'running'
+	`)
+	return err
+}
+
+// Reorder assigns queue positions following the order of ids
+func (r *DownloadJobRepo) Reorder(ctx context.Context, ids []int64) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, `UPDATE download_jobs SET position = ? WHERE job_id = ?`, i+1, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a job and its images
+func (r *DownloadJobRepo) Delete(ctx context.Context, id int64) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM download_job_images WHERE job_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM download_jobs WHERE job_id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// =====================
+// Job Images
+// =====================
+
+// GetImages returns the images of a job ordered by index
+func (r *DownloadJobRepo) GetImages(ctx context.Context, jobID int64) ([]models.DownloadJobImage, error) {
+	rows, err := r.DB.QueryContext(ctx, `
+		SELECT image_id, job_id, image_index, url, filename, status, attempts, error, updated_at
+		FROM download_job_images
+		WHERE job_id = ?
+		ORDER BY image_index
+	`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []models.DownloadJobImage
+	for rows.Next() {
+		var img models.DownloadJobImage
+		var filename, errMsg sql.NullString
+		if err := rows.Scan(
+			&img.ID, &img.JobID, &img.Index, &img.URL, &filename,
+			&img.Status, &img.Attempts, &errMsg, &img.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		img.Filename = filename.String
+		img.Error = errMsg.String
+		result = append(result, img)
+	}
+	return result, rows.Err()
+}
+
+// UpdateImage stores the outcome of a single image download
+func (r *DownloadJobRepo) UpdateImage(ctx context.Context, img *models.DownloadJobImage) error {
+	res, err := r.DB.ExecContext(ctx, `
+		UPDATE download_job_images
+		SET filename = ?, status = ?, attempts = ?, error = ?, updated_at = datetime('now')
+		WHERE job_id = ? AND image_index = ?
+	`, img.Filename, img.Status, img.Attempts, img.Error, img.JobID, img.Index)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("download job image not found")
+	}
+	return nil
+}
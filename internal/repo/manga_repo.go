@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"mangav5/internal/models"
+	"mangav5/internal/zipper"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
 )
@@ -371,8 +372,19 @@ func (r *MangaRepo) ScanDirectoryForManga(ctx context.Context, mangasDir string)
 				baseName = strings.TrimSuffix(name, ext)
 			}
 
-			// Try parsing number
+			// Metadata written by our downloader or other tools
+			var info *zipper.ComicInfo
+			if isArchive {
+				info, _ = zipper.ReadComicInfo(filepath.Join(mangaPath, name))
+			}
+
+			// Try parsing number, the archive metadata wins over the file name
 			chapterNum, err := parseChapterNumber(baseName)
+			if info != nil {
+				if n, ok := info.ChapterNumber(); ok {
+					chapterNum, err = n, nil
+				}
+			}
 			if err != nil {
 				// Skip if not a valid chapter name
 				continue
@@ -384,7 +396,7 @@ func (r *MangaRepo) ScanDirectoryForManga(ctx context.Context, mangasDir string)
 
 			// Add to new chapters
 			now := time.Now()
-			newChapters = append(newChapters, models.Chapter{
+			chapter := models.Chapter{
 				MangaID:         mangaID,
 				ChapterNumber:   chapterNum,
 				ChapterTitle:    fmt.Sprintf("Chapter %g", chapterNum),
@@ -397,7 +409,11 @@ func (r *MangaRepo) ScanDirectoryForManga(ctx context.Context, mangasDir string)
 				Path:            filepath.ToSlash(filepath.Join(mangaTitle, name)), // Use forward slashes for portability
 				IsCompressed:    isCompressed,
 				Status:          "valid",
-			})
+			}
+			if info != nil {
+				applyComicInfo(&chapter, info)
+			}
+			newChapters = append(newChapters, chapter)
 
 			// Mark as existing in local map to handle duplicate files (e.g. folder and zip for same chapter)
 			existingMap[chapterNum] = true
@@ -422,6 +438,26 @@ func (r *MangaRepo) ScanDirectoryForManga(ctx context.Context, mangasDir string)
 	return nil
 }
 
+// applyComicInfo overrides the scanner defaults of chapter with the values found in info
+func applyComicInfo(chapter *models.Chapter, info *zipper.ComicInfo) {
+	if info.Title != "" {
+		chapter.ChapterTitle = info.Title
+	}
+	if info.Volume > 0 {
+		chapter.Volume = info.Volume
+	}
+	if group := info.TranslatorGroup(); group != "" {
+		chapter.TranslatorGroup = group
+	}
+	if info.LanguageISO != "" {
+		chapter.Language = info.LanguageISO
+	}
+	if t, ok := info.ReleaseDate(); ok {
+		chapter.ReleaseTimeTS = t.Unix()
+		chapter.ReleaseTimeRaw = t.Format("2006-01-02")
+	}
+}
+
 // SaveManga inserts a new manga if it doesn't exist (by MainTitle), or retrieves the existing one.
 // It sets default values for Description, Year, and StatusID if they are missing.
 // Returns the manga ID and a boolean indicating if it was newly inserted (true) or retrieved (false).
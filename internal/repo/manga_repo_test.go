@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"testing"
+
+	"mangav5/internal/models"
+	"mangav5/internal/zipper"
+)
+
+func TestApplyComicInfo(t *testing.T) {
+	defaults := models.Chapter{
+		ChapterTitle:    "Chapter 7",
+		TranslatorGroup: "Unknown",
+		Language:        "en",
+		ReleaseTimeTS:   1,
+		ReleaseTimeRaw:  "scan time",
+	}
+
+	tests := []struct {
+		name string
+		info zipper.ComicInfo
+		want models.Chapter
+	}{
+		{"empty info keeps defaults", zipper.ComicInfo{}, defaults},
+		{
+			"metadata wins",
+			zipper.ComicInfo{Title: "The Beginning", Volume: 2, Translator: "Group A", LanguageISO: "id", Year: 2023, Month: 10, Day: 27},
+			models.Chapter{ChapterTitle: "The Beginning", Volume: 2, TranslatorGroup: "Group A", Language: "id", ReleaseTimeTS: 1698364800, ReleaseTimeRaw: "2023-10-27"},
+		},
+		{
+			"group from scan information",
+			zipper.ComicInfo{ScanInformation: "Old Scans"},
+			models.Chapter{ChapterTitle: "Chapter 7", TranslatorGroup: "Old Scans", Language: "en", ReleaseTimeTS: 1, ReleaseTimeRaw: "scan time"},
+		},
+		{
+			"out of range date is clamped",
+			zipper.ComicInfo{Year: 2020, Month: 13, Day: 40},
+			models.Chapter{ChapterTitle: "Chapter 7", TranslatorGroup: "Unknown", Language: "en", ReleaseTimeTS: 1577836800, ReleaseTimeRaw: "2020-01-01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := defaults
+			info := tt.info
+			applyComicInfo(&got, &info)
+			if got != tt.want {
+				t.Errorf("applyComicInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ type Repositories struct {
 	Config       *ConfigRepo
 	Chapter      *ChapterRepo
 	ScrapingRule *ScrapingRuleRepo
+	DownloadJob  *DownloadJobRepo
+	SiteSession  *SiteSessionRepo
 }
 
 func NewRepositories(db *sql.DB) *Repositories {
@@ -15,5 +17,7 @@ func NewRepositories(db *sql.DB) *Repositories {
 		Config:       NewConfigRepo(db),
 		Chapter:      NewChapterRepo(db),
 		ScrapingRule: NewScrapingRuleRepo(db),
+		DownloadJob:  NewDownloadJobRepo(db),
+		SiteSession:  NewSiteSessionRepo(db),
 	}
 }
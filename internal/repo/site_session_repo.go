@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+
+	"mangav5/internal/models"
+)
+
+type SiteSessionRepo struct {
+	DB *sql.DB
+}
+
+func NewSiteSessionRepo(db *sql.DB) *SiteSessionRepo {
+	return &SiteSessionRepo{DB: db}
+}
+
+// Get returns the session of siteKey, nil when there is none
+func (r *SiteSessionRepo) Get(ctx context.Context, siteKey string) (*models.SiteSession, error) {
+	row := r.DB.QueryRowContext(ctx, `
+		SELECT site_key, cookies, credentials, created_at, updated_at
+		FROM site_sessions
+		WHERE site_key = ?
+	`, siteKey)
+
+	var s models.SiteSession
+	err := row.Scan(&s.SiteKey, &s.Cookies, &s.Credentials, &s.CreatedAt, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &s, err
+}
+
+// SaveCookies stores the encrypted cookies of siteKey, keeping its credentials
+func (r *SiteSessionRepo) SaveCookies(ctx context.Context, siteKey string, cookies []byte) error {
+	_, err := r.DB.ExecContext(ctx, `
+		INSERT INTO site_sessions (site_key, cookies)
+		VALUES (?, ?)
+		ON CONFLICT(site_key) DO UPDATE SET
+			cookies = excluded.cookies
+	`, siteKey, cookies)
+	return err
+}
+
+// SaveCredentials stores the encrypted credentials of siteKey, keeping its cookies
+func (r *SiteSessionRepo) SaveCredentials(ctx context.Context, siteKey string, credentials []byte) error {
+	_, err := r.DB.ExecContext(ctx, `
+		INSERT INTO site_sessions (site_key, credentials)
+		VALUES (?, ?)
+		ON CONFLICT(site_key) DO UPDATE SET
+			credentials = excluded.credentials
+	`, siteKey, credentials)
+	return err
+}
+
+// ClearCookies forgets the cookies of siteKey
+func (r *SiteSessionRepo) ClearCookies(ctx context.Context, siteKey string) error {
+	_, err := r.DB.ExecContext(ctx, `
+		UPDATE site_sessions SET cookies = NULL WHERE site_key = ?
+	`, siteKey)
+	return err
+}
+
+// Delete removes the cookies and credentials of siteKey
+func (r *SiteSessionRepo) Delete(ctx context.Context, siteKey string) error {
+	_, err := r.DB.ExecContext(ctx, `
+		DELETE FROM site_sessions WHERE site_key = ?
+	`, siteKey)
+	return err
+}
@@ -0,0 +1,292 @@
+package transform
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mangav5/internal/util"
+)
+
+// Transform operations
+const (
+	OpAbsolute     = "absolute"      // resolve a link against the page URL
+	OpReplace      = "replace"       // replace text or a regular expression
+	OpSplit        = "split"         // split text into a list
+	OpJoin         = "join"          // join a list into text
+	OpLowercase    = "lowercase"     // lower case text
+	OpUppercase    = "uppercase"     // upper case text
+	OpTrim         = "trim"          // trim surrounding spaces
+	OpNumber       = "number"        // first number in the text
+	OpDate         = "date"          // release time via util.ParseReleaseTime
+	OpHTMLUnescape = "html_unescape" // decode HTML entities
+	OpBase64Decode = "base64_decode" // decode standard or URL safe base64
+	OpDedupe       = "dedupe"        // drop repeated list items
+)
+
+// Step is one entry of a field's transforms list
+type Step struct {
+	Op      string `json:"op"`
+	Pattern string `json:"pattern,omitempty"` // replace: text to find
+	With    string `json:"with,omitempty"`    // replace: replacement, $1 refers to a regex group
+	Regex   bool   `json:"regex,omitempty"`   // replace: pattern is a regular expression
+	Sep     string `json:"sep,omitempty"`     // split: default ",", join: default ", "
+	Base    string `json:"base,omitempty"`    // absolute: base URL, the page URL when empty
+	Format  string `json:"format,omitempty"`  // date: Go layout of the result, unix seconds when empty
+
+	re *regexp.Regexp // compiled Pattern of a regex replace, set by Prepare
+}
+
+var numberRe = regexp.MustCompile(`-?\d[\d,]*(?:\.\d+)?`)
+
+// Check reports a step that cannot run
+func (s Step) Check() error {
+	switch s.Op {
+	case OpReplace:
+		if s.Pattern == "" {
+			return fmt.Errorf("replace requires a pattern")
+		}
+		if s.Regex && s.re == nil {
+			if _, err := regexp.Compile(s.Pattern); err != nil {
+				return fmt.Errorf("replace pattern does not compile: %v", err)
+			}
+		}
+	case OpAbsolute:
+		if s.Base != "" {
+			if u, err := url.Parse(s.Base); err != nil || u.Scheme == "" {
+				return fmt.Errorf("base %q is not an absolute URL", s.Base)
+			}
+		}
+	case OpSplit, OpJoin, OpLowercase, OpUppercase, OpTrim, OpNumber, OpDate,
+		OpHTMLUnescape, OpBase64Decode, OpDedupe:
+	case "":
+		return fmt.Errorf("op is required")
+	default:
+		return fmt.Errorf("unknown transform %q", s.Op)
+	}
+	return nil
+}
+
+// Apply runs steps in order on a field value. Text operations apply to every
+// item of a list; split, join and dedupe change the list itself. pageURL is
+// the base of absolute when the step has none. A step that cannot run
+// leaves the value unchanged.
+func Apply(v interface{}, steps []Step, pageURL string) interface{} {
+	for _, s := range steps {
+		if s.Check() != nil {
+			continue
+		}
+		if s.Op == OpReplace && s.Regex && s.re == nil {
+			// Not prepared: compile once for the whole value
+			s.re = regexp.MustCompile(s.Pattern)
+		}
+		v = s.apply(v, pageURL)
+	}
+	return v
+}
+
+// Prepare returns a copy of steps with their regular expressions compiled,
+// so applying them to many values compiles nothing. Steps that cannot run are
+// kept as they are; Apply skips them.
+func Prepare(steps []Step) []Step {
+	if len(steps) == 0 {
+		return steps
+	}
+	out := make([]Step, len(steps))
+	for i, s := range steps {
+		if s.Op == OpReplace && s.Regex && s.Pattern != "" {
+			s.re, _ = regexp.Compile(s.Pattern)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+func (s Step) apply(v interface{}, pageURL string) interface{} {
+	switch s.Op {
+	case OpSplit:
+		sep := s.Sep
+		if sep == "" {
+			sep = ","
+		}
+		out := []interface{}{}
+		for _, item := range toList(v) {
+			for _, part := range strings.Split(toText(item), sep) {
+				if part = strings.TrimSpace(part); part != "" {
+					out = append(out, part)
+				}
+			}
+		}
+		return out
+
+	case OpJoin:
+		list, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		sep := s.Sep
+		if sep == "" {
+			sep = ", "
+		}
+		parts := make([]string, 0, len(list))
+		for _, item := range list {
+			if t := toText(item); t != "" {
+				parts = append(parts, t)
+			}
+		}
+		return strings.Join(parts, sep)
+
+	case OpDedupe:
+		list, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		seen := make(map[string]bool, len(list))
+		out := make([]interface{}, 0, len(list))
+		for _, item := range list {
+			key := toText(item)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			out = append(out, item)
+		}
+		return out
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		out := make([]interface{}, len(list))
+		for i, item := range list {
+			out[i] = s.applyValue(item, pageURL)
+		}
+		return out
+	}
+	return s.applyValue(v, pageURL)
+}
+
+// applyValue runs a text operation on one value; objects pass through
+func (s Step) applyValue(v interface{}, pageURL string) interface{} {
+	if v == nil {
+		return nil
+	}
+	if _, ok := v.(map[string]interface{}); ok {
+		return v
+	}
+	text := toText(v)
+
+	switch s.Op {
+	case OpAbsolute:
+		base := s.Base
+		if base == "" {
+			base = pageURL
+		}
+		return Absolute(base, text)
+
+	case OpReplace:
+		if s.Regex {
+			return s.re.ReplaceAllString(text, s.With)
+		}
+		return strings.ReplaceAll(text, s.Pattern, s.With)
+
+	case OpLowercase:
+		return strings.ToLower(text)
+
+	case OpUppercase:
+		return strings.ToUpper(text)
+
+	case OpTrim:
+		return strings.TrimSpace(text)
+
+	case OpNumber:
+		m := numberRe.FindString(text)
+		if m == "" {
+			return nil
+		}
+		n, err := strconv.ParseFloat(strings.ReplaceAll(m, ",", ""), 64)
+		if err != nil {
+			return nil
+		}
+		return n
+
+	case OpDate:
+		ts, raw := util.ParseReleaseTime(text)
+		if ts == nil {
+			return raw
+		}
+		if s.Format != "" {
+			return time.Unix(*ts, 0).UTC().Format(s.Format)
+		}
+		return *ts
+
+	case OpHTMLUnescape:
+		return html.UnescapeString(text)
+
+	case OpBase64Decode:
+		return decodeBase64(text)
+	}
+	return v
+}
+
+// Absolute resolves ref against base; data URIs and unparsable values pass through
+func Absolute(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || base == "" || strings.HasPrefix(ref, "data:") {
+		return ref
+	}
+	b, err := url.Parse(base)
+	if err != nil || b.Scheme == "" {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+func decodeBase64(text string) string {
+	trimmed := strings.TrimSpace(text)
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		if b, err := enc.DecodeString(trimmed); err == nil {
+			return string(b)
+		}
+	}
+	return text
+}
+
+func toList(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return val
+	}
+	return []interface{}{v}
+}
+
+// toText formats a scalar field value; numbers never use exponent notation
+func toText(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case int:
+		return strconv.Itoa(val)
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,145 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+)
+
+const page = "https://example.com/manga/one-piece/"
+
+func TestApply(t *testing.T) {
+	list := func(items ...interface{}) []interface{} { return items }
+
+	tests := []struct {
+		name  string
+		in    interface{}
+		steps []Step
+		want  interface{}
+	}{
+		// absolute
+		{"absolute relative path", "ch-1", []Step{{Op: OpAbsolute}}, "https://example.com/manga/one-piece/ch-1"},
+		{"absolute root path", "/img/1.jpg", []Step{{Op: OpAbsolute}}, "https://example.com/img/1.jpg"},
+		{"absolute protocol relative", "//cdn.example.com/1.jpg", []Step{{Op: OpAbsolute}}, "https://cdn.example.com/1.jpg"},
+		{"absolute keeps full URL", "https://other.org/a", []Step{{Op: OpAbsolute}}, "https://other.org/a"},
+		{"absolute explicit base", "1.jpg", []Step{{Op: OpAbsolute, Base: "https://cdn.example.com/c/"}}, "https://cdn.example.com/c/1.jpg"},
+		{"absolute keeps data URI", "data:image/png;base64,AAAA", []Step{{Op: OpAbsolute}}, "data:image/png;base64,AAAA"},
+		{"absolute each list item", list("/a", "/b"), []Step{{Op: OpAbsolute}}, list("https://example.com/a", "https://example.com/b")},
+
+		// replace
+		{"replace text", "Chapter 1 - Raw", []Step{{Op: OpReplace, Pattern: " - Raw"}}, "Chapter 1"},
+		{"replace every match", "a_b_c", []Step{{Op: OpReplace, Pattern: "_", With: " "}}, "a b c"},
+		{"replace regex with group", "Ch.012", []Step{{Op: OpReplace, Pattern: `Ch\.0*(\d+)`, With: "Chapter $1", Regex: true}}, "Chapter 12"},
+		{"replace bad regex is skipped", "abc", []Step{{Op: OpReplace, Pattern: "(", Regex: true}}, "abc"},
+
+		// split
+		{"split default comma", "Action, Comedy,,Drama ", []Step{{Op: OpSplit}}, list("Action", "Comedy", "Drama")},
+		{"split custom separator", "a|b", []Step{{Op: OpSplit, Sep: "|"}}, list("a", "b")},
+		{"split flattens list items", list("a,b", "c"), []Step{{Op: OpSplit}}, list("a", "b", "c")},
+		{"split empty text", "", []Step{{Op: OpSplit}}, []interface{}{}},
+
+		// join
+		{"join default separator", list("a", "b"), []Step{{Op: OpJoin}}, "a, b"},
+		{"join custom separator skips empty", list("a", "", 2.0), []Step{{Op: OpJoin, Sep: "/"}}, "a/2"},
+		{"join leaves text alone", "a", []Step{{Op: OpJoin}}, "a"},
+
+		// case and trim
+		{"lowercase", "OnGoing", []Step{{Op: OpLowercase}}, "ongoing"},
+		{"uppercase", "en", []Step{{Op: OpUppercase}}, "EN"},
+		{"trim", "  x \n", []Step{{Op: OpTrim}}, "x"},
+
+		// number
+		{"number integer", "Chapter 12", []Step{{Op: OpNumber}}, 12.0},
+		{"number decimal", "Ch. 12.5 end", []Step{{Op: OpNumber}}, 12.5},
+		{"number thousands separator", "1,234 views", []Step{{Op: OpNumber}}, 1234.0},
+		{"number negative", "-3", []Step{{Op: OpNumber}}, -3.0},
+		{"number from JSON number", 7.0, []Step{{Op: OpNumber}}, 7.0},
+		{"number missing", "none", []Step{{Op: OpNumber}}, nil},
+
+		// date
+		{"date to unix", "2023-10-27", []Step{{Op: OpDate}}, int64(1698364800)},
+		{"date with layout", "2023-10-27T10:00:00Z", []Step{{Op: OpDate, Format: "2006-01-02"}}, "2023-10-27"},
+		{"date from unix text", "1700000000", []Step{{Op: OpDate}}, int64(1700000000)},
+		{"date unparsable keeps text", "soon", []Step{{Op: OpDate}}, "soon"},
+
+		// html unescape
+		{"html unescape", "Tom &amp; Jerry &#39;s", []Step{{Op: OpHTMLUnescape}}, "Tom & Jerry 's"},
+
+		// base64
+		{"base64 standard", "aHR0cHM6Ly9hLmNvbS8xLmpwZw==", []Step{{Op: OpBase64Decode}}, "https://a.com/1.jpg"},
+		{"base64 raw url safe", "aHR0cHM6Ly9hLmNvbS8_cT0x", []Step{{Op: OpBase64Decode}}, "https://a.com/?q=1"},
+		{"base64 invalid keeps text", "not base64!", []Step{{Op: OpBase64Decode}}, "not base64!"},
+
+		// dedupe
+		{"dedupe keeps first order", list("a", "b", "a", "c", "b"), []Step{{Op: OpDedupe}}, list("a", "b", "c")},
+		{"dedupe leaves text alone", "a", []Step{{Op: OpDedupe}}, "a"},
+
+		// pipelines
+		{"split lowercase dedupe join", "Action, action, Drama", []Step{{Op: OpSplit}, {Op: OpLowercase}, {Op: OpDedupe}, {Op: OpJoin, Sep: ";"}}, "action;drama"},
+		{"decode then absolute", "L2ltZy8xLmpwZw==", []Step{{Op: OpBase64Decode}, {Op: OpAbsolute}}, "https://example.com/img/1.jpg"},
+		{"unknown op is skipped", "x", []Step{{Op: "reverse"}, {Op: OpUppercase}}, "X"},
+		{"objects pass through", map[string]interface{}{"a": "b"}, []Step{{Op: OpUppercase}}, map[string]interface{}{"a": "b"}},
+		{"nil stays nil", nil, []Step{{Op: OpTrim}}, nil},
+		{"no steps", "x", nil, "x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Apply(tt.in, tt.steps, page)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply(%#v) = %#v, want %#v", tt.in, got, tt.want)
+			}
+			// Prepared steps behave the same
+			if got := Apply(tt.in, Prepare(tt.steps), page); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply(%#v) with prepared steps = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	steps := []Step{
+		{Op: OpReplace, Pattern: `\d+`, Regex: true},
+		{Op: OpReplace, Pattern: "(", Regex: true},
+		{Op: OpReplace, Pattern: "x"},
+	}
+	prepared := Prepare(steps)
+
+	if prepared[0].re == nil {
+		t.Error("regex replace was not compiled")
+	}
+	if prepared[1].re != nil || prepared[1].Check() == nil {
+		t.Error("invalid pattern was compiled or passes Check")
+	}
+	if prepared[2].re != nil {
+		t.Error("text replace was compiled")
+	}
+	if steps[0].re != nil {
+		t.Error("Prepare changed its input")
+	}
+}
+
+func TestStepCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		wantErr bool
+	}{
+		{"known op", Step{Op: OpDedupe}, false},
+		{"missing op", Step{}, true},
+		{"unknown op", Step{Op: "reverse"}, true},
+		{"replace without pattern", Step{Op: OpReplace}, true},
+		{"replace bad regex", Step{Op: OpReplace, Pattern: "(", Regex: true}, true},
+		{"replace bad text is fine", Step{Op: OpReplace, Pattern: "("}, false},
+		{"absolute relative base", Step{Op: OpAbsolute, Base: "/img"}, true},
+		{"absolute full base", Step{Op: OpAbsolute, Base: "https://cdn.example.com"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.step.Check()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plain := []byte(`[{"name":"session","value":"abc"}]`)
+
+	sealed, err := Encrypt(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("session")) {
+		t.Fatal("sealed data contains the plain text")
+	}
+
+	got, err := Decrypt(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("Decrypt() = %q, want %q", got, plain)
+	}
+
+	if _, err := Decrypt(bytes.Repeat([]byte{8}, 32), sealed); err == nil {
+		t.Error("Decrypt() with another key succeeded")
+	}
+	if _, err := Decrypt(key, sealed[:4]); err == nil {
+		t.Error("Decrypt() of truncated data succeeded")
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app", secretKeyFile)
+
+	first, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 {
+		t.Fatalf("key length = %d, want 32", len(first))
+	}
+
+	again, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, again) {
+		t.Error("second call created a new key")
+	}
+}
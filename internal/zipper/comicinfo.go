@@ -0,0 +1,175 @@
+package zipper
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+)
+
+// ComicInfoName is the metadata entry read by comic readers (Anansi schema)
+const ComicInfoName = "ComicInfo.xml"
+
+// ComicInfo is the ComicInfo.xml document of a chapter archive.
+// Empty fields are left out of the XML.
+type ComicInfo struct {
+	XMLName         xml.Name        `xml:"ComicInfo"`
+	XMLNSXsi        string          `xml:"xmlns:xsi,attr,omitempty"`
+	XMLNSXsd        string          `xml:"xmlns:xsd,attr,omitempty"`
+	Title           string          `xml:"Title,omitempty"`
+	Series          string          `xml:"Series,omitempty"`
+	Number          string          `xml:"Number,omitempty"`
+	Count           int             `xml:"Count,omitempty"`
+	Volume          int             `xml:"Volume,omitempty"`
+	Summary         string          `xml:"Summary,omitempty"`
+	Notes           string          `xml:"Notes,omitempty"`
+	Year            int             `xml:"Year,omitempty"`
+	Month           int             `xml:"Month,omitempty"`
+	Day             int             `xml:"Day,omitempty"`
+	Writer          string          `xml:"Writer,omitempty"`
+	Penciller       string          `xml:"Penciller,omitempty"`
+	Translator      string          `xml:"Translator,omitempty"`
+	Publisher       string          `xml:"Publisher,omitempty"`
+	Genre           string          `xml:"Genre,omitempty"`
+	Tags            string          `xml:"Tags,omitempty"`
+	Web             string          `xml:"Web,omitempty"`
+	PageCount       int             `xml:"PageCount,omitempty"`
+	LanguageISO     string          `xml:"LanguageISO,omitempty"`
+	Manga           string          `xml:"Manga,omitempty"` // Yes, No, YesAndRightToLeft
+	ScanInformation string          `xml:"ScanInformation,omitempty"`
+	Pages           *ComicInfoPages `xml:"Pages,omitempty"`
+}
+
+type ComicInfoPages struct {
+	Page []ComicPageInfo `xml:"Page"`
+}
+
+// ComicPageInfo describes one page; Type is FrontCover, Story, Credits...
+type ComicPageInfo struct {
+	Image       int    `xml:"Image,attr"`
+	Type        string `xml:"Type,attr,omitempty"`
+	ImageSize   int64  `xml:"ImageSize,attr,omitempty"`
+	ImageWidth  int    `xml:"ImageWidth,attr,omitempty"`
+	ImageHeight int    `xml:"ImageHeight,attr,omitempty"`
+}
+
+// MarshalComicInfo encodes info as an indented XML document
+func MarshalComicInfo(info *ComicInfo) ([]byte, error) {
+	doc := *info
+	if doc.XMLNSXsi == "" {
+		doc.XMLNSXsi = "http://www.w3.org/2001/XMLSchema-instance"
+	}
+	if doc.XMLNSXsd == "" {
+		doc.XMLNSXsd = "http://www.w3.org/2001/XMLSchema"
+	}
+
+	data, err := xml.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// UnmarshalComicInfo decodes a ComicInfo.xml document
+func UnmarshalComicInfo(data []byte) (*ComicInfo, error) {
+	var info ComicInfo
+	if err := xml.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	info.Title = strings.TrimSpace(info.Title)
+	info.Series = strings.TrimSpace(info.Series)
+	info.Number = strings.TrimSpace(info.Number)
+	info.Translator = strings.TrimSpace(info.Translator)
+	info.LanguageISO = strings.TrimSpace(info.LanguageISO)
+	return &info, nil
+}
+
+// ReadComicInfo returns the ComicInfo.xml of a zip/cbz archive or of a
+// chapter directory. It returns nil without error when there is none.
+func ReadComicInfo(path string) (*ComicInfo, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			// Names are case sensitive outside Windows
+			if !e.Type().IsRegular() || !strings.EqualFold(e.Name(), ComicInfoName) {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(path, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			return UnmarshalComicInfo(data)
+		}
+		return nil, nil
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		// Some tools put it in a sub folder or change the case
+		if !strings.EqualFold(filepath.Base(f.Name), ComicInfoName) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalComicInfo(data)
+	}
+	return nil, nil
+}
+
+// ChapterNumber parses Number, ok is false when it is missing or not numeric
+func (c *ComicInfo) ChapterNumber() (float64, bool) {
+	n, err := strconv.ParseFloat(strings.TrimSpace(c.Number), 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// TranslatorGroup returns Translator, falling back to ScanInformation
+// which older scanlation tools use for the group name
+func (c *ComicInfo) TranslatorGroup() string {
+	if c.Translator != "" {
+		return c.Translator
+	}
+	return strings.TrimSpace(c.ScanInformation)
+}
+
+// ReleaseDate returns the date built from Year/Month/Day, ok is false without a year
+func (c *ComicInfo) ReleaseDate() (time.Time, bool) {
+	if c.Year <= 0 {
+		return time.Time{}, false
+	}
+	month, day := c.Month, c.Day
+	if month < 1 || month > 12 {
+		month = 1
+	}
+	if day < 1 || day > 31 {
+		day = 1
+	}
+	return time.Date(c.Year, time.Month(month), day, 0, 0, 0, 0, time.UTC), true
+}
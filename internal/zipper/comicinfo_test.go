@@ -0,0 +1,182 @@
+package zipper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zip"
+)
+
+func TestComicInfoRoundTrip(t *testing.T) {
+	in := &ComicInfo{
+		Title:       "The Beginning",
+		Series:      "One Piece",
+		Number:      "12.5",
+		Volume:      2,
+		Year:        2023,
+		Month:       10,
+		Day:         27,
+		Translator:  "Group A",
+		LanguageISO: "en",
+		Manga:       "YesAndRightToLeft",
+		PageCount:   2,
+		Pages: &ComicInfoPages{Page: []ComicPageInfo{
+			{Image: 0, Type: "FrontCover", ImageSize: 100},
+			{Image: 1},
+		}},
+	}
+
+	data, err := MarshalComicInfo(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xml := string(data)
+	if !strings.HasPrefix(xml, "<?xml") || !strings.Contains(xml, `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`) {
+		t.Errorf("MarshalComicInfo() missing header or namespaces:\n%s", xml)
+	}
+	if strings.Contains(xml, "<Summary>") || strings.Contains(xml, "<Count>") {
+		t.Errorf("MarshalComicInfo() kept empty fields:\n%s", xml)
+	}
+
+	out, err := UnmarshalComicInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Title != in.Title || out.Series != in.Series || out.Number != in.Number ||
+		out.Volume != in.Volume || out.Translator != in.Translator || out.LanguageISO != in.LanguageISO {
+		t.Errorf("round trip = %+v, want %+v", out, in)
+	}
+	if out.Pages == nil || len(out.Pages.Page) != 2 || out.Pages.Page[0].Type != "FrontCover" {
+		t.Errorf("round trip pages = %+v", out.Pages)
+	}
+}
+
+func TestComicInfoFields(t *testing.T) {
+	date := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name      string
+		xml       string
+		number    float64
+		numberOK  bool
+		group     string
+		release   time.Time
+		releaseOK bool
+	}{
+		{"full", `<ComicInfo><Number>12</Number><Translator>Group A</Translator><Year>2023</Year><Month>10</Month><Day>27</Day></ComicInfo>`,
+			12, true, "Group A", date(2023, 10, 27), true},
+		{"decimal number with spaces", `<ComicInfo><Number> 12.5 </Number></ComicInfo>`,
+			12.5, true, "", time.Time{}, false},
+		{"non numeric number", `<ComicInfo><Number>Extra</Number></ComicInfo>`,
+			0, false, "", time.Time{}, false},
+		{"missing number", `<ComicInfo></ComicInfo>`,
+			0, false, "", time.Time{}, false},
+		{"group from scan information", `<ComicInfo><ScanInformation> Old Scans </ScanInformation></ComicInfo>`,
+			0, false, "Old Scans", time.Time{}, false},
+		{"translator wins over scan information", `<ComicInfo><Translator> New </Translator><ScanInformation>Old</ScanInformation></ComicInfo>`,
+			0, false, "New", time.Time{}, false},
+		{"year only", `<ComicInfo><Year>2020</Year></ComicInfo>`,
+			0, false, "", date(2020, 1, 1), true},
+		{"month and day out of range are clamped", `<ComicInfo><Year>2020</Year><Month>13</Month><Day>40</Day></ComicInfo>`,
+			0, false, "", date(2020, 1, 1), true},
+		{"negative year", `<ComicInfo><Year>-1</Year><Month>5</Month></ComicInfo>`,
+			0, false, "", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := UnmarshalComicInfo([]byte(tt.xml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, ok := info.ChapterNumber(); n != tt.number || ok != tt.numberOK {
+				t.Errorf("ChapterNumber() = %v, %v, want %v, %v", n, ok, tt.number, tt.numberOK)
+			}
+			if g := info.TranslatorGroup(); g != tt.group {
+				t.Errorf("TranslatorGroup() = %q, want %q", g, tt.group)
+			}
+			if d, ok := info.ReleaseDate(); !d.Equal(tt.release) || ok != tt.releaseOK {
+				t.Errorf("ReleaseDate() = %v, %v, want %v, %v", d, ok, tt.release, tt.releaseOK)
+			}
+		})
+	}
+}
+
+func TestReadComicInfo(t *testing.T) {
+	const doc = `<?xml version="1.0"?><ComicInfo><Number>7</Number></ComicInfo>`
+
+	writeZip := func(t *testing.T, files map[string]string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "chapter.cbz")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		for name, content := range files {
+			w, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(content))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return path
+	}
+	writeDir := func(t *testing.T, files map[string]string) string {
+		t.Helper()
+		dir := t.TempDir()
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name    string
+		archive bool
+		files   map[string]string
+		found   bool
+	}{
+		{"archive root", true, map[string]string{"001.jpg": "x", "ComicInfo.xml": doc}, true},
+		{"archive sub folder", true, map[string]string{"ch7/001.jpg": "x", "ch7/ComicInfo.xml": doc}, true},
+		{"archive other case", true, map[string]string{"comicinfo.XML": doc}, true},
+		{"archive without metadata", true, map[string]string{"001.jpg": "x"}, false},
+		{"directory", false, map[string]string{"ComicInfo.xml": doc}, true},
+		{"directory other case", false, map[string]string{"comicinfo.xml": doc}, true},
+		{"directory without metadata", false, map[string]string{"001.jpg": "x"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			if tt.archive {
+				path = writeZip(t, tt.files)
+			} else {
+				path = writeDir(t, tt.files)
+			}
+			info, err := ReadComicInfo(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (info != nil) != tt.found {
+				t.Fatalf("ReadComicInfo() = %+v, want found %v", info, tt.found)
+			}
+			if info != nil && info.Number != "7" {
+				t.Errorf("Number = %q, want 7", info.Number)
+			}
+		})
+	}
+
+	if _, err := ReadComicInfo(filepath.Join(t.TempDir(), "missing.cbz")); err == nil {
+		t.Error("ReadComicInfo() of a missing file succeeded")
+	}
+}
@@ -97,6 +97,137 @@ func CompressDirectory(sourceDir string, destZipFile string) error {
 
 }
 
+// CompressChapter packs a chapter directory into destZipFile with info
+// written as ComicInfo.xml. Files named in exclude (relative to sourceDir,
+// e.g. the download manifest) are left out. The archive is built next to
+// destZipFile and renamed into place, so an existing archive is only replaced
+// once the new one is complete.
+func CompressChapter(sourceDir string, destZipFile string, info *ComicInfo, exclude ...string) error {
+	sourceDir = filepath.Clean(sourceDir)
+
+	dirInfo, err := os.Stat(sourceDir)
+	if err != nil {
+		return err
+	}
+	if !dirInfo.IsDir() {
+		return errors.New("sourceDir is not a directory")
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(destZipFile), "temp_*.zip")
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath) // Clean up if something fails
+
+	bufferedWriter := bufio.NewWriterSize(tempFile, 32*1024)
+	zipWriter := zip.NewWriter(bufferedWriter)
+
+	fail := func(err error) error {
+		zipWriter.Close()
+		tempFile.Close()
+		return err
+	}
+
+	if info != nil {
+		data, err := MarshalComicInfo(info)
+		if err != nil {
+			return fail(err)
+		}
+		w, err := zipWriter.Create(ComicInfoName)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fail(err)
+		}
+	}
+
+	// WalkDir visits entries in lexical order so pages keep their order
+	err = filepath.WalkDir(sourceDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if path != sourceDir && strings.HasPrefix(name, ".") {
+			// Temp and partial files of the downloader and the converter
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if info != nil && strings.EqualFold(relPath, ComicInfoName) {
+			return nil
+		}
+		for _, name := range exclude {
+			if strings.EqualFold(relPath, name) {
+				return nil
+			}
+		}
+		return addFileToZip(zipWriter, path, relPath)
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	// The old archive may still be open in the cache (Windows)
+	GetZipCache().Remove(destZipFile)
+	return os.Rename(tempPath, destZipFile)
+}
+
+func addFileToZip(zipWriter *zip.Writer, path string, name string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if isCompressed(name) {
+		hdr.Method = zip.Store
+	} else {
+		hdr.Method = zip.Deflate
+	}
+
+	w, err := zipWriter.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
 // ListImages returns a list of image filenames inside a zip/cbz archive.
 // It supports .zip and .cbz files.
 func ListImages(archivePath string) ([]string, error) {
@@ -0,0 +1,50 @@
+package zipper
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zip"
+)
+
+func TestCompressChapter(t *testing.T) {
+	src := t.TempDir()
+	for name, content := range map[string]string{
+		"001.jpg":       "page 1",
+		"002.jpg":       "page 2",
+		"manifest.json": "{}",
+		"ComicInfo.xml": "<ComicInfo><Title>old</Title></ComicInfo>",
+		".001.jpg.part": "partial",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := filepath.Join(t.TempDir(), "chapter.cbz")
+	if err := CompressChapter(src, dest, &ComicInfo{Title: "new"}, "manifest.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "001.jpg,002.jpg,ComicInfo.xml" {
+		t.Errorf("archive entries = %v, want only the pages and ComicInfo.xml", names)
+	}
+
+	info, err := ReadComicInfo(dest)
+	if err != nil || info == nil || info.Title != "new" {
+		t.Errorf("ReadComicInfo() = %+v, %v, want the new metadata", info, err)
+	}
+}
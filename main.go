@@ -63,9 +63,9 @@ func main() {
 
 	// Initialize Services
 	databaseService := services.NewDatabaseService(repos)
-	browserService := services.NewBrowserService()
+	browserService := services.NewBrowserService(repos)
 	defer browserService.Cleanup()
-	scraperService := services.NewScraperService(browserService)
+	scraperService := services.NewScraperService(browserService, repos)
 	fileService := services.NewFileService(databaseService)
 
 	app := application.New(application.Options{
@@ -74,7 +74,7 @@ func main() {
 		Services: []application.Service{
 			application.NewService(browserService),
 			application.NewService(scraperService),
-			application.NewService(services.NewDownloadService()),
+			application.NewService(services.NewDownloadService(repos, scraperService)),
 			application.NewService(databaseService),
 			application.NewServiceWithOptions(fileService, application.ServiceOptions{
 				Route: "/filemanga",
@@ -92,7 +92,7 @@ func main() {
 		browserService.Cleanup()
 	})
 
-	cm := menu.NewContextMenu()
+	cm := menu.NewContextMenu(fileService)
 	hcm := cm.GetHomeContextMenu()
 	rcm := cm.GetReadContextMenu()
 	app.ContextMenu.Add("home-menu", hcm)
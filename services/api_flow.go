@@ -0,0 +1,244 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	defaultStepConcurrency = 4
+	maxStepConcurrency     = 16
+)
+
+// runStep executes step unless its when condition fails. A foreach step is
+// called once per item and the responses are aggregated under the step ID.
+func (s *ScraperService) runStep(ctx map[string]interface{}, step APIStep) error {
+	if step.Foreach != "" {
+		return s.runForeach(ctx, step)
+	}
+	if step.When != "" && !evalCondition(ctx, step.When) {
+		return nil
+	}
+	_, err := s.executeStep(ctx, step, "")
+	return err
+}
+
+// runForeach calls step for every item of step.Foreach, at most
+// step.Concurrency at a time. ctx[step.ID] holds the parsed responses in item
+// order and ctx[step.ID+"_raw"] a JSON array of them (HTML bodies are joined),
+// so fields can read the aggregate like any other step. With Collect only
+// that path of every response is kept and arrays are flattened.
+func (s *ScraperService) runForeach(ctx map[string]interface{}, step APIStep) error {
+	items := toItems(contextValue(ctx, step.Foreach))
+	as := step.As
+	if as == "" {
+		as = "item"
+	}
+
+	workers := step.Concurrency
+	if workers <= 0 {
+		workers = defaultStepConcurrency
+	}
+	workers = min(workers, maxStepConcurrency)
+
+	values := make([]interface{}, len(items))
+	raws := make([]string, len(items))
+	ran := make([]bool, len(items))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, workers)
+
+	for i, item := range items {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		itemCtx := copyContext(ctx)
+		setItem(itemCtx, as, i, item)
+		if step.When != "" && !evalCondition(itemCtx, step.When) {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, itemCtx map[string]interface{}) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if _, err := s.executeStep(itemCtx, step, ""); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("foreach item %d: %w", i, err)
+				}
+				mu.Unlock()
+				return
+			}
+			values[i] = itemCtx[step.ID]
+			raws[i], _ = itemCtx[step.ID+"_raw"].(string)
+			ran[i] = true
+		}(i, itemCtx)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	html := step.Response == "html"
+	collected := []interface{}{}
+	var parts []string
+	for i := range items {
+		if !ran[i] {
+			continue
+		}
+		if step.Collect != "" && !html {
+			r := gjson.Get(raws[i], step.Collect)
+			if r.IsArray() {
+				for _, el := range r.Array() {
+					collected = append(collected, el.Value())
+					parts = append(parts, el.Raw)
+				}
+			} else if r.Exists() {
+				collected = append(collected, r.Value())
+				parts = append(parts, r.Raw)
+			}
+			continue
+		}
+
+		collected = append(collected, values[i])
+		raw := raws[i]
+		if !html && strings.TrimSpace(raw) == "" {
+			raw = "null"
+		}
+		parts = append(parts, raw)
+	}
+
+	ctx[step.ID] = collected
+	if html {
+		ctx[step.ID+"_raw"] = strings.Join(parts, "\n")
+	} else {
+		ctx[step.ID+"_raw"] = "[" + strings.Join(parts, ",") + "]"
+	}
+	return nil
+}
+
+// setItem exposes the current foreach item as {as} and {index}; the keys of
+// an object item are also available as {as.key}
+func setItem(ctx map[string]interface{}, as string, index int, item interface{}) {
+	ctx["index"] = strconv.Itoa(index)
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		// Text keeps large numeric IDs out of exponent notation in URLs
+		ctx[as] = toString(item)
+		return
+	}
+	ctx[as] = m
+	for k, v := range m {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			ctx[as+"."+k] = v
+		default:
+			ctx[as+"."+k] = toString(v)
+		}
+	}
+}
+
+// toItems turns a context value into the list a foreach step iterates
+func toItems(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return val
+	case []string:
+		items := make([]interface{}, len(val))
+		for i, s := range val {
+			items[i] = s
+		}
+		return items
+	}
+	return []interface{}{v}
+}
+
+// contextValue resolves path against ctx. The first segment names a context
+// key such as a step ID, the rest is a JSON path into its value, e.g.
+// "list.data.#.id".
+func contextValue(ctx map[string]interface{}, path string) interface{} {
+	path = strings.TrimSpace(path)
+	if v, ok := ctx[path]; ok {
+		return v
+	}
+
+	key, rest, found := strings.Cut(path, ".")
+	if !found {
+		return nil
+	}
+	if raw, ok := ctx[key+"_raw"].(string); ok && gjson.Valid(raw) {
+		return gjson.Get(raw, rest).Value()
+	}
+
+	v, ok := ctx[key]
+	if !ok {
+		return nil
+	}
+	if str, ok := v.(string); ok && gjson.Valid(str) {
+		return gjson.Get(str, rest).Value()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return gjson.GetBytes(b, rest).Value()
+}
+
+// evalCondition evaluates a when expression: "path" holds when the value is
+// set, "!path" when it is empty, "path == text" and "path != text" compare
+// the value as text
+func evalCondition(ctx map[string]interface{}, expr string) bool {
+	expr = strings.TrimSpace(expr)
+	for _, op := range []string{"!=", "=="} {
+		if left, right, ok := strings.Cut(expr, op); ok {
+			value := toString(contextValue(ctx, left))
+			want := strings.Trim(strings.TrimSpace(right), `"'`)
+			return (value == want) == (op == "==")
+		}
+	}
+	if strings.HasPrefix(expr, "!") {
+		return !isSet(contextValue(ctx, expr[1:]))
+	}
+	return isSet(contextValue(ctx, expr))
+}
+
+// conditionPath returns the context path a when expression reads
+func conditionPath(expr string) string {
+	expr = strings.TrimSpace(expr)
+	for _, op := range []string{"!=", "=="} {
+		if left, _, ok := strings.Cut(expr, op); ok {
+			return strings.TrimSpace(left)
+		}
+	}
+	return strings.TrimSpace(strings.TrimPrefix(expr, "!"))
+}
+
+func isSet(v interface{}) bool {
+	if isEmptyValue(v) {
+		return false
+	}
+	switch strings.ToLower(toString(v)) {
+	case "false", "0", "null":
+		return false
+	}
+	return true
+}
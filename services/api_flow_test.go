@@ -0,0 +1,288 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEvalCondition(t *testing.T) {
+	ctx := map[string]interface{}{
+		"id":       "42",
+		"empty":    "",
+		"zero":     "0",
+		"off":      "false",
+		"list":     []interface{}{},
+		"item":     map[string]interface{}{"lang": "en"},
+		"item.id":  "7",
+		"detail":   map[string]interface{}{"title": "x"},
+		"info_raw": `{"title":"Manga","locked":false,"chapters":[1,2]}`,
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"id", true},
+		{"empty", false},
+		{"zero", false},
+		{"off", false},
+		{"list", false},
+		{"missing", false},
+		{"!missing", true},
+		{"!id", false},
+		{"!empty", true},
+		{"id == 42", true},
+		{"id == '42'", true},
+		{`id == "43"`, false},
+		{"id != 43", true},
+		{"id != 42", false},
+		{"missing == ''", true},
+		{"missing != x", true},
+		{"item.id == 7", true},
+		{"item.lang == en", true},
+		{"detail.title", true},
+		{"detail.missing", false},
+		{"info.title == Manga", true},
+		{"info.locked", false},
+		{"!info.locked", true},
+		{"info.chapters", true},
+		{"info.missing", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := evalCondition(ctx, tt.expr); got != tt.want {
+				t.Errorf("evalCondition(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextValue(t *testing.T) {
+	ctx := map[string]interface{}{
+		"id":       "42",
+		"list":     map[string]interface{}{"data": []interface{}{map[string]interface{}{"id": "a"}}},
+		"list_raw": `{"data":[{"id":"a"},{"id":"b"}]}`,
+		"text":     `{"n":1}`,
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"id", "42"},
+		{" id ", "42"},
+		{"missing", nil},
+		{"missing.key", nil},
+		// _raw wins over the parsed value
+		{"list.data.#.id", []interface{}{"a", "b"}},
+		{"text.n", float64(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := contextValue(ctx, tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("contextValue(%q) = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunForeach(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		// Earlier items answer last so completion order differs from item order
+		id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		time.Sleep(time.Duration(5-id) * 10 * time.Millisecond)
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/empty":
+		case "/html":
+			fmt.Fprintf(w, "<p>%d</p>", id)
+		default:
+			fmt.Fprintf(w, `{"id":%d,"pages":["%da","%db"]}`, id, id, id)
+		}
+	}))
+	defer srv.Close()
+
+	step := func(mod func(*APIStep)) APIStep {
+		s := APIStep{
+			ID:      "ch",
+			Request: APIRequest{URL: srv.URL + "/item?id={item}"},
+			Foreach: "list.ids",
+		}
+		mod(&s)
+		return s
+	}
+
+	tests := []struct {
+		name      string
+		step      APIStep
+		want      interface{}
+		wantRaw   string
+		wantPeak  int32 // 0 skips the check
+		wantError bool
+	}{
+		{
+			name: "aggregates responses in item order",
+			step: step(func(s *APIStep) {}),
+			want: []interface{}{
+				map[string]interface{}{"id": float64(1), "pages": []interface{}{"1a", "1b"}},
+				map[string]interface{}{"id": float64(2), "pages": []interface{}{"2a", "2b"}},
+				map[string]interface{}{"id": float64(3), "pages": []interface{}{"3a", "3b"}},
+			},
+			wantRaw: `[{"id":1,"pages":["1a","1b"]},{"id":2,"pages":["2a","2b"]},{"id":3,"pages":["3a","3b"]}]`,
+		},
+		{
+			name:    "collect flattens arrays",
+			step:    step(func(s *APIStep) { s.Collect = "pages" }),
+			want:    []interface{}{"1a", "1b", "2a", "2b", "3a", "3b"},
+			wantRaw: `["1a","1b","2a","2b","3a","3b"]`,
+		},
+		{
+			name:    "collect keeps single values",
+			step:    step(func(s *APIStep) { s.Collect = "id" }),
+			want:    []interface{}{float64(1), float64(2), float64(3)},
+			wantRaw: `[1,2,3]`,
+		},
+		{
+			name:    "collect skips missing paths",
+			step:    step(func(s *APIStep) { s.Collect = "missing" }),
+			want:    []interface{}{},
+			wantRaw: `[]`,
+		},
+		{
+			name:    "when skips items",
+			step:    step(func(s *APIStep) { s.When = "item != 2"; s.Collect = "id" }),
+			want:    []interface{}{float64(1), float64(3)},
+			wantRaw: `[1,3]`,
+		},
+		{
+			name:    "empty body is null",
+			step:    step(func(s *APIStep) { s.Request.URL = srv.URL + "/empty?id={item}" }),
+			want:    []interface{}{nil, nil, nil},
+			wantRaw: `[null,null,null]`,
+		},
+		{
+			name: "html bodies are joined",
+			step: step(func(s *APIStep) {
+				s.Request.URL = srv.URL + "/html?id={item}"
+				s.Response = "html"
+			}),
+			want:    []interface{}{"<p>1</p>", "<p>2</p>", "<p>3</p>"},
+			wantRaw: "<p>1</p>\n<p>2</p>\n<p>3</p>",
+		},
+		{
+			name:     "concurrency one runs items one by one",
+			step:     step(func(s *APIStep) { s.Concurrency = 1; s.Collect = "id" }),
+			want:     []interface{}{float64(1), float64(2), float64(3)},
+			wantRaw:  `[1,2,3]`,
+			wantPeak: 1,
+		},
+		{
+			name:     "items run concurrently",
+			step:     step(func(s *APIStep) { s.Concurrency = 3; s.Collect = "id" }),
+			want:     []interface{}{float64(1), float64(2), float64(3)},
+			wantRaw:  `[1,2,3]`,
+			wantPeak: 3,
+		},
+		{
+			name:      "failed item fails the step",
+			step:      step(func(s *APIStep) { s.Request.URL = srv.URL + "/item?id={missing}" }),
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak.Store(0)
+			s := newTestScraper(t)
+			ctx := map[string]interface{}{
+				"list_raw": `{"ids":[1,2,3]}`,
+			}
+
+			err := s.runForeach(ctx, tt.step)
+			if tt.wantError {
+				if err == nil {
+					t.Fatal("runForeach() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ctx["ch"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ctx[ch] = %#v, want %#v", got, tt.want)
+			}
+			if got := ctx["ch_raw"]; got != tt.wantRaw {
+				t.Errorf("ctx[ch_raw] = %#v, want %q", got, tt.wantRaw)
+			}
+			if tt.wantPeak > 0 && peak.Load() != tt.wantPeak {
+				t.Errorf("peak in-flight = %d, want %d", peak.Load(), tt.wantPeak)
+			}
+		})
+	}
+}
+
+func TestScrapeAPIPagedStepWhen(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":[{"id":"a"}]}`))
+	}))
+	defer srv.Close()
+
+	rule := func(when string) SiteRule {
+		return SiteRule{
+			Site:     "test",
+			Strategy: "api",
+			API: &APIWorkflow{Steps: []APIStep{{
+				ID:         "list",
+				When:       when,
+				Request:    APIRequest{URL: srv.URL + "/list?offset={offset}"},
+				Pagination: &Pagination{Type: PageByOffset, MaxPages: 1},
+			}}},
+			Extract: []FieldRule{{Name: "ids", Type: "json", From: "list", Path: "data.#.id", Multiple: true}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		when      string
+		wantCalls int32
+	}{
+		{"no condition", "", 1},
+		{"condition holds", "url", 1},
+		{"condition fails", "missing", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			s := newTestScraper(t)
+			if _, err := s.Scrape(rule(tt.when), srv.URL, false); err != nil {
+				t.Fatal(err)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("requests = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/tidwall/gjson"
+)
+
+// A body value that is a single placeholder, with an optional type conversion
+var bodyPlaceholderRe = regexp.MustCompile(`^\{([^{}|\s]+)(?:\|(string|int|number|bool|json))?\}$`)
+
+func (r APIRequest) hasBody() bool {
+	return r.Body != nil || len(r.Form) > 0 || r.Query != ""
+}
+
+// hasHeader reports whether the rule sets header name itself
+func (r APIRequest) hasHeader(name string) bool {
+	for k := range r.Headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRequestBody renders the body of r from ctx and sets it on req
+func (s *ScraperService) setRequestBody(req *resty.Request, r APIRequest, ctx map[string]interface{}) error {
+	switch {
+	case r.Query != "":
+		payload := map[string]interface{}{"query": r.Query}
+		if len(r.Variables) > 0 {
+			vars, err := s.renderBody(r.Variables, ctx)
+			if err != nil {
+				return fmt.Errorf("variables: %w", err)
+			}
+			payload["variables"] = vars
+		}
+		if r.OperationName != "" {
+			payload["operationName"] = r.OperationName
+		}
+		if !r.hasHeader("Content-Type") {
+			req.SetHeader("Content-Type", "application/json")
+		}
+		req.SetBody(payload)
+
+	case len(r.Form) > 0:
+		form := make(map[string]string, len(r.Form))
+		for k, v := range r.Form {
+			val, err := s.renderBodyString(v, ctx)
+			if err != nil {
+				return fmt.Errorf("form %s: %w", k, err)
+			}
+			if str, ok := val.(string); ok {
+				form[k] = str
+			} else {
+				form[k] = toString(val)
+			}
+		}
+		req.SetFormData(form)
+
+	case r.Body != nil:
+		body, err := s.renderBody(r.Body, ctx)
+		if err != nil {
+			return fmt.Errorf("body: %w", err)
+		}
+		str, isText := body.(string)
+		if !r.hasHeader("Content-Type") && (!isText || gjson.Valid(str)) {
+			req.SetHeader("Content-Type", "application/json")
+		}
+		if isText {
+			req.SetBody(str)
+		} else {
+			req.SetBody(body)
+		}
+	}
+	return nil
+}
+
+// renderBody renders the placeholders in the string values of a JSON body
+func (s *ScraperService) renderBody(v interface{}, ctx map[string]interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return s.renderBodyString(val, ctx)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			rendered, err := s.renderBody(item, ctx)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			out[k] = rendered
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			rendered, err := s.renderBody(item, ctx)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			out[i] = rendered
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// renderBodyString renders one body value. "{path}" alone takes the context
+// value as is, anything else is rendered as text like the step URL.
+func (s *ScraperService) renderBodyString(str string, ctx map[string]interface{}) (interface{}, error) {
+	m := bodyPlaceholderRe.FindStringSubmatch(strings.TrimSpace(str))
+	if m == nil {
+		if !strings.Contains(str, "{") {
+			return str, nil
+		}
+		rendered := s.processTemplate(str, ctx)
+		if text, ok := rendered.(string); ok {
+			return text, nil
+		}
+		return fmt.Sprintf("%v", rendered), nil
+	}
+
+	v := contextValue(ctx, m[1])
+	if v == nil {
+		return nil, fmt.Errorf("placeholder {%s} has no value. Available keys: %v", m[1], getKeys(ctx))
+	}
+	return convertBodyValue(v, m[2])
+}
+
+// convertBodyValue converts a context value for a "{key|kind}" placeholder
+func convertBodyValue(v interface{}, kind string) (interface{}, error) {
+	text := toString(v)
+	switch kind {
+	case "":
+		return v, nil
+	case "string":
+		return text, nil
+	case "int":
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", text)
+		}
+		return n, nil
+	case "number":
+		n, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		return n, nil
+	case "bool":
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", text)
+		}
+		return b, nil
+	case "json":
+		str, ok := v.(string)
+		if !ok {
+			return v, nil
+		}
+		var out interface{}
+		if err := json.Unmarshal([]byte(str), &out); err != nil {
+			return nil, fmt.Errorf("value is not JSON: %w", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown conversion %q", kind)
+}
+
+// graphQLError returns the first GraphQL error of a response that carries no data
+func graphQLError(body string) error {
+	errs := gjson.Get(body, "errors")
+	if !errs.IsArray() || len(errs.Array()) == 0 {
+		return nil
+	}
+	if data := gjson.Get(body, "data"); data.Exists() && data.Type != gjson.Null {
+		// Partial data is still usable
+		return nil
+	}
+	msg := errs.Get("0.message").String()
+	if msg == "" {
+		msg = errs.Array()[0].Raw
+	}
+	return errors.New("graphql: " + msg)
+}
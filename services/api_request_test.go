@@ -0,0 +1,127 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetRequestBody(t *testing.T) {
+	ctx := map[string]interface{}{
+		"id":   "42",
+		"page": 2,
+		"big":  "9007199254740993",
+		"frac": "3.7",
+		"item": map[string]interface{}{"slug": "one-piece"},
+	}
+
+	tests := []struct {
+		name        string
+		req         APIRequest
+		body        string // JSON of the body, or the text body as is
+		form        string // encoded form data
+		contentType string
+		wantErr     string
+	}{
+		{
+			name:        "json body keeps types",
+			req:         APIRequest{Body: map[string]interface{}{"id": "{id|int}", "page": "{page}", "slug": "{item.slug}"}},
+			body:        `{"id":42,"page":2,"slug":"one-piece"}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "int beyond float precision",
+			req:         APIRequest{Body: map[string]interface{}{"id": "{big|int}"}},
+			body:        `{"id":9007199254740993}`,
+			contentType: "application/json",
+		},
+		{
+			name:    "int rejects fractions",
+			req:     APIRequest{Body: map[string]interface{}{"id": "{frac|int}"}},
+			wantErr: `id: "3.7" is not an integer`,
+		},
+		{
+			name:        "placeholder inside text",
+			req:         APIRequest{Body: map[string]interface{}{"q": "manga {id}"}},
+			body:        `{"q":"manga 42"}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "json string body",
+			req:         APIRequest{Body: `{"id":"{id}"}`},
+			body:        `{"id":"42"}`,
+			contentType: "application/json",
+		},
+		{
+			name: "text body",
+			req:  APIRequest{Body: "id={id}"},
+			body: "id=42",
+		},
+		{
+			name:        "rule content type wins",
+			req:         APIRequest{Body: map[string]interface{}{"id": "{id}"}, Headers: map[string]string{"content-type": "application/vnd.api+json"}},
+			body:        `{"id":"42"}`,
+			contentType: "application/vnd.api+json",
+		},
+		{
+			name: "form",
+			req:  APIRequest{Form: map[string]string{"id": "{id}", "page": "{page}"}},
+			form: "id=42&page=2",
+		},
+		{
+			name:        "graphql",
+			req:         APIRequest{Query: "query($id: ID!) { manga(id: $id) { title } }", Variables: map[string]interface{}{"id": "{id}"}, OperationName: "Manga"},
+			body:        `{"operationName":"Manga","query":"query($id: ID!) { manga(id: $id) { title } }","variables":{"id":"42"}}`,
+			contentType: "application/json",
+		},
+		{
+			name:    "missing placeholder",
+			req:     APIRequest{Body: map[string]interface{}{"id": "{chapter}"}},
+			wantErr: "id: placeholder {chapter} has no value",
+		},
+		{
+			name:    "bad conversion",
+			req:     APIRequest{Form: map[string]string{"n": "{item.slug|int}"}},
+			wantErr: "form n:",
+		},
+	}
+
+	s := newTestScraper(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := s.client.R()
+			for k, v := range tt.req.Headers {
+				req.SetHeader(k, v)
+			}
+			err := s.setRequestBody(req, tt.req, ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("setRequestBody() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var body string
+			switch b := req.Body.(type) {
+			case nil:
+			case string:
+				body = b
+			default:
+				data, _ := json.Marshal(b)
+				body = string(data)
+			}
+			if body != tt.body {
+				t.Errorf("body = %s, want %s", body, tt.body)
+			}
+			if form := req.FormData.Encode(); form != tt.form {
+				t.Errorf("form = %q, want %q", form, tt.form)
+			}
+			if ct := req.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+		})
+	}
+}
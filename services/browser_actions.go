@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/input"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+// Browser action types
+const (
+	ActionClick   = "click"    // click an element
+	ActionScroll  = "scroll"   // scroll to the bottom until the height stops growing
+	ActionType    = "type"     // enter text into an element
+	ActionWaitFor = "wait_for" // wait until an element is visible
+	ActionEval    = "eval"     // run JS, optionally storing the result
+)
+
+const (
+	defaultActionTimeout = 10 * time.Second
+	defaultScrollDelay   = 500 * time.Millisecond
+	defaultMaxScrolls    = 30
+
+	// Unchanged heights in a row before a scrolled page counts as stable
+	scrollStableChecks = 2
+)
+
+// scrollJS scrolls sel, or the page without one, to its bottom and returns
+// the scroll height, -1 when sel matches nothing
+const scrollJS = `(sel) => {
+	const el = sel ? document.querySelector(sel) : (document.scrollingElement || document.body);
+	if (!el) return -1;
+	el.scrollTop = el.scrollHeight;
+	if (!sel) window.scrollTo(0, el.scrollHeight);
+	return el.scrollHeight;
+}`
+
+// evalJS runs script, which is an expression or a function to call
+const evalJS = `() => {
+	const v = (%s);
+	return typeof v === "function" ? v() : v;
+}`
+
+// timeout bounds a single action. Without one set, a scroll gets the time
+// of all its scrolls so it stops at MaxScrolls rather than at a deadline.
+func (a BrowserAction) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return time.Duration(a.Timeout) * time.Millisecond
+	}
+	if a.Type == ActionScroll {
+		return time.Duration(a.maxScrolls())*a.scrollDelay() + defaultActionTimeout
+	}
+	return defaultActionTimeout
+}
+
+func (a BrowserAction) scrollDelay() time.Duration {
+	if a.ScrollDelay > 0 {
+		return time.Duration(a.ScrollDelay) * time.Millisecond
+	}
+	return defaultScrollDelay
+}
+
+func (a BrowserAction) maxScrolls() int {
+	if a.MaxScrolls > 0 {
+		return a.MaxScrolls
+	}
+	return defaultMaxScrolls
+}
+
+// actionsTimeout is the time the actions may add to the page deadline
+func actionsTimeout(actions []BrowserAction) time.Duration {
+	var d time.Duration
+	for _, a := range actions {
+		d += a.timeout() + time.Duration(a.Delay)*time.Millisecond
+	}
+	return d
+}
+
+// runActions runs actions in order on a ready page. Results of eval actions
+// with a store key are returned as context values, like a step with its
+// _raw counterpart.
+func runActions(page *rod.Page, actions []BrowserAction) (map[string]interface{}, error) {
+	stored := make(map[string]interface{})
+	for i, a := range actions {
+		if err := runAction(page, a, stored); err != nil && !a.Optional {
+			return nil, fmt.Errorf("action %d (%s) failed: %w", i, a.Type, err)
+		}
+		if a.Delay > 0 {
+			if err := sleepPage(page, time.Duration(a.Delay)*time.Millisecond); err != nil {
+				return nil, waitError(fmt.Sprintf("action %d delay", i), err)
+			}
+		}
+	}
+	return stored, nil
+}
+
+func runAction(page *rod.Page, a BrowserAction, stored map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(page.GetContext(), a.timeout())
+	defer cancel()
+	p := page.Context(ctx)
+
+	switch a.Type {
+	case ActionClick:
+		el, err := p.Element(a.Selector)
+		if err != nil {
+			return waitError("selector "+a.Selector, err)
+		}
+		return el.Click(proto.InputMouseButtonLeft, 1)
+
+	case ActionType:
+		el, err := p.Element(a.Selector)
+		if err != nil {
+			return waitError("selector "+a.Selector, err)
+		}
+		if err := el.Input(a.Text); err != nil {
+			return err
+		}
+		if a.Submit {
+			return el.Type(input.Enter)
+		}
+		return nil
+
+	case ActionWaitFor:
+		el, err := p.Element(a.Selector)
+		if err != nil {
+			return waitError("selector "+a.Selector, err)
+		}
+		if err := el.WaitVisible(); err != nil {
+			return waitError(a.Selector+" to be visible", err)
+		}
+		return nil
+
+	case ActionScroll:
+		return scrollToBottom(p, a)
+
+	case ActionEval:
+		script := strings.TrimRight(strings.TrimSpace(a.Script), "; \n")
+		res, err := p.Eval(fmt.Sprintf(evalJS, script))
+		if err != nil {
+			return waitError("script", err)
+		}
+		if a.Store != "" {
+			v := res.Value.Val()
+			stored[a.Store] = v
+			if text, ok := v.(string); ok {
+				// Text such as HTML stays readable by css fields
+				stored[a.Store+"_raw"] = text
+			} else {
+				stored[a.Store+"_raw"] = res.Value.JSON("", "")
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action type %q", a.Type)
+}
+
+// scrollToBottom scrolls until the scroll height is the same for
+// scrollStableChecks scrolls in a row or MaxScrolls is reached
+func scrollToBottom(p *rod.Page, a BrowserAction) error {
+	delay, maxScrolls := a.scrollDelay(), a.maxScrolls()
+
+	last, stable := -1, 0
+	for i := 0; i < maxScrolls && stable < scrollStableChecks; i++ {
+		res, err := p.Eval(scrollJS, a.Selector)
+		if err != nil {
+			return waitError("scroll", err)
+		}
+		height := res.Value.Int()
+		if height < 0 {
+			return fmt.Errorf("selector %s matched nothing", a.Selector)
+		}
+		if height == last {
+			stable++
+		} else {
+			last, stable = height, 0
+		}
+		if err := sleepPage(p, delay); err != nil {
+			return waitError("content after scrolling", err)
+		}
+	}
+	return nil
+}
+
+// sleepPage pauses for d unless the page context ends first
+func sleepPage(page *rod.Page, d time.Duration) error {
+	ctx := page.GetContext()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
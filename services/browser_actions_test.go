@@ -0,0 +1,34 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBrowserActionTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		action BrowserAction
+		want   time.Duration
+	}{
+		{"default", BrowserAction{Type: ActionClick}, defaultActionTimeout},
+		{"explicit", BrowserAction{Type: ActionClick, Timeout: 2500}, 2500 * time.Millisecond},
+		{"scroll defaults", BrowserAction{Type: ActionScroll}, 30*500*time.Millisecond + defaultActionTimeout},
+		{"scroll settings", BrowserAction{Type: ActionScroll, ScrollDelay: 1000, MaxScrolls: 50}, 50*time.Second + defaultActionTimeout},
+		{"scroll explicit", BrowserAction{Type: ActionScroll, Timeout: 5000, MaxScrolls: 50}, 5 * time.Second},
+		{"delay is not part of the action", BrowserAction{Type: ActionScroll, Delay: 3000}, 30*500*time.Millisecond + defaultActionTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.action.timeout(); got != tt.want {
+				t.Errorf("timeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	actions := []BrowserAction{{Type: ActionClick, Delay: 1000}, {Type: ActionScroll, Delay: 2000}}
+	want := defaultActionTimeout + time.Second + 30*500*time.Millisecond + defaultActionTimeout + 2*time.Second
+	if got := actionsTimeout(actions); got != want {
+		t.Errorf("actionsTimeout() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"mangav5/internal/downloader"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+	"github.com/tidwall/gjson"
+)
+
+const defaultCaptureID = "network"
+
+// Resource types a capture can record, by their rule name
+var captureTypes = map[string]proto.NetworkResourceType{
+	"image": proto.NetworkResourceTypeImage,
+	"xhr":   proto.NetworkResourceTypeXHR,
+	"fetch": proto.NetworkResourceTypeFetch,
+}
+
+func (c *Capture) id() string {
+	if c.ID == "" {
+		return defaultCaptureID
+	}
+	return c.ID
+}
+
+func (c *Capture) types() []string {
+	if len(c.Types) == 0 {
+		return []string{"image", "xhr", "fetch"}
+	}
+	return c.Types
+}
+
+// capturedResponse is one entry of the capture pseudo step
+type capturedResponse struct {
+	URL    string      `json:"url"`
+	Type   string      `json:"type"`
+	Mime   string      `json:"mime,omitempty"`
+	Status int         `json:"status"`
+	Body   interface{} `json:"body,omitempty"` // parsed JSON or text, never set for images
+	File   string      `json:"file,omitempty"` // file:// URL of a saved image
+}
+
+// networkRecorder pauses matching responses of a page through the Fetch
+// domain, copies their bodies and lets them go on
+type networkRecorder struct {
+	page *rod.Page
+	re   *regexp.Regexp
+	dir  string // saved images, empty unless SaveImages
+
+	mu     sync.Mutex
+	wg     sync.WaitGroup
+	closed bool
+	items  []*capturedResponse // arrival order, nil when not recorded
+}
+
+// startCapture starts recording on page; it must run before navigation
+func startCapture(page *rod.Page, cfg *Capture) (*networkRecorder, error) {
+	r := &networkRecorder{page: page}
+	if cfg.URLPattern != "" {
+		re, err := regexp.Compile(cfg.URLPattern)
+		if err != nil {
+			return nil, fmt.Errorf("capture url_pattern: %w", err)
+		}
+		r.re = re
+	}
+	if cfg.SaveImages {
+		dir, err := captureDir()
+		if err != nil {
+			return nil, fmt.Errorf("capture directory: %w", err)
+		}
+		r.dir = dir
+	}
+
+	patterns := make([]*proto.FetchRequestPattern, 0, len(cfg.types()))
+	for _, t := range cfg.types() {
+		rt, ok := captureTypes[t]
+		if !ok {
+			return nil, fmt.Errorf("unknown capture type %q", t)
+		}
+		patterns = append(patterns, &proto.FetchRequestPattern{
+			URLPattern:   "*",
+			ResourceType: rt,
+			RequestStage: proto.FetchRequestStageResponse,
+		})
+	}
+	if err := (proto.FetchEnable{Patterns: patterns}).Call(page); err != nil {
+		return nil, fmt.Errorf("failed to enable capture: %w", err)
+	}
+
+	go page.EachEvent(func(e *proto.FetchRequestPaused) {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			go r.resume(e)
+			return
+		}
+		index := len(r.items)
+		r.items = append(r.items, nil)
+		r.wg.Add(1)
+		r.mu.Unlock()
+
+		go r.record(e, index)
+	})()
+	return r, nil
+}
+
+// record copies the body of a paused response into items[index]
+func (r *networkRecorder) record(e *proto.FetchRequestPaused, index int) {
+	defer r.wg.Done()
+	defer r.resume(e)
+
+	if e.ResponseErrorReason != "" || e.ResponseStatusCode == nil {
+		return
+	}
+	status := *e.ResponseStatusCode
+	if status >= 300 && status < 400 {
+		// Redirects have no body, the target is paused on its own
+		return
+	}
+	if r.re != nil && !r.re.MatchString(e.Request.URL) {
+		return
+	}
+
+	res, err := proto.FetchGetResponseBody{RequestID: e.RequestID}.Call(r.page)
+	if err != nil {
+		return
+	}
+	body := []byte(res.Body)
+	if res.Base64Encoded {
+		if body, err = base64.StdEncoding.DecodeString(res.Body); err != nil {
+			return
+		}
+	}
+
+	item := &capturedResponse{
+		URL:    e.Request.URL,
+		Type:   strings.ToLower(string(e.ResourceType)),
+		Mime:   responseMime(e.ResponseHeaders),
+		Status: status,
+	}
+	if e.ResourceType == proto.NetworkResourceTypeImage {
+		if r.dir != "" && status == 200 && len(body) > 0 {
+			item.File = r.save(item.URL, item.Mime, body)
+		}
+	} else if gjson.ValidBytes(body) {
+		item.Body = gjson.ParseBytes(body).Value()
+	} else {
+		item.Body = string(body)
+	}
+
+	r.mu.Lock()
+	r.items[index] = item
+	r.mu.Unlock()
+}
+
+// resume lets a paused response go on; the page stalls on it otherwise
+func (r *networkRecorder) resume(e *proto.FetchRequestPaused) {
+	_ = proto.FetchContinueRequest{RequestID: e.RequestID}.Call(r.page)
+}
+
+// save writes an image the browser received and returns its file:// URL,
+// "" when it cannot be written
+func (r *networkRecorder) save(url, mimeType string, body []byte) string {
+	// The downloader sniffs the real type again when it copies the file
+	ext := ".img"
+	switch sub := strings.TrimPrefix(mimeType, "image/"); sub {
+	case "jpeg":
+		ext = ".jpg"
+	case "png", "webp", "gif", "avif", "bmp":
+		ext = "." + sub
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf("%x%s", sha1.Sum([]byte(url)), ext))
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		return ""
+	}
+	return downloader.FileURL(path)
+}
+
+// finish stops recording once the pending bodies are copied and returns
+// the captures as a step value and its raw JSON
+func (r *networkRecorder) finish() (interface{}, string) {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.wg.Wait()
+
+	items := []*capturedResponse{}
+	for _, item := range r.items {
+		if item != nil {
+			items = append(items, item)
+		}
+	}
+	b, err := json.Marshal(items)
+	if err != nil {
+		return []interface{}{}, "[]"
+	}
+	raw := string(b)
+	return gjson.Parse(raw).Value(), raw
+}
+
+// Saved images are kept this long so a scrape result, also a cached one,
+// can be downloaded again
+const captureMaxAge = 7 * 24 * time.Hour
+
+// captureDir holds saved images until they are pruned
+func captureDir() (string, error) {
+	dir := downloader.CaptureDir()
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+func responseMime(headers []*proto.FetchHeaderEntry) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			if m, _, err := mime.ParseMediaType(h.Value); err == nil {
+				return m
+			}
+			return h.Value
+		}
+	}
+	return ""
+}
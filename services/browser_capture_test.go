@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mangav5/internal/downloader"
+	"mangav5/internal/repo"
+
+	"github.com/go-rod/rod/lib/proto"
+)
+
+func TestCaptureTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Capture
+		want []string
+	}{
+		{"default", Capture{}, []string{"image", "xhr", "fetch"}},
+		{"empty list", Capture{Types: []string{}}, []string{"image", "xhr", "fetch"}},
+		{"images only", Capture{Types: []string{"image"}}, []string{"image"}},
+		{"api calls", Capture{Types: []string{"xhr", "fetch"}}, []string{"xhr", "fetch"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.types(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("types() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := (&Capture{}).id(); got != defaultCaptureID {
+		t.Errorf("id() = %q, want %q", got, defaultCaptureID)
+	}
+	if got := (&Capture{ID: "images"}).id(); got != "images" {
+		t.Errorf("id() = %q, want images", got)
+	}
+}
+
+func TestResponseMime(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*proto.FetchHeaderEntry
+		want    string
+	}{
+		{"no headers", nil, ""},
+		{"no content type", []*proto.FetchHeaderEntry{{Name: "Content-Length", Value: "3"}}, ""},
+		{"plain", []*proto.FetchHeaderEntry{{Name: "Content-Type", Value: "image/webp"}}, "image/webp"},
+		{"with parameters", []*proto.FetchHeaderEntry{{Name: "content-type", Value: "application/json; charset=utf-8"}}, "application/json"},
+		{"upper case", []*proto.FetchHeaderEntry{{Name: "CONTENT-TYPE", Value: "Image/PNG"}}, "image/png"},
+		{"unparsable", []*proto.FetchHeaderEntry{{Name: "Content-Type", Value: "image/jpeg;;"}}, "image/jpeg;;"},
+		{"first one wins", []*proto.FetchHeaderEntry{{Name: "Content-Type", Value: "image/gif"}, {Name: "Content-Type", Value: "text/html"}}, "image/gif"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := responseMime(tt.headers); got != tt.want {
+				t.Errorf("responseMime() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecorderSave(t *testing.T) {
+	dir := t.TempDir()
+	r := &networkRecorder{dir: dir}
+
+	tests := []struct {
+		url     string
+		mime    string
+		wantExt string
+	}{
+		{"https://cdn.test/1", "image/jpeg", ".jpg"},
+		{"https://cdn.test/2", "image/png", ".png"},
+		{"https://cdn.test/3", "image/webp", ".webp"},
+		{"https://cdn.test/4", "image/avif", ".avif"},
+		{"https://cdn.test/5", "application/octet-stream", ".img"},
+		{"https://cdn.test/6", "", ".img"},
+	}
+	for _, tt := range tests {
+		body := []byte("bytes of " + tt.url)
+		got := r.save(tt.url, tt.mime, body)
+		if !strings.HasPrefix(got, "file://") || !strings.HasSuffix(got, tt.wantExt) {
+			t.Errorf("save(%q) = %q, want a file URL ending in %s", tt.mime, got, tt.wantExt)
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, "*"+tt.wantExt))
+		found := false
+		for _, m := range matches {
+			if downloader.FileURL(m) == got {
+				data, _ := os.ReadFile(m)
+				found = string(data) == string(body)
+			}
+		}
+		if !found {
+			t.Errorf("save(%q) did not write the body to %s", tt.url, got)
+		}
+	}
+
+	// The same URL is saved under the same name
+	first := r.save("https://cdn.test/same", "image/png", []byte("a"))
+	if again := r.save("https://cdn.test/same", "image/png", []byte("b")); again != first {
+		t.Errorf("same URL saved as %q and %q", first, again)
+	}
+
+	missing := &networkRecorder{dir: filepath.Join(dir, "missing")}
+	if got := missing.save("https://cdn.test/x", "image/png", []byte("x")); got != "" {
+		t.Errorf("save() into a missing dir = %q, want empty", got)
+	}
+}
+
+func TestRecorderFinish(t *testing.T) {
+	r := &networkRecorder{}
+	value, raw := r.finish()
+	if !reflect.DeepEqual(value, []interface{}{}) || raw != "[]" {
+		t.Errorf("empty finish() = %#v, %q", value, raw)
+	}
+	if !r.closed {
+		t.Error("finish() did not stop recording")
+	}
+
+	// Responses that were not recorded leave a nil slot behind
+	r = &networkRecorder{items: []*capturedResponse{
+		{URL: "https://api.test/list", Type: "fetch", Mime: "application/json", Status: 200, Body: map[string]interface{}{"n": float64(1)}},
+		nil,
+		{URL: "https://cdn.test/1.png", Type: "image", Mime: "image/png", Status: 200, File: "file:///tmp/1.png"},
+	}}
+	value, raw = r.finish()
+	want := []interface{}{
+		map[string]interface{}{"url": "https://api.test/list", "type": "fetch", "mime": "application/json", "status": float64(200), "body": map[string]interface{}{"n": float64(1)}},
+		map[string]interface{}{"url": "https://cdn.test/1.png", "type": "image", "mime": "image/png", "status": float64(200), "file": "file:///tmp/1.png"},
+	}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("finish() = %#v, want %#v", value, want)
+	}
+	wantRaw := `[{"url":"https://api.test/list","type":"fetch","mime":"application/json","status":200,"body":{"n":1}},` +
+		`{"url":"https://cdn.test/1.png","type":"image","mime":"image/png","status":200,"file":"file:///tmp/1.png"}]`
+	if raw != wantRaw {
+		t.Errorf("finish() raw = %s, want %s", raw, wantRaw)
+	}
+}
+
+func TestScrapeBrowserCapture(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	bs := newTestBrowser(t)
+	captureFileURL(t) // moves the capture directory into a temp dir
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/chapter":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"title":"Chapter 1","pages":2}`)
+		case "/other":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"ignored":true}`)
+		case "/page.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(img.Bytes())
+		default:
+			fmt.Fprint(w, `<html><body><img src="/page.png"><script>
+				Promise.all([fetch('/api/chapter'), fetch('/other')]).then(() => {
+					document.body.insertAdjacentHTML('beforeend', '<div id="done">done</div>')
+				})
+			</script></body></html>`)
+		}
+	}))
+	defer srv.Close()
+
+	rule := SiteRule{
+		Site:       "test",
+		Strategy:   "browser",
+		WaitConfig: &WaitConfig{ContentSelectors: []string{"#done"}, RequireImageLoaded: true, SkipRenderStable: true},
+		Capture:    &Capture{URLPattern: `/api/|\.png$`, SaveImages: true},
+		Extract: []FieldRule{
+			{Name: "title", Type: "json", From: "network", Path: `#(type=="fetch").body.title`},
+			{Name: "urls", Type: "json", From: "network", Path: "#.url", Multiple: true},
+			{Name: "image", Type: "json", From: "network", Path: `#(type=="image").file`},
+		},
+	}
+
+	s := NewScraperService(bs, &repo.Repositories{})
+	s.cacheDir = t.TempDir()
+	res, err := s.Scrape(rule, srv.URL+"/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res["title"] != "Chapter 1" {
+		t.Errorf("title = %#v", res["title"])
+	}
+	urls := toStrings(res["urls"])
+	if len(urls) != 2 || !strings.Contains(strings.Join(urls, " "), "/api/chapter") {
+		t.Errorf("captured URLs = %v, want the API call and the image only", urls)
+	}
+	saved := toString(res["image"])
+	if !downloader.IsCaptureURL(saved) {
+		t.Fatalf("image = %q, want a saved capture", saved)
+	}
+}
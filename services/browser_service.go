@@ -3,17 +3,63 @@ package services
 import (
 	"context"
 	"fmt"
+	"log"
+	neturl "net/url"
+	"strconv"
+	"sync"
 	"time"
 
+	"mangav5/internal/downloader"
+	"mangav5/internal/proxy"
+	"mangav5/internal/repo"
+
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
 )
 
-// BrowserService menangani operasi scraping menggunakan browser headless
+const (
+	defaultPoolSize    = 4               // tab yang boleh terbuka bersamaan
+	defaultIdleTimeout = 5 * time.Minute // browser dimatikan setelah tidak dipakai selama ini
+	pageResetTimeout   = 5 * time.Second
+	healthTimeout      = 2 * time.Second // browser yang tidak menjawab selama ini dianggap crash
+)
+
+// Kunci tabel config untuk pool browser, dibaca setiap kali browser diluncurkan
+const (
+	BrowserMaxPagesKey    = "browser_max_pages"    // tab yang boleh terbuka bersamaan, default 4
+	BrowserIdleMinutesKey = "browser_idle_minutes" // menit menganggur sebelum browser dimatikan, 0 = tidak pernah, default 5
+)
+
+// BrowserService menangani operasi scraping menggunakan browser headless.
+// Semua field dijaga oleh mu sehingga aman dipakai beberapa scrape sekaligus.
 type BrowserService struct {
+	configRepo *repo.ConfigRepo
+
+	mu       sync.Mutex
 	browser  *rod.Browser
 	launcher *launcher.Launcher
+	gen      int // naik setiap kali browser diluncurkan ulang
+
+	// Browser context per proxy server; tab tanpa proxy memakai context bawaan
+	contexts map[string]proto.BrowserBrowserContextID
+
+	// Pool tab: slots membatasi tab yang dipakai bersamaan, idle berisi tab
+	// yang sudah dikembalikan dan siap dipakai ulang
+	poolSize int
+	slots    chan struct{}
+	idle     []pooledPage
+	active   int
+
+	idleTimeout time.Duration
+	lastUsed    time.Time
+	idleTimer   *time.Timer
+}
+
+type pooledPage struct {
+	page  *rod.Page
+	gen   int
+	proxy string // proxy server dari browser context tab, kosong tanpa proxy
 }
 
 // ScrapeResult menyimpan hasil scraping
@@ -25,18 +71,76 @@ type ScrapeResult struct {
 }
 
 // NewBrowserService membuat instance baru dari BrowserService
-func NewBrowserService() *BrowserService {
-	return &BrowserService{}
+func NewBrowserService(repos *repo.Repositories) *BrowserService {
+	// Gambar hasil capture yang sudah lama dibersihkan di sini
+	go downloader.PruneCaptures(captureMaxAge)
+
+	return &BrowserService{
+		configRepo:  repos.Config,
+		poolSize:    defaultPoolSize,
+		slots:       make(chan struct{}, defaultPoolSize),
+		idleTimeout: defaultIdleTimeout,
+	}
+}
+
+// loadPoolOptionsLocked membaca pengaturan pool dari tabel config. Nilai
+// yang kosong atau tidak valid memakai default. Pemanggil memegang mu.
+func (s *BrowserService) loadPoolOptionsLocked() {
+	maxPages, idleMinutes := defaultPoolSize, int(defaultIdleTimeout/time.Minute)
+	if s.configRepo != nil {
+		ctx := context.Background()
+		if v, err := s.configRepo.GetValue(ctx, BrowserMaxPagesKey); err != nil {
+			log.Printf("browser: read %s: %v", BrowserMaxPagesKey, err)
+		} else if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			maxPages = n
+		}
+		if v, err := s.configRepo.GetValue(ctx, BrowserIdleMinutesKey); err != nil {
+			log.Printf("browser: read %s: %v", BrowserIdleMinutesKey, err)
+		} else if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			idleMinutes = n
+		}
+	}
+	s.setPoolOptionsLocked(maxPages, idleMinutes)
+}
+
+// setPoolOptionsLocked mengatur jumlah tab yang boleh terbuka bersamaan dan
+// berapa menit browser boleh menganggur sebelum dimatikan (0 = tidak pernah).
+// Tab yang sedang dipakai tetap berjalan sampai selesai. Pemanggil memegang mu.
+func (s *BrowserService) setPoolOptionsLocked(maxPages int, idleMinutes int) {
+	if maxPages <= 0 {
+		maxPages = defaultPoolSize
+	}
+	if maxPages != s.poolSize {
+		s.poolSize = maxPages
+		s.slots = make(chan struct{}, maxPages)
+		for len(s.idle) > maxPages {
+			_ = s.idle[0].page.Close()
+			s.idle = s.idle[1:]
+		}
+	}
+	s.idleTimeout = time.Duration(max(idleMinutes, 0)) * time.Minute
 }
 
 // initBrowser menginisialisasi browser jika belum ada atau terputus
 func (s *BrowserService) initBrowser() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ensureBrowserLocked(); err != nil {
+		return err
+	}
+	s.lastUsed = time.Now()
+	s.scheduleIdleLocked()
+	return nil
+}
+
+// ensureBrowserLocked meluncurkan browser bila belum ada. Browser yang
+// crash dibuang oleh takePage saat tab gagal dibuka. Pemanggil memegang mu.
+func (s *BrowserService) ensureBrowserLocked() error {
 	if s.browser != nil {
-		// Cek apakah browser masih responsif
-		if _, err := s.browser.Version(); err == nil {
-			return nil
-		}
+		return nil
 	}
+	// Pengaturan pool yang diubah berlaku setiap kali browser diluncurkan
+	s.loadPoolOptionsLocked()
 
 	// Gunakan launcher untuk mencari browser default dan set headless=true
 	// Kita nonaktifkan Leakless untuk menghindari false positive antivirus di Windows
@@ -52,28 +156,265 @@ func (s *BrowserService) initBrowser() error {
 		l = l.Bin(path)
 	}
 
+	u, err := l.Launch()
+	if err != nil {
+		return fmt.Errorf("failed to launch browser: %w", err)
+	}
+
+	// Connect ke browser
+	browser := rod.New().ControlURL(u)
+	if err := browser.Connect(); err != nil {
+		l.Kill()
+		return fmt.Errorf("failed to connect to browser: %w", err)
+	}
+
 	// Simpan instance launcher untuk keperluan cleanup
 	s.launcher = l
+	s.browser = browser
+	s.gen++
+	return nil
+}
 
-	u := l.MustLaunch()
+// acquirePage mengambil tab dari pool, atau membuat tab baru, untuk satu
+// request lewat proxy server (kosong = langsung). ctx membatasi lama
+// menunggu tab yang kosong. release wajib dipanggil setelah selesai untuk
+// mengembalikan tab ke pool.
+func (s *BrowserService) acquirePage(ctx context.Context, server string) (page *rod.Page, release func(), err error) {
+	s.mu.Lock()
+	slots := s.slots
+	s.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, waitError("a free browser page", ctx.Err())
+	}
 
-	// Connect ke browser
-	s.browser = rod.New().ControlURL(u).MustConnect()
+	page, gen, err := s.takePage(server)
+	if err != nil {
+		s.mu.Lock()
+		s.active--
+		s.scheduleIdleLocked()
+		s.mu.Unlock()
+		<-slots
+		return nil, nil, err
+	}
 
-	return nil
+	release = func() {
+		s.putPage(page, gen, server)
+		<-slots
+	}
+	return page, release, nil
+}
+
+// takePage mengambil tab yang menganggur dengan proxy server yang sama dari
+// browser yang sekarang atau membuka tab baru. Bila browser ternyata mati,
+// browser diluncurkan ulang sekali.
+func (s *BrowserService) takePage(server string) (*rod.Page, int, error) {
+	for attempt := 0; ; attempt++ {
+		s.mu.Lock()
+		if attempt == 0 {
+			s.active++
+			s.stopIdleLocked()
+		}
+		if err := s.ensureBrowserLocked(); err != nil {
+			s.mu.Unlock()
+			return nil, 0, err
+		}
+		gen, browser := s.gen, s.browser
+		for i := len(s.idle) - 1; i >= 0; i-- {
+			p := s.idle[i]
+			if p.gen != gen {
+				// Tab dari browser lama sudah mati
+				s.idle = append(s.idle[:i], s.idle[i+1:]...)
+				continue
+			}
+			if p.proxy == server {
+				s.idle = append(s.idle[:i], s.idle[i+1:]...)
+				s.mu.Unlock()
+				return p.page, gen, nil
+			}
+		}
+		contextID, err := s.proxyContextLocked(server)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		page, err := browser.Page(proto.TargetCreateTarget{BrowserContextID: contextID})
+		if err == nil {
+			return page, gen, nil
+		}
+		if attempt > 0 {
+			return nil, 0, fmt.Errorf("failed to open page: %w", err)
+		}
+		s.dropIfDead(browser, gen)
+	}
+}
+
+// dropIfDead mematikan browser gen bila tidak menjawab, supaya percobaan
+// berikutnya meluncurkan yang baru. Pengecekan berjalan tanpa mu sehingga
+// scrape lain tidak ikut tertahan; browser yang lambat tapi masih menjawab
+// tidak dimatikan.
+func (s *BrowserService) dropIfDead(browser *rod.Browser, gen int) {
+	if _, err := browser.Timeout(healthTimeout).Version(); err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Scrape lain mungkin sudah meluncurkan ulang browser
+	if s.gen == gen && s.browser == browser {
+		s.shutdownLocked()
+	}
+}
+
+// proxyContextLocked mengembalikan browser context untuk proxy server,
+// dibuat saat pertama dipakai. Pemanggil memegang mu.
+func (s *BrowserService) proxyContextLocked(server string) (proto.BrowserBrowserContextID, error) {
+	if server == "" {
+		return "", nil
+	}
+	if id, ok := s.contexts[server]; ok {
+		return id, nil
+	}
+	res, err := proto.TargetCreateBrowserContext{ProxyServer: server}.Call(s.browser)
+	if err != nil {
+		return "", fmt.Errorf("failed to create browser context for proxy %s: %w", server, err)
+	}
+	if s.contexts == nil {
+		s.contexts = make(map[string]proto.BrowserBrowserContextID)
+	}
+	s.contexts[server] = res.BrowserContextID
+	return res.BrowserContextID, nil
+}
+
+// putPage mengembalikan tab ke pool dalam keadaan bersih. Tab yang gagal
+// dibersihkan atau berasal dari browser lama langsung ditutup.
+func (s *BrowserService) putPage(page *rod.Page, gen int, server string) {
+	ctx, cancel := context.WithTimeout(context.Background(), pageResetTimeout)
+	defer cancel()
+
+	p := page.Context(ctx)
+	// Matikan intersepsi jaringan dari capture sebelum tab dipakai ulang
+	err := proto.FetchDisable{}.Call(p)
+	if err == nil {
+		err = p.Navigate("about:blank")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	s.lastUsed = time.Now()
+	if err != nil || gen != s.gen || len(s.idle) >= s.poolSize {
+		_ = page.Close()
+	} else {
+		s.idle = append(s.idle, pooledPage{page: page, gen: gen, proxy: server})
+	}
+	s.scheduleIdleLocked()
+}
+
+// scheduleIdleLocked memasang timer untuk mematikan browser yang menganggur
+func (s *BrowserService) scheduleIdleLocked() {
+	s.stopIdleLocked()
+	if s.active > 0 || s.browser == nil || s.idleTimeout <= 0 {
+		return
+	}
+	s.idleTimer = time.AfterFunc(s.idleTimeout, s.shutdownIfIdle)
+}
+
+func (s *BrowserService) stopIdleLocked() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+// shutdownIfIdle mematikan Chromium bila tidak ada tab yang dipakai sejak
+// idleTimeout; scrape berikutnya akan meluncurkannya lagi
+func (s *BrowserService) shutdownIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active > 0 || s.idleTimeout <= 0 || time.Since(s.lastUsed) < s.idleTimeout {
+		return
+	}
+	s.shutdownLocked()
+}
+
+// shutdownLocked menutup semua tab dan browser lalu mematikan prosesnya
+func (s *BrowserService) shutdownLocked() error {
+	s.stopIdleLocked()
+	s.idle = nil
+	s.contexts = nil
+
+	var err error
+	if s.browser != nil {
+		// Browser yang hang tidak akan menjawab; prosesnya tetap dimatikan di bawah
+		err = s.browser.Timeout(healthTimeout).Close()
+		s.browser = nil
+	}
+
+	// Matikan proses browser via launcher
+	if s.launcher != nil {
+		s.launcher.Kill()
+		s.launcher = nil
+	}
+	return err
+}
+
+// openPage membuka tab dari pool ke url dengan ctx sebagai batas waktu.
+// Tab yang dikembalikan terikat ke ctx; close tetap bisa dipanggil setelah
+// ctx habis untuk mengembalikan tab ke pool. before (opsional) dijalankan
+// sebelum navigasi, misalnya untuk mulai merekam jaringan. Dengan pool,
+// tab memakai proxy berikutnya dari pool dan hasil navigasinya dicatat
+// sebagai kesehatan proxy tersebut.
+func (s *BrowserService) openPage(ctx context.Context, url string, pool *proxy.Pool, before func(*rod.Page) error) (page *rod.Page, close func(), err error) {
+	var proxyURL *neturl.URL
+	var server string
+	if pool != nil {
+		proxyURL = pool.Next()
+		if server, err = proxy.BrowserServer(proxyURL); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	raw, close, err := s.acquirePage(ctx, server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	page = raw.Context(ctx)
+	if before != nil {
+		if err := before(page); err != nil {
+			close()
+			return nil, nil, err
+		}
+	}
+	if err := page.Navigate(url); err != nil {
+		if ctx.Err() == nil {
+			pool.Report(proxyURL, err)
+		}
+		close()
+		return nil, nil, waitError("navigation to "+url, err)
+	}
+	pool.Report(proxyURL, nil)
+	return page, close, nil
 }
 
 // ScrapePage melakukan scraping sederhana pada halaman web
 // url: Alamat web yang akan discrape
 // selector: CSS selector untuk elemen yang ingin diambil teksnya (opsional)
 func (s *BrowserService) ScrapePage(url string, selector string) ScrapeResult {
-	if err := s.initBrowser(); err != nil {
-		return ScrapeResult{Error: fmt.Sprintf("Failed to init browser: %v", err)}
-	}
+	deadline, cancel := context.WithTimeout(context.Background(), defaultBrowserTimeout)
+	defer cancel()
 
-	// Buat page baru
-	page := s.browser.MustPage(url)
-	defer page.Close() // Pastikan page ditutup setelah selesai
+	// Ambil tab dari pool
+	page, closePage, err := s.openPage(deadline, url, nil, nil)
+	if err != nil {
+		return ScrapeResult{Error: fmt.Sprintf("Failed to open page: %v", err)}
+	}
+	defer closePage() // Pastikan tab dikembalikan setelah selesai
 
 	// Tunggu halaman selesai loading (Load Event Fired)
 	// Kita juga bisa gunakan page.WaitStable() untuk menunggu animasi/ajax selesai
@@ -88,10 +429,7 @@ func (s *BrowserService) ScrapePage(url string, selector string) ScrapeResult {
 		defer cancel()
 
 		// Race condition handling: Wait for element or timeout
-		err := rod.Try(func() {
-			page.Context(ctx).MustElement(selector)
-		})
-		if err != nil {
+		if _, err := page.Context(ctx).Element(selector); err != nil {
 			return ScrapeResult{Error: fmt.Sprintf("Element selector '%s' not found", selector)}
 		}
 	}
@@ -136,22 +474,25 @@ func (s *BrowserService) ScrapePage(url string, selector string) ScrapeResult {
 
 // Close menutup browser instance
 func (s *BrowserService) Close() error {
-	if s.browser != nil {
-		return s.browser.Close()
-	}
-	return nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdownLocked()
 }
 
 // Screenshot mengambil screenshot halaman
 func (s *BrowserService) Screenshot(url string) (string, error) {
-	if err := s.initBrowser(); err != nil {
+	deadline, cancel := context.WithTimeout(context.Background(), defaultBrowserTimeout)
+	defer cancel()
+
+	page, closePage, err := s.openPage(deadline, url, nil, nil)
+	if err != nil {
 		return "", err
 	}
+	defer closePage()
 
-	page := s.browser.MustPage(url)
-	defer page.Close()
-
-	page.MustWaitLoad()
+	if err := page.WaitLoad(); err != nil {
+		return "", err
+	}
 
 	// Ambil screenshot full page
 	data, err := page.Screenshot(true, &proto.PageCaptureScreenshot{
@@ -171,29 +512,27 @@ func (s *BrowserService) Screenshot(url string) (string, error) {
 
 // ScrapFull mengambil seluruh HTML halaman setelah render selesai
 func (s *BrowserService) ScrapFull(url string) (string, error) {
-	if err := s.initBrowser(); err != nil {
-		return "", fmt.Errorf("failed to init browser: %w", err)
+	deadline, cancel := context.WithTimeout(context.Background(), defaultBrowserTimeout)
+	defer cancel()
+
+	page, closePage, err := s.openPage(deadline, url, nil, nil)
+	if err != nil {
+		return "", err
 	}
-	page := s.browser.MustPage(url)
-	defer page.Close()
+	defer closePage()
 
 	// Tunggu hingga halaman stabil (network idle & tidak ada perubahan DOM)
 	// Ini penting untuk website SPA atau yang menggunakan banyak JS
-	page.MustWaitStable()
+	if err := page.WaitStable(time.Second); err != nil {
+		return "", err
+	}
 
-	return page.MustHTML(), nil
+	return page.HTML()
 }
 
 // Cleanup menutup browser dan membersihkan resource
 func (s *BrowserService) Cleanup() {
-	if s.browser != nil {
-		_ = s.browser.Close()
-		s.browser = nil
-	}
-
-	// Matikan proses browser via launcher
-	if s.launcher != nil {
-		s.launcher.Kill()
-		s.launcher = nil
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.shutdownLocked()
 }
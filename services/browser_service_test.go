@@ -0,0 +1,191 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"mangav5/internal/db"
+	"mangav5/internal/repo"
+)
+
+func TestSetPoolOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxPages    int
+		idleMinutes int
+		wantSize    int
+		wantIdle    time.Duration
+	}{
+		{"defaults", 0, 5, defaultPoolSize, 5 * time.Minute},
+		{"negative pages", -2, 1, defaultPoolSize, time.Minute},
+		{"more pages", 8, 10, 8, 10 * time.Minute},
+		{"single page", 1, 5, 1, 5 * time.Minute},
+		{"never idle", 4, 0, 4, 0},
+		{"negative idle", 4, -3, 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &BrowserService{poolSize: defaultPoolSize, slots: make(chan struct{}, defaultPoolSize)}
+			s.setPoolOptionsLocked(tt.maxPages, tt.idleMinutes)
+			if s.poolSize != tt.wantSize || cap(s.slots) != tt.wantSize {
+				t.Errorf("pool size = %d, slots = %d, want %d", s.poolSize, cap(s.slots), tt.wantSize)
+			}
+			if s.idleTimeout != tt.wantIdle {
+				t.Errorf("idle timeout = %v, want %v", s.idleTimeout, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestSetPoolOptionsKeepsSlotsOfSameSize(t *testing.T) {
+	s := &BrowserService{poolSize: defaultPoolSize, slots: make(chan struct{}, defaultPoolSize)}
+	slots := s.slots
+	// A page in use holds its slot across a reload of the same settings
+	slots <- struct{}{}
+	s.setPoolOptionsLocked(defaultPoolSize, 5)
+	if s.slots != slots {
+		t.Error("slots were replaced although the size did not change")
+	}
+}
+
+func TestLoadPoolOptions(t *testing.T) {
+	conn, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := db.Migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	configRepo := repo.NewConfigRepo(conn)
+
+	tests := []struct {
+		name        string
+		maxPages    string
+		idleMinutes string
+		wantSize    int
+		wantIdle    time.Duration
+	}{
+		{"unset", "", "", defaultPoolSize, defaultIdleTimeout},
+		{"set", "2", "15", 2, 15 * time.Minute},
+		{"never idle", "6", "0", 6, 0},
+		{"invalid", "many", "-1", defaultPoolSize, defaultIdleTimeout},
+		{"zero pages", "0", "5", defaultPoolSize, 5 * time.Minute},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := configRepo.Set(ctx, BrowserMaxPagesKey, tt.maxPages); err != nil {
+				t.Fatal(err)
+			}
+			if err := configRepo.Set(ctx, BrowserIdleMinutesKey, tt.idleMinutes); err != nil {
+				t.Fatal(err)
+			}
+
+			s := &BrowserService{configRepo: configRepo, poolSize: defaultPoolSize, slots: make(chan struct{}, defaultPoolSize)}
+			s.loadPoolOptionsLocked()
+			if s.poolSize != tt.wantSize || s.idleTimeout != tt.wantIdle {
+				t.Errorf("pool = %d pages / %v idle, want %d / %v", s.poolSize, s.idleTimeout, tt.wantSize, tt.wantIdle)
+			}
+		})
+	}
+
+	// Without a database the defaults apply
+	s := &BrowserService{poolSize: 1, slots: make(chan struct{}, 1)}
+	s.loadPoolOptionsLocked()
+	if s.poolSize != defaultPoolSize || s.idleTimeout != defaultIdleTimeout {
+		t.Errorf("without config = %d pages / %v idle", s.poolSize, s.idleTimeout)
+	}
+}
+
+func TestAcquirePageWaitsForFreeSlot(t *testing.T) {
+	s := &BrowserService{poolSize: 1, slots: make(chan struct{}, 1), idleTimeout: defaultIdleTimeout}
+	// Every page of the pool is in use
+	s.slots <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := s.acquirePage(ctx, "")
+	if err == nil || !strings.Contains(err.Error(), "timed out waiting for a free browser page") {
+		t.Fatalf("acquirePage() = %v, want a timeout", err)
+	}
+	if s.active != 0 || s.browser != nil {
+		t.Errorf("waiting changed the pool: active = %d, browser started = %v", s.active, s.browser != nil)
+	}
+}
+
+func TestScheduleIdleWithoutBrowser(t *testing.T) {
+	s := &BrowserService{idleTimeout: time.Millisecond}
+	s.scheduleIdleLocked()
+	if s.idleTimer != nil {
+		t.Error("idle timer set without a running browser")
+	}
+}
+
+func TestBrowserPagePool(t *testing.T) {
+	s := newTestBrowser(t)
+	s.mu.Lock()
+	s.setPoolOptionsLocked(1, 5)
+	s.mu.Unlock()
+	ctx := context.Background()
+
+	page, release, err := s.acquirePage(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The only page is taken, a second scrape waits
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.acquirePage(short, ""); err == nil {
+		t.Fatal("acquirePage() got a page beyond the pool size")
+	}
+
+	release()
+	again, releaseAgain, err := s.acquirePage(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseAgain()
+	if again.TargetID != page.TargetID {
+		t.Error("released page was not reused")
+	}
+}
+
+func TestBrowserShutsDownWhenIdle(t *testing.T) {
+	s := newTestBrowser(t)
+	s.mu.Lock()
+	s.idleTimeout = 100 * time.Millisecond
+	s.mu.Unlock()
+
+	_, release, err := s.acquirePage(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A page in use keeps the browser running
+	time.Sleep(300 * time.Millisecond)
+	s.mu.Lock()
+	running := s.browser != nil
+	s.mu.Unlock()
+	if !running {
+		t.Fatal("browser shut down while a page was in use")
+	}
+
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		stopped := s.browser == nil && len(s.idle) == 0
+		s.mu.Unlock()
+		if stopped {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle browser was not shut down")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-rod/rod"
+)
+
+const (
+	defaultBrowserTimeout = 30 * time.Second
+	defaultPollInterval   = 200 * time.Millisecond
+	renderStableFor       = time.Second
+)
+
+// pageReadyJS reports the first WaitConfig condition the page does not meet
+// yet, "" once every one holds. Containers and contents match when any of
+// their selectors does; text length and images are checked inside the
+// content matches, or the whole body without content selectors.
+const pageReadyJS = `(containers, contents, minText, needImages) => {
+	if (containers.length && !containers.some(s => document.querySelector(s))) {
+		return "container selectors " + containers.join(", ");
+	}
+	let roots = [document.body];
+	if (contents.length) {
+		roots = contents.flatMap(s => Array.from(document.querySelectorAll(s)));
+		if (!roots.length) return "content selectors " + contents.join(", ");
+	}
+	if (minText > 0) {
+		const n = roots.reduce((sum, el) => sum + ((el && el.innerText) || "").trim().length, 0);
+		if (n < minText) return "text length " + n + " of " + minText;
+	}
+	if (needImages) {
+		for (const root of roots) {
+			const imgs = root.tagName === "IMG" ? [root] : Array.from(root.querySelectorAll("img"));
+			const pending = imgs.filter(img => img.getAttribute("src") && !(img.complete && img.naturalWidth > 0));
+			if (pending.length) return pending.length + " images to load";
+		}
+	}
+	return "";
+}`
+
+// browserTimeout is the deadline of loading and waiting for one page
+func browserTimeout(wc *WaitConfig) time.Duration {
+	if wc != nil && wc.Timeout > 0 {
+		return time.Duration(wc.Timeout) * time.Millisecond
+	}
+	return defaultBrowserTimeout
+}
+
+// waitForPage applies wc to a page whose context carries the deadline.
+// Without a wait config the page only has to load and render stable.
+func waitForPage(page *rod.Page, wc *WaitConfig) error {
+	if wc == nil {
+		wc = &WaitConfig{}
+	}
+	if wc.SkipWaits {
+		return nil
+	}
+
+	if !wc.SkipNavigationWait {
+		if err := page.WaitLoad(); err != nil {
+			return waitError("page load", err)
+		}
+	}
+
+	if len(wc.ContainerSelectors) > 0 || len(wc.ContentSelectors) > 0 || wc.MinTextLength > 0 || wc.RequireImageLoaded {
+		if err := waitForContent(page, wc); err != nil {
+			return err
+		}
+	}
+
+	if !wc.SkipRenderStable {
+		if err := page.WaitDOMStable(renderStableFor, 0); err != nil {
+			return waitError("stable render", err)
+		}
+	}
+	return nil
+}
+
+// waitForContent polls the page every PollInterval until pageReadyJS passes
+func waitForContent(page *rod.Page, wc *WaitConfig) error {
+	poll := defaultPollInterval
+	if wc.PollInterval > 0 {
+		poll = time.Duration(wc.PollInterval) * time.Millisecond
+	}
+
+	containers := wc.ContainerSelectors
+	if containers == nil {
+		containers = []string{}
+	}
+	contents := wc.ContentSelectors
+	if contents == nil {
+		contents = []string{}
+	}
+
+	ctx := page.GetContext()
+	pending := "content"
+	for {
+		res, err := page.Eval(pageReadyJS, containers, contents, wc.MinTextLength, wc.RequireImageLoaded)
+		if err != nil {
+			return waitError(pending, err)
+		}
+		if pending = res.Value.Str(); pending == "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return waitError(pending, ctx.Err())
+		case <-time.After(poll):
+		}
+	}
+}
+
+func waitError(what string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out waiting for %s", what)
+	}
+	return fmt.Errorf("waiting for %s: %w", what, err)
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-rod/rod/lib/launcher"
+)
+
+// newTestBrowser returns a BrowserService for tests that need a real
+// browser; they are skipped when none is installed
+func newTestBrowser(t *testing.T) *BrowserService {
+	t.Helper()
+	if _, ok := launcher.LookPath(); !ok {
+		t.Skip("no browser installed")
+	}
+	s := &BrowserService{
+		poolSize:    defaultPoolSize,
+		slots:       make(chan struct{}, defaultPoolSize),
+		idleTimeout: defaultIdleTimeout,
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.initBrowser(); err != nil {
+		t.Skipf("browser does not start: %v", err)
+	}
+	return s
+}
+
+func TestBrowserTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		wc   *WaitConfig
+		want time.Duration
+	}{
+		{"no wait config", nil, defaultBrowserTimeout},
+		{"no timeout", &WaitConfig{PollInterval: 100}, defaultBrowserTimeout},
+		{"negative timeout", &WaitConfig{Timeout: -1}, defaultBrowserTimeout},
+		{"timeout", &WaitConfig{Timeout: 4500}, 4500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := browserTimeout(tt.wc); got != tt.want {
+				t.Errorf("browserTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitError(t *testing.T) {
+	if got := waitError("page load", fmt.Errorf("eval: %w", context.DeadlineExceeded)); got.Error() != "timed out waiting for page load" {
+		t.Errorf("deadline error = %q", got)
+	}
+	cause := errors.New("target closed")
+	got := waitError("stable render", cause)
+	if !errors.Is(got, cause) || got.Error() != "waiting for stable render: target closed" {
+		t.Errorf("other error = %q", got)
+	}
+}
+
+func TestWaitForPageSkipWaits(t *testing.T) {
+	// Nothing is asked of the page, so no browser is needed
+	if err := waitForPage(nil, &WaitConfig{SkipWaits: true, ContainerSelectors: []string{"#x"}}); err != nil {
+		t.Errorf("waitForPage() = %v, want nil", err)
+	}
+}
+
+func TestWaitForPage(t *testing.T) {
+	s := newTestBrowser(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow.png":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		case "/late":
+			fmt.Fprint(w, `<html><body><script>
+				setTimeout(() => { document.body.innerHTML = '<div id="late">loaded later</div>' }, 300)
+			</script></body></html>`)
+		case "/image":
+			fmt.Fprint(w, `<html><body><div id="c"><img src="/slow.png"></div></body></html>`)
+		default:
+			fmt.Fprint(w, `<html><body><div id="c">hello world</div></body></html>`)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		wc      *WaitConfig
+		wantErr string
+	}{
+		{"no wait config", "/", nil, ""},
+		{"container and text", "/", &WaitConfig{ContainerSelectors: []string{"#missing", "#c"}, MinTextLength: 5}, ""},
+		{"content shows up later", "/late", &WaitConfig{ContentSelectors: []string{"#late"}, PollInterval: 50, SkipRenderStable: true}, ""},
+		{
+			"missing container",
+			"/", &WaitConfig{ContainerSelectors: []string{"#missing"}, Timeout: 500, SkipRenderStable: true},
+			"timed out waiting for container selectors #missing",
+		},
+		{
+			"text too short",
+			"/", &WaitConfig{ContentSelectors: []string{"#c"}, MinTextLength: 1000, Timeout: 500, SkipRenderStable: true},
+			"timed out waiting for text length 11 of 1000",
+		},
+		{
+			"image never loads",
+			"/image", &WaitConfig{ContentSelectors: []string{"#c"}, RequireImageLoaded: true, SkipNavigationWait: true, SkipRenderStable: true, Timeout: 500},
+			"timed out waiting for 1 images to load",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), browserTimeout(tt.wc))
+			defer cancel()
+
+			page, closePage, err := s.openPage(ctx, srv.URL+tt.path, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closePage()
+
+			err = waitForPage(page, tt.wc)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("waitForPage() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("waitForPage() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mangav5/internal/proxy"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const (
+	challengeTimeout = 45 * time.Second
+	challengePoll    = 500 * time.Millisecond
+)
+
+// Markers of anti-bot challenge pages. Some of them also appear in normal
+// pages of protected sites, so those only count on a blocking status.
+var (
+	challengeMarkers = []string{
+		"window._cf_chl_opt",
+		"<title>Just a moment...</title>",
+		"cf-browser-verification",
+		"<title>DDoS-Guard</title>",
+		"sucuri_cloudproxy_js",
+	}
+	blockedMarkers = []string{
+		"/cdn-cgi/challenge-platform/",
+		"/_Incapsula_Resource",
+		"ddos-guard",
+	}
+)
+
+// challengeJS reports whether the page still shows a challenge
+const challengeJS = `() => {
+	if (document.readyState !== "complete") return true;
+	if (window._cf_chl_opt) return true;
+	const title = document.title || "";
+	if (title === "Just a moment..." || title === "DDoS-Guard") return true;
+	return !!document.querySelector("#challenge-form, #challenge-running, #cf-challenge-running, .cf-browser-verification");
+}`
+
+// ChallengeError is returned when a source answers with an anti-bot
+// challenge instead of the page
+type ChallengeError struct {
+	URL    string
+	Status int
+	Reason string
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("%s answered with an anti-bot challenge (%s, status %d)", e.URL, e.Reason, e.Status)
+}
+
+// detectChallenge returns a *ChallengeError when resp is a challenge page
+func detectChallenge(resp *resty.Response) error {
+	status := resp.StatusCode()
+	challenge := func(reason string) error {
+		return &ChallengeError{URL: resp.Request.URL, Status: status, Reason: reason}
+	}
+
+	if strings.EqualFold(resp.Header().Get("cf-mitigated"), "challenge") {
+		return challenge("cf-mitigated header")
+	}
+	if !strings.Contains(resp.Header().Get("Content-Type"), "html") {
+		return nil
+	}
+
+	body := resp.String()
+	for _, m := range challengeMarkers {
+		if strings.Contains(body, m) {
+			return challenge(m)
+		}
+	}
+	if status == http.StatusForbidden || status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		lower := strings.ToLower(body)
+		for _, m := range blockedMarkers {
+			if strings.Contains(lower, strings.ToLower(m)) {
+				return challenge(m)
+			}
+		}
+	}
+	return nil
+}
+
+// bootstrapSession solves the challenge of target in the browser and copies
+// the resulting cookies and User-Agent into the scraper client for its
+// domain. The browser goes through pool like the scrape did, since clearance
+// is given to an address. Concurrent calls for one host wait for the first.
+func (s *ScraperService) bootstrapSession(target string, pool *proxy.Pool) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid challenge URL %q", target)
+	}
+	host := u.Hostname()
+
+	return s.single(host, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), challengeTimeout)
+		defer cancel()
+
+		cookies, userAgent, err := s.browserService.solveChallenge(ctx, target, pool)
+		if err != nil {
+			return err
+		}
+		domains := append([]string{host}, s.importCookies(cookies, u.Scheme)...)
+
+		// Clearance cookies are only honoured with the User-Agent that earned them
+		s.sessionMu.Lock()
+		for _, d := range domains {
+			s.userAgents[d] = userAgent
+		}
+		s.sessionMu.Unlock()
+		return nil
+	})
+}
+
+// applySession sends requests to rawURL with the User-Agent of a solved
+// challenge of its domain, even over a User-Agent set by the rule
+func (s *ScraperService) applySession(req *resty.Request, rawURL string) {
+	if ua := s.sessionUserAgent(rawURL); ua != "" {
+		req.SetHeader("User-Agent", ua)
+	}
+}
+
+// sessionUserAgent returns the User-Agent of a solved challenge of the
+// domain of rawURL or a parent domain, "" without one
+func (s *ScraperService) sessionUserAgent(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	host := u.Hostname()
+
+	s.sessionMu.RLock()
+	defer s.sessionMu.RUnlock()
+	for host != "" {
+		if ua, ok := s.userAgents[host]; ok {
+			return ua
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found || !strings.Contains(parent, ".") {
+			break
+		}
+		host = parent
+	}
+	return ""
+}
+
+// solveChallenge opens target like a regular browser and waits until its
+// challenge is gone. It returns the cookies of target and the User-Agent the
+// browser used.
+func (s *BrowserService) solveChallenge(ctx context.Context, target string, pool *proxy.Pool) ([]*proto.NetworkCookie, string, error) {
+	userAgent, err := s.userAgent()
+	if err != nil {
+		return nil, "", err
+	}
+
+	page, closePage, err := s.openPage(ctx, target, pool, func(p *rod.Page) error {
+		// The headless marker in the default User-Agent gives the browser away
+		return proto.NetworkSetUserAgentOverride{UserAgent: userAgent}.Call(p)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer closePage()
+
+	for {
+		res, err := page.Eval(challengeJS)
+		if err != nil {
+			return nil, "", waitError("the challenge to pass", err)
+		}
+		if !res.Value.Bool() {
+			break
+		}
+		if err := sleepPage(page, challengePoll); err != nil {
+			return nil, "", waitError("the challenge to pass", err)
+		}
+	}
+
+	cookies, err := page.Cookies([]string{target})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read cookies: %w", err)
+	}
+	return cookies, userAgent, nil
+}
+
+// userAgent starts the browser and returns its User-Agent without the
+// headless marker. A browser that stopped answering is launched again once.
+func (s *BrowserService) userAgent() (string, error) {
+	for attempt := 0; ; attempt++ {
+		if err := s.initBrowser(); err != nil {
+			return "", err
+		}
+		s.mu.Lock()
+		browser, gen := s.browser, s.gen
+		s.mu.Unlock()
+		if browser == nil {
+			return "", errors.New("browser is not running")
+		}
+
+		v, err := browser.Timeout(healthTimeout).Version()
+		if err == nil {
+			return strings.Replace(v.UserAgent, "HeadlessChrome", "Chrome", 1), nil
+		}
+		if attempt > 0 {
+			return "", fmt.Errorf("failed to read browser version: %w", err)
+		}
+		s.dropIfDead(browser, gen)
+	}
+}
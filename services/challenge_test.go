@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetectChallenge(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		header      map[string]string
+		body        string
+		reason      string // "" when the page is not a challenge
+	}{
+		{"plain page", http.StatusOK, "text/html", nil, "<html><title>Manga</title></html>", ""},
+		{"cf-mitigated header", http.StatusForbidden, "application/json", map[string]string{"cf-mitigated": "challenge"}, `{}`, "cf-mitigated header"},
+		{"cloudflare interstitial", http.StatusForbidden, "text/html; charset=UTF-8", nil, "<title>Just a moment...</title>", "<title>Just a moment...</title>"},
+		{"challenge script on 200", http.StatusOK, "text/html", nil, "<script>window._cf_chl_opt={}</script>", "window._cf_chl_opt"},
+		{"marker in json is ignored", http.StatusOK, "application/json", nil, `{"html":"<title>Just a moment...</title>"}`, ""},
+		{"blocked page", http.StatusServiceUnavailable, "text/html", nil, `<script src="/cdn-cgi/challenge-platform/x.js"></script>`, "/cdn-cgi/challenge-platform/"},
+		{"blocked marker is case insensitive", http.StatusTooManyRequests, "text/html", nil, "Protected by DDoS-Guard", "ddos-guard"},
+		{"blocked marker on 200", http.StatusOK, "text/html", nil, "protected by ddos-guard", ""},
+		{"plain 403", http.StatusForbidden, "text/html", nil, "<h1>Forbidden</h1>", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			resp, err := newTestScraper(t).client.R().Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = detectChallenge(resp)
+
+			var ce *ChallengeError
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("detectChallenge() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.As(err, &ce) {
+				t.Fatalf("detectChallenge() = %v, want a ChallengeError", err)
+			}
+			if ce.Reason != tt.reason || ce.Status != tt.status || ce.URL != srv.URL {
+				t.Errorf("ChallengeError = %+v, want reason %q, status %d", ce, tt.reason, tt.status)
+			}
+		})
+	}
+}
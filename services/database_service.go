@@ -3,8 +3,11 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
 	"mangav5/internal/models"
+	"mangav5/internal/proxy"
 	"mangav5/internal/repo"
+	"strconv"
 	"strings"
 )
 
@@ -154,6 +157,10 @@ func (s *DatabaseService) MarkChapterAsRead(ctx context.Context, chapterID int64
 // =====================
 
 func (s *DatabaseService) SaveScrapingRule(ctx context.Context, rule models.ScrapingRule) error {
+	// A proxy that cannot be parsed would fail every scrape of the site
+	if _, err := proxy.Resolve(rule.Proxy); err != nil {
+		return fmt.Errorf("proxy of %s: %w", rule.SiteKey, err)
+	}
 	return s.scrapingRuleRepo.Upsert(ctx, &rule)
 }
 
@@ -179,6 +186,20 @@ func (s *DatabaseService) DeleteScrapingRule(ctx context.Context, siteKey string
 
 // SetConfig sets a configuration value for a given key
 func (s *DatabaseService) SetConfig(ctx context.Context, key, value string) error {
+	switch key {
+	case proxy.ConfigKey:
+		if _, err := proxy.Resolve(value); err != nil {
+			return err
+		}
+	case BrowserMaxPagesKey:
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			return fmt.Errorf("%s must be a number of at least 1", key)
+		}
+	case BrowserIdleMinutesKey:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a number of minutes, 0 to never stop the browser", key)
+		}
+	}
 	return s.configRepo.Set(ctx, key, value)
 }
 
@@ -2,18 +2,149 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"mangav5/internal/downloader"
+	"mangav5/internal/models"
+	"mangav5/internal/proxy"
+	"mangav5/internal/repo"
+	"mangav5/internal/util"
+	"mangav5/internal/zipper"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
 )
 
 // DownloadService handles file downloading operations
-type DownloadService struct{}
+type DownloadService struct {
+	queue            *downloader.Queue
+	limiter          *downloader.HostLimiter
+	scrapingRuleRepo *repo.ScrapingRuleRepo
+	mangaRepo        *repo.MangaRepo
+	chapterRepo      *repo.ChapterRepo
+	configRepo       *repo.ConfigRepo
+	scraperService   *ScraperService
+}
+
+// defaultHostPolicy applies to hosts without a rate_limit in their scraping rule
+var defaultHostPolicy = downloader.HostPolicy{
+	RequestsPerSecond: 5,
+	Burst:             5,
+}
 
 // NewDownloadService creates a new instance of DownloadService
-func NewDownloadService() *DownloadService {
-	return &DownloadService{}
+func NewDownloadService(repos *repo.Repositories, scraperService *ScraperService) *DownloadService {
+	s := &DownloadService{
+		limiter:          downloader.NewHostLimiter(defaultHostPolicy),
+		scrapingRuleRepo: repos.ScrapingRule,
+		mangaRepo:        repos.Manga,
+		chapterRepo:      repos.Chapter,
+		configRepo:       repos.Config,
+		scraperService:   scraperService,
+	}
+	s.queue = downloader.NewQueue(repos.DownloadJob, func(job models.DownloadJob) (downloader.DownloadConfig, error) {
+		options, err := jobOptions(job)
+		if err != nil {
+			return downloader.DownloadConfig{}, err
+		}
+		ctx := context.Background()
+		s.refreshHostPolicies(ctx)
+		cfg := buildDownloadConfig(job.OutputDir, options)
+		cfg.Limiter = s.limiter
+		s.applySiteProfile(ctx, &cfg, options)
+
+		pool, err := s.proxyPool(ctx, options)
+		cfg.Proxy = pool
+		return cfg, err
+	})
+	s.queue.OnFinished(func(ctx context.Context, job models.DownloadJob) error {
+		options, err := jobOptions(job)
+		if err != nil {
+			return err
+		}
+		if !options.PackCbz {
+			return nil
+		}
+		if options.MangaID == 0 {
+			options.MangaID = job.MangaID
+		}
+		_, err = s.packChapter(ctx, job.OutputDir, options)
+		return err
+	})
+	return s
+}
+
+// jobOptions decodes the options stored with job. Corrupt options fail the
+// job rather than running it with defaults (no CBZ, other concurrency).
+func jobOptions(job models.DownloadJob) (*DownloadOptions, error) {
+	var options DownloadOptions
+	if job.OptionsJSON == "" {
+		return &options, nil
+	}
+	if err := json.Unmarshal([]byte(job.OptionsJSON), &options); err != nil {
+		return nil, fmt.Errorf("invalid stored download options: %w", err)
+	}
+	return &options, nil
+}
+
+// refreshHostPolicies loads the rate_limit of every enabled scraping rule into the limiter.
+// The chapter rule takes precedence over the manga rule since it describes where images come from.
+func (s *DownloadService) refreshHostPolicies(ctx context.Context) {
+	rules, err := s.scrapingRuleRepo.List(ctx)
+	if err != nil {
+		return
+	}
+
+	policies := make(map[string]downloader.HostPolicy)
+	for _, r := range rules {
+		if r.Enabled == 0 {
+			continue
+		}
+
+		var domains []string
+		_ = json.Unmarshal([]byte(r.DomainsJSON), &domains)
+
+		for _, raw := range []string{r.ChapterRuleJSON, r.MangaRuleJSON} {
+			var rule SiteRule
+			if err := json.Unmarshal([]byte(raw), &rule); err != nil || rule.RateLimit == nil {
+				continue
+			}
+
+			policy := downloader.HostPolicy{
+				RequestsPerSecond: rule.RateLimit.RequestsPerSecond,
+				Burst:             rule.RateLimit.Burst,
+				MinDelay:          time.Duration(rule.RateLimit.MinDelayMs) * time.Millisecond,
+			}
+			for _, list := range [][]string{domains, rule.Domains, rule.RateLimit.Hosts} {
+				for _, d := range list {
+					policies[d] = policy
+				}
+			}
+			break
+		}
+	}
+
+	s.limiter.ReplacePolicies(policies)
+}
+
+// ServiceStartup resumes unfinished download jobs when the application starts
+func (s *DownloadService) ServiceStartup(ctx context.Context, options application.ServiceOptions) error {
+	s.queue.OnProgress(func(report downloader.ProgressReport) {
+		if app := application.Get(); app != nil {
+			app.Event.Emit("downloadProgress", report)
+		}
+	})
+	s.queue.OnJobUpdate(func(job models.DownloadJob) {
+		if app := application.Get(); app != nil {
+			app.Event.Emit("downloadJobUpdate", job)
+		}
+	})
+	return s.queue.Start(ctx)
 }
 
 // DownloadOptions allows configuring the download behavior
@@ -22,11 +153,28 @@ type DownloadOptions struct {
 	MaxConcurrency int `json:"maxConcurrency"`
 	RetryCount     int `json:"retryCount"`
 	TimeoutSeconds int `json:"timeoutSeconds"`
+	LatencyLowMs   int `json:"latencyLowMs"`  // grow concurrency below this average latency
+	LatencyHighMs  int `json:"latencyHighMs"` // halve concurrency above it
+
+	// Site the images belong to. Requests then carry the rule headers, the
+	// scraper User-Agent and the cookies collected while scraping.
+	SiteKey string            `json:"siteKey"`
+	Referer string            `json:"referer"` // usually the chapter page URL
+	Headers map[string]string `json:"headers"` // extra headers, override the rule ones
+
+	// Proxy URLs the images are requested through, "direct" for none.
+	// Empty uses the proxy of the site rule, then the global one.
+	Proxy string `json:"proxy"`
+
+	// PackCbz packs the chapter into <outputDir>.cbz with a ComicInfo.xml once
+	// every image is downloaded, then records it in the chapters table
+	PackCbz bool            `json:"packCbz"`
+	MangaID int64           `json:"mangaId"`
+	Chapter *models.Chapter `json:"chapter"` // number, title, volume... of the downloaded chapter
 }
 
-// DownloadImages downloads a list of images to the specified output directory
-// It uses an adaptive downloader engine to manage concurrency
-func (s *DownloadService) DownloadImages(urls []string, outputDir string, options *DownloadOptions) error {
+// buildDownloadConfig applies options on top of the default configuration
+func buildDownloadConfig(outputDir string, options *DownloadOptions) downloader.DownloadConfig {
 	// Default configuration
 	cfg := downloader.DownloadConfig{
 		MinConcurrency:   2,
@@ -35,6 +183,7 @@ func (s *DownloadService) DownloadImages(urls []string, outputDir string, option
 		RetryCount:       3,
 		Timeout:          30 * time.Second,
 		OutputDir:        outputDir,
+		WriteManifest:    true,
 	}
 
 	// Apply options if provided
@@ -51,6 +200,12 @@ func (s *DownloadService) DownloadImages(urls []string, outputDir string, option
 		if options.TimeoutSeconds > 0 {
 			cfg.Timeout = time.Duration(options.TimeoutSeconds) * time.Second
 		}
+		if options.LatencyLowMs > 0 {
+			cfg.LatencyLow = time.Duration(options.LatencyLowMs) * time.Millisecond
+		}
+		if options.LatencyHighMs > 0 {
+			cfg.LatencyHigh = time.Duration(options.LatencyHighMs) * time.Millisecond
+		}
 	}
 
 	// Ensure StartConcurrency is within logical bounds
@@ -61,16 +216,155 @@ func (s *DownloadService) DownloadImages(urls []string, outputDir string, option
 		cfg.StartConcurrency = cfg.MinConcurrency
 	}
 
+	return cfg
+}
+
+// applySiteProfile makes image requests look like the scraper requests of the
+// site: same User-Agent, entry headers of the chapter rule, a Referer and the
+// scraper cookie jar
+func (s *DownloadService) applySiteProfile(ctx context.Context, cfg *downloader.DownloadConfig, options *DownloadOptions) {
+	headers := map[string]string{
+		"User-Agent": DefaultUserAgent,
+	}
+	if s.scraperService != nil {
+		cfg.CookieJar = s.scraperService.cookieJar()
+	}
+
+	if options == nil {
+		cfg.Headers = headers
+		return
+	}
+
+	referer := options.Referer
+
+	if options.SiteKey != "" {
+		if rule, err := s.scrapingRuleRepo.GetBySiteKey(ctx, options.SiteKey); err == nil && rule != nil {
+			var siteRule SiteRule
+			if err := json.Unmarshal([]byte(rule.ChapterRuleJSON), &siteRule); err == nil {
+				if siteRule.Entry != nil {
+					for k, v := range siteRule.Entry.Headers {
+						// Templated values only make sense for the page request
+						if !strings.Contains(v, "{") {
+							headers[k] = v
+						}
+					}
+				}
+
+				if referer == "" {
+					var domains []string
+					_ = json.Unmarshal([]byte(rule.DomainsJSON), &domains)
+					if len(domains) == 0 {
+						domains = siteRule.Domains
+					}
+					if len(domains) > 0 {
+						referer = siteOrigin(domains[0]) + "/"
+					}
+				}
+			}
+		}
+	}
+
+	if referer != "" {
+		headers["Referer"] = referer
+		// Clearance cookies in the shared jar need the User-Agent that earned them
+		if s.scraperService != nil {
+			if ua := s.scraperService.sessionUserAgent(referer); ua != "" {
+				headers["User-Agent"] = ua
+			}
+		}
+	}
+	for k, v := range options.Headers {
+		headers[k] = v
+	}
+	cfg.Headers = headers
+}
+
+// proxyPool resolves the proxy of a download: the one of the job, else the
+// one of its scraping rule, else the global one
+func (s *DownloadService) proxyPool(ctx context.Context, options *DownloadOptions) (*proxy.Pool, error) {
+	var job, site string
+	if options != nil {
+		job = options.Proxy
+		if options.SiteKey != "" && strings.TrimSpace(job) == "" {
+			if rule, err := s.scrapingRuleRepo.GetBySiteKey(ctx, options.SiteKey); err == nil && rule != nil {
+				site = rule.Proxy
+			}
+		}
+	}
+	global, err := s.configRepo.GetValue(ctx, proxy.ConfigKey)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.Resolve(job, site, global)
+}
+
+// siteOrigin turns a rule domain ("example.com", "*.example.com" or a URL) into an origin
+func siteOrigin(domain string) string {
+	domain = strings.TrimSpace(domain)
+	if strings.Contains(domain, "://") {
+		return strings.TrimSuffix(domain, "/")
+	}
+	return "https://" + strings.TrimPrefix(domain, "*.")
+}
+
+// DownloadImages downloads a list of images to the specified output directory
+// It uses an adaptive downloader engine to manage concurrency.
+// The per-image report is returned and also emitted as "downloadResult".
+func (s *DownloadService) DownloadImages(urls []string, outputDir string, options *DownloadOptions) (*downloader.DownloadResult, error) {
+	cfg := buildDownloadConfig(outputDir, options)
+
 	// get application context
 	app := application.Get()
 	ctx := app.Context()
 
-	// TODO: Add support for progress reporting callback or event emission
-	// For now, we pass nil as the progress handler
-	return downloader.DownloadImagesAdaptive(ctx, urls, cfg, func(report downloader.ProgressReport) {
+	s.refreshHostPolicies(ctx)
+	cfg.Limiter = s.limiter
+	s.applySiteProfile(ctx, &cfg, options)
+	pool, err := s.proxyPool(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Proxy = pool
+
+	result, err := downloader.DownloadImagesAdaptive(ctx, urls, cfg, func(report downloader.ProgressReport) {
 		// Emit progress event to frontend
 		app.Event.Emit("downloadProgress", report)
 	})
+	if err == nil {
+		err = s.packIfComplete(ctx, result, options)
+	}
+	app.Event.Emit("downloadResult", result)
+	return result, err
+}
+
+// RetryFailedImages downloads again only the failed images of a previous
+// DownloadImages result into the same directory with the same file names
+func (s *DownloadService) RetryFailedImages(previous downloader.DownloadResult, options *DownloadOptions) (*downloader.DownloadResult, error) {
+	cfg := buildDownloadConfig(previous.OutputDir, options)
+
+	// get application context
+	app := application.Get()
+	ctx := app.Context()
+
+	s.refreshHostPolicies(ctx)
+	cfg.Limiter = s.limiter
+	s.applySiteProfile(ctx, &cfg, options)
+	pool, err := s.proxyPool(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Proxy = pool
+
+	result, err := downloader.RetryFailed(ctx, &previous, cfg, func(report downloader.ProgressReport) {
+		app.Event.Emit("downloadProgress", report)
+	})
+	if err == nil && result != nil {
+		err = s.packIfComplete(ctx, result, options)
+	}
+	if result != nil {
+		app.Event.Emit("downloadResult", result)
+	}
+	return result, err
 }
 
 // DownloadImage downloads a single image to the specified output directory
@@ -96,7 +390,226 @@ func (s *DownloadService) DownloadImage(url string, outputDir string, baseName s
 		ctx = app.Context()
 	}
 
-	client := downloader.NewRestyClient(timeout)
+	var cfg downloader.DownloadConfig
+	s.applySiteProfile(ctx, &cfg, options)
+	pool, err := s.proxyPool(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	client := downloader.NewRestyClient(timeout, pool).
+		SetHeaders(cfg.Headers).
+		SetCookieJar(cfg.CookieJar)
 
 	return downloader.DownloadImage(ctx, client, url, outputDir, baseName, retry)
 }
+
+// VerifyChapter checks the pages of a downloaded chapter folder against the
+// sha256 hashes recorded in its manifest
+func (s *DownloadService) VerifyChapter(outputDir string) (*downloader.VerifyReport, error) {
+	return downloader.VerifyManifest(outputDir)
+}
+
+// =====================
+// Chapter Packing
+// =====================
+
+// packIfComplete packs the chapter of result when packing was requested and no image failed
+func (s *DownloadService) packIfComplete(ctx context.Context, result *downloader.DownloadResult, options *DownloadOptions) error {
+	if options == nil || !options.PackCbz || result == nil || result.Failed > 0 {
+		return nil
+	}
+	cbzPath, err := s.packChapter(ctx, result.OutputDir, options)
+	if err != nil {
+		return err
+	}
+	result.ArchivePath = cbzPath
+	return nil
+}
+
+// packChapter compresses outputDir into outputDir.cbz with a ComicInfo.xml,
+// upserts the matching chapters row as compressed and removes the directory.
+// The directory is only removed once the row is saved so a failed job can be
+// resumed and packed again.
+func (s *DownloadService) packChapter(ctx context.Context, outputDir string, options *DownloadOptions) (string, error) {
+	if options.MangaID == 0 {
+		return "", errors.New("manga id is required to pack a chapter")
+	}
+	if options.Chapter == nil {
+		return "", errors.New("chapter metadata is required to pack a chapter")
+	}
+
+	manga, err := s.mangaRepo.GetByID(ctx, options.MangaID)
+	if err != nil {
+		return "", err
+	}
+	if manga == nil {
+		return "", fmt.Errorf("manga %d not found", options.MangaID)
+	}
+
+	chapter := *options.Chapter
+	chapter.MangaID = manga.ID
+	if chapter.ReleaseTimeTS == 0 && chapter.ReleaseTimeRaw != "" {
+		if ts, _ := util.ParseReleaseTime(chapter.ReleaseTimeRaw); ts != nil {
+			chapter.ReleaseTimeTS = *ts
+		}
+	}
+
+	outputDir = filepath.Clean(outputDir)
+	pages, err := countImages(outputDir)
+	if err != nil {
+		return "", err
+	}
+
+	cbzPath := outputDir + ".cbz"
+	if err := zipper.CompressChapter(outputDir, cbzPath, comicInfoFor(manga, &chapter, pages, options.Referer), downloader.ManifestName); err != nil {
+		return "", err
+	}
+
+	chapter.Path = s.chapterPath(ctx, cbzPath)
+	chapter.IsCompressed = 1
+	chapter.Status = "valid"
+	if err := s.upsertChapter(ctx, &chapter); err != nil {
+		return "", err
+	}
+
+	if err := os.RemoveAll(outputDir); err != nil {
+		return "", err
+	}
+	return cbzPath, nil
+}
+
+// comicInfoFor builds the ComicInfo.xml of a downloaded chapter
+func comicInfoFor(manga *models.Manga, chapter *models.Chapter, pages int, web string) *zipper.ComicInfo {
+	info := &zipper.ComicInfo{
+		Title:       chapter.ChapterTitle,
+		Series:      manga.MainTitle,
+		Number:      strconv.FormatFloat(chapter.ChapterNumber, 'f', -1, 64),
+		Volume:      chapter.Volume,
+		Summary:     manga.Description,
+		Translator:  chapter.TranslatorGroup,
+		Web:         web,
+		PageCount:   pages,
+		LanguageISO: chapter.Language,
+		Manga:       "Yes",
+	}
+	if chapter.ReleaseTimeTS > 0 {
+		t := time.Unix(chapter.ReleaseTimeTS, 0).UTC()
+		info.Year, info.Month, info.Day = t.Year(), int(t.Month()), t.Day()
+	}
+	return info
+}
+
+// chapterPath returns the path stored in the chapters table for cbzPath
+func (s *DownloadService) chapterPath(ctx context.Context, cbzPath string) string {
+	mangaDir, err := s.configRepo.GetValue(ctx, "manga_directory")
+	if err != nil {
+		mangaDir = ""
+	}
+	return storedChapterPath(mangaDir, cbzPath)
+}
+
+// upsertChapter updates the chapter with the same manga and number or inserts a new one.
+// Read status and creation time of an existing row are kept.
+func (s *DownloadService) upsertChapter(ctx context.Context, chapter *models.Chapter) error {
+	existing, err := s.chapterRepo.GetByMangaAndNumber(ctx, chapter.MangaID, chapter.ChapterNumber)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		id, err := s.chapterRepo.Insert(ctx, chapter)
+		if err != nil {
+			return err
+		}
+		chapter.ID = id
+		return nil
+	}
+
+	chapter.ID = existing.ID
+	chapter.StatusRead = existing.StatusRead
+	if chapter.ChapterTitle == "" {
+		chapter.ChapterTitle = existing.ChapterTitle
+	}
+	if chapter.Volume == 0 {
+		chapter.Volume = existing.Volume
+	}
+	if chapter.TranslatorGroup == "" {
+		chapter.TranslatorGroup = existing.TranslatorGroup
+	}
+	if chapter.Language == "" {
+		chapter.Language = existing.Language
+	}
+	if chapter.ReleaseTimeTS == 0 {
+		chapter.ReleaseTimeTS = existing.ReleaseTimeTS
+		chapter.ReleaseTimeRaw = existing.ReleaseTimeRaw
+	}
+	return s.chapterRepo.Update(ctx, chapter)
+}
+
+func countImages(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() && isImageFile(e.Name()) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// =====================
+// Download Queue
+// =====================
+
+// QueueChapter adds a chapter download job to the persistent queue and returns its ID.
+// Progress is emitted as "downloadProgress" and status changes as "downloadJobUpdate".
+func (s *DownloadService) QueueChapter(ctx context.Context, title string, mangaID int64, urls []string, outputDir string, options *DownloadOptions) (int64, error) {
+	optionsJSON := "{}"
+	if options != nil {
+		b, err := json.Marshal(options)
+		if err != nil {
+			return 0, err
+		}
+		optionsJSON = string(b)
+	}
+
+	return s.queue.Enqueue(ctx, models.DownloadJob{
+		MangaID:     mangaID,
+		Title:       title,
+		OutputDir:   outputDir,
+		OptionsJSON: optionsJSON,
+	}, urls)
+}
+
+// ListDownloadJobs returns every job in queue order
+func (s *DownloadService) ListDownloadJobs(ctx context.Context) ([]models.DownloadJob, error) {
+	return s.queue.Jobs(ctx)
+}
+
+// PauseDownloadJob pauses a queued or running job
+func (s *DownloadService) PauseDownloadJob(ctx context.Context, jobID int64) error {
+	return s.queue.Pause(ctx, jobID)
+}
+
+// ResumeDownloadJob re-queues a paused, failed or cancelled job
+func (s *DownloadService) ResumeDownloadJob(ctx context.Context, jobID int64) error {
+	return s.queue.Resume(ctx, jobID)
+}
+
+// CancelDownloadJob cancels a job
+func (s *DownloadService) CancelDownloadJob(ctx context.Context, jobID int64) error {
+	return s.queue.Cancel(ctx, jobID)
+}
+
+// ReorderDownloadJobs sets the queue order from the given job IDs
+func (s *DownloadService) ReorderDownloadJobs(ctx context.Context, jobIDs []int64) error {
+	return s.queue.Reorder(ctx, jobIDs)
+}
+
+// RemoveDownloadJob deletes a job that is not running from the queue
+func (s *DownloadService) RemoveDownloadJob(ctx context.Context, jobID int64) error {
+	return s.queue.Remove(ctx, jobID)
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mangav5/internal/downloader"
+	"mangav5/internal/models"
+	"mangav5/internal/proxy"
+	"mangav5/internal/repo"
+)
+
+// imageServer serves a PNG on every path and records the headers of the
+// requests it gets
+type imageServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func newImageServer(t *testing.T) *imageServer {
+	t.Helper()
+	var img bytes.Buffer
+	png.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 4)))
+
+	is := &imageServer{}
+	is.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.mu.Lock()
+		is.requests = append(is.requests, r)
+		is.mu.Unlock()
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	t.Cleanup(is.Close)
+	return is
+}
+
+func (is *imageServer) last(t *testing.T) *http.Request {
+	t.Helper()
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if len(is.requests) == 0 {
+		t.Fatal("no image request reached the server")
+	}
+	return is.requests[len(is.requests)-1]
+}
+
+// newTestDownloads returns a download service whose site "site" has a chapter
+// rule with entry headers, and the scraper it shares cookies with
+func newTestDownloads(t *testing.T, repos *repo.Repositories, siteProxy string) (*DownloadService, *ScraperService) {
+	t.Helper()
+	chapterRule, _ := json.Marshal(SiteRule{
+		Site:     "site",
+		Domains:  []string{"example.com"},
+		Strategy: "static",
+		Entry: &EntryRule{
+			URL:     "https://example.com/read/{id}",
+			Headers: map[string]string{"X-Token": "rule", "X-Page": "{id}"},
+		},
+	})
+	if _, err := repos.ScrapingRule.Insert(context.Background(), &models.ScrapingRule{
+		SiteKey:         "site",
+		Name:            "Site",
+		DomainsJSON:     `["example.com"]`,
+		ChapterRuleJSON: string(chapterRule),
+		Enabled:         1,
+		Proxy:           siteProxy,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	scraper := newSessionScraper(t, repos)
+	return NewDownloadService(repos, scraper), scraper
+}
+
+// download fetches urls the way DownloadImages and the queue do
+func download(t *testing.T, s *DownloadService, urls []string, options *DownloadOptions) *downloader.DownloadResult {
+	t.Helper()
+	ctx := context.Background()
+	cfg := buildDownloadConfig(t.TempDir(), options)
+	cfg.Limiter = s.limiter
+	s.applySiteProfile(ctx, &cfg, options)
+	pool, err := s.proxyPool(ctx, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Proxy = pool
+
+	result, err := downloader.DownloadImagesAdaptive(ctx, urls, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed > 0 {
+		t.Fatalf("download failed: %+v", result.Images)
+	}
+	return result
+}
+
+func TestImageRequestsCarrySiteProfile(t *testing.T) {
+	images := newImageServer(t)
+	s, scraper := newTestDownloads(t, newTestRepos(t), "")
+
+	// Cookies collected while scraping, e.g. a login or a clearance cookie
+	imagesURL, _ := url.Parse(images.URL)
+	scraper.jar.SetCookies(imagesURL, []*http.Cookie{{Name: "sid", Value: "s3cr3t"}})
+	scraper.sessionMu.Lock()
+	scraper.userAgents["example.com"] = "Solver/1.0"
+	scraper.sessionMu.Unlock()
+
+	tests := []struct {
+		name    string
+		options *DownloadOptions
+		want    map[string]string // header -> value, "" for unset
+	}{
+		{
+			name:    "no options",
+			options: nil,
+			want:    map[string]string{"User-Agent": DefaultUserAgent, "Referer": "", "X-Token": ""},
+		},
+		{
+			name:    "site without referer",
+			options: &DownloadOptions{SiteKey: "site"},
+			want: map[string]string{
+				"Referer":    "https://example.com/",
+				"User-Agent": "Solver/1.0",
+				"X-Token":    "rule",
+				"X-Page":     "",
+			},
+		},
+		{
+			name: "referer and custom headers",
+			options: &DownloadOptions{
+				SiteKey: "site",
+				Referer: "https://example.com/read/7",
+				Headers: map[string]string{"X-Token": "job", "X-Extra": "1"},
+			},
+			want: map[string]string{
+				"Referer":    "https://example.com/read/7",
+				"User-Agent": "Solver/1.0",
+				"X-Token":    "job",
+				"X-Extra":    "1",
+			},
+		},
+		{
+			name:    "referer of another site",
+			options: &DownloadOptions{Referer: "https://other.org/"},
+			want:    map[string]string{"Referer": "https://other.org/", "User-Agent": DefaultUserAgent},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			download(t, s, []string{images.URL + "/1.png"}, tt.options)
+			r := images.last(t)
+			for header, want := range tt.want {
+				if got := r.Header.Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			if c, err := r.Cookie("sid"); err != nil || c.Value != "s3cr3t" {
+				t.Errorf("scraper cookie not sent: %v", r.Header["Cookie"])
+			}
+		})
+	}
+}
+
+func TestDownloadImageCarriesSiteProfile(t *testing.T) {
+	images := newImageServer(t)
+	s, scraper := newTestDownloads(t, newTestRepos(t), "")
+	imagesURL, _ := url.Parse(images.URL)
+	scraper.jar.SetCookies(imagesURL, []*http.Cookie{{Name: "sid", Value: "s3cr3t"}})
+
+	options := &DownloadOptions{SiteKey: "site", Referer: "https://example.com/read/1", RetryCount: 1}
+	if err := s.DownloadImage(images.URL+"/cover.png", t.TempDir(), "cover", options); err != nil {
+		t.Fatal(err)
+	}
+	r := images.last(t)
+	if r.Header.Get("Referer") != "https://example.com/read/1" || r.Header.Get("X-Token") != "rule" {
+		t.Errorf("headers = %v", r.Header)
+	}
+	if c, err := r.Cookie("sid"); err != nil || c.Value != "s3cr3t" {
+		t.Errorf("scraper cookie not sent: %v", r.Header["Cookie"])
+	}
+}
+
+func TestImageRequestsUseSiteProxy(t *testing.T) {
+	// The proxy answers for every host; a request that bypasses it cannot
+	// resolve the image host
+	proxied := newImageServer(t)
+	repos := newTestRepos(t)
+	s, _ := newTestDownloads(t, repos, proxied.URL)
+
+	download(t, s, []string{"http://images.invalid/1.png"}, &DownloadOptions{SiteKey: "site"})
+	r := proxied.last(t)
+	if r.Host != "images.invalid" || r.Header.Get("Referer") != "https://example.com/" || r.Header.Get("X-Token") != "rule" {
+		t.Errorf("proxied request to %s with %v", r.Host, r.Header)
+	}
+}
+
+func TestDownloadProxyPool(t *testing.T) {
+	repos := newTestRepos(t)
+	ctx := context.Background()
+	if err := repos.Config.Set(ctx, proxy.ConfigKey, "http://global.test:8080"); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestDownloads(t, repos, "http://site.test:8080")
+
+	tests := []struct {
+		name    string
+		options *DownloadOptions
+		want    string // proxy URL, "" for none
+	}{
+		{"no options", nil, "http://global.test:8080"},
+		{"other site", &DownloadOptions{SiteKey: "unknown"}, "http://global.test:8080"},
+		{"site proxy", &DownloadOptions{SiteKey: "site"}, "http://site.test:8080"},
+		{"job proxy", &DownloadOptions{SiteKey: "site", Proxy: "http://job.test:8080"}, "http://job.test:8080"},
+		{"job direct", &DownloadOptions{SiteKey: "site", Proxy: proxy.Direct}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := s.proxyPool(ctx, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if pool != nil {
+				got = pool.Next().String()
+			}
+			if got != tt.want {
+				t.Errorf("proxy = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueuedJobWithBadOptionsFails(t *testing.T) {
+	repos := newTestRepos(t)
+	s, _ := newTestDownloads(t, repos, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.queue.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.queue.Enqueue(ctx, models.DownloadJob{OutputDir: t.TempDir(), OptionsJSON: `{"siteKey":`}, []string{"http://img.test/1.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := repos.DownloadJob.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == models.DownloadJobFailed {
+			if !strings.Contains(job.Error, "invalid stored download options") {
+				t.Errorf("error = %q", job.Error)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job status = %q, want failed", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
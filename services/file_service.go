@@ -2,6 +2,7 @@ package services
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"mime"
@@ -11,6 +12,7 @@ import (
 	"sort"
 	"strings"
 
+	"mangav5/internal/convert"
 	"mangav5/internal/zipper"
 
 	"github.com/wailsapp/wails/v3/pkg/application"
@@ -28,6 +30,33 @@ func NewFileService(dbService *DatabaseService) *FileService {
 	return &FileService{dbService: dbService}
 }
 
+// storedChapterPath returns the path stored in the chapters table for path:
+// relative to the manga directory with forward slashes like the directory
+// scanner writes it, or absolute when the chapter lives elsewhere
+func storedChapterPath(mangaDir, path string) string {
+	if mangaDir == "" {
+		return filepath.ToSlash(path)
+	}
+	rel, err := filepath.Rel(mangaDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// chapterFullPath resolves a path of the chapters table, see storedChapterPath
+func (s *FileService) chapterFullPath(stored string) (string, error) {
+	path := filepath.FromSlash(stored)
+	if filepath.IsAbs(path) {
+		return path, nil
+	}
+	mangaDir, err := s.GetMangaDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mangaDir, path), nil
+}
+
 func (s *FileService) GetMangaDir() (string, error) {
 	if MANGA_DIR == "" {
 		ctx := application.Get().Context()
@@ -192,6 +221,85 @@ func (s *FileService) ConvertToCbz(dirPath string) error {
 	return os.RemoveAll(dirPath)
 }
 
+// ConvertChapter re-encodes every page of a chapter to options.Format (webp, avif or jpeg).
+// It prioritizes: Directory > .cbz > .zip
+// relativePath: path relative to the manga directory (e.g. "MangaTitle/Chapter1")
+// Progress is emitted as "convertProgress", the report as "convertResult"
+// and a failure as "convertError".
+func (s *FileService) ConvertChapter(relativePath string, options *convert.Options) (*convert.Report, error) {
+	mangaDir, err := s.GetMangaDir()
+	if err != nil {
+		return nil, err
+	}
+	return s.convertChapterAt(filepath.Join(mangaDir, relativePath), relativePath, options)
+}
+
+// convertChapterAt converts the chapter at fullPath, a directory or the path of
+// a .cbz/.zip without its extension; name identifies it in errors
+func (s *FileService) convertChapterAt(fullPath, name string, options *convert.Options) (*convert.Report, error) {
+	target := ""
+	for _, p := range []string{fullPath, fullPath + ".cbz", fullPath + ".zip"} {
+		if _, err := os.Stat(p); err == nil {
+			target = p
+			break
+		}
+	}
+	if target == "" {
+		return nil, errors.New("target path not found (directory, .cbz, or .zip): " + name)
+	}
+
+	app := application.Get()
+	ctx := app.Context()
+
+	var opts convert.Options
+	if options != nil {
+		opts = *options
+	}
+	// Encoder locations can be set when the tools are not in PATH
+	if v, err := s.dbService.GetConfigValue(ctx, "cwebp_path"); err == nil {
+		opts.CWebPPath = v
+	}
+	if v, err := s.dbService.GetConfigValue(ctx, "avifenc_path"); err == nil {
+		opts.AvifEncPath = v
+	}
+
+	report, err := convert.ConvertChapter(ctx, target, opts, func(p convert.Progress) {
+		app.Event.Emit("convertProgress", p)
+	})
+	if report != nil {
+		app.Event.Emit("convertResult", report)
+	}
+	if err != nil {
+		app.Event.Emit("convertError", map[string]any{"path": name, "error": err.Error()})
+	}
+	return report, err
+}
+
+// ConvertChapterByID converts the chapter stored with chapterID, see ConvertChapter
+func (s *FileService) ConvertChapterByID(chapterID int64, options *convert.Options) (*convert.Report, error) {
+	app := application.Get()
+	chapter, err := s.dbService.GetChapter(app.Context(), chapterID)
+	if err == nil && chapter == nil {
+		err = fmt.Errorf("chapter %d not found", chapterID)
+	}
+	if err != nil {
+		app.Event.Emit("convertError", map[string]any{"chapterId": chapterID, "error": err.Error()})
+		return nil, err
+	}
+
+	// Downloaded chapters outside the manga directory are stored absolute
+	fullPath, err := s.chapterFullPath(chapter.Path)
+	if err != nil {
+		app.Event.Emit("convertError", map[string]any{"chapterId": chapterID, "error": err.Error()})
+		return nil, err
+	}
+	// The archive extension is added back while resolving the path
+	if ext := strings.ToLower(filepath.Ext(fullPath)); ext == ".cbz" || ext == ".zip" {
+		fullPath = strings.TrimSuffix(fullPath, filepath.Ext(fullPath))
+	}
+	return s.convertChapterAt(fullPath, chapter.Path, options)
+}
+
 // DeleteImages deletes specific image files from a directory or a cbz/zip archive.
 // It prioritizes: Directory > .cbz > .zip
 // relativePath: path relative to the manga directory (e.g. "MangaTitle/Chapter1")
@@ -289,7 +397,7 @@ func (s *FileService) GetImageList(relativePath string) ([]string, error) {
 func isImageFile(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
 	switch ext {
-	case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".bmp":
+	case ".jpg", ".jpeg", ".png", ".webp", ".gif", ".bmp", ".avif":
 		return true
 	}
 	return false
@@ -0,0 +1,348 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/tidwall/gjson"
+)
+
+// Pagination types
+const (
+	PageByNext   = "next"
+	PageByOffset = "offset"
+	PageByPage   = "page"
+	PageByCursor = "cursor"
+)
+
+const defaultMaxPages = 20
+
+// pageSource is what the pager reads the next page from
+type pageSource struct {
+	URL  string             // URL the page was fetched from
+	Doc  *goquery.Selection // parsed HTML, nil for JSON
+	Body string
+}
+
+// pager tracks the position of a paginated scrape
+type pager struct {
+	cfg   Pagination
+	pages int // pages fetched so far
+	value int // offset or page number
+	seen  map[string]bool
+}
+
+// typeOf returns the pagination type, guessing next and cursor pagination
+// from their properties. Offset and page pagination must be set explicitly,
+// "" means the rule does not paginate.
+func (p Pagination) typeOf() string {
+	switch {
+	case p.Type != "":
+		return strings.ToLower(p.Type)
+	case p.NextSelector != "" || p.NextPath != "":
+		return PageByNext
+	case p.CursorPath != "":
+		return PageByCursor
+	}
+	return ""
+}
+
+// param is the context key changed between pages
+func (p Pagination) param() string {
+	if p.Param != "" {
+		return p.Param
+	}
+	switch p.typeOf() {
+	case PageByPage:
+		return "page"
+	case PageByCursor:
+		return "cursor"
+	}
+	return "offset"
+}
+
+func (p Pagination) maxPages() int {
+	if p.MaxPages > 0 {
+		return p.MaxPages
+	}
+	return defaultMaxPages
+}
+
+// newPager seeds the pagination parameter of the first page in ctx
+func newPager(cfg Pagination, ctx map[string]interface{}) *pager {
+	p := &pager{cfg: cfg, seen: make(map[string]bool)}
+	param := cfg.param()
+
+	switch cfg.typeOf() {
+	case PageByOffset:
+		p.value, _ = strconv.Atoi(toString(ctx[param]))
+		ctx[param] = strconv.Itoa(p.value)
+	case PageByPage:
+		p.value = cfg.Start
+		if p.value == 0 {
+			p.value = 1
+		}
+		if n, err := strconv.Atoi(toString(ctx[param])); err == nil {
+			p.value = n
+		}
+		ctx[param] = strconv.Itoa(p.value)
+	case PageByCursor:
+		if _, ok := ctx[param]; !ok {
+			ctx[param] = ""
+		}
+	}
+	return p
+}
+
+// advance moves ctx to the page after src. It returns the URL of that page
+// for next links ("" otherwise) and false once there is no page to follow.
+// added is the number of list items src produced, -1 when the rule has no list.
+func (p *pager) advance(ctx map[string]interface{}, src pageSource, added int) (string, bool) {
+	p.pages++
+	p.seen[src.URL] = true
+
+	if p.pages >= p.cfg.maxPages() || added == 0 {
+		return "", false
+	}
+	if p.cfg.StopSelector != "" && src.Doc != nil && src.Doc.Find(p.cfg.StopSelector).Length() > 0 {
+		return "", false
+	}
+	if p.cfg.StopPath != "" && isTruthy(gjson.Get(src.Body, p.cfg.StopPath)) {
+		return "", false
+	}
+
+	param := p.cfg.param()
+	switch p.cfg.typeOf() {
+	case PageByNext:
+		next := p.nextLink(src)
+		if next == "" || p.seen[next] {
+			return "", false
+		}
+		return next, true
+
+	case PageByCursor:
+		cursor := strings.TrimSpace(gjson.Get(src.Body, p.cfg.CursorPath).String())
+		if cursor == "" || cursor == toString(ctx[param]) {
+			return "", false
+		}
+		ctx[param] = cursor
+
+	case PageByOffset:
+		inc := p.cfg.Increment
+		if inc <= 0 {
+			inc, _ = strconv.Atoi(toString(ctx["limit"]))
+		}
+		if inc <= 0 {
+			inc = added
+		}
+		if inc <= 0 {
+			return "", false
+		}
+		p.value += inc
+		if total := p.total(src); total > 0 && p.value >= total {
+			return "", false
+		}
+		ctx[param] = strconv.Itoa(p.value)
+
+	case PageByPage:
+		inc := p.cfg.Increment
+		if inc <= 0 {
+			inc = 1
+		}
+		p.value += inc
+		if total := p.total(src); total > 0 && p.value > total {
+			return "", false
+		}
+		ctx[param] = strconv.Itoa(p.value)
+
+	default:
+		return "", false
+	}
+	return "", true
+}
+
+// nextLink finds the absolute URL of the following page in src
+func (p *pager) nextLink(src pageSource) string {
+	var link string
+	switch {
+	case p.cfg.NextSelector != "" && src.Doc != nil:
+		el := src.Doc.Find(p.cfg.NextSelector).First()
+		attr := p.cfg.NextAttr
+		if attr == "" {
+			attr = "href"
+		}
+		link, _ = el.Attr(attr)
+	case p.cfg.NextPath != "":
+		link = gjson.Get(src.Body, p.cfg.NextPath).String()
+	}
+
+	link = strings.TrimSpace(link)
+	if link == "" || strings.HasPrefix(link, "#") || strings.HasPrefix(strings.ToLower(link), "javascript:") {
+		return ""
+	}
+	return resolveURL(src.URL, link)
+}
+
+func (p *pager) total(src pageSource) int {
+	if p.cfg.TotalPath == "" {
+		return 0
+	}
+	return int(gjson.Get(src.Body, p.cfg.TotalPath).Int())
+}
+
+// paginate fetches the first page and, when cfg is set, the pages after it
+// and merges their results. fetch receives the URL of a next link, or "" when
+// the page is addressed by the parameter the pager keeps in ctx.
+func paginate(cfg *Pagination, ctx map[string]interface{}, fetch func(nextURL string) (map[string]interface{}, pageSource, error)) (map[string]interface{}, error) {
+	if cfg == nil {
+		result, _, err := fetch("")
+		return result, err
+	}
+
+	pg := newPager(*cfg, ctx)
+	var merged map[string]interface{}
+	lists := make(map[string]bool)
+	next := ""
+	for {
+		result, src, err := fetch(next)
+		if err != nil {
+			if pg.pages > 0 {
+				return nil, fmt.Errorf("page %d: %w", pg.pages+1, err)
+			}
+			return nil, err
+		}
+
+		// A site ignoring the page parameter serves the same list again
+		if key := listKey(result); key != "" {
+			if lists[key] {
+				return merged, nil
+			}
+			lists[key] = true
+		}
+
+		var added int
+		merged, added = mergePage(merged, result)
+
+		more := false
+		if next, more = pg.advance(ctx, src, added); !more {
+			return merged, nil
+		}
+	}
+}
+
+// mergePage appends the list values of page to acc; other values only fill
+// what acc is missing. It returns the number of list items page added, -1
+// when page has no list value.
+func mergePage(acc, page map[string]interface{}) (map[string]interface{}, int) {
+	added := -1
+	count := func(n int) {
+		if added < 0 {
+			added = 0
+		}
+		added += n
+	}
+
+	if acc == nil {
+		acc = make(map[string]interface{}, len(page))
+	}
+	for k, v := range page {
+		switch val := v.(type) {
+		case []interface{}:
+			count(len(val))
+			if prev, ok := acc[k].([]interface{}); ok {
+				acc[k] = append(prev, val...)
+				continue
+			}
+		case []string:
+			count(len(val))
+			if prev, ok := acc[k].([]string); ok {
+				acc[k] = append(prev, val...)
+				continue
+			}
+		}
+		if isEmptyValue(acc[k]) {
+			acc[k] = v
+		}
+	}
+	return acc, added
+}
+
+// listKey identifies the list values of a page, "" when it has none
+func listKey(page map[string]interface{}) string {
+	lists := make(map[string]interface{})
+	for k, v := range page {
+		switch val := v.(type) {
+		case []interface{}:
+			if len(val) > 0 {
+				lists[k] = val
+			}
+		case []string:
+			if len(val) > 0 {
+				lists[k] = val
+			}
+		}
+	}
+	if len(lists) == 0 {
+		return ""
+	}
+	// Map keys are sorted, equal lists give equal keys
+	data, err := json.Marshal(lists)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// paginatedURL sets the pagination parameter of ctx in base, replacing a {param}
+// placeholder or the query parameter of the same name
+func paginatedURL(cfg *Pagination, base string, ctx map[string]interface{}) string {
+	if cfg == nil || cfg.typeOf() == PageByNext || cfg.typeOf() == "" {
+		return base
+	}
+
+	param := cfg.param()
+	value := toString(ctx[param])
+	if placeholder := "{" + param + "}"; strings.Contains(base, placeholder) {
+		return strings.ReplaceAll(base, placeholder, url.QueryEscape(value))
+	}
+	if value == "" {
+		return base
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return base
+	}
+	q := u.Query()
+	q.Set(param, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// isTruthy reports whether a JSON value means "yes"
+func isTruthy(r gjson.Result) bool {
+	switch r.Type {
+	case gjson.True:
+		return true
+	case gjson.Number:
+		return r.Num != 0
+	case gjson.String:
+		s := strings.ToLower(strings.TrimSpace(r.Str))
+		return s != "" && s != "false" && s != "0" && s != "no"
+	case gjson.JSON:
+		return r.IsObject() || len(r.Array()) > 0
+	}
+	return false
+}
+
+func copyContext(ctx map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(ctx)+2)
+	for k, v := range ctx {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func htmlSource(t *testing.T, pageURL, html string) pageSource {
+	t.Helper()
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(html))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pageSource{URL: pageURL, Doc: doc.Selection, Body: html}
+}
+
+func TestPagerAdvance(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Pagination
+		ctx     map[string]interface{}
+		src     pageSource
+		added   int
+		next    string
+		more    bool
+		param   string // context key checked after advancing
+		want    string
+		noParam bool // the context must not get a pagination parameter
+	}{
+		{
+			name:  "next link is resolved",
+			cfg:   Pagination{NextSelector: "a.next"},
+			src:   pageSource{URL: "https://example.com/list?p=1", Body: `<a class="next" href="?p=2">next</a>`},
+			added: -1, next: "https://example.com/list?p=2", more: true,
+		},
+		{
+			name:  "next link seen before stops",
+			cfg:   Pagination{NextSelector: "a.next"},
+			src:   pageSource{URL: "https://example.com/list", Body: `<a class="next" href="/list">next</a>`},
+			added: -1,
+		},
+		{
+			name:  "next path in json",
+			cfg:   Pagination{NextPath: "links.next"},
+			src:   pageSource{URL: "https://api.example.com/a", Body: `{"links":{"next":"/a?page=2"}}`},
+			added: -1, next: "https://api.example.com/a?page=2", more: true,
+		},
+		{
+			name:  "offset by limit",
+			cfg:   Pagination{Type: PageByOffset},
+			ctx:   map[string]interface{}{"limit": "50"},
+			src:   pageSource{Body: `{}`},
+			added: 50, more: true, param: "offset", want: "50",
+		},
+		{
+			name:  "offset by items without limit",
+			cfg:   Pagination{Type: PageByOffset, Param: "skip"},
+			src:   pageSource{Body: `{}`},
+			added: 30, more: true, param: "skip", want: "30",
+		},
+		{
+			name:  "offset reaches total",
+			cfg:   Pagination{Type: PageByOffset, TotalPath: "total"},
+			src:   pageSource{Body: `{"total":20}`},
+			added: 20, param: "offset", want: "0",
+		},
+		{
+			name:  "page number",
+			cfg:   Pagination{Type: PageByPage},
+			src:   pageSource{Body: `{"pages":3}`},
+			added: 10, more: true, param: "page", want: "2",
+		},
+		{
+			name:  "page past total pages",
+			cfg:   Pagination{Type: PageByPage, Start: 3, TotalPath: "pages"},
+			src:   pageSource{Body: `{"pages":3}`},
+			added: 10, param: "page", want: "3",
+		},
+		{
+			name:  "cursor",
+			cfg:   Pagination{CursorPath: "meta.cursor"},
+			src:   pageSource{Body: `{"meta":{"cursor":"abc"}}`},
+			added: 10, more: true, param: "cursor", want: "abc",
+		},
+		{
+			name:  "empty cursor stops",
+			cfg:   Pagination{CursorPath: "meta.cursor"},
+			src:   pageSource{Body: `{"meta":{"cursor":""}}`},
+			added: 10,
+		},
+		{
+			name:  "empty page stops",
+			cfg:   Pagination{Type: PageByPage},
+			src:   pageSource{Body: `{}`},
+			added: 0, param: "page", want: "1",
+		},
+		{
+			name:  "stop path",
+			cfg:   Pagination{Type: PageByPage, StopPath: "last"},
+			src:   pageSource{Body: `{"last":true}`},
+			added: 10, param: "page", want: "1",
+		},
+		{
+			name:  "max pages",
+			cfg:   Pagination{Type: PageByPage, MaxPages: 1},
+			src:   pageSource{Body: `{}`},
+			added: 10, param: "page", want: "1",
+		},
+		{
+			name:  "no type does not paginate",
+			cfg:   Pagination{MaxPages: 5},
+			src:   pageSource{Body: `{}`},
+			added: 10, param: "offset", noParam: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = map[string]interface{}{}
+			}
+			src := tt.src
+			if strings.HasPrefix(strings.TrimSpace(src.Body), "<") {
+				src = htmlSource(t, src.URL, src.Body)
+			}
+
+			p := newPager(tt.cfg, ctx)
+			next, more := p.advance(ctx, src, tt.added)
+			if next != tt.next || more != tt.more {
+				t.Errorf("advance() = %q, %v, want %q, %v", next, more, tt.next, tt.more)
+			}
+			if tt.param == "" {
+				return
+			}
+			if v, ok := ctx[tt.param]; tt.noParam {
+				if ok {
+					t.Errorf("ctx[%s] = %v, want unset", tt.param, v)
+				}
+			} else if got := toString(v); got != tt.want {
+				t.Errorf("ctx[%s] = %q, want %q", tt.param, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaginateStopsOnRepeatedList(t *testing.T) {
+	cfg := &Pagination{Type: PageByOffset}
+	fetches := 0
+	result, err := paginate(cfg, map[string]interface{}{}, func(string) (map[string]interface{}, pageSource, error) {
+		fetches++
+		// The site ignores the offset and serves the first page again
+		return map[string]interface{}{
+			"title":    "Manga",
+			"chapters": []interface{}{"ch 2", "ch 1"},
+		}, pageSource{Body: `{}`}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches != 2 {
+		t.Errorf("fetched %d pages, want 2", fetches)
+	}
+	if chapters := result["chapters"].([]interface{}); len(chapters) != 2 {
+		t.Errorf("chapters = %v, want the first page only", chapters)
+	}
+}
+
+func TestPaginatedURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Pagination
+		base string
+		ctx  map[string]interface{}
+		want string
+	}{
+		{"placeholder", &Pagination{Type: PageByPage}, "https://a.com/list/{page}", map[string]interface{}{"page": "2"}, "https://a.com/list/2"},
+		{"query parameter", &Pagination{Type: PageByOffset, Param: "skip"}, "https://a.com/list?sort=new", map[string]interface{}{"skip": "40"}, "https://a.com/list?skip=40&sort=new"},
+		{"next keeps the url", &Pagination{NextSelector: "a.next"}, "https://a.com/list", map[string]interface{}{"offset": "40"}, "https://a.com/list"},
+		{"no type keeps the url", &Pagination{}, "https://a.com/list", map[string]interface{}{"offset": "0"}, "https://a.com/list"},
+		{"no pagination", nil, "https://a.com/list", nil, "https://a.com/list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := paginatedURL(tt.cfg, tt.base, tt.ctx); got != tt.want {
+				t.Errorf("paginatedURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScrapeAPIPagination(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page, _ = strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/list/"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if page > 3 {
+			w.Write([]byte(`{"data":[]}`))
+			return
+		}
+		fmt.Fprintf(w, `{"data":[{"id":"%da"},{"id":"%db"}]}`, page, page)
+	}))
+	defer srv.Close()
+
+	rule := func(stepURL string) SiteRule {
+		return SiteRule{
+			Site:     "test",
+			Strategy: "api",
+			API: &APIWorkflow{Steps: []APIStep{{
+				ID:         "list",
+				Request:    APIRequest{URL: stepURL},
+				Pagination: &Pagination{Type: PageByPage},
+			}}},
+			Extract: []FieldRule{{Name: "ids", Type: "json", From: "list", Path: "data.#.id", Multiple: true}},
+		}
+	}
+
+	want := []string{"1a", "1b", "2a", "2b", "3a", "3b"}
+	tests := []struct {
+		name    string
+		stepURL string
+	}{
+		{"placeholder", srv.URL + "/list/{page}"},
+		{"query parameter", srv.URL + "/list?sort=new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			got, err := s.Scrape(rule(tt.stepURL), srv.URL, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := toStrings(got["ids"]); !reflect.DeepEqual(ids, want) {
+				t.Errorf("ids = %v, want %v", ids, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"mangav5/internal/models"
+)
+
+// Rule kinds picked by the resolver
+const (
+	RuleKindManga   = "manga"
+	RuleKindChapter = "chapter"
+)
+
+// ResolvedRule is the scraping rule matching a pasted URL
+type ResolvedRule struct {
+	SiteKey string `json:"site_key"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`   // manga or chapter
+	Domain  string `json:"domain"` // rule domain that matched the URL host
+}
+
+// ScrapeURLResult holds the typed result of ScrapeURL; only the field of Rule.Kind is set
+type ScrapeURLResult struct {
+	Rule    ResolvedRule  `json:"rule"`
+	Manga   *MangaInfo    `json:"manga,omitempty"`
+	Chapter *ChapterPages `json:"chapter,omitempty"`
+}
+
+// Path fragments that usually only appear in chapter reader URLs
+var chapterPathHints = regexp.MustCompile(`(?i)(chapter|/ch[-_.]?\d|/c\d|/episode|/ep[-_.]?\d|/read/|/reader/|/viewer)`)
+
+// Placeholder such as {id} once the entry template went through regexp.QuoteMeta
+var quotedPlaceholder = regexp.MustCompile(`\\\{[^}]*\\\}`)
+
+// ResolveRule finds the enabled scraping rule whose domains match rawURL
+// and whether the URL points to a manga or a chapter page
+func (s *ScraperService) ResolveRule(ctx context.Context, rawURL string) (*ResolvedRule, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("%q is not a valid URL", rawURL)
+	}
+	host := strings.ToLower(u.Hostname())
+
+	rules, err := s.scrapingRuleRepo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *models.ScrapingRule
+	bestDomain, bestScore := "", 0
+	for i := range rules {
+		r := &rules[i]
+		if r.Enabled == 0 {
+			continue
+		}
+		for _, d := range ruleDomains(r) {
+			if score := matchDomain(host, d); score > bestScore {
+				best, bestDomain, bestScore = r, d, score
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no enabled scraping rule matches %s", host)
+	}
+
+	return &ResolvedRule{
+		SiteKey: best.SiteKey,
+		Name:    best.Name,
+		Kind:    guessRuleKind(best, rawURL),
+		Domain:  bestDomain,
+	}, nil
+}
+
+// ScrapeURL resolves the rule of rawURL and runs it, so a pasted URL is all the
+// frontend needs. Missing required fields are listed in the Missing field of
+// the manga or chapter result.
+func (s *ScraperService) ScrapeURL(ctx context.Context, rawURL string) (*ScrapeURLResult, error) {
+	resolved, err := s.ResolveRule(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ScrapeURLResult{Rule: *resolved}
+	if resolved.Kind == RuleKindChapter {
+		result.Chapter, err = s.ScrapeChapter(ctx, resolved.SiteKey, rawURL)
+	} else {
+		result.Manga, err = s.ScrapeManga(ctx, resolved.SiteKey, rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ruleDomains collects the domains of the rule row and of its manga and chapter rules
+func ruleDomains(r *models.ScrapingRule) []string {
+	var domains []string
+	_ = json.Unmarshal([]byte(r.DomainsJSON), &domains)
+
+	for _, raw := range []string{r.MangaRuleJSON, r.ChapterRuleJSON} {
+		var rule SiteRule
+		if err := json.Unmarshal([]byte(raw), &rule); err == nil {
+			domains = append(domains, rule.Domains...)
+		}
+	}
+	return domains
+}
+
+// matchDomain scores how well pattern matches host, 0 when it does not.
+// "example.com" matches the domain and its subdomains, "*.example.com" does
+// the same; an exact host match scores above any suffix match and longer
+// patterns above shorter ones.
+func matchDomain(host, pattern string) int {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if strings.Contains(pattern, "://") {
+		if u, err := url.Parse(pattern); err == nil {
+			pattern = strings.ToLower(u.Hostname())
+		}
+	}
+	pattern = strings.TrimSuffix(pattern, ".")
+	if pattern == "" {
+		return 0
+	}
+
+	wildcard := strings.HasPrefix(pattern, "*.")
+	pattern = strings.TrimPrefix(pattern, "*.")
+
+	switch {
+	case host == pattern && !wildcard:
+		return 1000 + len(pattern)
+	case host == pattern:
+		return 500 + len(pattern)
+	case strings.HasSuffix(host, "."+pattern):
+		return len(pattern)
+	}
+	return 0
+}
+
+// guessRuleKind decides between the manga and chapter rule of r for rawURL
+// by matching the URL against the entry of each rule, then by path hints
+func guessRuleKind(r *models.ScrapingRule, rawURL string) string {
+	mangaScore := entryMatchScore(r.MangaRuleJSON, rawURL)
+	chapterScore := entryMatchScore(r.ChapterRuleJSON, rawURL)
+
+	switch {
+	case chapterScore > mangaScore:
+		return RuleKindChapter
+	case mangaScore > chapterScore:
+		return RuleKindManga
+	case strings.TrimSpace(r.ChapterRuleJSON) == "":
+		return RuleKindManga
+	case strings.TrimSpace(r.MangaRuleJSON) == "":
+		return RuleKindChapter
+	}
+
+	u, err := url.Parse(rawURL)
+	if err == nil && chapterPathHints.MatchString(u.Path) {
+		return RuleKindChapter
+	}
+	return RuleKindManga
+}
+
+// entryMatchScore rates how well rawURL fits the entry of a rule:
+// 3 for the entry regex, 2 for the full URL template, 1 for the template
+// followed by extra path segments and 0 otherwise
+func entryMatchScore(ruleJSON string, rawURL string) int {
+	var rule SiteRule
+	if err := json.Unmarshal([]byte(ruleJSON), &rule); err != nil || rule.Entry == nil {
+		return 0
+	}
+
+	target := strings.SplitN(rawURL, "?", 2)[0]
+	target = strings.SplitN(target, "#", 2)[0]
+
+	if rule.Entry.Regex != "" {
+		if re, err := regexp.Compile(rule.Entry.Regex); err == nil && re.MatchString(target) {
+			return 3
+		}
+	}
+
+	tmpl := strings.TrimSuffix(rule.Entry.URL, "/")
+	if tmpl == "" || !strings.Contains(tmpl, "{") {
+		return 0
+	}
+
+	// http/https and a www. prefix do not change the page
+	target, tmpl = bareURL(target), bareURL(tmpl)
+
+	// Every placeholder matches one path segment
+	pattern := quotedPlaceholder.ReplaceAllString(regexp.QuoteMeta(tmpl), `[^/]+`)
+
+	if re, err := regexp.Compile("^" + pattern + "/?$"); err == nil && re.MatchString(target) {
+		return 2
+	}
+	if re, err := regexp.Compile("^" + pattern + "/.+$"); err == nil && re.MatchString(target) {
+		return 1
+	}
+	return 0
+}
+
+func bareURL(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+	return strings.TrimPrefix(u, "www.")
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"mangav5/internal/models"
+)
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		host    string
+		pattern string
+		want    int
+	}{
+		{"example.com", "example.com", 1011},
+		{"example.com", " Example.com. ", 1011},
+		{"example.com", "https://example.com/manga", 1011},
+		{"www.example.com", "example.com", 11},
+		{"example.com", "*.example.com", 511},
+		{"a.b.example.com", "*.example.com", 11},
+		{"notexample.com", "example.com", 0},
+		{"example.com", "www.example.com", 0},
+		{"example.com", "", 0},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(tt.host, tt.pattern); got != tt.want {
+			t.Errorf("matchDomain(%q, %q) = %d, want %d", tt.host, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestGuessRuleKind(t *testing.T) {
+	ruleJSON := func(entry *EntryRule) string {
+		b, _ := json.Marshal(SiteRule{Site: "test", Entry: entry})
+		return string(b)
+	}
+	manga := ruleJSON(&EntryRule{URL: "https://site.com/manga/{id}"})
+	chapter := ruleJSON(&EntryRule{URL: "https://site.com/manga/{id}/{chapter}"})
+	noEntry := ruleJSON(nil)
+
+	tests := []struct {
+		name    string
+		manga   string
+		chapter string
+		url     string
+		want    string
+	}{
+		{"manga template", manga, chapter, "https://site.com/manga/abc", RuleKindManga},
+		{"chapter template", manga, chapter, "https://site.com/manga/abc/12", RuleKindChapter},
+		{"scheme and www ignored", manga, chapter, "http://www.site.com/manga/abc/?sort=asc", RuleKindManga},
+		{
+			"chapter regex",
+			manga, ruleJSON(&EntryRule{Regex: `/read/(?P<id>\d+)`}),
+			"https://site.com/manga/abc/read/5", RuleKindChapter,
+		},
+		{"only a manga rule", manga, "", "https://site.com/chapter/1", RuleKindManga},
+		{"only a chapter rule", "", chapter, "https://site.com/title/1", RuleKindChapter},
+		{"chapter path hint", noEntry, noEntry, "https://site.com/title/abc/chapter-3", RuleKindChapter},
+		{"no hint", noEntry, noEntry, "https://site.com/title/abc", RuleKindManga},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &models.ScrapingRule{MangaRuleJSON: tt.manga, ChapterRuleJSON: tt.chapter}
+			if got := guessRuleKind(r, tt.url); got != tt.want {
+				t.Errorf("guessRuleKind(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,927 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/tidwall/gjson"
+)
+
+// Issue levels
+const (
+	IssueError   = "error"   // the rule cannot work as written
+	IssueWarning = "warning" // the rule may yield empty values
+)
+
+// RuleIssue is one problem found in a rule.
+// Path points at the offending property, e.g. "extract[2].children[0].regex".
+type RuleIssue struct {
+	Path    string `json:"path"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// RuleValidation is the result of ValidateRule
+type RuleValidation struct {
+	Valid  bool        `json:"valid"` // no error level issue
+	Issues []RuleIssue `json:"issues"`
+}
+
+// RuleFixture is saved content a rule is tested against, no request is made
+type RuleFixture struct {
+	URL   string            `json:"url"`   // page URL or ID the rule would be run with
+	Page  string            `json:"page"`  // HTML or JSON of the entry page
+	Steps map[string]string `json:"steps"` // response body per API step ID, capture ID or action store key
+}
+
+// FieldResult is the outcome of one top level extract field in TestRule
+type FieldResult struct {
+	Name        string      `json:"name"`
+	Value       interface{} `json:"value"`
+	Empty       bool        `json:"empty"`
+	Count       int         `json:"count"` // number of items for multiple fields
+	Diagnostics []string    `json:"diagnostics"`
+}
+
+// RuleTestResult is the result of TestRule
+type RuleTestResult struct {
+	Validation  *RuleValidation        `json:"validation"`
+	Fields      []FieldResult          `json:"fields"`
+	Result      map[string]interface{} `json:"result"`
+	Diagnostics []string               `json:"diagnostics"` // not tied to a field
+}
+
+var (
+	fieldNameRe   = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	placeholderRe = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+)
+
+// ValidateRule checks a rule without running it: required properties,
+// strategy, regexes, CSS selectors, templates and that every "from" names an API step
+func (s *ScraperService) ValidateRule(rule SiteRule) *RuleValidation {
+	v := &ruleValidator{}
+	v.validate(rule)
+
+	result := &RuleValidation{Valid: true, Issues: v.issues}
+	if result.Issues == nil {
+		result.Issues = []RuleIssue{}
+	}
+	for _, issue := range result.Issues {
+		if issue.Level == IssueError {
+			result.Valid = false
+			break
+		}
+	}
+	return result
+}
+
+type ruleValidator struct {
+	issues  []RuleIssue
+	stepIDs map[string]bool
+}
+
+func (v *ruleValidator) errorf(path, format string, args ...interface{}) {
+	v.issues = append(v.issues, RuleIssue{Path: path, Level: IssueError, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *ruleValidator) warnf(path, format string, args ...interface{}) {
+	v.issues = append(v.issues, RuleIssue{Path: path, Level: IssueWarning, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *ruleValidator) validate(rule SiteRule) {
+	if strings.TrimSpace(rule.Site) == "" {
+		v.errorf("site", "site is required")
+	}
+	if len(rule.Domains) == 0 {
+		v.errorf("domains", "at least one domain is required")
+	}
+	for i, d := range rule.Domains {
+		if strings.TrimSpace(d) == "" {
+			v.errorf(fmt.Sprintf("domains[%d]", i), "domain is empty")
+		}
+	}
+
+	switch rule.Strategy {
+	case "static", "browser", "auto":
+		if rule.Entry == nil || rule.Entry.URL == "" {
+			v.warnf("entry.url", "no entry url, the rule only works with a full URL as input")
+		}
+	case "api":
+		if rule.API == nil || len(rule.API.Steps) == 0 {
+			v.errorf("api.steps", "api strategy requires api steps")
+		}
+	case "":
+		v.errorf("strategy", "strategy is required")
+	default:
+		v.errorf("strategy", "unknown strategy %q, expected static, browser, api or auto", rule.Strategy)
+	}
+
+	// Keys available to step URL templates
+	known := map[string]bool{"id": true, "url": true, "offset": true, "limit": true}
+
+	if rule.Entry != nil {
+		v.checkMethod("entry.method", rule.Entry.Method)
+		if re := v.checkRegex("entry.regex", rule.Entry.Regex); re != nil {
+			for _, name := range re.SubexpNames() {
+				if name != "" {
+					known[name] = true
+				}
+			}
+		}
+		for _, m := range placeholderRe.FindAllStringSubmatch(rule.Entry.URL, -1) {
+			known[m[1]] = true
+		}
+	}
+
+	if rule.Pagination != nil {
+		known[rule.Pagination.param()] = true
+		v.checkPagination("pagination", *rule.Pagination)
+	}
+
+	v.stepIDs = make(map[string]bool)
+	if c := rule.Capture; c != nil {
+		if rule.Strategy == "static" || rule.Strategy == "api" {
+			v.warnf("capture", "capture only applies to the browser strategy")
+		}
+		v.checkRegex("capture.url_pattern", c.URLPattern)
+		for i, t := range c.Types {
+			if _, ok := captureTypes[t]; !ok {
+				v.errorf(fmt.Sprintf("capture.types[%d]", i), "unknown capture type %q, expected image, xhr or fetch", t)
+			}
+		}
+		if c.SaveImages && !slices.Contains(c.types(), "image") {
+			v.warnf("capture.save_images", "save_images has no effect without the image type")
+		}
+		// Steps and fields read the captures like a step
+		v.stepIDs[c.id()] = true
+		known[c.id()] = true
+	}
+	for i, a := range rule.Actions {
+		v.checkAction(fmt.Sprintf("actions[%d]", i), rule.Strategy, a, known)
+	}
+	if rule.Login != nil {
+		v.checkLogin("login", *rule.Login)
+	}
+	if rule.API != nil {
+		paged := false
+		for i, step := range rule.API.Steps {
+			path := fmt.Sprintf("api.steps[%d]", i)
+			if step.Pagination != nil {
+				switch {
+				case rule.Strategy != "api":
+					v.warnf(path+".pagination", "step pagination only applies to the api strategy")
+				case paged:
+					v.warnf(path+".pagination", "only the first paginated step is followed")
+				case rule.Pagination != nil:
+					v.warnf("pagination", "ignored, api.steps[%d] has its own pagination", i)
+				}
+				paged = true
+				known[step.Pagination.param()] = true
+				v.checkPagination(path+".pagination", *step.Pagination)
+			}
+			if step.ID == "" {
+				v.errorf(path+".id", "step id is required")
+			} else if v.stepIDs[step.ID] {
+				v.errorf(path+".id", "duplicate step id %q", step.ID)
+			}
+
+			if step.Request.URL == "" {
+				v.errorf(path+".request.url", "request url is required")
+			}
+			as := step.As
+			if as == "" {
+				as = "item"
+			}
+			if step.Foreach != "" {
+				v.checkFlow(path, step, as, known)
+			} else if step.When != "" {
+				v.checkCondition(path+".when", step.When, known)
+			}
+			if step.Foreach == "" && (step.As != "" || step.Collect != "" || step.Concurrency != 0) {
+				v.warnf(path, "as, collect and concurrency only apply to foreach steps")
+			}
+
+			// Keys the request of this step can use
+			stepKnown := known
+			if step.Foreach != "" {
+				stepKnown = map[string]bool{as: true, "index": true}
+				for k := range known {
+					stepKnown[k] = true
+				}
+			}
+
+			for _, m := range placeholderRe.FindAllStringSubmatch(step.Request.URL, -1) {
+				if !stepKnown[m[1]] {
+					v.warnf(path+".request.url", "placeholder {%s} is not an entry parameter or a previous step; it must come from the URL query", m[1])
+				}
+			}
+			v.checkMethod(path+".request.method", step.Request.Method)
+			v.checkRequestBody(path+".request", step.Request, stepKnown)
+			if step.Response != "" && step.Response != "json" && step.Response != "html" {
+				v.errorf(path+".response", "unknown response type %q, expected json or html", step.Response)
+			}
+
+			if step.ID != "" {
+				v.stepIDs[step.ID] = true
+				known[step.ID] = true
+			}
+		}
+	}
+
+	if len(rule.Extract) == 0 {
+		v.errorf("extract", "at least one extract field is required")
+	}
+	v.checkFields("extract", rule.Extract)
+
+	if rule.WaitConfig != nil {
+		if rule.Strategy == "static" || rule.Strategy == "api" {
+			v.warnf("wait_config", "wait_config only applies to the browser strategy")
+		}
+		if wc := rule.WaitConfig; wc.Timeout > 0 && wc.PollInterval >= wc.Timeout {
+			v.warnf("wait_config.poll_ms", "poll interval is not shorter than the timeout")
+		}
+		if rule.WaitConfig.Timeout < 0 {
+			v.errorf("wait_config.timeout_ms", "timeout cannot be negative")
+		}
+		if rule.WaitConfig.PollInterval < 0 {
+			v.errorf("wait_config.poll_ms", "poll interval cannot be negative")
+		}
+		for i, sel := range rule.WaitConfig.ContainerSelectors {
+			v.checkSelector(fmt.Sprintf("wait_config.container_selectors[%d]", i), sel)
+		}
+		for i, sel := range rule.WaitConfig.ContentSelectors {
+			v.checkSelector(fmt.Sprintf("wait_config.content_selectors[%d]", i), sel)
+		}
+	}
+
+	if rl := rule.RateLimit; rl != nil {
+		if rl.RequestsPerSecond < 0 || rl.Burst < 0 || rl.MinDelayMs < 0 {
+			v.errorf("rate_limit", "rate limit values cannot be negative")
+		}
+	}
+
+	if c := rule.Cache; c != nil {
+		if c.TTL < 0 {
+			v.errorf("cache.ttl_seconds", "ttl cannot be negative")
+		}
+		if rule.Strategy == "browser" {
+			v.warnf("cache", "browser pages are not cached, only api steps")
+		}
+		if rule.Login != nil && !c.Disabled {
+			v.warnf("cache", "rules with a login are never cached")
+		}
+		if c.Disabled && c.TTL > 0 {
+			v.warnf("cache.ttl_seconds", "ttl has no effect while the cache is disabled")
+		}
+	}
+}
+
+func (v *ruleValidator) checkFields(path string, fields []FieldRule) {
+	seen := make(map[string]bool)
+	for i, f := range fields {
+		fp := fmt.Sprintf("%s[%d]", path, i)
+
+		if !fieldNameRe.MatchString(f.Name) {
+			v.errorf(fp+".name", "invalid field name %q", f.Name)
+		} else if seen[f.Name] {
+			v.warnf(fp+".name", "duplicate field name %q, the last one wins", f.Name)
+		}
+		seen[f.Name] = true
+
+		// Fields without a type are extracted as CSS
+		fieldType := f.Type
+		if fieldType == "" {
+			fieldType = "css"
+		}
+
+		switch fieldType {
+		case "css":
+			v.checkSelector(fp+".selector", f.Selector)
+			if f.Filter != "" {
+				v.checkSelector(fp+".filter", f.Filter)
+			}
+		case "json":
+			if strings.TrimSpace(f.Path) == "" {
+				v.errorf(fp+".path", "json field requires a path")
+			} else {
+				v.checkJSONPath(fp+".path", f.Path)
+			}
+		case "template":
+			if f.Template == "" {
+				v.errorf(fp+".template", "template field requires a template")
+			} else {
+				v.checkTemplate(fp+".template", f)
+			}
+		case "text":
+			if f.Text == "" {
+				v.warnf(fp+".text", "text field has an empty value")
+			}
+		default:
+			v.errorf(fp+".type", "unknown type %q, expected css, json, template or text", f.Type)
+		}
+
+		if f.FilterMode != "" && f.FilterMode != "has" && f.FilterMode != "not" {
+			v.errorf(fp+".filter_mode", "unknown filter mode %q, expected has or not", f.FilterMode)
+		}
+		if f.FilterMode != "" && f.Filter == "" {
+			v.warnf(fp+".filter_mode", "filter_mode has no effect without filter")
+		}
+
+		v.checkRegex(fp+".regex", f.Regex)
+		if len(f.Transforms) > 0 && fieldType != "css" && fieldType != "json" {
+			v.warnf(fp+".transforms", "transforms only apply to css and json fields")
+		}
+		for j, t := range f.Transforms {
+			if err := t.Check(); err != nil {
+				v.errorf(fmt.Sprintf("%s.transforms[%d]", fp, j), "%v", err)
+			}
+		}
+
+		if f.From != "" && !v.stepIDs[f.From] {
+			v.errorf(fp+".from", "from %q does not match any api step id", f.From)
+		}
+
+		v.checkFields(fp+".children", f.Children)
+	}
+}
+
+func (v *ruleValidator) checkFlow(path string, step APIStep, as string, known map[string]bool) {
+	v.checkContextPath(path+".foreach", step.Foreach, known)
+	if step.When != "" {
+		// The condition may read the current item
+		itemKnown := map[string]bool{as: true, "index": true}
+		for k := range known {
+			itemKnown[k] = true
+		}
+		v.checkCondition(path+".when", step.When, itemKnown)
+	}
+
+	if !fieldNameRe.MatchString(as) {
+		v.errorf(path+".as", "invalid item name %q", as)
+	}
+	if step.Concurrency < 0 {
+		v.errorf(path+".concurrency", "concurrency cannot be negative")
+	} else if step.Concurrency > maxStepConcurrency {
+		v.warnf(path+".concurrency", "concurrency is capped at %d", maxStepConcurrency)
+	}
+	if step.Collect != "" {
+		if step.Response == "html" {
+			v.warnf(path+".collect", "collect only applies to json responses")
+		} else {
+			v.checkJSONPath(path+".collect", step.Collect)
+		}
+	}
+	if step.Pagination != nil {
+		v.warnf(path+".foreach", "foreach is ignored on a paginated step")
+	}
+}
+
+func (v *ruleValidator) checkCondition(path, expr string, known map[string]bool) {
+	p := conditionPath(expr)
+	if p == "" {
+		v.errorf(path, "condition has no context path")
+		return
+	}
+	v.checkContextPath(path, p, known)
+}
+
+// checkContextPath warns when the first segment of p is not a context key
+// that exists when the step runs
+func (v *ruleValidator) checkContextPath(path, p string, known map[string]bool) {
+	key, rest, _ := strings.Cut(p, ".")
+	if !known[key] && !known[p] {
+		v.warnf(path, "%q is not an entry parameter or a previous step", key)
+	}
+	if rest != "" {
+		v.checkJSONPath(path, rest)
+	}
+}
+
+func (v *ruleValidator) checkRequestBody(path string, r APIRequest, known map[string]bool) {
+	bodies := 0
+	for _, set := range []bool{r.Body != nil, len(r.Form) > 0, r.Query != ""} {
+		if set {
+			bodies++
+		}
+	}
+	if bodies > 1 {
+		v.errorf(path, "set only one of body, form and query")
+	}
+	if bodies > 0 && strings.EqualFold(r.Method, "GET") {
+		v.warnf(path+".method", "the body is not sent with GET")
+	}
+
+	if r.Query != "" && !strings.Contains(r.Query, "{") {
+		v.errorf(path+".query", "query does not look like a GraphQL document")
+	}
+	if r.Query == "" && (len(r.Variables) > 0 || r.OperationName != "") {
+		v.warnf(path+".variables", "variables and operation_name only apply with a GraphQL query")
+	}
+
+	switch body := r.Body.(type) {
+	case nil, string, map[string]interface{}, []interface{}:
+	default:
+		v.errorf(path+".body", "body must be an object, an array or a string, not %T", body)
+	}
+
+	v.checkBodyValue(path+".body", r.Body, known)
+	for _, k := range sortedKeys(r.Form) {
+		v.checkBodyValue(path+".form."+k, r.Form[k], known)
+	}
+	v.checkBodyValue(path+".variables", map[string]interface{}(r.Variables), known)
+}
+
+// checkBodyValue warns about placeholders in a request body that name no context key
+func (v *ruleValidator) checkBodyValue(path string, val interface{}, known map[string]bool) {
+	switch b := val.(type) {
+	case string:
+		if m := bodyPlaceholderRe.FindStringSubmatch(strings.TrimSpace(b)); m != nil {
+			v.checkContextPath(path, m[1], known)
+			return
+		}
+		for _, m := range placeholderRe.FindAllStringSubmatch(b, -1) {
+			if !known[m[1]] {
+				v.warnf(path, "placeholder {%s} is not an entry parameter or a previous step", m[1])
+			}
+		}
+	case map[string]interface{}:
+		for _, k := range sortedKeys(b) {
+			v.checkBodyValue(path+"."+k, b[k], known)
+		}
+	case []interface{}:
+		for i, item := range b {
+			v.checkBodyValue(fmt.Sprintf("%s[%d]", path, i), item, known)
+		}
+	}
+}
+
+func (v *ruleValidator) checkAction(path, strategy string, a BrowserAction, known map[string]bool) {
+	if strategy == "static" || strategy == "api" {
+		v.warnf(path, "actions only apply to the browser strategy")
+	}
+	switch a.Type {
+	case ActionClick, ActionType, ActionWaitFor:
+		if a.Selector == "" {
+			v.errorf(path+".selector", "%s requires a selector", a.Type)
+		}
+		v.checkSelector(path+".selector", a.Selector)
+	case ActionScroll:
+		v.checkSelector(path+".selector", a.Selector)
+	case ActionEval:
+		if strings.TrimSpace(a.Script) == "" {
+			v.errorf(path+".script", "eval requires a script")
+		}
+	case "":
+		v.errorf(path+".type", "action type is required")
+	default:
+		v.errorf(path+".type", "unknown action type %q, expected click, scroll, type, wait_for or eval", a.Type)
+	}
+
+	if a.Type == ActionType && a.Text == "" && !a.Submit {
+		v.warnf(path+".text", "type action without text")
+	}
+	if a.Store != "" {
+		if a.Type != ActionEval {
+			v.warnf(path+".store", "store only applies to eval actions")
+		} else {
+			if v.stepIDs[a.Store] {
+				v.errorf(path+".store", "duplicate step id %q", a.Store)
+			}
+			// Stored results read like a step
+			v.stepIDs[a.Store] = true
+			known[a.Store] = true
+		}
+	}
+	if a.Timeout < 0 || a.Delay < 0 || a.ScrollDelay < 0 || a.MaxScrolls < 0 {
+		v.errorf(path, "timeout_ms, delay_ms, scroll_delay_ms and max_scrolls cannot be negative")
+	}
+	if a.Type != ActionScroll && (a.ScrollDelay != 0 || a.MaxScrolls != 0) {
+		v.warnf(path, "scroll_delay_ms and max_scrolls only apply to scroll actions")
+	}
+}
+
+func (v *ruleValidator) checkLogin(path string, l LoginFlow) {
+	if strings.TrimSpace(l.URL) == "" {
+		v.errorf(path+".url", "login requires a url")
+	} else if u, err := url.Parse(l.URL); err != nil || u.Host == "" {
+		v.errorf(path+".url", "login url must be absolute")
+	}
+	if l.LoggedOutSelector == "" && l.LoggedOutText == "" {
+		v.errorf(path, "login requires logged_out_selector or logged_out_text to know when to run")
+	}
+	v.checkSelector(path+".logged_out_selector", l.LoggedOutSelector)
+
+	switch {
+	case len(l.Form) == 0 && len(l.Actions) == 0:
+		v.errorf(path, "login requires form fields or actions")
+	case len(l.Form) > 0 && len(l.Actions) > 0:
+		v.warnf(path+".form", "form is ignored when the login has actions")
+	}
+	if len(l.Actions) > 0 && (l.Method != "" || len(l.Headers) > 0) {
+		v.warnf(path, "method and headers only apply to a form login")
+	}
+
+	// Login actions run in their own page, nothing they store is read
+	for i, a := range l.Actions {
+		p := fmt.Sprintf("%s.actions[%d]", path, i)
+		if a.Store != "" {
+			v.warnf(p+".store", "results of login actions are not stored")
+			a.Store = ""
+		}
+		v.checkAction(p, "browser", a, nil)
+	}
+}
+
+func (v *ruleValidator) checkPagination(path string, p Pagination) {
+	switch p.typeOf() {
+	case PageByNext:
+		if p.NextSelector == "" && p.NextPath == "" {
+			v.errorf(path, "next pagination requires next_selector or next_path")
+		}
+	case PageByCursor:
+		if p.CursorPath == "" {
+			v.errorf(path+".cursor_path", "cursor pagination requires cursor_path")
+		}
+	case PageByOffset, PageByPage:
+	case "":
+		v.errorf(path+".type", "pagination type is required, expected next, offset, page or cursor")
+	default:
+		v.errorf(path+".type", "unknown pagination type %q, expected next, offset, page or cursor", p.Type)
+	}
+
+	if p.MaxPages < 0 || p.Increment < 0 || p.Start < 0 {
+		v.errorf(path, "max_pages, increment and start cannot be negative")
+	}
+	if p.TotalPath != "" && p.typeOf() != PageByOffset && p.typeOf() != PageByPage {
+		v.warnf(path+".total_path", "total_path only applies to offset and page pagination")
+	}
+
+	v.checkSelector(path+".next_selector", p.NextSelector)
+	v.checkSelector(path+".stop_selector", p.StopSelector)
+	for _, jp := range [][2]string{
+		{"next_path", p.NextPath},
+		{"cursor_path", p.CursorPath},
+		{"total_path", p.TotalPath},
+		{"stop_path", p.StopPath},
+	} {
+		if jp[1] != "" {
+			v.checkJSONPath(path+"."+jp[0], jp[1])
+		}
+	}
+}
+
+func (v *ruleValidator) checkRegex(path, expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		v.errorf(path, "regex does not compile: %v", err)
+		return nil
+	}
+	return re
+}
+
+func (v *ruleValidator) checkSelector(path, sel string) {
+	if strings.TrimSpace(sel) == "" {
+		return
+	}
+	if _, err := cascadia.Compile(sel); err != nil {
+		v.errorf(path, "css selector does not compile: %v", err)
+	}
+}
+
+func (v *ruleValidator) checkMethod(path, method string) {
+	switch strings.ToUpper(method) {
+	case "", "GET", "POST":
+	default:
+		v.errorf(path, "unsupported method %q, expected GET or POST", method)
+	}
+}
+
+// checkJSONPath catches unbalanced brackets and quotes; gjson itself never
+// reports a bad path, it just finds nothing
+func (v *ruleValidator) checkJSONPath(path, p string) {
+	p = strings.ReplaceAll(p, "'", "\"")
+	depth := map[rune]int{}
+	inQuote := false
+	for i, r := range p {
+		if r == '"' && (i == 0 || p[i-1] != '\\') {
+			inQuote = !inQuote
+			continue
+		}
+		if inQuote {
+			continue
+		}
+		switch r {
+		case '(', '[', '{':
+			depth[r]++
+		case ')':
+			depth['(']--
+		case ']':
+			depth['[']--
+		case '}':
+			depth['{']--
+		}
+	}
+	if inQuote {
+		v.errorf(path, "json path has an unterminated quote")
+	}
+	for open, d := range depth {
+		if d != 0 {
+			v.errorf(path, "json path has unbalanced %q", string(open))
+		}
+	}
+}
+
+func (v *ruleValidator) checkTemplate(path string, f FieldRule) {
+	if strings.Contains(f.Template, "{{") {
+		if _, err := template.New("tmpl").Parse(f.Template); err != nil {
+			v.errorf(path, "template does not parse: %v", err)
+		}
+		return
+	}
+	if len(f.Children) == 0 {
+		return
+	}
+
+	children := make(map[string]bool, len(f.Children))
+	for _, c := range f.Children {
+		children[c.Name] = true
+	}
+	for _, m := range placeholderRe.FindAllStringSubmatch(f.Template, -1) {
+		if !children[m[1]] {
+			v.warnf(path, "placeholder {%s} does not match any child field", m[1])
+		}
+	}
+}
+
+// TestRule runs rule against fixture without any request and reports the
+// value of every extract field together with hints for empty ones
+func (s *ScraperService) TestRule(rule SiteRule, fixture RuleFixture) (*RuleTestResult, error) {
+	result := &RuleTestResult{
+		Validation:  s.ValidateRule(rule),
+		Fields:      []FieldResult{},
+		Diagnostics: []string{},
+	}
+
+	targetURL, params := s.resolveEntry(rule, fixture.URL)
+
+	ctx := make(map[string]interface{})
+	for k, v := range params {
+		ctx[k] = v
+	}
+	ctx["url"] = targetURL
+	if _, ok := ctx["id"]; !ok {
+		ctx["id"] = targetURL
+	}
+	if rule.Strategy == "api" {
+		if _, ok := ctx["offset"]; !ok {
+			ctx["offset"] = "0"
+		}
+		if _, ok := ctx["limit"]; !ok {
+			ctx["limit"] = "100"
+		}
+	}
+
+	page := strings.TrimSpace(fixture.Page)
+	pageIsJSON := page != "" && json.Valid([]byte(page))
+	switch {
+	case page == "":
+		if rule.Strategy != "api" {
+			result.Diagnostics = append(result.Diagnostics, "no page fixture, fields without from will be empty")
+		}
+	case pageIsJSON:
+		ctx["__default_selection__"] = page
+	default:
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			return nil, err
+		}
+		ctx["__default_selection__"] = doc.Selection
+		if err := rule.Login.loggedOut(targetURL, doc.Selection, page); err != nil {
+			result.Diagnostics = append(result.Diagnostics, "the page fixture shows the logged out marker, scraping it would log in first")
+		}
+	}
+
+	// Fixtures of the capture ID and of action store keys stand for what the
+	// browser would record
+	var browserKeys []string
+	if rule.Capture != nil {
+		browserKeys = append(browserKeys, rule.Capture.id())
+	}
+	for _, a := range rule.Actions {
+		if a.Store != "" {
+			browserKeys = append(browserKeys, a.Store)
+		}
+	}
+	for _, key := range browserKeys {
+		if body, ok := fixture.Steps[key]; ok {
+			if json.Valid([]byte(body)) {
+				ctx[key] = gjson.Parse(body).Value()
+			} else {
+				ctx[key] = body
+			}
+			ctx[key+"_raw"] = body
+		}
+	}
+
+	if rule.API != nil {
+		for _, step := range rule.API.Steps {
+			body, ok := fixture.Steps[step.ID]
+			if !ok {
+				result.Diagnostics = append(result.Diagnostics, fmt.Sprintf("no fixture for step %q, fields reading from it will be empty", step.ID))
+				continue
+			}
+			if step.Response == "html" {
+				ctx[step.ID] = body
+			} else {
+				if !json.Valid([]byte(body)) {
+					result.Diagnostics = append(result.Diagnostics, fmt.Sprintf("fixture of step %q is not valid JSON", step.ID))
+				}
+				ctx[step.ID] = gjson.Parse(body).Value()
+			}
+			ctx[step.ID+"_raw"] = body
+		}
+	}
+
+	values, err := s.extractFromContext(ctx, rule.Extract)
+	if err != nil {
+		// Validation already lists the cause, nothing can be extracted
+		result.Diagnostics = append(result.Diagnostics, err.Error())
+		return result, nil
+	}
+	result.Result = values
+
+	for i, field := range rule.Extract {
+		val := values[field.Name]
+		fr := FieldResult{
+			Name:        field.Name,
+			Value:       val,
+			Diagnostics: []string{},
+		}
+		if arr, ok := val.([]interface{}); ok {
+			fr.Count = len(arr)
+		} else if arr, ok := val.([]string); ok {
+			fr.Count = len(arr)
+		}
+		fr.Empty = isEmptyValue(val)
+
+		// Issues found by the validator for this field or its children
+		prefix := fmt.Sprintf("extract[%d]", i)
+		for _, issue := range result.Validation.Issues {
+			if issue.Path == prefix || strings.HasPrefix(issue.Path, prefix+".") {
+				fr.Diagnostics = append(fr.Diagnostics, fmt.Sprintf("%s: %s (%s)", issue.Level, issue.Message, issue.Path))
+			}
+		}
+		if fr.Empty {
+			fr.Diagnostics = append(fr.Diagnostics, s.explainEmpty(ctx, field)...)
+		}
+
+		result.Fields = append(result.Fields, fr)
+	}
+
+	return result, nil
+}
+
+// explainEmpty looks for the usual reasons of an empty field
+func (s *ScraperService) explainEmpty(ctx map[string]interface{}, field FieldRule) []string {
+	source, ok := ctx["__default_selection__"]
+	if field.From != "" {
+		source, ok = ctx[field.From+"_raw"]
+		if !ok {
+			return []string{fmt.Sprintf("step %q produced no data", field.From)}
+		}
+	}
+	if !ok && field.Type != "template" && field.Type != "text" {
+		return []string{"no source to extract from"}
+	}
+
+	var hints []string
+	switch field.Type {
+	case "css":
+		var sel *goquery.Selection
+		switch src := source.(type) {
+		case *goquery.Selection:
+			sel = src
+		case string:
+			if doc, err := goquery.NewDocumentFromReader(strings.NewReader(src)); err == nil {
+				sel = doc.Selection
+			}
+		}
+		if sel == nil || field.Selector == "" {
+			break
+		}
+		if _, err := cascadia.Compile(field.Selector); err != nil {
+			break
+		}
+		n := sel.Find(field.Selector).Length()
+		if n == 0 {
+			hints = append(hints, fmt.Sprintf("selector %q matched no element", field.Selector))
+			break
+		}
+		if len(field.Attr) > 0 {
+			first := sel.Find(field.Selector).First()
+			found := false
+			for _, a := range field.Attr {
+				if _, exists := first.Attr(a); exists {
+					found = true
+					break
+				}
+			}
+			if !found {
+				hints = append(hints, fmt.Sprintf("selector matched %d elements but none of the attributes %v is set on the first one", n, field.Attr))
+			}
+		}
+		if field.Filter != "" {
+			hints = append(hints, fmt.Sprintf("filter %q (%s) may have removed every match", field.Filter, filterModeOf(field)))
+		}
+	case "json":
+		jsonStr := ""
+		switch src := source.(type) {
+		case string:
+			jsonStr = src
+		case *goquery.Selection:
+			jsonStr = src.Text()
+		default:
+			b, _ := json.Marshal(src)
+			jsonStr = string(b)
+		}
+		if field.Path != "" && !gjson.Get(jsonStr, strings.ReplaceAll(field.Path, "'", "\"")).Exists() {
+			hints = append(hints, fmt.Sprintf("json path %q found nothing", field.Path))
+		}
+	case "template":
+		var buf bytes.Buffer
+		for _, c := range field.Children {
+			if c.Multiple {
+				buf.WriteString(c.Name + " ")
+			}
+		}
+		if buf.Len() > 0 {
+			hints = append(hints, "multiple children produced no items: "+strings.TrimSpace(buf.String()))
+		}
+	}
+
+	if field.Regex != "" {
+		if _, err := regexp.Compile(field.Regex); err == nil {
+			hints = append(hints, fmt.Sprintf("regex %q may not match the extracted text", field.Regex))
+		}
+	}
+	if len(field.Transforms) > 0 {
+		raw := field
+		raw.Transforms = nil
+		if before, err := s.extractFromContext(ctx, []FieldRule{raw}); err == nil && !isEmptyValue(before[field.Name]) {
+			hints = append(hints, fmt.Sprintf("value %q became empty after transforms", toString(before[field.Name])))
+		}
+	}
+	if len(hints) == 0 {
+		hints = append(hints, "no value extracted")
+	}
+	return hints
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func filterModeOf(f FieldRule) string {
+	if f.FilterMode == "" {
+		return "has"
+	}
+	return f.FilterMode
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(val) == ""
+	case []interface{}:
+		return len(val) == 0
+	case []string:
+		return len(val) == 0
+	case map[string]interface{}:
+		for _, item := range val {
+			if !isEmptyValue(item) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateRule(t *testing.T) {
+	valid := func() SiteRule {
+		return SiteRule{
+			Site:     "test",
+			Domains:  []string{"example.com"},
+			Strategy: "static",
+			Entry:    &EntryRule{URL: "https://example.com/manga/{id}"},
+			Extract:  []FieldRule{{Name: "title", Type: "css", Selector: "h1"}},
+		}
+	}
+	with := func(change func(*SiteRule)) SiteRule {
+		r := valid()
+		change(&r)
+		return r
+	}
+	api := func(change func(*SiteRule)) SiteRule {
+		return with(func(r *SiteRule) {
+			r.Strategy = "api"
+			r.API = &APIWorkflow{Steps: []APIStep{{ID: "detail", Request: APIRequest{URL: "https://api.example.com/manga/{id}"}}}}
+			r.Extract = []FieldRule{{Name: "title", Type: "json", From: "detail", Path: "data.title"}}
+			change(r)
+		})
+	}
+
+	tests := []struct {
+		name  string
+		rule  SiteRule
+		valid bool
+		path  string // path of the expected issue, "" for none
+		level string
+	}{
+		{"valid", valid(), true, "", ""},
+		{"valid api", api(func(*SiteRule) {}), true, "", ""},
+		{"missing site", with(func(r *SiteRule) { r.Site = "" }), false, "site", IssueError},
+		{"no domains", with(func(r *SiteRule) { r.Domains = nil }), false, "domains", IssueError},
+		{"unknown strategy", with(func(r *SiteRule) { r.Strategy = "magic" }), false, "strategy", IssueError},
+		{"no entry url", with(func(r *SiteRule) { r.Entry = nil }), true, "entry.url", IssueWarning},
+		{"api without steps", with(func(r *SiteRule) { r.Strategy = "api" }), false, "api.steps", IssueError},
+		{"unsupported method", with(func(r *SiteRule) { r.Entry.Method = "PUT" }), false, "entry.method", IssueError},
+		{"bad entry regex", with(func(r *SiteRule) { r.Entry.Regex = "(" }), false, "entry.regex", IssueError},
+		{"no fields", with(func(r *SiteRule) { r.Extract = nil }), false, "extract", IssueError},
+		{"field without type is css", with(func(r *SiteRule) { r.Extract[0].Type = "" }), true, "", ""},
+		{"bad selector without type", with(func(r *SiteRule) { r.Extract[0].Type = ""; r.Extract[0].Selector = "h1[" }), false, "extract[0].selector", IssueError},
+		{"bad field name", with(func(r *SiteRule) { r.Extract[0].Name = "1title" }), false, "extract[0].name", IssueError},
+		{"bad selector", with(func(r *SiteRule) { r.Extract[0].Selector = "h1[" }), false, "extract[0].selector", IssueError},
+		{"bad field regex", with(func(r *SiteRule) { r.Extract[0].Regex = "[" }), false, "extract[0].regex", IssueError},
+		{
+			"bad child regex",
+			with(func(r *SiteRule) {
+				r.Extract[0].Children = []FieldRule{{Name: "n", Type: "css", Selector: "a", Regex: "("}}
+			}),
+			false, "extract[0].children[0].regex", IssueError,
+		},
+		{"json field without path", api(func(r *SiteRule) { r.Extract[0].Path = "" }), false, "extract[0].path", IssueError},
+		{"unknown from", api(func(r *SiteRule) { r.Extract[0].From = "list" }), false, "extract[0].from", IssueError},
+		{
+			"duplicate step id",
+			api(func(r *SiteRule) { r.API.Steps = append(r.API.Steps, r.API.Steps[0]) }),
+			false, "api.steps[1].id", IssueError,
+		},
+		{
+			"two request bodies",
+			api(func(r *SiteRule) {
+				r.API.Steps[0].Request.Body = map[string]interface{}{"id": "{id}"}
+				r.API.Steps[0].Request.Form = map[string]string{"id": "{id}"}
+			}),
+			false, "api.steps[0].request", IssueError,
+		},
+		{"pagination without type", with(func(r *SiteRule) { r.Pagination = &Pagination{MaxPages: 3} }), false, "pagination.type", IssueError},
+		{"negative cache ttl", with(func(r *SiteRule) { r.Cache = &CacheConfig{TTL: -1} }), false, "cache.ttl_seconds", IssueError},
+		{
+			"cache on a login rule",
+			with(func(r *SiteRule) {
+				r.Login = &LoginFlow{URL: "https://example.com/login", LoggedOutSelector: "a.login", Form: map[string]string{"user": "{username}"}}
+				r.Cache = &CacheConfig{TTL: 60}
+			}),
+			true, "cache", IssueWarning,
+		},
+	}
+
+	s := newTestScraper(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.ValidateRule(tt.rule)
+			if got.Valid != tt.valid {
+				t.Errorf("Valid = %v, want %v, issues: %+v", got.Valid, tt.valid, got.Issues)
+			}
+			if tt.path == "" {
+				if len(got.Issues) > 0 {
+					t.Errorf("issues = %+v, want none", got.Issues)
+				}
+				return
+			}
+			for _, issue := range got.Issues {
+				if issue.Path == tt.path && issue.Level == tt.level {
+					return
+				}
+			}
+			t.Errorf("issues = %+v, want a %s at %s", got.Issues, tt.level, tt.path)
+		})
+	}
+}
+
+func TestTestRule(t *testing.T) {
+	const page = `<html><body>
+		<h1>One Piece</h1>
+		<span class="status">Ongoing</span>
+		<span class="year"></span>
+		<ul class="chapters">
+			<li><a href="/c/2">Chapter 2</a></li>
+			<li><a href="/c/1">Chapter 1</a></li>
+		</ul>
+	</body></html>`
+	const detail = `{"data":{"title":"One Piece","tags":["action","pirates"],"cover":""}}`
+
+	static := func(fields ...FieldRule) SiteRule {
+		return SiteRule{Site: "test", Domains: []string{"example.com"}, Strategy: "static", Extract: fields}
+	}
+	api := func(fields ...FieldRule) SiteRule {
+		return SiteRule{
+			Site:     "test",
+			Domains:  []string{"example.com"},
+			Strategy: "api",
+			API:      &APIWorkflow{Steps: []APIStep{{ID: "detail", Request: APIRequest{URL: "https://api.example.com/manga/{id}"}}}},
+			Extract:  fields,
+		}
+	}
+
+	type want struct {
+		value interface{} // nil when the field is empty
+		hints []string    // diagnostics of the field
+	}
+	tests := []struct {
+		name    string
+		rule    SiteRule
+		fixture RuleFixture
+		want    map[string]want
+	}{
+		{
+			name: "html fields",
+			rule: static(
+				FieldRule{Name: "title", Type: "css", Selector: "h1"},
+				FieldRule{Name: "chapters", Type: "css", Selector: ".chapters a", Multiple: true},
+				FieldRule{Name: "number", Type: "css", Selector: ".chapters a", Regex: `Chapter (\d+)`},
+			),
+			fixture: RuleFixture{URL: "https://example.com/manga/1", Page: page},
+			want: map[string]want{
+				"title":    {value: "One Piece"},
+				"chapters": {value: []interface{}{"Chapter 2", "Chapter 1"}},
+				"number":   {value: "2"},
+			},
+		},
+		{
+			name: "missing selector",
+			rule: static(
+				FieldRule{Name: "title", Type: "css", Selector: "h1"},
+				FieldRule{Name: "author", Type: "css", Selector: ".author"},
+			),
+			fixture: RuleFixture{URL: "https://example.com/manga/1", Page: page},
+			want: map[string]want{
+				"title":  {value: "One Piece"},
+				"author": {hints: []string{`selector ".author" matched no element`}},
+			},
+		},
+		{
+			name: "regex matching nothing",
+			rule: static(
+				FieldRule{Name: "year", Type: "css", Selector: ".year", Regex: `(\d{4})`},
+				// A regex without a match keeps the text as is
+				FieldRule{Name: "status", Type: "css", Selector: ".status", Regex: `(\d{4})`},
+			),
+			fixture: RuleFixture{URL: "https://example.com/manga/1", Page: page},
+			want: map[string]want{
+				"year":   {hints: []string{`regex "(\\d{4})" may not match the extracted text`}},
+				"status": {value: "Ongoing"},
+			},
+		},
+		{
+			name:    "missing attribute",
+			rule:    static(FieldRule{Name: "cover", Type: "css", Selector: "h1", Attr: []string{"data-src", "src"}}),
+			fixture: RuleFixture{URL: "https://example.com/manga/1", Page: page},
+			want: map[string]want{
+				"cover": {hints: []string{"selector matched 1 elements but none of the attributes [data-src src] is set on the first one"}},
+			},
+		},
+		{
+			name: "json fields",
+			rule: api(
+				FieldRule{Name: "title", Type: "json", From: "detail", Path: "data.title"},
+				FieldRule{Name: "tags", Type: "json", From: "detail", Path: "data.tags", Multiple: true},
+			),
+			fixture: RuleFixture{URL: "1", Steps: map[string]string{"detail": detail}},
+			want: map[string]want{
+				"title": {value: "One Piece"},
+				"tags":  {value: []interface{}{"action", "pirates"}},
+			},
+		},
+		{
+			name: "json path finding nothing",
+			rule: api(
+				FieldRule{Name: "title", Type: "json", From: "detail", Path: "data.title"},
+				FieldRule{Name: "author", Type: "json", From: "detail", Path: "data.author.name"},
+			),
+			fixture: RuleFixture{URL: "1", Steps: map[string]string{"detail": detail}},
+			want: map[string]want{
+				"title":  {value: "One Piece"},
+				"author": {hints: []string{`json path "data.author.name" found nothing`}},
+			},
+		},
+		{
+			name:    "empty json value",
+			rule:    api(FieldRule{Name: "cover", Type: "json", From: "detail", Path: "data.cover"}),
+			fixture: RuleFixture{URL: "1", Steps: map[string]string{"detail": detail}},
+			want: map[string]want{
+				"cover": {hints: []string{"no value extracted"}},
+			},
+		},
+		{
+			name:    "step without fixture",
+			rule:    api(FieldRule{Name: "title", Type: "json", From: "detail", Path: "data.title"}),
+			fixture: RuleFixture{URL: "1"},
+			want: map[string]want{
+				"title": {hints: []string{`step "detail" produced no data`}},
+			},
+		},
+		{
+			name:    "json page",
+			rule:    static(FieldRule{Name: "title", Type: "json", Path: "data.title"}),
+			fixture: RuleFixture{URL: "https://example.com/manga/1", Page: detail},
+			want: map[string]want{
+				"title": {value: "One Piece"},
+			},
+		},
+	}
+
+	s := newTestScraper(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.TestRule(tt.rule, tt.fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Fields) != len(tt.rule.Extract) {
+				t.Fatalf("fields = %+v, want one per extract field", got.Fields)
+			}
+			for _, f := range got.Fields {
+				w, ok := tt.want[f.Name]
+				if !ok {
+					t.Fatalf("unexpected field %q", f.Name)
+				}
+				if f.Empty != (w.value == nil) {
+					t.Errorf("%s: empty = %v, value = %#v", f.Name, f.Empty, f.Value)
+				}
+				if w.value != nil && !reflect.DeepEqual(f.Value, w.value) {
+					t.Errorf("%s = %#v, want %#v", f.Name, f.Value, w.value)
+				}
+				if w.hints == nil {
+					w.hints = []string{}
+				}
+				if !reflect.DeepEqual(f.Diagnostics, w.hints) {
+					t.Errorf("%s diagnostics = %q, want %q", f.Name, f.Diagnostics, w.hints)
+				}
+			}
+		})
+	}
+}
+
+func TestTestRuleDiagnostics(t *testing.T) {
+	s := newTestScraper(t)
+	rule := SiteRule{
+		Site:     "test",
+		Domains:  []string{"example.com"},
+		Strategy: "api",
+		API:      &APIWorkflow{Steps: []APIStep{{ID: "detail", Request: APIRequest{URL: "https://api.example.com/{id}"}}}},
+		Extract:  []FieldRule{{Name: "title", Type: "json", From: "detail", Path: "title"}},
+	}
+
+	got, err := s.TestRule(rule, RuleFixture{URL: "1", Steps: map[string]string{"detail": "<html>"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`fixture of step "detail" is not valid JSON`}
+	if !reflect.DeepEqual(got.Diagnostics, want) {
+		t.Errorf("diagnostics = %q, want %q", got.Diagnostics, want)
+	}
+
+	got, err = s.TestRule(rule, RuleFixture{URL: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{`no fixture for step "detail", fields reading from it will be empty`}
+	if !reflect.DeepEqual(got.Diagnostics, want) {
+		t.Errorf("diagnostics = %q, want %q", got.Diagnostics, want)
+	}
+
+	rule.Strategy = "static"
+	rule.API = nil
+	rule.Extract = []FieldRule{{Name: "title", Type: "css", Selector: "h1"}}
+	got, err = s.TestRule(rule, RuleFixture{URL: "https://example.com/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"no page fixture, fields without from will be empty"}
+	if !reflect.DeepEqual(got.Diagnostics, want) {
+		t.Errorf("diagnostics = %q, want %q", got.Diagnostics, want)
+	}
+	if !got.Fields[0].Empty || !reflect.DeepEqual(got.Fields[0].Diagnostics, []string{"no source to extract from"}) {
+		t.Errorf("field = %+v", got.Fields[0])
+	}
+}
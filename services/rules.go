@@ -1,14 +1,28 @@
 package services
 
+import (
+	"regexp"
+
+	"mangav5/internal/transform"
+)
+
 // SiteRule defines the scraping rules for a specific site
 type SiteRule struct {
-	Site       string       `json:"site"`
-	Domains    []string     `json:"domains"`
-	Strategy   string       `json:"strategy"` // static, browser, api, auto
-	Entry      *EntryRule   `json:"entry,omitempty"`
-	API        *APIWorkflow `json:"api,omitempty"`
-	Extract    []FieldRule  `json:"extract"`
-	WaitConfig *WaitConfig  `json:"wait_config,omitempty"`
+	Site       string          `json:"site"`
+	Domains    []string        `json:"domains"`
+	Strategy   string          `json:"strategy"` // static, browser, api, auto
+	Entry      *EntryRule      `json:"entry,omitempty"`
+	API        *APIWorkflow    `json:"api,omitempty"`
+	Extract    []FieldRule     `json:"extract"`
+	WaitConfig *WaitConfig     `json:"wait_config,omitempty"`
+	RateLimit  *RateLimit      `json:"rate_limit,omitempty"`
+	Pagination *Pagination     `json:"pagination,omitempty"` // static/browser: follows the entry page, api: the last step
+	Capture    *Capture        `json:"capture,omitempty"`    // browser: record network responses
+	Actions    []BrowserAction `json:"actions,omitempty"`    // browser: run in order once the page is ready, before its HTML is read
+	Login      *LoginFlow      `json:"login,omitempty"`      // signs in again when a page shows the logged out marker
+	Cache      *CacheConfig    `json:"cache,omitempty"`      // static pages and API steps, responses are revalidated by default
+
+	Proxy string `json:"-"` // proxy setting of the scraping rule row, set when the rule is loaded
 }
 
 type EntryRule struct {
@@ -23,15 +37,33 @@ type APIWorkflow struct {
 }
 
 type APIStep struct {
-	ID       string      `json:"id"`
-	Request  APIRequest  `json:"request"`
-	Response string      `json:"response,omitempty"` // json, html. default json
+	ID         string      `json:"id"`
+	Request    APIRequest  `json:"request"`
+	Response   string      `json:"response,omitempty"` // json, html. default json
+	Pagination *Pagination `json:"pagination,omitempty"`
+
+	// Flow control
+	When        string `json:"when,omitempty"`        // condition on the context, e.g. "!details.title"; the step is skipped when false
+	Foreach     string `json:"foreach,omitempty"`     // context array the step is called for, e.g. "list.data.#.id"
+	As          string `json:"as,omitempty"`          // placeholder of the current item, default item
+	Collect     string `json:"collect,omitempty"`     // JSON path kept from every foreach response, arrays are flattened
+	Concurrency int    `json:"concurrency,omitempty"` // foreach requests in flight, default 4
 }
 
 type APIRequest struct {
 	URL     string            `json:"url"`
-	Method  string            `json:"method,omitempty"`
+	Method  string            `json:"method,omitempty"` // default GET, POST when a body is set
 	Headers map[string]string `json:"headers,omitempty"`
+
+	// Request body, at most one of them. Placeholders are rendered from the
+	// step context like the URL; a value that is only "{key}" keeps the type
+	// of the context value or converts it with "{key|int}", "|number",
+	// "|bool", "|json" or "|string".
+	Body          interface{}            `json:"body,omitempty"`           // JSON object or array, a string is sent as is
+	Form          map[string]string      `json:"form,omitempty"`           // form-encoded
+	Query         string                 `json:"query,omitempty"`          // GraphQL query, not rendered
+	Variables     map[string]interface{} `json:"variables,omitempty"`      // GraphQL variables
+	OperationName string                 `json:"operation_name,omitempty"` // GraphQL operation
 }
 
 type FieldRule struct {
@@ -45,6 +77,9 @@ type FieldRule struct {
 	Children []FieldRule `json:"children,omitempty"`
 	From     string      `json:"from,omitempty"`
 
+	// Applied in order after trim and regex, e.g. absolute, split, dedupe
+	Transforms []transform.Step `json:"transforms,omitempty"`
+
 	// CSS
 	Selector   string   `json:"selector,omitempty"`
 	Attr       []string `json:"attr,omitempty"`
@@ -59,6 +94,37 @@ type FieldRule struct {
 
 	// Text (Fixed Value)
 	Text string `json:"text,omitempty"`
+
+	// Set by prepareFields: page URL relative links are resolved against
+	// and the compiled Regex
+	baseURL string
+	re      *regexp.Regexp
+}
+
+// Pagination describes how to reach the following pages of a list.
+// Results of multiple fields are merged across pages, single fields keep
+// the first non-empty value.
+type Pagination struct {
+	Type string `json:"type,omitempty"` // next, offset, page, cursor. Next and cursor are guessed from their properties, without a type nothing is paginated
+
+	// next: link to the following page
+	NextSelector string `json:"next_selector,omitempty"` // CSS selector of the link in HTML pages
+	NextAttr     string `json:"next_attr,omitempty"`     // default href
+	NextPath     string `json:"next_path,omitempty"`     // JSON path of the URL in JSON responses
+
+	// offset, page, cursor: parameter changed between pages, used as {param}
+	// in the page or API step URL template or else set in its query string
+	Param      string `json:"param,omitempty"`       // default offset, page or cursor
+	Start      int    `json:"start,omitempty"`       // page: first page number, default 1
+	Increment  int    `json:"increment,omitempty"`   // offset: default {limit} or the items of the last page, page: default 1
+	CursorPath string `json:"cursor_path,omitempty"` // cursor: JSON path of the next cursor
+	TotalPath  string `json:"total_path,omitempty"`  // offset: total item count, page: total page count
+
+	// Stop conditions; an empty page, a missing link or cursor, a page seen
+	// before and a list repeating an earlier page always stop
+	StopPath     string `json:"stop_path,omitempty"`     // JSON path that is true on the last page
+	StopSelector string `json:"stop_selector,omitempty"` // CSS selector only present on the last page
+	MaxPages     int    `json:"max_pages,omitempty"`     // guard, default 20
 }
 
 type WaitConfig struct {
@@ -72,3 +138,61 @@ type WaitConfig struct {
 	SkipRenderStable   bool     `json:"skip_render_stable,omitempty"`
 	SkipNavigationWait bool     `json:"skip_navigation_wait,omitempty"`
 }
+
+// Capture records the responses a browser page receives while it renders.
+// They are exposed to extraction like an API step: {id} holds the list of
+// {url, type, mime, status, body, file} in arrival order and fields read it
+// with from: <id>, e.g. the json path `#(type=="image")#.url`.
+type Capture struct {
+	ID         string   `json:"id,omitempty"`          // default network
+	URLPattern string   `json:"url_pattern,omitempty"` // regular expression on the response URL, every URL when empty
+	Types      []string `json:"types,omitempty"`       // image, xhr, fetch. Default all of them
+	SaveImages bool     `json:"save_images,omitempty"` // keep image bytes on disk; file is a file:// URL the downloader copies
+}
+
+// BrowserAction is one interaction with a browser page, e.g. dismissing an
+// age gate or scrolling to load lazy images
+type BrowserAction struct {
+	Type        string `json:"type"`                      // click, scroll, type, wait_for, eval
+	Selector    string `json:"selector,omitempty"`        // click, type, wait_for: target element. scroll: scrolled element, the page when empty
+	Text        string `json:"text,omitempty"`            // type: text entered
+	Submit      bool   `json:"submit,omitempty"`          // type: press Enter afterwards
+	Script      string `json:"script,omitempty"`          // eval: JS expression or function, a promise is awaited
+	Store       string `json:"store,omitempty"`           // eval: context key of the result, readable with from like a step
+	Timeout     int    `json:"timeout_ms,omitempty"`      // default 10s; scroll: every scroll and its delay plus 10s
+	Delay       int    `json:"delay_ms,omitempty"`        // pause once the action is done
+	ScrollDelay int    `json:"scroll_delay_ms,omitempty"` // scroll: pause between scrolls, default 500ms
+	MaxScrolls  int    `json:"max_scrolls,omitempty"`     // scroll: guard, default 30
+	Optional    bool   `json:"optional,omitempty"`        // a failure is ignored, e.g. an age gate that is not always shown
+}
+
+// LoginFlow signs in to a site whose pages need an account. The session
+// cookies are saved per site, so it only runs when a scraped page shows the
+// logged out marker. {username} and {password} in Form values and action
+// texts are replaced by the credentials saved for the site.
+type LoginFlow struct {
+	URL               string            `json:"url"`                           // form: target of the POST; actions: page they run on
+	LoggedOutSelector string            `json:"logged_out_selector,omitempty"` // element only shown to guests, e.g. "a.login"
+	LoggedOutText     string            `json:"logged_out_text,omitempty"`     // text only shown to guests
+	Method            string            `json:"method,omitempty"`              // form: default POST
+	Headers           map[string]string `json:"headers,omitempty"`             // form: extra request headers
+	Form              map[string]string `json:"form,omitempty"`                // form fields, sent url-encoded
+	Actions           []BrowserAction   `json:"actions,omitempty"`             // browser login instead of a form
+}
+
+// RateLimit is the per-host request budget used when downloading images for a site
+type RateLimit struct {
+	RequestsPerSecond float64  `json:"requests_per_second,omitempty"`
+	Burst             int      `json:"burst,omitempty"`
+	MinDelayMs        int      `json:"min_delay_ms,omitempty"`
+	Hosts             []string `json:"hosts,omitempty"` // Extra hosts (e.g. image CDNs) sharing this budget
+}
+
+// CacheConfig controls the on-disk cache of static pages and API step
+// responses, keyed by method, URL and body. Without a TTL a response is
+// stored only when it has an ETag or Last-Modified and is revalidated on
+// every use; browser pages and rules with a login are never cached.
+type CacheConfig struct {
+	TTL      int  `json:"ttl_seconds,omitempty"` // responses younger than this are used without a request
+	Disabled bool `json:"disabled,omitempty"`
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"mangav5/internal/httpcache"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// cacheKey holds the response cache policy of the rule in a scrape context
+const cacheKey = "__cache__"
+
+// Cached responses not used for this long are removed when the cache opens
+const cachePruneAge = 7 * 24 * time.Hour
+
+// cachePolicy is how a scrape uses the response cache
+type cachePolicy struct {
+	ttl     time.Duration // responses younger than this are used without a request
+	refresh bool          // ignore stored responses, still store the new ones
+}
+
+// newCachePolicy returns the policy of rule, nil when its cache is disabled.
+// Without a TTL responses are stored only when they can be revalidated.
+// Rules with a login are never cached: the cache key has no session, so a
+// page seen while logged in would be served after logging out or to
+// another account.
+func newCachePolicy(rule SiteRule, refresh bool) *cachePolicy {
+	if rule.Login != nil {
+		return nil
+	}
+	p := &cachePolicy{refresh: refresh}
+	if c := rule.Cache; c != nil {
+		if c.Disabled {
+			return nil
+		}
+		p.ttl = time.Duration(c.TTL) * time.Second
+	}
+	return p
+}
+
+// responseCache opens the response cache on first use; nil when it cannot
+// be opened, scrapes then go to the network
+func (s *ScraperService) responseCache() *httpcache.Store {
+	s.cacheOnce.Do(func() {
+		store, err := httpcache.Open(s.cacheDir)
+		if err != nil {
+			return
+		}
+		s.cache = store
+		go store.Prune(cachePruneAge)
+	})
+	return s.cache
+}
+
+// ClearScrapeCache removes every cached scraper response
+func (s *ScraperService) ClearScrapeCache() error {
+	store := s.responseCache()
+	if store == nil {
+		return fmt.Errorf("response cache is not available")
+	}
+	return store.Clear()
+}
+
+// fetch executes req through the response cache of the scrape context.
+// check validates a response before it is stored, so challenge and logged
+// out pages are never cached.
+func (s *ScraperService) fetch(ctx map[string]interface{}, req *resty.Request, method, rawURL string, check func(*resty.Response) error) (*resty.Response, error) {
+	policy, _ := ctx[cacheKey].(*cachePolicy)
+	var store *httpcache.Store
+	if policy != nil {
+		store = s.responseCache()
+	}
+	if store == nil {
+		resp, err := req.Execute(method, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return resp, check(resp)
+	}
+
+	key := httpcache.Key(method, rawURL, requestBody(req))
+	entry, _ := store.Get(key) // an unreadable entry is a miss
+	if entry != nil && !policy.refresh {
+		if entry.Fresh(policy.ttl) {
+			resp := cachedResponse(req, method, rawURL, entry)
+			return resp, check(resp)
+		}
+		if method == http.MethodGet {
+			etag, lastModified := entry.Validators()
+			if etag != "" {
+				req.SetHeader("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.SetHeader("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := req.Execute(method, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotModified && entry != nil {
+		if entry.Header == nil {
+			entry.Header = http.Header{}
+		}
+		for _, h := range []string{"ETag", "Last-Modified"} {
+			if v := resp.Header().Get(h); v != "" {
+				entry.Header.Set(h, v)
+			}
+		}
+		entry.StoredAt = time.Now()
+		store.Put(key, entry)
+		resp = cachedResponse(req, method, rawURL, entry)
+		return resp, check(resp)
+	}
+	if err := check(resp); err != nil {
+		return resp, err
+	}
+
+	if resp.IsSuccess() {
+		entry = &httpcache.Entry{
+			Method:   method,
+			URL:      rawURL,
+			Status:   resp.StatusCode(),
+			Header:   resp.Header().Clone(),
+			Body:     resp.Body(),
+			StoredAt: time.Now(),
+		}
+		// Cookies belong to the session jar, not to the page
+		entry.Header.Del("Set-Cookie")
+		etag, lastModified := entry.Validators()
+		if policy.ttl > 0 || (method == http.MethodGet && (etag != "" || lastModified != "")) {
+			store.Put(key, entry)
+		}
+	}
+	return resp, nil
+}
+
+// requestBody returns the body req sends, part of its cache key
+func requestBody(req *resty.Request) []byte {
+	var body []byte
+	switch b := req.Body.(type) {
+	case nil:
+	case string:
+		body = []byte(b)
+	case []byte:
+		body = append([]byte(nil), b...)
+	default:
+		// Map keys are sorted, so equal bodies give equal keys
+		body, _ = json.Marshal(b)
+	}
+	if len(req.FormData) > 0 {
+		body = append(body, req.FormData.Encode()...)
+	}
+	return body
+}
+
+// cachedResponse builds the response of req from a cache entry
+func cachedResponse(req *resty.Request, method, rawURL string, e *httpcache.Entry) *resty.Response {
+	req.Method = strings.ToUpper(method)
+	req.URL = rawURL
+	resp := &resty.Response{
+		Request: req,
+		RawResponse: &http.Response{
+			Status:     fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+			StatusCode: e.Status,
+			Header:     e.Header.Clone(),
+		},
+	}
+	return resp.SetBody(e.Body)
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestFetchCache(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	tests := []struct {
+		name     string
+		cache    *CacheConfig
+		refresh  bool
+		method   string
+		bodies   [2]interface{} // request body of each fetch
+		serve    func(w http.ResponseWriter, r *http.Request, n int)
+		requests int    // requests the server gets
+		second   string // body of the second fetch
+		revalid  bool   // the second request is conditional
+	}{
+		{
+			name:  "fresh within ttl",
+			cache: &CacheConfig{TTL: 3600},
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 1, second: "v1",
+		},
+		{
+			name: "not modified by etag",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("ETag", `"abc"`)
+				if r.Header.Get("If-None-Match") == `"abc"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v1", revalid: true,
+		},
+		{
+			name: "not modified since",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("Last-Modified", lastModified)
+				if r.Header.Get("If-Modified-Since") == lastModified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v1", revalid: true,
+		},
+		{
+			name: "changed since revalidation",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2", revalid: true,
+		},
+		{
+			name: "no validators without ttl",
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2",
+		},
+		{
+			name:    "refresh skips the cache",
+			cache:   &CacheConfig{TTL: 3600},
+			refresh: true,
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2",
+		},
+		{
+			name:  "disabled",
+			cache: &CacheConfig{Disabled: true, TTL: 3600},
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2",
+		},
+		{
+			name:  "errors are not stored",
+			cache: &CacheConfig{TTL: 3600},
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				if n == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2",
+		},
+		{
+			name:   "same post body",
+			cache:  &CacheConfig{TTL: 3600},
+			method: http.MethodPost,
+			bodies: [2]interface{}{
+				map[string]interface{}{"id": 1, "page": 2},
+				map[string]interface{}{"page": 2, "id": 1},
+			},
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 1, second: "v1",
+		},
+		{
+			name:   "other post body",
+			cache:  &CacheConfig{TTL: 3600},
+			method: http.MethodPost,
+			bodies: [2]interface{}{`{"page":1}`, `{"page":2}`},
+			serve: func(w http.ResponseWriter, r *http.Request, n int) {
+				fmt.Fprintf(w, "v%d", n)
+			},
+			requests: 2, second: "v2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			revalid := false
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests == 2 {
+					revalid = r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+				}
+				tt.serve(w, r, requests)
+			}))
+			defer srv.Close()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			s := newTestScraper(t)
+			ctx := map[string]interface{}{}
+			if policy := newCachePolicy(SiteRule{Cache: tt.cache}, tt.refresh); policy != nil {
+				ctx[cacheKey] = policy
+			}
+
+			var body string
+			for i := range tt.bodies {
+				req := s.client.R()
+				if tt.bodies[i] != nil {
+					req.SetBody(tt.bodies[i])
+				}
+				resp, err := s.fetch(ctx, req, method, srv.URL+"/page", func(*resty.Response) error { return nil })
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = resp.String()
+			}
+
+			if requests != tt.requests {
+				t.Errorf("server got %d requests, want %d", requests, tt.requests)
+			}
+			if body != tt.second {
+				t.Errorf("second body = %q, want %q", body, tt.second)
+			}
+			if revalid != tt.revalid {
+				t.Errorf("conditional request = %v, want %v", revalid, tt.revalid)
+			}
+		})
+	}
+}
+
+func TestFetchCacheSkipsFailedCheck(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<title>Just a moment...</title>"))
+	}))
+	defer srv.Close()
+
+	s := newTestScraper(t)
+	ctx := map[string]interface{}{cacheKey: newCachePolicy(SiteRule{Cache: &CacheConfig{TTL: 3600}}, false)}
+	for i := 0; i < 2; i++ {
+		if _, err := s.fetch(ctx, s.client.R(), http.MethodGet, srv.URL, detectChallenge); err == nil {
+			t.Fatal("fetch() error = nil, want the challenge")
+		}
+	}
+	if requests != 2 {
+		t.Errorf("server got %d requests, want 2, a challenge page must not be cached", requests)
+	}
+}
+
+func TestNewCachePolicy(t *testing.T) {
+	login := &LoginFlow{URL: "https://example.com/login", LoggedOutSelector: "a.login"}
+	tests := []struct {
+		name    string
+		rule    SiteRule
+		wantTTL time.Duration
+		cached  bool
+	}{
+		{"default", SiteRule{}, 0, true},
+		{"ttl", SiteRule{Cache: &CacheConfig{TTL: 60}}, time.Minute, true},
+		{"disabled", SiteRule{Cache: &CacheConfig{TTL: 60, Disabled: true}}, 0, false},
+		{"login", SiteRule{Login: login}, 0, false},
+		{"login with ttl", SiteRule{Login: login, Cache: &CacheConfig{TTL: 60}}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newCachePolicy(tt.rule, true)
+			if (p != nil) != tt.cached {
+				t.Fatalf("newCachePolicy() = %+v, want cached = %v", p, tt.cached)
+			}
+			if p != nil && (p.ttl != tt.wantTTL || !p.refresh) {
+				t.Errorf("policy = %+v, want ttl %v", p, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestScrapeLoginRuleIsNotCached(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"same"`)
+		fmt.Fprintf(w, "<html><body><h1>Members only %d</h1></body></html>", requests)
+	}))
+	defer srv.Close()
+
+	rule := SiteRule{
+		Site:     "members",
+		Strategy: "static",
+		Login:    &LoginFlow{URL: srv.URL + "/login", LoggedOutSelector: "a.login"},
+		Cache:    &CacheConfig{TTL: 3600},
+		Extract:  []FieldRule{{Name: "title", Type: "css", Selector: "h1"}},
+	}
+	s := newTestScraper(t)
+	for i := 1; i <= 2; i++ {
+		res, err := s.Scrape(rule, srv.URL+"/manga/1", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("Members only %d", i); res["title"] != want {
+			t.Errorf("scrape %d = %v, want %q", i, res["title"], want)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("server got %d requests, want 2", requests)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	s := newTestScraper(t)
+	key := func(set func(*resty.Request)) string {
+		req := s.client.R()
+		set(req)
+		return string(requestBody(req))
+	}
+
+	tests := []struct {
+		name string
+		a, b func(*resty.Request)
+		same bool
+	}{
+		{
+			"string and bytes",
+			func(r *resty.Request) { r.SetBody(`{"id":1}`) },
+			func(r *resty.Request) { r.SetBody([]byte(`{"id":1}`)) },
+			true,
+		},
+		{
+			"map key order",
+			func(r *resty.Request) { r.SetBody(map[string]interface{}{"a": 1, "b": 2}) },
+			func(r *resty.Request) { r.SetBody(map[string]interface{}{"b": 2, "a": 1}) },
+			true,
+		},
+		{
+			"form values",
+			func(r *resty.Request) { r.SetFormData(map[string]string{"id": "1"}) },
+			func(r *resty.Request) { r.SetFormData(map[string]string{"id": "2"}) },
+			false,
+		},
+		{
+			"body and none",
+			func(r *resty.Request) { r.SetBody(`{}`) },
+			func(r *resty.Request) {},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := key(tt.a), key(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("requestBody() = %q and %q, want same %v", a, b, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mangav5/internal/downloader"
+	"mangav5/internal/transform"
+)
+
+// MangaInfo is the normalized result of a manga rule.
+// JSON names follow the field names used by the rule schema.
+type MangaInfo struct {
+	ID          string        `json:"id"`
+	URL         string        `json:"url"`
+	Title       string        `json:"title"`
+	AltTitles   []string      `json:"alt_titles"`
+	Cover       string        `json:"cover"`
+	Description string        `json:"description"`
+	Status      string        `json:"status"`     // ongoing, completed, hiatus, cancelled, unknown
+	StatusRaw   string        `json:"status_raw"` // as found on the site
+	Chapters    []ChapterInfo `json:"chapters"`
+	TotalPages  int           `json:"total_pages,omitempty"`
+
+	// Required fields the rule did not produce; the result is still returned
+	// without an error so the frontend can show what was found
+	Missing []string `json:"missing,omitempty"`
+}
+
+// ChapterInfo is one entry of MangaInfo.Chapters
+type ChapterInfo struct {
+	ChapterID     string  `json:"chapter_id"`
+	Chapter       string  `json:"chapter"`
+	ChapterNumber float64 `json:"chapter_number"` // parsed from Chapter, -1 when it has no number
+	ChapterTitle  string  `json:"chapter_title,omitempty"`
+	Volume        string  `json:"chapter_volume,omitempty"`
+	GroupName     string  `json:"group_name"`
+	Language      string  `json:"language"`
+	Time          string  `json:"time"`
+}
+
+// ChapterPages is the normalized result of a chapter rule
+type ChapterPages struct {
+	ChapterID string   `json:"chapter_id"`
+	URL       string   `json:"url"`
+	Pages     []string `json:"pages"` // absolute image URLs in reading order
+
+	// Required fields the rule did not produce; the result is still returned
+	// without an error so the frontend can show what was found
+	Missing []string `json:"missing,omitempty"`
+}
+
+// Accepted names of each field in rule output, first match wins
+var (
+	mangaTitleKeys       = []string{"title", "main_title", "name"}
+	mangaAltTitlesKeys   = []string{"alt_titles", "alternative_titles", "alt_title", "alternative_title"}
+	mangaCoverKeys       = []string{"cover", "cover_url", "thumbnail", "image"}
+	mangaDescriptionKeys = []string{"description", "synopsis", "summary"}
+	mangaStatusKeys      = []string{"status", "manga_status"}
+	mangaChaptersKeys    = []string{"chapters", "chapter_list"}
+
+	chapterIDKeys     = []string{"chapter_id", "id", "url", "link"}
+	chapterNumberKeys = []string{"chapter", "chapter_number", "number"}
+	chapterTitleKeys  = []string{"chapter_title", "title"}
+	chapterVolumeKeys = []string{"chapter_volume", "volume"}
+	chapterGroupKeys  = []string{"group_name", "group", "translator_group", "scanlator"}
+	chapterLangKeys   = []string{"language", "lang"}
+	chapterTimeKeys   = []string{"time", "release_time", "date", "updated_at"}
+
+	chapterPagesKeys = []string{"pages", "images"}
+)
+
+var chapterNumberRe = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// normalizeMangaInfo maps the output of a manga rule to MangaInfo.
+// pageURL resolves relative links.
+func normalizeMangaInfo(raw map[string]interface{}, pageURL string) *MangaInfo {
+	info := &MangaInfo{
+		ID:          toString(raw["id"]),
+		URL:         pageURL,
+		Title:       toString(pick(raw, mangaTitleKeys)),
+		AltTitles:   toStrings(pick(raw, mangaAltTitlesKeys)),
+		Cover:       resolveURL(pageURL, toString(pick(raw, mangaCoverKeys))),
+		Description: toString(pick(raw, mangaDescriptionKeys)),
+		StatusRaw:   toString(pick(raw, mangaStatusKeys)),
+		Chapters:    []ChapterInfo{},
+	}
+	info.Status = normalizeMangaStatus(info.StatusRaw)
+	if n, err := strconv.Atoi(toString(raw["total_pages"])); err == nil {
+		info.TotalPages = n
+	}
+
+	if items, ok := pick(raw, mangaChaptersKeys).([]interface{}); ok {
+		for _, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			c := ChapterInfo{
+				ChapterID:    toString(pick(m, chapterIDKeys)),
+				Chapter:      toString(pick(m, chapterNumberKeys)),
+				ChapterTitle: toString(pick(m, chapterTitleKeys)),
+				Volume:       toString(pick(m, chapterVolumeKeys)),
+				GroupName:    toString(pick(m, chapterGroupKeys)),
+				Language:     toString(pick(m, chapterLangKeys)),
+				Time:         toString(pick(m, chapterTimeKeys)),
+			}
+			c.ChapterNumber = parseScrapedNumber(c.Chapter)
+			if c.ChapterID == "" {
+				continue
+			}
+			info.Chapters = append(info.Chapters, c)
+		}
+	}
+
+	if info.Title == "" {
+		info.Missing = append(info.Missing, "title")
+	}
+	if len(info.Chapters) == 0 {
+		info.Missing = append(info.Missing, "chapters")
+	}
+	return info
+}
+
+// normalizeChapterPages maps the output of a chapter rule to ChapterPages
+func normalizeChapterPages(raw map[string]interface{}, chapterID string, pageURL string) *ChapterPages {
+	pages := &ChapterPages{
+		ChapterID: chapterID,
+		URL:       pageURL,
+		Pages:     []string{},
+	}
+
+	seen := make(map[string]bool)
+	for _, p := range toStrings(pick(raw, chapterPagesKeys)) {
+		p = resolveURL(pageURL, p)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		pages.Pages = append(pages.Pages, p)
+	}
+
+	if len(pages.Pages) == 0 {
+		pages.Missing = append(pages.Missing, "pages")
+	}
+	return pages
+}
+
+// pick returns the first non-empty value of keys in m
+func pick(m map[string]interface{}, keys []string) interface{} {
+	for _, k := range keys {
+		if v, ok := m[k]; ok && v != nil && toString(v) != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+// toString flattens a scraped value; lists yield their first non-empty item
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case json.Number:
+		return val.String()
+	case []string:
+		for _, s := range val {
+			if s = strings.TrimSpace(s); s != "" {
+				return s
+			}
+		}
+		return ""
+	case []interface{}:
+		for _, item := range val {
+			if s := toString(item); s != "" {
+				return s
+			}
+		}
+		return ""
+	case map[string]interface{}:
+		b, _ := json.Marshal(val)
+		return string(b)
+	default:
+		return strings.TrimSpace(fmt.Sprintf("%v", val))
+	}
+}
+
+// toStrings flattens a scraped value into a list without empty items
+func toStrings(v interface{}) []string {
+	var out []string
+	switch val := v.(type) {
+	case nil:
+	case []string:
+		for _, s := range val {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			out = append(out, toStrings(item)...)
+		}
+	default:
+		if s := toString(val); s != "" {
+			out = append(out, s)
+		}
+	}
+	if out == nil {
+		out = []string{}
+	}
+	return out
+}
+
+func normalizeMangaStatus(raw string) string {
+	s := strings.ToLower(raw)
+	switch {
+	case s == "":
+		return "unknown"
+	case strings.Contains(s, "hiatus"):
+		return "hiatus"
+	case strings.Contains(s, "cancel"), strings.Contains(s, "drop"), strings.Contains(s, "discontinued"):
+		return "cancelled"
+	case strings.Contains(s, "complete"), strings.Contains(s, "finished"), strings.Contains(s, "ended"):
+		return "completed"
+	case strings.Contains(s, "ongoing"), strings.Contains(s, "publishing"), strings.Contains(s, "releasing"):
+		return "ongoing"
+	}
+	return "unknown"
+}
+
+// parseScrapedNumber reads the first number of a chapter label like "Ch. 12.5", -1 without one
+func parseScrapedNumber(s string) float64 {
+	m := chapterNumberRe.FindString(s)
+	if m == "" {
+		return -1
+	}
+	n, err := strconv.ParseFloat(m, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// resolveURL makes ref absolute against base; non URL values are returned as
+// is. Local files are dropped unless they are images saved by a capture.
+func resolveURL(base, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if len(ref) >= len("file:") && strings.EqualFold(ref[:len("file:")], "file:") {
+		if downloader.IsCaptureURL(ref) {
+			return ref
+		}
+		return ""
+	}
+	return transform.Absolute(base, ref)
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mangav5/internal/downloader"
+)
+
+// captureFileURL writes a captured image and returns its file:// URL; the
+// capture directory is moved into a temp dir through the user cache dir
+func captureFileURL(t *testing.T) string {
+	t.Helper()
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+	dir := filepath.Join(downloader.CaptureDir(), "test")
+	if !strings.HasPrefix(dir, cache) {
+		t.Skip("the user cache dir does not follow XDG_CACHE_HOME here")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "page.img")
+	if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return downloader.FileURL(path)
+}
+
+func TestNormalizeMangaStatus(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"", "unknown"},
+		{"Ongoing", "ongoing"},
+		{"Publishing", "ongoing"},
+		{"RELEASING", "ongoing"},
+		{"Completed", "completed"},
+		{"Finished", "completed"},
+		{"Ended", "completed"},
+		{"On Hiatus", "hiatus"},
+		{"Cancelled", "cancelled"},
+		{"Dropped", "cancelled"},
+		{"Discontinued", "cancelled"},
+		{"Status: ongoing", "ongoing"},
+		{"Berjalan", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := normalizeMangaStatus(tt.raw); got != tt.want {
+			t.Errorf("normalizeMangaStatus(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeMangaInfo(t *testing.T) {
+	const pageURL = "https://example.com/manga/one-piece"
+
+	tests := []struct {
+		name string
+		raw  map[string]interface{}
+		want *MangaInfo
+	}{
+		{
+			name: "full result",
+			raw: map[string]interface{}{
+				"id":          "one-piece",
+				"title":       " One Piece ",
+				"alt_titles":  []interface{}{"ワンピース", "", "OP"},
+				"cover":       "/covers/1.jpg",
+				"synopsis":    "Pirates",
+				"status":      "Completed",
+				"total_pages": "3",
+				"chapters": []interface{}{
+					map[string]interface{}{"url": "/c/2", "chapter": "Chapter 2.5", "title": "Two", "group": "Scans", "lang": "en", "date": "2024-01-02"},
+					map[string]interface{}{"id": "c1", "number": "Prologue"},
+					map[string]interface{}{"chapter": "No ID"},
+					"not a chapter",
+				},
+			},
+			want: &MangaInfo{
+				ID:          "one-piece",
+				URL:         pageURL,
+				Title:       "One Piece",
+				AltTitles:   []string{"ワンピース", "OP"},
+				Cover:       "https://example.com/covers/1.jpg",
+				Description: "Pirates",
+				Status:      "completed",
+				StatusRaw:   "Completed",
+				TotalPages:  3,
+				Chapters: []ChapterInfo{
+					{ChapterID: "/c/2", Chapter: "Chapter 2.5", ChapterNumber: 2.5, ChapterTitle: "Two", GroupName: "Scans", Language: "en", Time: "2024-01-02"},
+					{ChapterID: "c1", Chapter: "Prologue", ChapterNumber: -1},
+				},
+			},
+		},
+		{
+			name: "relative and protocol relative covers",
+			raw: map[string]interface{}{
+				"name":      "Title",
+				"thumbnail": "//cdn.example.com/c.webp",
+				"chapters":  []interface{}{map[string]interface{}{"id": "1"}},
+			},
+			want: &MangaInfo{
+				URL:       pageURL,
+				Title:     "Title",
+				AltTitles: []string{},
+				Cover:     "https://cdn.example.com/c.webp",
+				Status:    "unknown",
+				Chapters:  []ChapterInfo{{ChapterID: "1", ChapterNumber: -1}},
+			},
+		},
+		{
+			name: "local cover is dropped",
+			raw: map[string]interface{}{
+				"title":    "Title",
+				"cover":    "file:///etc/passwd",
+				"chapters": []interface{}{map[string]interface{}{"id": "1"}},
+			},
+			want: &MangaInfo{
+				URL:       pageURL,
+				Title:     "Title",
+				AltTitles: []string{},
+				Status:    "unknown",
+				Chapters:  []ChapterInfo{{ChapterID: "1", ChapterNumber: -1}},
+			},
+		},
+		{
+			name: "partial result",
+			raw:  map[string]interface{}{"title": "", "cover": "data:image/png;base64,AAAA", "status": "ongoing"},
+			want: &MangaInfo{
+				URL:       pageURL,
+				AltTitles: []string{},
+				Cover:     "data:image/png;base64,AAAA",
+				Status:    "ongoing",
+				StatusRaw: "ongoing",
+				Chapters:  []ChapterInfo{},
+				Missing:   []string{"title", "chapters"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeMangaInfo(tt.raw, pageURL); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeMangaInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeChapterPages(t *testing.T) {
+	const pageURL = "https://example.com/read/1/"
+
+	tests := []struct {
+		name        string
+		raw         map[string]interface{}
+		wantPages   []string
+		wantMissing []string
+	}{
+		{
+			name: "relative pages in order without duplicates",
+			raw: map[string]interface{}{
+				"pages": []interface{}{"02.jpg", "/img/01.jpg", "https://cdn.example.com/03.jpg", "02.jpg", ""},
+			},
+			wantPages: []string{
+				"https://example.com/read/1/02.jpg",
+				"https://example.com/img/01.jpg",
+				"https://cdn.example.com/03.jpg",
+			},
+		},
+		{
+			name:      "images key and a single page",
+			raw:       map[string]interface{}{"images": " //cdn.example.com/1.png "},
+			wantPages: []string{"https://cdn.example.com/1.png"},
+		},
+		{
+			name:        "only local files",
+			raw:         map[string]interface{}{"pages": []interface{}{"file:///etc/passwd"}},
+			wantPages:   []string{},
+			wantMissing: []string{"pages"},
+		},
+		{
+			name:        "no pages",
+			raw:         map[string]interface{}{"title": "Chapter 1"},
+			wantPages:   []string{},
+			wantMissing: []string{"pages"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeChapterPages(tt.raw, "ch-1", pageURL)
+			if got.ChapterID != "ch-1" || got.URL != pageURL {
+				t.Errorf("chapter = %q %q", got.ChapterID, got.URL)
+			}
+			if !reflect.DeepEqual(got.Pages, tt.wantPages) {
+				t.Errorf("pages = %q, want %q", got.Pages, tt.wantPages)
+			}
+			if !reflect.DeepEqual(got.Missing, tt.wantMissing) {
+				t.Errorf("missing = %q, want %q", got.Missing, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestNormalizeChapterPagesKeepsCaptures(t *testing.T) {
+	captured := captureFileURL(t)
+	raw := map[string]interface{}{"pages": []interface{}{captured, "file:///etc/passwd", "FILE:///C:/Windows/win.ini"}}
+	got := normalizeChapterPages(raw, "ch-1", "https://example.com/read/1/")
+	if !reflect.DeepEqual(got.Pages, []string{captured}) || got.Missing != nil {
+		t.Errorf("pages = %q, missing = %q, want only the captured image", got.Pages, got.Missing)
+	}
+}
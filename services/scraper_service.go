@@ -2,16 +2,26 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	"mangav5/internal/httpcache"
+	"mangav5/internal/proxy"
+	"mangav5/internal/repo"
+	"mangav5/internal/transform"
+
 	"github.com/PuerkitoBio/goquery"
 	"github.com/go-resty/resty/v2"
+	"github.com/go-rod/rod"
 	"github.com/tidwall/gjson"
 )
 
@@ -19,25 +29,186 @@ const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/
 
 // ScraperService handles rule-based scraping
 type ScraperService struct {
-	browserService *BrowserService
-	client         *resty.Client
+	browserService   *BrowserService
+	scrapingRuleRepo *repo.ScrapingRuleRepo
+	siteSessionRepo  *repo.SiteSessionRepo
+	configRepo       *repo.ConfigRepo
+	client           *resty.Client
+	jar              *sessionJar
+
+	// Sessions bootstrapped in the browser after an anti-bot challenge or
+	// a login, saved per site
+	sessionMu  sync.RWMutex
+	userAgents map[string]string      // domain -> User-Agent the clearance cookies belong to
+	solving    map[string]*singleCall // hosts with a challenge being solved, sites logging in
+	loaded     map[string]bool        // sites whose saved session was restored
+	savedAt    map[string]uint64      // site -> jar version last saved
+	key        []byte                 // session encryption key, loaded on first use
+
+	// Responses of static pages and API steps, opened on first use
+	cacheDir  string
+	cacheOnce sync.Once
+	cache     *httpcache.Store
 }
 
 // NewScraperService creates a new instance
-func NewScraperService(bs *BrowserService) *ScraperService {
+func NewScraperService(bs *BrowserService, repos *repo.Repositories) *ScraperService {
 	client := resty.New()
-	client.SetCookieJar(nil) // Enable CookieJar
+	// Requests pick their proxy pool through their context
+	client.SetTransport(proxy.NewTransport(nil))
+	// Shared with image downloads so CDN requests carry the site session
+	jar := newSessionJar()
+	client.SetCookieJar(jar)
 	client.SetHeader("User-Agent", DefaultUserAgent)
 	client.SetTimeout(30 * time.Second)
 
 	return &ScraperService{
-		browserService: bs,
-		client:         client,
+		browserService:   bs,
+		scrapingRuleRepo: repos.ScrapingRule,
+		siteSessionRepo:  repos.SiteSession,
+		configRepo:       repos.Config,
+		client:           client,
+		jar:              jar,
+		userAgents:       make(map[string]string),
+		solving:          make(map[string]*singleCall),
+		loaded:           make(map[string]bool),
+		savedAt:          make(map[string]uint64),
+		cacheDir:         httpcache.DefaultDir(),
+	}
+}
+
+// newRequest starts a request with the default User-Agent through the proxy
+// pool of a scrape context
+func (s *ScraperService) newRequest(ctx map[string]interface{}) *resty.Request {
+	req := s.client.R()
+	req.SetHeader("User-Agent", DefaultUserAgent)
+	if pool, ok := ctx[proxyKey].(*proxy.Pool); ok {
+		req.SetContext(proxy.WithPool(context.Background(), pool))
+	}
+	return req
+}
+
+// proxyPool resolves the proxy of rule: the one of its scraping rule, else
+// the global one
+func (s *ScraperService) proxyPool(rule SiteRule) (*proxy.Pool, error) {
+	var global string
+	if s.configRepo != nil {
+		var err error
+		if global, err = s.configRepo.GetValue(context.Background(), proxy.ConfigKey); err != nil {
+			return nil, err
+		}
+	}
+	pool, err := proxy.Resolve(rule.Proxy, global)
+	if err != nil {
+		return nil, fmt.Errorf("proxy of %s: %w", rule.Site, err)
+	}
+	return pool, nil
+}
+
+// ProxyStatus returns the health of the proxies siteKey is scraped through,
+// or of the global proxies without a siteKey; nil without a proxy
+func (s *ScraperService) ProxyStatus(ctx context.Context, siteKey string) ([]proxy.Status, error) {
+	rule := SiteRule{Site: siteKey}
+	if siteKey != "" {
+		stored, err := s.scrapingRuleRepo.GetBySiteKey(ctx, siteKey)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			return nil, fmt.Errorf("scraping rule %s not found", siteKey)
+		}
+		rule.Proxy = stored.Proxy
+	}
+	pool, err := s.proxyPool(rule)
+	if err != nil || pool == nil {
+		return nil, err
+	}
+	return pool.Status(), nil
+}
+
+// cookieJar returns the jar holding the cookies collected while scraping
+func (s *ScraperService) cookieJar() http.CookieJar {
+	return s.jar
+}
+
+// Scrape executes the scraping rule. forceRefresh ignores cached responses,
+// e.g. while a rule is being edited.
+func (s *ScraperService) Scrape(rule SiteRule, overrideURL string, forceRefresh bool) (map[string]interface{}, error) {
+	targetURL, params := s.resolveEntry(rule, overrideURL)
+	return s.run(rule, targetURL, params, forceRefresh)
+}
+
+// ScrapeManga runs the manga rule of siteKey on url (a full URL or an ID)
+// and returns the typed result. Required fields the rule did not produce are
+// listed in Missing; only fetch and parse failures return an error.
+func (s *ScraperService) ScrapeManga(ctx context.Context, siteKey string, url string) (*MangaInfo, error) {
+	rule, err := s.siteRule(ctx, siteKey, "manga")
+	if err != nil {
+		return nil, err
+	}
+
+	targetURL, params := s.resolveEntry(*rule, url)
+	raw, err := s.run(*rule, targetURL, params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info := normalizeMangaInfo(raw, targetURL)
+	if info.ID == "" {
+		info.ID = toString(params["id"])
+	}
+	return info, nil
+}
+
+// ScrapeChapter runs the chapter rule of siteKey on chapterID (a full URL or
+// an ID) and returns the ordered page URLs, missing fields are listed in
+// Missing like in ScrapeManga
+func (s *ScraperService) ScrapeChapter(ctx context.Context, siteKey string, chapterID string) (*ChapterPages, error) {
+	rule, err := s.siteRule(ctx, siteKey, "chapter")
+	if err != nil {
+		return nil, err
+	}
+
+	targetURL, params := s.resolveEntry(*rule, chapterID)
+	raw, err := s.run(*rule, targetURL, params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeChapterPages(raw, chapterID, targetURL), nil
+}
+
+// siteRule loads the manga or chapter rule stored for siteKey
+func (s *ScraperService) siteRule(ctx context.Context, siteKey string, kind string) (*SiteRule, error) {
+	stored, err := s.scrapingRuleRepo.GetBySiteKey(ctx, siteKey)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, fmt.Errorf("scraping rule %s not found", siteKey)
+	}
+
+	raw := stored.MangaRuleJSON
+	if kind == "chapter" {
+		raw = stored.ChapterRuleJSON
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil, fmt.Errorf("scraping rule %s has no %s rule", siteKey, kind)
+	}
+
+	var rule SiteRule
+	if err := json.Unmarshal([]byte(raw), &rule); err != nil {
+		return nil, fmt.Errorf("invalid %s rule of %s: %w", kind, siteKey, err)
 	}
+	// Sessions are saved under the site key
+	rule.Site = siteKey
+	rule.Proxy = stored.Proxy
+	return &rule, nil
 }
 
-// Scrape executes the scraping rule
-func (s *ScraperService) Scrape(rule SiteRule, overrideURL string) (map[string]interface{}, error) {
+// resolveEntry turns the user input (full URL, ID or nothing) into the target
+// URL and the initial template parameters of the rule
+func (s *ScraperService) resolveEntry(rule SiteRule, overrideURL string) (string, map[string]interface{}) {
 	targetURL := overrideURL
 	params := make(map[string]interface{})
 
@@ -125,16 +296,52 @@ func (s *ScraperService) Scrape(rule SiteRule, overrideURL string) (map[string]i
 		params["url"] = targetURL
 	}
 
+	return targetURL, params
+}
+
+// run executes the strategy of rule on targetURL; refresh bypasses cached
+// responses
+func (s *ScraperService) run(rule SiteRule, targetURL string, params map[string]interface{}, refresh bool) (map[string]interface{}, error) {
+	pool, err := s.proxyPool(rule)
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		params[proxyKey] = pool
+	}
+	if policy := newCachePolicy(rule, refresh); policy != nil {
+		params[cacheKey] = policy
+	}
+
 	switch rule.Strategy {
 	case "static":
-		return s.scrapeStatic(targetURL, rule, params)
+		return s.withSession(rule, pool, func() (map[string]interface{}, error) {
+			return s.scrapeStatic(targetURL, rule, params)
+		})
 	case "browser":
-		return s.scrapeBrowser(targetURL, rule, params)
+		return s.withSession(rule, pool, func() (map[string]interface{}, error) {
+			return s.scrapeBrowser(targetURL, rule, params)
+		})
 	case "api":
-		return s.scrapeAPI(targetURL, rule, params)
+		return s.withSession(rule, pool, func() (map[string]interface{}, error) {
+			return s.scrapeAPI(targetURL, rule, params)
+		})
 	case "auto":
-		// Default to static, fallback logic could be added here
-		return s.scrapeStatic(targetURL, rule, params)
+		// Static first; a challenge the browser session cannot get past
+		// falls back to rendering the page in the browser
+		res, err := s.withSession(rule, pool, func() (map[string]interface{}, error) {
+			if targetURL == "" && rule.API != nil && len(rule.API.Steps) > 0 {
+				return s.scrapeAPI(targetURL, rule, params)
+			}
+			return s.scrapeStatic(targetURL, rule, params)
+		})
+		var ce *ChallengeError
+		if errors.As(err, &ce) && targetURL != "" && s.browserService != nil {
+			return s.withSession(rule, pool, func() (map[string]interface{}, error) {
+				return s.scrapeBrowser(targetURL, rule, params)
+			})
+		}
+		return res, err
 	default:
 		return nil, fmt.Errorf("unknown strategy: %s", rule.Strategy)
 	}
@@ -191,6 +398,9 @@ func (s *ScraperService) scrapeStatic(url string, rule SiteRule, params map[stri
 		ctx[k] = v
 	}
 	ctx["url"] = url
+	if rule.Login != nil {
+		ctx[loginKey] = rule.Login
+	}
 	if _, ok := ctx["id"]; !ok {
 		ctx["id"] = url // Default ID to url if not provided
 	}
@@ -214,33 +424,56 @@ func (s *ScraperService) scrapeStatic(url string, rule SiteRule, params map[stri
 		}
 	}
 
-	req := s.client.R()
-	req.SetHeader("User-Agent", DefaultUserAgent)
+	return paginate(rule.Pagination, ctx, func(next string) (map[string]interface{}, pageSource, error) {
+		pageURL := next
+		if pageURL == "" {
+			pageURL = paginatedURL(rule.Pagination, url, ctx)
+		}
+		return s.scrapeStaticPage(pageURL, rule, ctx)
+	})
+}
+
+// scrapeStaticPage fetches one page of a static rule and extracts it
+func (s *ScraperService) scrapeStaticPage(pageURL string, rule SiteRule, ctx map[string]interface{}) (map[string]interface{}, pageSource, error) {
+	src := pageSource{URL: pageURL}
+
+	req := s.newRequest(ctx)
 	if rule.Entry != nil && rule.Entry.Headers != nil {
 		req.SetHeaders(rule.Entry.Headers)
 	}
+	s.applySession(req, pageURL)
 
-	resp, err := req.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(resp.Body()))
+	var doc *goquery.Document
+	resp, err := s.fetch(ctx, req, http.MethodGet, pageURL, func(resp *resty.Response) error {
+		if err := detectChallenge(resp); err != nil {
+			return err
+		}
+		var err error
+		if doc, err = goquery.NewDocumentFromReader(bytes.NewReader(resp.Body())); err != nil {
+			return err
+		}
+		return rule.Login.loggedOut(pageURL, doc.Selection, resp.String())
+	})
 	if err != nil {
-		return nil, err
+		return nil, src, err
 	}
+	src.Body = resp.String()
+	src.Doc = doc.Selection
 
-	// Store default selection
-	ctx["__default_selection__"] = doc.Selection
+	// Steps and defaults of one page must not leak into the next
+	pageCtx := copyContext(ctx)
+	pageCtx["__default_selection__"] = doc.Selection
+	pageCtx["page_url"] = pageURL
 
 	// Execute API Steps if present
 	if rule.API != nil && len(rule.API.Steps) > 0 {
-		if err := s.executeAPISteps(ctx, rule.API.Steps); err != nil {
-			return nil, err
+		if err := s.executeAPISteps(pageCtx, rule.API.Steps); err != nil {
+			return nil, src, err
 		}
 	}
 
-	return s.extractFromContext(ctx, rule.Extract), nil
+	values, err := s.extractFromContext(pageCtx, rule.Extract)
+	return values, src, err
 }
 
 func (s *ScraperService) scrapeBrowser(url string, rule SiteRule, params map[string]interface{}) (map[string]interface{}, error) {
@@ -254,6 +487,9 @@ func (s *ScraperService) scrapeBrowser(url string, rule SiteRule, params map[str
 		ctx[k] = v
 	}
 	ctx["url"] = url
+	if rule.Login != nil {
+		ctx[loginKey] = rule.Login
+	}
 	if _, ok := ctx["id"]; !ok {
 		ctx["id"] = url
 	}
@@ -262,48 +498,90 @@ func (s *ScraperService) scrapeBrowser(url string, rule SiteRule, params map[str
 		return nil, err
 	}
 
-	page := s.browserService.browser.MustPage(url)
-	defer page.Close()
-
-	// Apply Wait Config
-	if rule.WaitConfig != nil {
-		wc := rule.WaitConfig
-		if wc.Timeout > 0 {
-			// Note: Rod context timeout logic would go here if needed
+	return paginate(rule.Pagination, ctx, func(next string) (map[string]interface{}, pageSource, error) {
+		pageURL := next
+		if pageURL == "" {
+			pageURL = paginatedURL(rule.Pagination, url, ctx)
 		}
+		return s.scrapeBrowserPage(pageURL, rule, ctx)
+	})
+}
 
-		if !wc.SkipNavigationWait {
-			page.MustWaitLoad()
+// scrapeBrowserPage renders one page of a browser rule within the wait
+// config timeout, runs the rule actions and extracts it like a static page
+func (s *ScraperService) scrapeBrowserPage(pageURL string, rule SiteRule, ctx map[string]interface{}) (map[string]interface{}, pageSource, error) {
+	src := pageSource{URL: pageURL}
+
+	timeout := browserTimeout(rule.WaitConfig) + actionsTimeout(rule.Actions)
+	deadline, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var recorder *networkRecorder
+	before := func(page *rod.Page) (err error) {
+		if rule.Login != nil {
+			// Saved and form login sessions live in the client jar
+			if err := s.sendSessionCookies(page, pageURL); err != nil {
+				return err
+			}
 		}
-
-		if !wc.SkipRenderStable {
-			page.MustWaitStable()
+		if rule.Capture != nil {
+			recorder, err = startCapture(page, rule.Capture)
 		}
+		return err
+	}
 
-		// Wait for specific selectors
-		if len(wc.ContainerSelectors) > 0 {
-			for _, sel := range wc.ContainerSelectors {
-				if err := page.WaitElementsMoreThan(sel, 0); err != nil {
-					// Log or ignore?
-				}
-			}
-		}
-	} else {
-		// Default wait
-		page.MustWaitStable()
+	pool, _ := ctx[proxyKey].(*proxy.Pool)
+	page, closePage, err := s.browserService.openPage(deadline, pageURL, pool, before)
+	if err != nil {
+		return nil, src, err
+	}
+	defer closePage()
+
+	if err := waitForPage(page, rule.WaitConfig); err != nil {
+		return nil, src, fmt.Errorf("%s: %w", pageURL, err)
+	}
+
+	stored, err := runActions(page, rule.Actions)
+	if err != nil {
+		return nil, src, fmt.Errorf("%s: %w", pageURL, err)
 	}
 
 	htmlStr, err := page.HTML()
 	if err != nil {
-		return nil, err
+		return nil, src, waitError("page HTML", err)
 	}
+	src.Body = htmlStr
 
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlStr))
 	if err != nil {
-		return nil, err
+		return nil, src, err
+	}
+	src.Doc = doc.Selection
+	if err := rule.Login.loggedOut(pageURL, doc.Selection, htmlStr); err != nil {
+		return nil, src, err
 	}
 
-	return s.extractFields(doc.Selection, rule.Extract), nil
+	pageCtx := copyContext(ctx)
+	pageCtx["__default_selection__"] = doc.Selection
+	pageCtx["page_url"] = pageURL
+	for k, v := range stored {
+		pageCtx[k] = v
+	}
+
+	if recorder != nil {
+		// Captured responses read like the output of an API step
+		id := rule.Capture.id()
+		pageCtx[id], pageCtx[id+"_raw"] = recorder.finish()
+	}
+
+	if rule.API != nil && len(rule.API.Steps) > 0 {
+		if err := s.executeAPISteps(pageCtx, rule.API.Steps); err != nil {
+			return nil, src, err
+		}
+	}
+
+	values, err := s.extractFromContext(pageCtx, rule.Extract)
+	return values, src, err
 }
 
 func (s *ScraperService) scrapeAPI(url string, rule SiteRule, params map[string]interface{}) (map[string]interface{}, error) {
@@ -326,6 +604,9 @@ func (s *ScraperService) scrapeAPI(url string, rule SiteRule, params map[string]
 	}
 
 	ctx["url"] = url
+	if rule.Login != nil {
+		ctx[loginKey] = rule.Login
+	}
 	// Default 'id' to url for convenience when passing IDs directly
 	if _, ok := ctx["id"]; !ok {
 		ctx["id"] = url
@@ -347,73 +628,198 @@ func (s *ScraperService) scrapeAPI(url string, rule SiteRule, params map[string]
 		}
 	}
 
-	if err := s.executeAPISteps(ctx, rule.API.Steps); err != nil {
+	steps := rule.API.Steps
+	paged, cfg := pagedStep(rule)
+	if cfg == nil {
+		if err := s.executeAPISteps(ctx, steps); err != nil {
+			return nil, err
+		}
+		return s.extractFromContext(ctx, rule.Extract)
+	}
+
+	// Steps before the paginated one run once, the rest again for every page
+	if err := s.executeAPISteps(ctx, steps[:paged]); err != nil {
 		return nil, err
 	}
 
-	return s.extractFromContext(ctx, rule.Extract), nil
+	step := steps[paged]
+	if step.When != "" && !evalCondition(ctx, step.When) {
+		// A skipped step has no pages to follow
+		if err := s.executeAPISteps(ctx, steps[paged+1:]); err != nil {
+			return nil, err
+		}
+		return s.extractFromContext(ctx, rule.Extract)
+	}
+	return paginate(cfg, ctx, func(next string) (map[string]interface{}, pageSource, error) {
+		pageCtx := copyContext(ctx)
+
+		// Without a {param} placeholder the page goes in the query string
+		if next == "" && !strings.Contains(step.Request.URL, "{"+cfg.param()+"}") {
+			base, err := s.stepURL(pageCtx, step)
+			if err != nil {
+				return nil, pageSource{URL: base}, err
+			}
+			next = paginatedURL(cfg, base, pageCtx)
+		}
+
+		stepURL, err := s.executeStep(pageCtx, step, next)
+		src := pageSource{URL: stepURL}
+		if err != nil {
+			return nil, src, err
+		}
+		src.Body, _ = pageCtx[step.ID+"_raw"].(string)
+		if step.Response == "html" {
+			if doc, err := goquery.NewDocumentFromReader(strings.NewReader(src.Body)); err == nil {
+				src.Doc = doc.Selection
+			}
+		}
+
+		if err := s.executeAPISteps(pageCtx, steps[paged+1:]); err != nil {
+			return nil, src, err
+		}
+		values, err := s.extractFromContext(pageCtx, rule.Extract)
+		return values, src, err
+	})
+}
+
+// pagedStep returns the index and pagination of the first paginated API
+// step; a rule level pagination applies to the last step
+func pagedStep(rule SiteRule) (int, *Pagination) {
+	for i, step := range rule.API.Steps {
+		if step.Pagination != nil {
+			return i, step.Pagination
+		}
+	}
+	if rule.Pagination != nil {
+		return len(rule.API.Steps) - 1, rule.Pagination
+	}
+	return 0, nil
 }
 
 func (s *ScraperService) executeAPISteps(ctx map[string]interface{}, steps []APIStep) error {
 	for _, step := range steps {
-		// Process URL template if needed
-		stepURLRaw := s.processTemplate(step.Request.URL, ctx)
-		stepURL := ""
-		if str, ok := stepURLRaw.(string); ok {
-			stepURL = strings.TrimSpace(str)
-		} else {
-			// Should not happen for API steps URL template with ctx map
-			stepURL = fmt.Sprintf("%v", stepURLRaw)
+		if err := s.runStep(ctx, step); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Check for unreplaced placeholders
-		if strings.Contains(stepURL, "{") && strings.Contains(stepURL, "}") {
-			return fmt.Errorf("step %s failed: URL %s contains unreplaced placeholders. Available keys: %v", step.ID, stepURL, getKeys(ctx))
-		}
+// stepURL renders the URL template of step with ctx
+func (s *ScraperService) stepURL(ctx map[string]interface{}, step APIStep) (string, error) {
+	var stepURL string
+	stepURLRaw := s.processTemplate(step.Request.URL, ctx)
+	if str, ok := stepURLRaw.(string); ok {
+		stepURL = strings.TrimSpace(str)
+	} else {
+		// Should not happen for API steps URL template with ctx map
+		stepURL = fmt.Sprintf("%v", stepURLRaw)
+	}
 
-		req := s.client.R()
-		req.SetHeader("User-Agent", DefaultUserAgent)
-		if step.Request.Headers != nil {
-			req.SetHeaders(step.Request.Headers)
-		}
+	// Check for unreplaced placeholders
+	if strings.Contains(stepURL, "{") && strings.Contains(stepURL, "}") {
+		return stepURL, fmt.Errorf("step %s failed: URL %s contains unreplaced placeholders. Available keys: %v", step.ID, stepURL, getKeys(ctx))
+	}
+	return stepURL, nil
+}
 
-		var resp *resty.Response
+// executeStep runs one API step and stores its response in ctx. overrideURL
+// replaces the templated URL, e.g. with the next page link. It returns the
+// URL that was requested.
+func (s *ScraperService) executeStep(ctx map[string]interface{}, step APIStep, overrideURL string) (string, error) {
+	stepURL := overrideURL
+	if stepURL == "" {
 		var err error
-
-		method := strings.ToUpper(step.Request.Method)
-		if method == "" {
-			method = "GET"
+		if stepURL, err = s.stepURL(ctx, step); err != nil {
+			return stepURL, err
 		}
+	}
 
-		switch method {
-		case "POST":
-			resp, err = req.Post(stepURL)
-		default:
-			resp, err = req.Get(stepURL)
-		}
+	req := s.newRequest(ctx)
+	if step.Request.Headers != nil {
+		req.SetHeaders(step.Request.Headers)
+	}
+	s.applySession(req, stepURL)
 
-		if err != nil {
-			return fmt.Errorf("step %s failed: %w", step.ID, err)
+	var resp *resty.Response
+	var err error
+
+	method := strings.ToUpper(step.Request.Method)
+	if method == "" {
+		method = "GET"
+		if step.Request.hasBody() {
+			method = "POST"
 		}
+	}
 
+	switch method {
+	case "GET":
+	case "POST":
+		if err := s.setRequestBody(req, step.Request, ctx); err != nil {
+			return stepURL, fmt.Errorf("step %s failed: %w", step.ID, err)
+		}
+	default:
+		// Only GET and POST are sent; a body would silently go missing
+		if step.Request.hasBody() {
+			return stepURL, fmt.Errorf("step %s failed: unsupported method %s with a request body, expected POST", step.ID, method)
+		}
+		method = "GET"
+	}
+	resp, err = s.fetch(ctx, req, method, stepURL, func(resp *resty.Response) error {
+		if err := detectChallenge(resp); err != nil {
+			return err
+		}
+		flow, ok := ctx[loginKey].(*LoginFlow)
+		if !ok {
+			return nil
+		}
 		body := resp.String()
+		var doc *goquery.Selection
+		if step.Response == "html" && flow.LoggedOutSelector != "" {
+			if d, err := goquery.NewDocumentFromReader(strings.NewReader(body)); err == nil {
+				doc = d.Selection
+			}
+		}
+		return flow.loggedOut(stepURL, doc, body)
+	})
+	if err != nil {
+		return stepURL, fmt.Errorf("step %s failed: %w", step.ID, err)
+	}
 
-		// Parse response based on type
-		if step.Response == "html" {
-			ctx[step.ID] = body
-			ctx[step.ID+"_raw"] = body
-		} else {
-			ctx[step.ID] = gjson.Parse(body).Value()
-			ctx[step.ID+"_raw"] = body
+	body := resp.String()
+
+	if step.Request.Query != "" {
+		if err := graphQLError(body); err != nil {
+			return stepURL, fmt.Errorf("step %s failed: %w", step.ID, err)
 		}
 	}
-	return nil
+
+	// Parse response based on type
+	if step.Response == "html" {
+		ctx[step.ID] = body
+		ctx[step.ID+"_raw"] = body
+	} else {
+		ctx[step.ID] = gjson.Parse(body).Value()
+		ctx[step.ID+"_raw"] = body
+	}
+	return stepURL, nil
 }
 
-// extractFromContext handles extraction when source is a map of step results
-func (s *ScraperService) extractFromContext(ctx map[string]interface{}, rules []FieldRule) map[string]interface{} {
+// extractFromContext handles extraction when source is a map of step results.
+// It fails only on a field regex that does not compile.
+func (s *ScraperService) extractFromContext(ctx map[string]interface{}, rules []FieldRule) (map[string]interface{}, error) {
 	result := make(map[string]interface{})
 
+	// Relative links resolve against the fetched page, else the entry URL
+	base := toString(ctx["page_url"])
+	if base == "" {
+		base = toString(ctx["url"])
+	}
+	rules, err := prepareFields(rules, base)
+	if err != nil {
+		return nil, err
+	}
+
 	var defaultSource interface{} = ctx
 	if sel, ok := ctx["__default_selection__"]; ok {
 		defaultSource = sel
@@ -437,7 +843,7 @@ func (s *ScraperService) extractFromContext(ctx map[string]interface{}, rules []
 			result[field.Name] = s.extractFieldGeneric(defaultSource, field)
 		}
 	}
-	return result
+	return result, nil
 }
 
 func (s *ScraperService) extractFieldGeneric(source interface{}, field FieldRule) interface{} {
@@ -598,6 +1004,18 @@ func (s *ScraperService) extractFieldGeneric(source interface{}, field FieldRule
 
 	// If type is json, source can be JSON string or object
 	if field.Type == "json" {
+		// JSON embedded in HTML, e.g. a script tag: use the text of the selector
+		if sel, ok := source.(*goquery.Selection); ok {
+			if field.Selector != "" {
+				sel = sel.Find(field.Selector)
+			}
+			jsonStr := sel.Text()
+			if field.Trim {
+				jsonStr = strings.TrimSpace(jsonStr)
+			}
+			return s.extractJSON(jsonStr, field)
+		}
+
 		// If it's already an object, marshal it back? or use reflection?
 		// gjson works on strings.
 		jsonStr, ok := source.(string)
@@ -684,6 +1102,9 @@ func (s *ScraperService) extractCSS(sel *goquery.Selection, rule FieldRule) inte
 				items = append(items, val)
 			}
 		})
+		if len(rule.Transforms) > 0 && len(rule.Children) == 0 {
+			return transform.Apply(items, rule.Transforms, rule.baseURL)
+		}
 		return items
 	}
 
@@ -717,18 +1138,20 @@ func (s *ScraperService) extractValue(sel *goquery.Selection, rule FieldRule) in
 	}
 
 	// Regex
-	if rule.Regex != "" {
-		re, err := regexp.Compile(rule.Regex)
-		if err == nil {
-			matches := re.FindStringSubmatch(val)
-			if len(matches) > 1 {
-				val = matches[1] // Return first capture group
-			} else if len(matches) > 0 {
-				val = matches[0] // Return full match
-			}
+	if rule.re != nil {
+		matches := rule.re.FindStringSubmatch(val)
+		if len(matches) > 1 {
+			val = matches[1] // Return first capture group
+		} else if len(matches) > 0 {
+			val = matches[0] // Return full match
 		}
 	}
 
+	// Lists get their transforms once every item is extracted
+	if len(rule.Transforms) > 0 && !rule.Multiple {
+		return transform.Apply(val, rule.Transforms, rule.baseURL)
+	}
+
 	return val
 }
 
@@ -766,6 +1189,9 @@ func (s *ScraperService) extractJSON(jsonStr string, rule FieldRule) interface{}
 			}
 			return true
 		})
+		if len(rule.Transforms) > 0 && len(rule.Children) == 0 {
+			return transform.Apply(items, rule.Transforms, rule.baseURL)
+		}
 		return items
 	}
 
@@ -781,19 +1207,49 @@ func (s *ScraperService) extractJSON(jsonStr string, rule FieldRule) interface{}
 
 	val := res.String()
 	// Regex on string value
-	if rule.Regex != "" {
-		re, err := regexp.Compile(rule.Regex)
-		if err == nil {
-			matches := re.FindStringSubmatch(val)
-			if len(matches) > 1 {
-				val = matches[1]
-			}
+	if rule.re != nil {
+		matches := rule.re.FindStringSubmatch(val)
+		if len(matches) > 1 {
+			val = matches[1]
 		}
 	}
 
+	if len(rule.Transforms) > 0 {
+		return transform.Apply(val, rule.Transforms, rule.baseURL)
+	}
+
 	return val
 }
 
+// prepareFields returns a copy of rules whose transforms resolve relative
+// links against base and whose regexes, also those of transforms, are
+// compiled. An invalid regex fails
+// the scrape instead of letting the unfiltered value through.
+func prepareFields(rules []FieldRule, base string) ([]FieldRule, error) {
+	if len(rules) == 0 {
+		return rules, nil
+	}
+	out := make([]FieldRule, len(rules))
+	for i, r := range rules {
+		r.baseURL = base
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: invalid regex: %w", r.Name, err)
+			}
+			r.re = re
+		}
+		r.Transforms = transform.Prepare(r.Transforms)
+		children, err := prepareFields(r.Children, base)
+		if err != nil {
+			return nil, err
+		}
+		r.Children = children
+		out[i] = r
+	}
+	return out, nil
+}
+
 func (s *ScraperService) renderTemplate(tmplStr string, data interface{}) string {
 	t, err := template.New("tmpl").Parse(tmplStr)
 	if err != nil {
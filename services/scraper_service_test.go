@@ -0,0 +1,82 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mangav5/internal/repo"
+)
+
+// newTestScraper returns a scraper without browser or database whose
+// response cache lives in a temp dir
+func newTestScraper(t *testing.T) *ScraperService {
+	t.Helper()
+	s := NewScraperService(nil, &repo.Repositories{})
+	s.cacheDir = t.TempDir()
+	return s
+}
+
+func TestScrapeFieldRegex(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"title":"Chapter 12 - The End"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><body><h1>Chapter 12 - The End</h1></body></html>`))
+	}))
+	defer srv.Close()
+
+	static := func(field FieldRule) SiteRule {
+		return SiteRule{Site: "test", Strategy: "static", Extract: []FieldRule{field}}
+	}
+	api := func(field FieldRule) SiteRule {
+		return SiteRule{
+			Site:     "test",
+			Strategy: "api",
+			API:      &APIWorkflow{Steps: []APIStep{{ID: "detail", Request: APIRequest{URL: srv.URL + "/api"}}}},
+			Extract:  []FieldRule{field},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		rule    SiteRule
+		want    string
+		wantErr string
+	}{
+		{"css capture group", static(FieldRule{Name: "n", Type: "css", Selector: "h1", Regex: `Chapter (\d+)`}), "12", ""},
+		{"css full match", static(FieldRule{Name: "n", Type: "css", Selector: "h1", Regex: `\d+`}), "12", ""},
+		{"css no match keeps value", static(FieldRule{Name: "n", Type: "css", Selector: "h1", Regex: `Volume (\d+)`}), "Chapter 12 - The End", ""},
+		{"css invalid regex", static(FieldRule{Name: "n", Type: "css", Selector: "h1", Regex: `Chapter (\d+`}), "", "field n: invalid regex"},
+		{"json capture group", api(FieldRule{Name: "n", Type: "json", From: "detail", Path: "title", Regex: `Chapter (\d+)`}), "12", ""},
+		{"json invalid regex", api(FieldRule{Name: "n", Type: "json", From: "detail", Path: "title", Regex: `[`}), "", "field n: invalid regex"},
+		{
+			"invalid regex of a child",
+			static(FieldRule{Name: "n", Type: "css", Selector: "body", Children: []FieldRule{{Name: "c", Type: "css", Selector: "h1", Regex: `(`}}}),
+			"", "field c: invalid regex",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestScraper(t)
+			got, err := s.Scrape(tt.rule, srv.URL, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Scrape() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["n"] != tt.want {
+				t.Errorf("n = %#v, want %q", got["n"], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storedCookie is a cookie as it is persisted per site
+type storedCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"` // without a leading dot
+	HostOnly bool      `json:"host_only,omitempty"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitempty"` // zero for session cookies
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+}
+
+// sessionJar is a cookie jar that also remembers the attributes of the
+// cookies it is given, which net/http/cookiejar does not expose, so the
+// cookies of a site can be saved and restored
+type sessionJar struct {
+	jar *cookiejar.Jar
+
+	mu      sync.Mutex
+	cookies map[string]storedCookie // domain, path and name -> cookie
+	changes uint64                  // bumped by every SetCookies
+}
+
+func newSessionJar() *sessionJar {
+	jar, _ := cookiejar.New(nil)
+	return &sessionJar{jar: jar, cookies: make(map[string]storedCookie)}
+}
+
+func (j *sessionJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.changes++
+	for _, c := range cookies {
+		sc := storedCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Domain:   strings.ToLower(strings.TrimPrefix(c.Domain, ".")),
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if sc.Domain == "" {
+			sc.Domain = strings.ToLower(u.Hostname())
+			sc.HostOnly = true
+		}
+		if sc.Path == "" || !strings.HasPrefix(sc.Path, "/") {
+			sc.Path = "/"
+		}
+		key := sc.Domain + ";" + sc.Path + ";" + sc.Name
+
+		switch {
+		case c.MaxAge < 0:
+			delete(j.cookies, key)
+			continue
+		case c.MaxAge > 0:
+			sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			sc.Expires = c.Expires
+		}
+		if !sc.Expires.IsZero() && !sc.Expires.After(now) {
+			delete(j.cookies, key)
+			continue
+		}
+		j.cookies[key] = sc
+	}
+}
+
+// version changes whenever cookies are set, so callers can tell whether
+// there is anything new to save
+func (j *sessionJar) version() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changes
+}
+
+// forDomains returns the live cookies that belong to one of domains
+func (j *sessionJar) forDomains(domains []string) []storedCookie {
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var out []storedCookie
+	for _, c := range j.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) {
+			continue
+		}
+		for _, d := range domains {
+			if domainMatches(c.Domain, d) {
+				out = append(out, c)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// restore puts saved cookies back into the jar
+func (j *sessionJar) restore(cookies []storedCookie) {
+	for _, c := range cookies {
+		hc := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Expires:  c.Expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if !c.HostOnly {
+			hc.Domain = c.Domain
+		}
+		j.SetCookies(&url.URL{Scheme: "https", Host: c.Domain, Path: "/"}, []*http.Cookie{hc})
+	}
+}
+
+// clear drops the cookies that belong to one of domains
+func (j *sessionJar) clear(domains []string) {
+	for _, c := range j.forDomains(domains) {
+		hc := &http.Cookie{Name: c.Name, Path: c.Path, MaxAge: -1}
+		if !c.HostOnly {
+			hc.Domain = c.Domain
+		}
+		j.SetCookies(&url.URL{Scheme: "https", Host: c.Domain, Path: "/"}, []*http.Cookie{hc})
+	}
+}
+
+// domainMatches reports whether a cookie of cookieDomain is sent to domain
+// or set by it: either one is the other or a parent of it
+func domainMatches(cookieDomain, domain string) bool {
+	cd := strings.ToLower(strings.TrimPrefix(cookieDomain, "."))
+	d := strings.ToLower(strings.TrimPrefix(domain, "."))
+	return cd == d || strings.HasSuffix(d, "."+cd) || strings.HasSuffix(cd, "."+d)
+}
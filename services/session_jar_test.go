@@ -0,0 +1,101 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+)
+
+func TestDomainMatches(t *testing.T) {
+	tests := []struct {
+		cookieDomain string
+		domain       string
+		want         bool
+	}{
+		{"example.com", "example.com", true},
+		{".example.com", "example.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "www.example.com", true},
+		{"cdn.example.com", "example.com", true},
+		{"example.com", "notexample.com", false},
+		{"example.com", "example.org", false},
+		{"a.example.com", "b.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := domainMatches(tt.cookieDomain, tt.domain); got != tt.want {
+			t.Errorf("domainMatches(%q, %q) = %v, want %v", tt.cookieDomain, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func cookieNames(cookies []storedCookie) []string {
+	names := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSessionJar(t *testing.T) {
+	site := &url.URL{Scheme: "https", Host: "www.example.com", Path: "/"}
+	other := &url.URL{Scheme: "https", Host: "other.org", Path: "/"}
+
+	jar := newSessionJar()
+	jar.SetCookies(site, []*http.Cookie{
+		{Name: "sid", Value: "1", Domain: ".example.com", MaxAge: 3600},
+		{Name: "host", Value: "2"},
+		{Name: "gone", Value: "3", MaxAge: -1},
+	})
+	jar.SetCookies(other, []*http.Cookie{{Name: "other", Value: "4"}})
+	if jar.version() != 2 {
+		t.Errorf("version() = %d, want 2", jar.version())
+	}
+
+	got := jar.forDomains([]string{"example.com"})
+	if names := cookieNames(got); len(names) != 2 || names[0] != "host" || names[1] != "sid" {
+		t.Fatalf("forDomains(example.com) = %v", names)
+	}
+	for _, c := range got {
+		switch c.Name {
+		case "sid":
+			if c.Domain != "example.com" || c.HostOnly || c.Expires.IsZero() {
+				t.Errorf("sid = %+v", c)
+			}
+		case "host":
+			if c.Domain != "www.example.com" || !c.HostOnly || !c.Expires.IsZero() {
+				t.Errorf("host = %+v", c)
+			}
+		}
+	}
+	if got := jar.forDomains([]string{"example.net"}); len(got) != 0 {
+		t.Errorf("forDomains(example.net) = %v", cookieNames(got))
+	}
+
+	// Saved cookies come back with their domain and host-only flag
+	restored := newSessionJar()
+	restored.restore(got)
+	if names := cookieNames(restored.forDomains([]string{"example.com"})); len(names) != 2 {
+		t.Errorf("restored cookies = %v", names)
+	}
+	sub := &url.URL{Scheme: "https", Host: "cdn.example.com", Path: "/"}
+	if cookies := restored.Cookies(sub); len(cookies) != 1 || cookies[0].Name != "sid" {
+		t.Errorf("cookies sent to a subdomain = %v, want only the domain cookie", cookies)
+	}
+	if cookies := restored.Cookies(site); len(cookies) != 2 {
+		t.Errorf("cookies sent to the site = %v", cookies)
+	}
+
+	// Clearing a site leaves the other sites alone
+	jar.clear([]string{"example.com"})
+	if got := jar.forDomains([]string{"example.com"}); len(got) != 0 {
+		t.Errorf("cookies left after clear = %v", cookieNames(got))
+	}
+	if cookies := jar.Cookies(site); len(cookies) != 0 {
+		t.Errorf("cookies still sent after clear = %v", cookies)
+	}
+	if cookies := jar.Cookies(other); len(cookies) != 1 {
+		t.Errorf("cookies of another site = %v", cookies)
+	}
+}
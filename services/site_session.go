@@ -0,0 +1,545 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mangav5/internal/proxy"
+	"mangav5/internal/util"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const loginTimeout = 60 * time.Second
+
+// proxyKey holds the proxy pool of the rule in a scrape context
+const proxyKey = "__proxy__"
+
+// loginKey holds the login flow of the rule in a scrape context, so API
+// steps can check their responses for the logged out marker
+const loginKey = "__login__"
+
+// LoggedOutError is returned when a page shows the logged out marker of
+// the rule login
+type LoggedOutError struct {
+	URL    string
+	Marker string
+}
+
+func (e *LoggedOutError) Error() string {
+	return fmt.Sprintf("%s is not logged in (%s)", e.URL, e.Marker)
+}
+
+// savedSession is the encrypted cookies column of a site session
+type savedSession struct {
+	Cookies    []storedCookie    `json:"cookies"`
+	UserAgents map[string]string `json:"user_agents,omitempty"`
+}
+
+// siteCredentials is the encrypted credentials column of a site session
+type siteCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *siteCredentials) fill(s string) string {
+	return strings.NewReplacer("{username}", c.Username, "{password}", c.Password).Replace(s)
+}
+
+func (f *LoginFlow) usesCredentials() bool {
+	uses := func(s string) bool {
+		return strings.Contains(s, "{username}") || strings.Contains(s, "{password}")
+	}
+	for _, v := range f.Form {
+		if uses(v) {
+			return true
+		}
+	}
+	for _, a := range f.Actions {
+		if uses(a.Text) || uses(a.Script) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedOut returns a *LoggedOutError when a page shows the logged out
+// marker; the selector is only checked when doc is set
+func (f *LoginFlow) loggedOut(pageURL string, doc *goquery.Selection, body string) error {
+	if f == nil {
+		return nil
+	}
+	if f.LoggedOutSelector != "" && doc != nil && doc.Find(f.LoggedOutSelector).Length() > 0 {
+		return &LoggedOutError{URL: pageURL, Marker: f.LoggedOutSelector}
+	}
+	if f.LoggedOutText != "" && strings.Contains(body, f.LoggedOutText) {
+		return &LoggedOutError{URL: pageURL, Marker: fmt.Sprintf("%q", f.LoggedOutText)}
+	}
+	return nil
+}
+
+// sessionDomains are the domains whose cookies make up the session of rule
+func sessionDomains(rule SiteRule) []string {
+	var domains []string
+	add := func(rawURL string) {
+		if u, err := url.Parse(rawURL); err == nil && u.Hostname() != "" && !strings.Contains(u.Hostname(), "{") {
+			domains = append(domains, strings.ToLower(u.Hostname()))
+		}
+	}
+	for _, d := range rule.Domains {
+		add(siteOrigin(d))
+	}
+	if rule.Entry != nil {
+		add(rule.Entry.URL)
+	}
+	if rule.Login != nil {
+		add(rule.Login.URL)
+	}
+	return domains
+}
+
+// withSession runs scrape with the saved session of the rule site. When it
+// hits a challenge, the challenge is solved once in the browser; when it is
+// logged out, the rule logs in once. Either way scrape runs again. Both go
+// through pool, the proxy of the scrape.
+func (s *ScraperService) withSession(rule SiteRule, pool *proxy.Pool, scrape func() (map[string]interface{}, error)) (map[string]interface{}, error) {
+	s.restoreSession(rule)
+
+	res, err := scrape()
+	var ce *ChallengeError
+	if errors.As(err, &ce) && s.browserService != nil {
+		if err := s.bootstrapSession(ce.URL, pool); err != nil {
+			return nil, fmt.Errorf("%w; solving it in the browser failed: %v", ce, err)
+		}
+		res, err = scrape()
+	}
+
+	var le *LoggedOutError
+	if errors.As(err, &le) && rule.Login != nil {
+		if err := s.login(rule, pool); err != nil {
+			return nil, fmt.Errorf("%w; login failed: %v", le, err)
+		}
+		res, err = scrape()
+	}
+
+	if err == nil {
+		// A session that cannot be saved only costs a login after a restart
+		_ = s.persistSession(rule)
+	}
+	return res, err
+}
+
+// restoreSession loads the saved cookies of the rule site into the client,
+// once per site
+func (s *ScraperService) restoreSession(rule SiteRule) {
+	if rule.Site == "" || s.siteSessionRepo == nil {
+		return
+	}
+	s.sessionMu.Lock()
+	if s.loaded[rule.Site] {
+		s.sessionMu.Unlock()
+		return
+	}
+	s.loaded[rule.Site] = true
+	s.sessionMu.Unlock()
+
+	stored, err := s.siteSessionRepo.Get(context.Background(), rule.Site)
+	if err != nil || stored == nil || len(stored.Cookies) == 0 {
+		return
+	}
+	var saved savedSession
+	if err := s.decrypt(stored.Cookies, &saved); err != nil {
+		// Unreadable, e.g. after the key was lost; the site logs in again
+		return
+	}
+
+	s.jar.restore(saved.Cookies)
+	s.sessionMu.Lock()
+	for domain, ua := range saved.UserAgents {
+		if _, ok := s.userAgents[domain]; !ok {
+			s.userAgents[domain] = ua
+		}
+	}
+	s.sessionMu.Unlock()
+}
+
+// persistSession saves the session cookies of the rule site when the jar
+// changed since the site was last saved
+func (s *ScraperService) persistSession(rule SiteRule) error {
+	if rule.Site == "" || s.siteSessionRepo == nil {
+		return nil
+	}
+	version := s.jar.version()
+	s.sessionMu.RLock()
+	saved, ok := s.savedAt[rule.Site]
+	s.sessionMu.RUnlock()
+	if ok && saved == version {
+		return nil
+	}
+
+	domains := sessionDomains(rule)
+	session := savedSession{Cookies: s.jar.forDomains(domains), UserAgents: make(map[string]string)}
+	s.sessionMu.RLock()
+	for domain, ua := range s.userAgents {
+		for _, d := range domains {
+			if domainMatches(domain, d) {
+				session.UserAgents[domain] = ua
+				break
+			}
+		}
+	}
+	s.sessionMu.RUnlock()
+
+	data, err := s.encrypt(session)
+	if err != nil {
+		return err
+	}
+	if err := s.siteSessionRepo.SaveCookies(context.Background(), rule.Site, data); err != nil {
+		return err
+	}
+	s.sessionMu.Lock()
+	s.savedAt[rule.Site] = version
+	s.sessionMu.Unlock()
+	return nil
+}
+
+// login runs the login flow of rule and saves the new session. Concurrent
+// calls for one site wait for the first.
+func (s *ScraperService) login(rule SiteRule, pool *proxy.Pool) error {
+	flow := rule.Login
+	if flow == nil {
+		return fmt.Errorf("rule %s has no login", rule.Site)
+	}
+
+	return s.single("login "+rule.Site, func() error {
+		creds := &siteCredentials{}
+		if flow.usesCredentials() {
+			var err error
+			if creds, err = s.credentials(rule.Site); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if len(flow.Actions) > 0 {
+			err = s.loginBrowser(rule, creds, pool)
+		} else {
+			err = s.loginForm(flow, creds, pool)
+		}
+		if err != nil {
+			return err
+		}
+		return s.persistSession(rule)
+	})
+}
+
+// loginForm posts the login form with the scraper client
+func (s *ScraperService) loginForm(flow *LoginFlow, creds *siteCredentials, pool *proxy.Pool) error {
+	form := make(map[string]string, len(flow.Form))
+	for k, v := range flow.Form {
+		form[k] = creds.fill(v)
+	}
+
+	req := s.newRequest(map[string]interface{}{proxyKey: pool})
+	if flow.Headers != nil {
+		req.SetHeaders(flow.Headers)
+	}
+	s.applySession(req, flow.URL)
+	req.SetFormData(form)
+
+	method := strings.ToUpper(flow.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	resp, err := req.Execute(method, flow.URL)
+	if err != nil {
+		return fmt.Errorf("login request failed: %w", err)
+	}
+	if err := detectChallenge(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() >= 400 {
+		return fmt.Errorf("login request answered with status %d", resp.StatusCode())
+	}
+
+	body := resp.String()
+	var doc *goquery.Selection
+	if d, err := goquery.NewDocumentFromReader(strings.NewReader(body)); err == nil {
+		doc = d.Selection
+	}
+	if err := flow.loggedOut(resp.Request.URL, doc, body); err != nil {
+		return fmt.Errorf("still logged out after login, check the credentials: %w", err)
+	}
+	return nil
+}
+
+// loginBrowser runs the login actions in the browser and copies the
+// cookies it got into the scraper client
+func (s *ScraperService) loginBrowser(rule SiteRule, creds *siteCredentials, pool *proxy.Pool) error {
+	if s.browserService == nil {
+		return errors.New("browser login needs the browser service")
+	}
+	flow := rule.Login
+
+	actions := make([]BrowserAction, len(flow.Actions))
+	for i, a := range flow.Actions {
+		a.Text = creds.fill(a.Text)
+		a.Script = creds.fill(a.Script)
+		actions[i] = a
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout+actionsTimeout(actions))
+	defer cancel()
+
+	if err := s.browserService.initBrowser(); err != nil {
+		return err
+	}
+	page, closePage, err := s.browserService.openPage(ctx, flow.URL, pool, func(p *rod.Page) error {
+		return s.sendSessionCookies(p, flow.URL)
+	})
+	if err != nil {
+		return err
+	}
+	defer closePage()
+
+	if err := waitForPage(page, rule.WaitConfig); err != nil {
+		return fmt.Errorf("%s: %w", flow.URL, err)
+	}
+	if _, err := runActions(page, actions); err != nil {
+		return err
+	}
+
+	if htmlStr, err := page.HTML(); err == nil {
+		var doc *goquery.Selection
+		if d, err := goquery.NewDocumentFromReader(strings.NewReader(htmlStr)); err == nil {
+			doc = d.Selection
+		}
+		if err := flow.loggedOut(flow.URL, doc, htmlStr); err != nil {
+			return fmt.Errorf("still logged out after login, check the credentials: %w", err)
+		}
+	}
+
+	res, err := proto.NetworkGetAllCookies{}.Call(page)
+	if err != nil {
+		return fmt.Errorf("failed to read cookies: %w", err)
+	}
+	domains := sessionDomains(rule)
+	var cookies []*proto.NetworkCookie
+	for _, c := range res.Cookies {
+		for _, d := range domains {
+			if domainMatches(c.Domain, d) {
+				cookies = append(cookies, c)
+				break
+			}
+		}
+	}
+	s.importCookies(cookies, "https")
+	return nil
+}
+
+// sendSessionCookies gives a browser page the client cookies of pageURL,
+// e.g. a session restored from disk or logged in with a form
+func (s *ScraperService) sendSessionCookies(page *rod.Page, pageURL string) error {
+	u, err := url.Parse(pageURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	cookies := s.jar.Cookies(u)
+	if len(cookies) == 0 {
+		return nil
+	}
+	origin := u.Scheme + "://" + u.Host + "/"
+	params := make([]*proto.NetworkCookieParam, 0, len(cookies))
+	for _, c := range cookies {
+		params = append(params, &proto.NetworkCookieParam{Name: c.Name, Value: c.Value, URL: origin, Path: "/"})
+	}
+	if err := page.SetCookies(params); err != nil {
+		return fmt.Errorf("failed to set session cookies: %w", err)
+	}
+	return nil
+}
+
+// importCookies copies browser cookies into the client jar and returns
+// their domains
+func (s *ScraperService) importCookies(cookies []*proto.NetworkCookie, scheme string) []string {
+	var domains []string
+	for _, c := range cookies {
+		domain := strings.TrimPrefix(c.Domain, ".")
+		cookie := &http.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Secure:   c.Secure,
+			HttpOnly: c.HTTPOnly,
+		}
+		if !c.Session && c.Expires > 0 {
+			cookie.Expires = c.Expires.Time()
+		}
+		s.jar.SetCookies(&url.URL{Scheme: scheme, Host: domain, Path: "/"}, []*http.Cookie{cookie})
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// singleCall is a call of single that other callers wait for
+type singleCall struct {
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// single runs fn once for key at a time; concurrent callers wait for the
+// running call and get its error without running fn themselves
+func (s *ScraperService) single(key string, fn func() error) error {
+	s.sessionMu.Lock()
+	if c, ok := s.solving[key]; ok {
+		s.sessionMu.Unlock()
+		<-c.done
+		return c.err
+	}
+	c := &singleCall{done: make(chan struct{})}
+	s.solving[key] = c
+	s.sessionMu.Unlock()
+
+	defer func() {
+		s.sessionMu.Lock()
+		delete(s.solving, key)
+		s.sessionMu.Unlock()
+		close(c.done)
+	}()
+	c.err = fn()
+	return c.err
+}
+
+// credentials returns the saved credentials of site
+func (s *ScraperService) credentials(site string) (*siteCredentials, error) {
+	if s.siteSessionRepo == nil {
+		return nil, errors.New("site sessions are not available")
+	}
+	stored, err := s.siteSessionRepo.Get(context.Background(), site)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || len(stored.Credentials) == 0 {
+		return nil, fmt.Errorf("no credentials saved for %s", site)
+	}
+	var creds siteCredentials
+	if err := s.decrypt(stored.Credentials, &creds); err != nil {
+		return nil, fmt.Errorf("failed to read the credentials of %s: %w", site, err)
+	}
+	return &creds, nil
+}
+
+func (s *ScraperService) encrypt(v interface{}) ([]byte, error) {
+	key, err := s.secretKey()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return util.Encrypt(key, plain)
+}
+
+func (s *ScraperService) decrypt(data []byte, v interface{}) error {
+	key, err := s.secretKey()
+	if err != nil {
+		return err
+	}
+	plain, err := util.Decrypt(key, data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// secretKey loads the key sessions are encrypted with, once
+func (s *ScraperService) secretKey() ([]byte, error) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	if s.key == nil {
+		key, err := util.SecretKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the session key: %w", err)
+		}
+		s.key = key
+	}
+	return s.key, nil
+}
+
+// SaveSiteCredentials stores the login of siteKey, encrypted, for the
+// login flow of its rules
+func (s *ScraperService) SaveSiteCredentials(ctx context.Context, siteKey string, username string, password string) error {
+	if s.siteSessionRepo == nil {
+		return errors.New("site sessions are not available")
+	}
+	data, err := s.encrypt(siteCredentials{Username: username, Password: password})
+	if err != nil {
+		return err
+	}
+	return s.siteSessionRepo.SaveCredentials(ctx, siteKey, data)
+}
+
+// ClearSiteSession logs siteKey out: its cookies and user agents are dropped
+// from the client and from disk. Saved credentials are kept.
+func (s *ScraperService) ClearSiteSession(ctx context.Context, siteKey string) error {
+	stored, err := s.scrapingRuleRepo.GetBySiteKey(ctx, siteKey)
+	if err != nil {
+		return err
+	}
+	var domains []string
+	if stored != nil {
+		for _, d := range ruleDomains(stored) {
+			if u, err := url.Parse(siteOrigin(d)); err == nil && u.Hostname() != "" {
+				domains = append(domains, u.Hostname())
+			}
+		}
+		s.jar.clear(domains)
+	}
+
+	s.sessionMu.Lock()
+	s.loaded[siteKey] = true
+	delete(s.savedAt, siteKey)
+	// The user agent a challenge was solved with belongs to the session too
+	for domain := range s.userAgents {
+		for _, d := range domains {
+			if domainMatches(domain, d) {
+				delete(s.userAgents, domain)
+				break
+			}
+		}
+	}
+	s.sessionMu.Unlock()
+
+	if s.siteSessionRepo == nil {
+		return nil
+	}
+	return s.siteSessionRepo.ClearCookies(ctx, siteKey)
+}
+
+// LoginSite runs the login flow of the manga rule of siteKey, or of its
+// chapter rule when only that one has a login
+func (s *ScraperService) LoginSite(ctx context.Context, siteKey string) error {
+	for _, kind := range []string{"manga", "chapter"} {
+		rule, err := s.siteRule(ctx, siteKey, kind)
+		if err != nil || rule.Login == nil {
+			continue
+		}
+		pool, err := s.proxyPool(*rule)
+		if err != nil {
+			return err
+		}
+		s.restoreSession(*rule)
+		return s.login(*rule, pool)
+	}
+	return fmt.Errorf("scraping rule %s has no login", siteKey)
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mangav5/internal/db"
+	"mangav5/internal/models"
+	"mangav5/internal/repo"
+)
+
+// newSessionScraper returns a scraper on repos with a fixed session key,
+// as the app would be after a restart
+func newSessionScraper(t *testing.T, repos *repo.Repositories) *ScraperService {
+	t.Helper()
+	s := NewScraperService(nil, repos)
+	s.cacheDir = t.TempDir()
+	s.key = make([]byte, 32)
+	return s
+}
+
+func newTestRepos(t *testing.T) *repo.Repositories {
+	t.Helper()
+	conn, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := db.Migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	return repo.NewRepositories(conn)
+}
+
+// loginServer shows a login link until the form at /login was posted with
+// the right password; /login waits for release before it answers
+type loginServer struct {
+	*httptest.Server
+	logins  atomic.Int32
+	release chan struct{}
+}
+
+func newLoginServer(t *testing.T) *loginServer {
+	ls := &loginServer{release: make(chan struct{})}
+	close(ls.release)
+	ls.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			ls.logins.Add(1)
+			<-ls.release
+			if r.PostFormValue("user") != "reader" || r.PostFormValue("pass") != "secret" {
+				fmt.Fprint(w, `<html><body><a class="login">Log in</a></body></html>`)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s3cr3t", Path: "/", MaxAge: 3600})
+			fmt.Fprint(w, `<html><body>Welcome</body></html>`)
+		default:
+			if c, err := r.Cookie("sid"); err != nil || c.Value != "s3cr3t" {
+				fmt.Fprint(w, `<html><body><a class="login">Log in</a></body></html>`)
+				return
+			}
+			fmt.Fprint(w, `<html><body><h1>Members only</h1></body></html>`)
+		}
+	}))
+	t.Cleanup(ls.Close)
+	return ls
+}
+
+func (ls *loginServer) rule() SiteRule {
+	u, _ := url.Parse(ls.URL)
+	return SiteRule{
+		Site:     "members",
+		Domains:  []string{u.Hostname()},
+		Strategy: "static",
+		Login: &LoginFlow{
+			URL:               ls.URL + "/login",
+			LoggedOutSelector: "a.login",
+			Form:              map[string]string{"user": "{username}", "pass": "{password}"},
+		},
+		Extract: []FieldRule{{Name: "title", Type: "css", Selector: "h1"}},
+	}
+}
+
+func TestSessionSurvivesRestart(t *testing.T) {
+	ls := newLoginServer(t)
+	repos := newTestRepos(t)
+	rule := ls.rule()
+
+	s := newSessionScraper(t, repos)
+	if err := s.SaveSiteCredentials(context.Background(), rule.Site, "reader", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Scrape(rule, ls.URL+"/manga/1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["title"] != "Members only" || ls.logins.Load() != 1 {
+		t.Fatalf("first scrape = %v after %d logins", res, ls.logins.Load())
+	}
+
+	// The session is on disk, encrypted
+	stored, err := repos.SiteSession.Get(context.Background(), rule.Site)
+	if err != nil || stored == nil {
+		t.Fatalf("saved session = %v, %v", stored, err)
+	}
+	var saved savedSession
+	if json.Unmarshal(stored.Cookies, &saved) == nil {
+		t.Error("session cookies are saved in plain text")
+	}
+
+	// After a restart the saved cookies are sent without logging in again
+	restarted := newSessionScraper(t, repos)
+	res, err = restarted.Scrape(rule, ls.URL+"/manga/2", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res["title"] != "Members only" || ls.logins.Load() != 1 {
+		t.Errorf("scrape after restart = %v after %d logins", res, ls.logins.Load())
+	}
+}
+
+func TestLoginWithWrongCredentials(t *testing.T) {
+	ls := newLoginServer(t)
+	rule := ls.rule()
+	s := newSessionScraper(t, newTestRepos(t))
+	if err := s.SaveSiteCredentials(context.Background(), rule.Site, "reader", "wrong"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Scrape(rule, ls.URL+"/manga/1", false)
+	if err == nil {
+		t.Fatal("Scrape() succeeded with wrong credentials")
+	}
+	if ls.logins.Load() != 1 {
+		t.Errorf("logins = %d, want 1", ls.logins.Load())
+	}
+	if stored, _ := s.siteSessionRepo.Get(context.Background(), rule.Site); stored != nil && len(stored.Cookies) > 0 {
+		t.Error("a failed login saved a session")
+	}
+}
+
+func TestLoggedOutScrapesLogInOnce(t *testing.T) {
+	ls := newLoginServer(t)
+	ls.release = make(chan struct{})
+	rule := ls.rule()
+	s := newSessionScraper(t, newTestRepos(t))
+	if err := s.SaveSiteCredentials(context.Background(), rule.Site, "reader", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	const scrapes = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, scrapes)
+	for i := 0; i < scrapes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.Scrape(rule, fmt.Sprintf("%s/manga/%d", ls.URL, i), false)
+			errs <- err
+		}(i)
+	}
+
+	// Every scrape is logged out and waits for the login in flight
+	time.Sleep(300 * time.Millisecond)
+	close(ls.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := ls.logins.Load(); got != 1 {
+		t.Errorf("logins = %d, want 1", got)
+	}
+}
+
+func TestSingle(t *testing.T) {
+	s := newTestScraper(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs atomic.Int32
+
+	first := make(chan error, 1)
+	go func() {
+		first <- s.single("login a", func() error {
+			runs.Add(1)
+			close(started)
+			<-release
+			return fmt.Errorf("login failed")
+		})
+	}()
+	<-started
+
+	// A concurrent call waits for the running one and shares its error
+	second := make(chan error, 1)
+	go func() {
+		second <- s.single("login a", func() error {
+			runs.Add(1)
+			return nil
+		})
+	}()
+	// Another key does not wait
+	if err := s.single("login b", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if err := <-first; err == nil {
+		t.Error("first call lost its error")
+	}
+	if err := <-second; err == nil || err.Error() != "login failed" {
+		t.Errorf("waiting call = %v, want the error of the running one", err)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("runs = %d, want 1", runs.Load())
+	}
+
+	// Once done, the key runs again
+	if err := s.single("login a", func() error { runs.Add(1); return nil }); err != nil || runs.Load() != 2 {
+		t.Errorf("call after the first = %v, runs = %d", err, runs.Load())
+	}
+}
+
+func TestClearSiteSession(t *testing.T) {
+	ls := newLoginServer(t)
+	repos := newTestRepos(t)
+	rule := ls.rule()
+	ctx := context.Background()
+
+	ruleJSON, _ := json.Marshal(rule)
+	domainsJSON, _ := json.Marshal(rule.Domains)
+	if _, err := repos.ScrapingRule.Insert(ctx, &models.ScrapingRule{
+		SiteKey:       rule.Site,
+		Name:          rule.Site,
+		DomainsJSON:   string(domainsJSON),
+		MangaRuleJSON: string(ruleJSON),
+		Enabled:       1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSessionScraper(t, repos)
+	if err := s.SaveSiteCredentials(ctx, rule.Site, "reader", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scrape(rule, ls.URL+"/manga/1", false); err != nil {
+		t.Fatal(err)
+	}
+	host := rule.Domains[0]
+	s.sessionMu.Lock()
+	s.userAgents[host] = "Solver/1.0"
+	s.userAgents["other.org"] = "Other/1.0"
+	s.sessionMu.Unlock()
+
+	if err := s.ClearSiteSession(ctx, rule.Site); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.jar.forDomains(rule.Domains); len(got) != 0 {
+		t.Errorf("cookies left = %v", cookieNames(got))
+	}
+	s.sessionMu.RLock()
+	_, hostUA := s.userAgents[host]
+	_, otherUA := s.userAgents["other.org"]
+	s.sessionMu.RUnlock()
+	if hostUA || !otherUA {
+		t.Errorf("user agents after clear = %v", s.userAgents)
+	}
+	stored, err := repos.SiteSession.Get(ctx, rule.Site)
+	if err != nil || stored == nil || len(stored.Cookies) != 0 || len(stored.Credentials) == 0 {
+		t.Errorf("stored session = %+v, %v, want credentials only", stored, err)
+	}
+
+	// The next scrape logs in again
+	if _, err := s.Scrape(rule, ls.URL+"/manga/1", false); err != nil {
+		t.Fatal(err)
+	}
+	if ls.logins.Load() != 2 {
+		t.Errorf("logins = %d, want 2", ls.logins.Load())
+	}
+}